@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/velocity-trinity/core/pkg/analyzer"
+	"github.com/velocity-trinity/core/pkg/audit"
+	"github.com/velocity-trinity/core/pkg/logger"
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Run the full suite and check what smart selection would have missed",
+	Long: `Runs every test file, then computes the smart selection for the same change and
+reports failing tests the selection would have skipped (false negatives).
+Example: dependency-ci audit --cmd="npx jest" --base=origin/main`,
+	Run: func(cmd *cobra.Command, args []string) {
+		root, _ := cmd.Flags().GetString("root")
+		filesStr, _ := cmd.Flags().GetString("files")
+		base, _ := cmd.Flags().GetString("base")
+		storePath := auditStorePath(cmd)
+		parallel, _ := cmd.Flags().GetInt("parallel")
+
+		if filesStr == "" && base == "" {
+			logger.Log.Fatal("Specify the change to audit with --files or --base")
+		}
+
+		graph, err := analyzer.BuildGraph(root, analyzerOptions())
+		if err != nil {
+			logger.Log.Fatal("Failed to build dependency graph: " + err.Error())
+		}
+		var all []string
+		for _, test := range graph.Tests() {
+			all = append(all, filepath.Join(root, filepath.FromSlash(test)))
+		}
+
+		// Full run: each test file on its own so failures can be attributed
+		logger.Log.Info(fmt.Sprintf("Running full suite (%d test files)...", len(all)))
+		failing := runEach(testRunners(cmd), all, parallel)
+
+		selected, err := selectTests(root, filesStr, base)
+		if err != nil {
+			logger.Log.Fatal("Failed to compute selection: " + err.Error())
+		}
+
+		record := audit.Evaluate(all, failing, selected)
+		record.Base = base
+		record.Commit, _ = analyzer.CurrentCommit(root)
+
+		store := &audit.Store{Path: storePath}
+		if err := store.Append(record); err != nil {
+			logger.Log.Warn("Failed to store audit result: " + err.Error())
+		}
+
+		fmt.Printf("Selected %d of %d test files (%.1f%% saved)\n", record.Selected, record.Total, record.Savings*100)
+		fmt.Printf("Failing: %d, recall %.1f%%, precision %.1f%%\n", len(record.Failing), record.Recall*100, record.Precision*100)
+		if len(record.Missed) == 0 {
+			fmt.Println("✅ Selection caught every failing test")
+			return
+		}
+		fmt.Printf("❌ Selection would have missed %d failing test file(s):\n", len(record.Missed))
+		for _, test := range record.Missed {
+			fmt.Println(" - " + test)
+		}
+		os.Exit(1)
+	},
+}
+
+var auditHistoryCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Show stored audit results",
+	Run: func(cmd *cobra.Command, args []string) {
+		storePath := auditStorePath(cmd)
+
+		store := &audit.Store{Path: storePath}
+		records, err := store.Load()
+		if err != nil {
+			logger.Log.Fatal("Failed to read audit history: " + err.Error())
+		}
+		if len(records) == 0 {
+			fmt.Println("No audits recorded yet.")
+			return
+		}
+
+		var recall, precision, savings float64
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "DATE\tCOMMIT\tSELECTED\tFAILING\tMISSED\tRECALL\tPRECISION\tSAVED")
+		for _, r := range records {
+			fmt.Fprintf(w, "%s\t%.8s\t%d/%d\t%d\t%d\t%.1f%%\t%.1f%%\t%.1f%%\n",
+				r.Timestamp.Format("2006-01-02 15:04"), r.Commit, r.Selected, r.Total,
+				len(r.Failing), len(r.Missed), r.Recall*100, r.Precision*100, r.Savings*100)
+			recall += r.Recall
+			precision += r.Precision
+			savings += r.Savings
+		}
+		w.Flush()
+
+		n := float64(len(records))
+		fmt.Printf("\nAverage over %d audits: recall %.1f%%, precision %.1f%%, saved %.1f%%\n", len(records), recall/n*100, precision/n*100, savings/n*100)
+	},
+}
+
+// auditStorePath defaults the history file to the configured cache directory
+func auditStorePath(cmd *cobra.Command) string {
+	if path, _ := cmd.Flags().GetString("store"); path != "" {
+		return path
+	}
+	return filepath.Join(appConfig.DependencyCI.CacheDir, "audit.jsonl")
+}
+
+// runEach runs every test file separately and returns the ones that failed
+func runEach(runners []testRunner, tests []string, parallel int) []string {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		failing []string
+	)
+	sem := make(chan struct{}, parallel)
+
+	for _, test := range tests {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(test string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var out bytes.Buffer
+			if err := runSelected(runners, []string{test}, &out, &out); err != nil {
+				logger.Log.Info("FAIL " + test)
+				mu.Lock()
+				failing = append(failing, test)
+				mu.Unlock()
+				return
+			}
+			logger.Log.Debug("PASS " + test)
+		}(test)
+	}
+	wg.Wait()
+	return failing
+}
+
+func init() {
+	auditCmd.PersistentFlags().String("store", "", "File that accumulates audit results (default <cache_dir>/audit.jsonl)")
+	auditCmd.Flags().String("root", ".", "Project root to analyze")
+	auditCmd.Flags().String("cmd", "npm test", "Base test command (e.g., 'npm test', 'pytest'); overrides configured runners")
+	auditCmd.Flags().String("files", "", "Space-separated list of changed files")
+	auditCmd.Flags().String("base", "", "Git ref to diff against")
+	auditCmd.Flags().Int("parallel", 1, "Number of test files to run at once during the full run")
+
+	auditCmd.AddCommand(auditHistoryCmd)
+	rootCmd.AddCommand(auditCmd)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/velocity-trinity/core/pkg/cache"
+	"github.com/velocity-trinity/core/pkg/logger"
+)
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manage the parse cache",
+}
+
+var cacheServeCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve a shared cache for CI runners and developers",
+	Long: `Stores parse results and graphs uploaded by other dependency-ci runs.
+Point clients at it with dependency-ci.remote_cache in config.yaml.
+Only clients with the token (--token, or $` + cache.TokenEnv + ` for the server and
+the clients) may upload; without one the cache is read-only.
+Example: dependency-ci cache serve --addr=:8090 --dir=/var/cache/dep-ci`,
+	Run: func(cmd *cobra.Command, args []string) {
+		addr, _ := cmd.Flags().GetString("addr")
+		dir, _ := cmd.Flags().GetString("dir")
+		maxEntrySize, _ := cmd.Flags().GetInt64("max-entry-size")
+		token, _ := cmd.Flags().GetString("token")
+		if token == "" {
+			token = os.Getenv(cache.TokenEnv)
+		}
+		if token == "" {
+			logger.Log.Warn("No --token or $" + cache.TokenEnv + "; serving the cache read-only")
+		}
+
+		logger.Log.Info(fmt.Sprintf("Serving cache from %s on %s", dir, addr))
+		if err := http.ListenAndServe(addr, cache.Handler(&cache.DirStore{Dir: dir}, maxEntrySize, token)); err != nil {
+			logger.Log.Fatal("Cache server failed: " + err.Error())
+		}
+	},
+}
+
+var cacheCleanCmd = &cobra.Command{
+	Use:   "clean",
+	Short: "Delete the local parse cache",
+	Run: func(cmd *cobra.Command, args []string) {
+		dir := filepath.Join(appConfig.DependencyCI.CacheDir, "objects")
+		if err := os.RemoveAll(dir); err != nil {
+			logger.Log.Fatal("Failed to clean cache: " + err.Error())
+		}
+		fmt.Println("Removed " + dir)
+	},
+}
+
+func init() {
+	cacheServeCmd.Flags().String("addr", ":8090", "Address to listen on")
+	cacheServeCmd.Flags().String("dir", ".dep-ci/shared", "Directory holding cache entries")
+	cacheServeCmd.Flags().Int64("max-entry-size", 16<<20, "Largest entry accepted, in bytes")
+	cacheServeCmd.Flags().String("token", "", "Token clients must send to upload (default $"+cache.TokenEnv+")")
+
+	cacheCmd.AddCommand(cacheServeCmd, cacheCleanCmd)
+	rootCmd.AddCommand(cacheCmd)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/velocity-trinity/core/pkg/analyzer"
+	"github.com/velocity-trinity/core/pkg/cache"
+	"github.com/velocity-trinity/core/pkg/config"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the dependency-ci section of config.yaml",
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check the config file against the schema",
+	Run: func(cmd *cobra.Command, args []string) {
+		file, _ := cmd.Flags().GetString("file")
+
+		err := configErr
+		if file != "" {
+			var cfg *config.Config
+			cfg, err = config.LoadFile("dependency-ci", file)
+			if err == nil {
+				err = cfg.Validate()
+			}
+		}
+
+		name := config.File()
+		if name == "" {
+			fmt.Println("No config file found; using defaults.")
+			return
+		}
+		if err == nil {
+			fmt.Printf("✅ %s is valid\n", name)
+			return
+		}
+
+		problems := []error{err}
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			problems = joined.Unwrap()
+		}
+		fmt.Printf("❌ %s has %d problem(s):\n", name, len(problems))
+		for _, problem := range problems {
+			fmt.Println(" - " + problem.Error())
+		}
+		os.Exit(1)
+	},
+}
+
+// analyzerOptions converts the dependency-ci config section into analyzer options
+func analyzerOptions() analyzer.Options {
+	d := appConfig.DependencyCI
+	opts := analyzer.Options{
+		SourceRoots:    d.SourceRoots,
+		Aliases:        d.Aliases,
+		Ignore:         d.Ignore,
+		RunAllTriggers: d.RunAllTriggers,
+		TestLayouts:    make(map[string]analyzer.TestLayout, len(d.TestLayouts)),
+	}
+
+	for lang, layout := range d.TestLayouts {
+		converted := analyzer.TestLayout{Patterns: layout.Patterns, TestDirs: layout.TestDirs}
+		for _, mirror := range layout.Mirrors {
+			converted.Mirrors = append(converted.Mirrors, analyzer.Mirror{Source: mirror.Source, Tests: mirror.Tests})
+		}
+		opts.TestLayouts[lang] = converted
+	}
+
+	// Local objects first; remote hits are copied down so the next build is offline
+	stores := cache.Layered{&cache.DirStore{Dir: filepath.Join(d.CacheDir, "objects")}}
+	if d.RemoteCache != "" {
+		remote := cache.NewHTTPStore(d.RemoteCache)
+		remote.Token = os.Getenv(cache.TokenEnv)
+		stores = append(stores, remote)
+	}
+	opts.Cache = stores
+	opts.CacheRefresh, _ = rootCmd.PersistentFlags().GetBool("clean")
+	return opts
+}
+
+func init() {
+	configValidateCmd.Flags().String("file", "", "Config file to validate (default: the one dependency-ci would load)")
+
+	configCmd.AddCommand(configValidateCmd)
+	rootCmd.AddCommand(configCmd)
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 
 	"github.com/spf13/cobra"
@@ -12,10 +15,21 @@ import (
 	"github.com/velocity-trinity/core/pkg/logger"
 )
 
+var (
+	// appConfig is loaded in main; configErr is reported by every command except `config validate`
+	appConfig *config.Config
+	configErr error
+)
+
 var rootCmd = &cobra.Command{
 	Use:   "dependency-ci",
 	Short: "Smart Dependency Analyzer for CI Pipelines",
 	Long:  `Analyzes your codebase to determine which tests need to run based on changed files.`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if configErr != nil && cmd != configValidateCmd {
+			logger.Log.Fatal("Invalid config (run `dependency-ci config validate` for details): " + configErr.Error())
+		}
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		cmd.Help()
 	},
@@ -49,18 +63,19 @@ var analyzeCmd = &cobra.Command{
 var runCmd = &cobra.Command{
 	Use:   "run",
 	Short: "Run tests only for changed files",
-	Long: `Example: dependency-ci run --cmd="npm test" --files="src/foo.ts src/bar.ts"`,
+	Long: `Example: dependency-ci run --cmd="npm test" --files="src/foo.ts src/bar.ts"
+         dependency-ci run --cmd="pytest" --base=origin/main`,
 	Run: func(cmd *cobra.Command, args []string) {
 		filesStr, _ := cmd.Flags().GetString("files")
-		testCmd, _ := cmd.Flags().GetString("cmd")
+		base, _ := cmd.Flags().GetString("base")
+		root, _ := cmd.Flags().GetString("root")
 
-		if filesStr == "" {
+		if filesStr == "" && base == "" {
 			logger.Log.Info("No files changed. Skipping tests.")
 			return
 		}
 
-		files := strings.Split(filesStr, " ")
-		testFiles, err := analyzer.FindTestFiles(files)
+		testFiles, err := selectTests(root, filesStr, base)
 		if err != nil {
 			logger.Log.Fatal("Failed to find tests: " + err.Error())
 		}
@@ -72,20 +87,7 @@ var runCmd = &cobra.Command{
 
 		logger.Log.Info(fmt.Sprintf("Running %d test files...", len(testFiles)))
 		
-		// Construct the command: npm test file1 file2 ...
-		fullCmd := fmt.Sprintf("%s %s", testCmd, strings.Join(testFiles, " "))
-		logger.Log.Info("Executing: " + fullCmd)
-
-		// execute command
-		parts := strings.Fields(fullCmd)
-		head := parts[0]
-		parts = parts[1:]
-
-		c := exec.Command(head, parts...)
-		c.Stdout = os.Stdout
-		c.Stderr = os.Stderr
-		
-		if err := c.Run(); err != nil {
+		if err := runSelected(testRunners(cmd), testFiles, os.Stdout, os.Stderr); err != nil {
 			logger.Log.Error("Tests failed!")
 			os.Exit(1)
 		}
@@ -94,22 +96,83 @@ var runCmd = &cobra.Command{
 	},
 }
 
+// selectTests builds the import graph for root and picks the tests affected by
+// the changed files. With a base ref the git diff narrows changes to the
+// top-level symbols they touch. Returned paths are relative to the working directory.
+func selectTests(root, filesStr, base string) ([]string, error) {
+	graph, err := analyzer.BuildGraph(root, analyzerOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []analyzer.Change
+	if base != "" {
+		changes, err = analyzer.DiffChanges(root, base)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, file := range strings.Fields(filesStr) {
+			rel, err := graph.Rel(file)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, analyzer.Change{File: rel})
+		}
+	}
+
+	for _, change := range changes {
+		if change.Symbols != nil {
+			logger.Log.Debug(fmt.Sprintf("%s: changed symbols %s", change.File, strings.Join(change.Symbols, ", ")))
+		}
+	}
+
+	tests := graph.AffectedTestsForChanges(changes)
+	for i, test := range tests {
+		tests[i] = filepath.Join(root, filepath.FromSlash(test))
+	}
+	return tests, nil
+}
+
+// runTests runs the base test command with the test files appended as arguments
+func runTests(testCmd string, testFiles []string, stdout, stderr io.Writer) error {
+	parts := strings.Fields(testCmd)
+	if len(parts) == 0 {
+		return errors.New("the test command is empty")
+	}
+	c := exec.Command(parts[0], append(parts[1:], testFiles...)...)
+	c.Stdout = stdout
+	c.Stderr = stderr
+	return c.Run()
+}
+
 func init() {
+	rootCmd.PersistentFlags().Bool("clean", false, "Ignore cached parse results and re-parse every file")
+
 	runCmd.Flags().String("files", "", "Space-separated list of changed files")
-	runCmd.Flags().String("cmd", "npm test", "Base test command (e.g., 'npm test', 'pytest')")
+	runCmd.Flags().String("cmd", "npm test", "Base test command (e.g., 'npm test', 'pytest'); overrides configured runners")
+	runCmd.Flags().String("base", "", "Git ref to diff against; narrows selection to the symbols that changed")
+	runCmd.Flags().String("root", ".", "Project root to analyze")
 }
 
 func main() {
 	// Initialize Config & Logger
 	cfg, err := config.Load("dependency-ci")
+	if err == nil {
+		err = cfg.Validate()
+	}
 	if err != nil {
-		// Non-fatal config error
+		// Not fatal yet: `config validate` needs to run to explain it
+		configErr = err
 	}
 
 	env := "development"
 	if cfg != nil {
 		env = cfg.Env
+	} else {
+		cfg = &config.Config{DependencyCI: config.DependencyCI{CacheDir: ".dep-ci"}}
 	}
+	appConfig = cfg
 	logger.Init(env)
 	defer logger.Sync()
 
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/velocity-trinity/core/pkg/analyzer"
+	"github.com/velocity-trinity/core/pkg/logger"
+)
+
+var orphansCmd = &cobra.Command{
+	Use:   "orphans",
+	Short: "List modules and test helpers that nothing imports",
+	Long: `Walks the import graph from entrypoints and tests and reports what it can't reach.
+Example: dependency-ci orphans --entry="src/server.ts" --entry="scripts/**"`,
+	Run: func(cmd *cobra.Command, args []string) {
+		root, _ := cmd.Flags().GetString("root")
+		entrypoints, _ := cmd.Flags().GetStringSlice("entry")
+
+		graph, err := analyzer.BuildGraph(root, analyzerOptions())
+		if err != nil {
+			logger.Log.Fatal("Failed to build dependency graph: " + err.Error())
+		}
+
+		report := graph.FindOrphans(entrypoints)
+		printSection("Unreachable modules", report.Modules)
+		printSection("Unused test helpers", report.TestHelpers)
+		printSection("Tests that import no project files", report.HollowTests)
+	},
+}
+
+func printSection(title string, files []string) {
+	fmt.Printf("%s (%d):\n", title, len(files))
+	for _, file := range files {
+		fmt.Println(" - " + file)
+	}
+}
+
+func init() {
+	orphansCmd.Flags().String("root", ".", "Project root to analyze")
+	orphansCmd.Flags().StringSlice("entry", analyzer.DefaultEntrypoints, "Entrypoint globs (repeatable, supports **)")
+
+	rootCmd.AddCommand(orphansCmd)
+}
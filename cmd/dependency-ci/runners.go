@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/velocity-trinity/core/pkg/glob"
+	"github.com/velocity-trinity/core/pkg/logger"
+)
+
+// testRunner is a test command and the test files it accepts
+type testRunner struct {
+	name    string
+	command string
+	// match globs select the files this runner handles; empty means all
+	match []string
+}
+
+// testRunners returns an explicit --cmd as the only runner, otherwise the configured runners
+func testRunners(cmd *cobra.Command) []testRunner {
+	testCmd, _ := cmd.Flags().GetString("cmd")
+	configured := appConfig.DependencyCI.Runners
+	if cmd.Flags().Changed("cmd") || len(configured) == 0 {
+		return []testRunner{{name: "cmd", command: testCmd}}
+	}
+
+	// Runners with match globs go first so a catch-all runner doesn't shadow them
+	names := make([]string, 0, len(configured))
+	for name := range configured {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := len(configured[names[i]].Match) > 0, len(configured[names[j]].Match) > 0
+		if a != b {
+			return a
+		}
+		return names[i] < names[j]
+	})
+
+	runners := make([]testRunner, 0, len(names))
+	for _, name := range names {
+		runners = append(runners, testRunner{name: name, command: configured[name].Command, match: configured[name].Match})
+	}
+	return runners
+}
+
+// runSelected hands each test file to the first runner that matches it and
+// runs every runner that got files. It keeps going after a failure.
+func runSelected(runners []testRunner, tests []string, stdout, stderr io.Writer) error {
+	groups := make(map[string][]string)
+	for _, test := range tests {
+		matched := false
+		for _, runner := range runners {
+			if len(runner.match) == 0 || glob.MatchAny(runner.match, test) {
+				groups[runner.name] = append(groups[runner.name], test)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			logger.Log.Warn("No runner matches " + test + ", skipping it")
+		}
+	}
+
+	var failed []string
+	for _, runner := range runners {
+		files := groups[runner.name]
+		if len(files) == 0 {
+			continue
+		}
+		// Construct the command: npm test file1 file2 ...
+		logger.Log.Debug("Executing: " + runner.command + " " + strings.Join(files, " "))
+		if err := runTests(runner.command, files, stdout, stderr); err != nil {
+			// A failing test exits non-zero; anything else means the tests didn't run
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) {
+				logger.Log.Error(fmt.Sprintf("Runner %s couldn't run: %v", runner.name, err))
+			}
+			failed = append(failed, runner.name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("tests failed in runner(s): %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/velocity-trinity/core/pkg/analyzer"
+	"github.com/velocity-trinity/core/pkg/glob"
+	"github.com/velocity-trinity/core/pkg/logger"
+	"github.com/velocity-trinity/core/pkg/watcher"
+)
+
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Rerun affected tests whenever a file is saved",
+	Long:  `Example: dependency-ci watch --cmd="npx jest" --root=.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		root, _ := cmd.Flags().GetString("root")
+		debounce, _ := cmd.Flags().GetDuration("debounce")
+
+		opts := analyzerOptions()
+		graph, err := analyzer.BuildGraph(root, opts)
+		if err != nil {
+			logger.Log.Fatal("Failed to build dependency graph: " + err.Error())
+		}
+
+		w, err := watcher.New(root, debounce)
+		if err != nil {
+			logger.Log.Fatal("Failed to start watcher: " + err.Error())
+		}
+		defer w.Close()
+		w.Ignore = func(rel string, isDir bool) bool {
+			return watcher.DefaultIgnore(rel, isDir) || glob.MatchAny(opts.Ignore, filepath.ToSlash(rel))
+		}
+		runners := testRunners(cmd)
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		fmt.Printf("👀 Watching %d source files in %s (Ctrl+C to stop)\n", len(graph.Files()), root)
+
+		w.Run(ctx, func(paths []string) {
+			// Tests affected by deleted (or renamed-away) files must be found
+			// before the graph forgets who imported them
+			var removed []string
+			for _, path := range paths {
+				if _, err := os.Stat(filepath.Join(root, path)); os.IsNotExist(err) {
+					removed = append(removed, graphFilesUnder(graph, filepath.ToSlash(path))...)
+				}
+			}
+			var affected []string
+			if len(removed) > 0 {
+				affected = graph.AffectedTests(removed)
+			}
+
+			// Keep the graph current, then only consider files we can parse
+			var changed []string
+			for _, path := range paths {
+				rel := filepath.ToSlash(path)
+				if err := graph.Update(rel); err != nil {
+					logger.Log.Warn("Failed to parse " + rel + ": " + err.Error())
+				}
+				if _, err := analyzer.GetParser(rel); err == nil {
+					changed = append(changed, rel)
+				}
+			}
+			if len(changed) == 0 && len(removed) == 0 {
+				return
+			}
+			if len(changed) == 0 {
+				changed = removed
+			}
+
+			// Deleted tests can't be run
+			var tests []string
+			for _, test := range append(affected, graph.AffectedTests(changed)...) {
+				if graph.Has(test) && !slices.Contains(tests, test) {
+					tests = append(tests, test)
+				}
+			}
+			sort.Strings(tests)
+			stamp := time.Now().Format("15:04:05")
+			if len(tests) == 0 {
+				fmt.Printf("[%s] %s → no affected tests\n", stamp, describeChanges(changed))
+				return
+			}
+			fmt.Printf("[%s] %s → %d test file(s)\n", stamp, describeChanges(changed), len(tests))
+
+			testPaths := make([]string, len(tests))
+			for i, test := range tests {
+				testPaths[i] = filepath.Join(root, filepath.FromSlash(test))
+			}
+
+			start := time.Now()
+			if err := runSelected(runners, testPaths, os.Stdout, os.Stderr); err != nil {
+				fmt.Printf("[%s] ❌ Tests failed after %v\n", time.Now().Format("15:04:05"), time.Since(start).Round(time.Millisecond))
+				return
+			}
+			fmt.Printf("[%s] ✅ Tests passed in %v\n", time.Now().Format("15:04:05"), time.Since(start).Round(time.Millisecond))
+		})
+	},
+}
+
+// graphFilesUnder returns the files in the graph at rel or below it
+func graphFilesUnder(graph *analyzer.Graph, rel string) []string {
+	var files []string
+	for _, file := range graph.Files() {
+		if file == rel || strings.HasPrefix(file, rel+"/") {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+func describeChanges(files []string) string {
+	if len(files) == 1 {
+		return files[0]
+	}
+	return fmt.Sprintf("%d files changed", len(files))
+}
+
+func init() {
+	watchCmd.Flags().String("root", ".", "Project root to watch")
+	watchCmd.Flags().String("cmd", "npm test", "Base test command (e.g., 'npm test', 'pytest'); overrides configured runners")
+	watchCmd.Flags().Duration("debounce", 300*time.Millisecond, "Quiet period before a burst of saves triggers a run")
+
+	rootCmd.AddCommand(watchCmd)
+}
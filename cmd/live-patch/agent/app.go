@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/velocity-trinity/core/pkg/logger"
+	"github.com/velocity-trinity/core/pkg/supervisor"
+)
+
+// superviseApp starts the application the agent runs as an entrypoint, copying
+// its output to the agent's and to appLog. stopOnSignal stops it with the agent.
+func superviseApp(cmd *cobra.Command, command []string, dir string, appLog io.Writer) *supervisor.Supervisor {
+	reloadSignal, _ := cmd.Flags().GetString("reload-signal")
+	stopTimeout, _ := cmd.Flags().GetDuration("stop-timeout")
+	maxCrashes, _ := cmd.Flags().GetInt("max-crashes")
+	crashWindow, _ := cmd.Flags().GetDuration("crash-window")
+	minUptime, _ := cmd.Flags().GetDuration("min-uptime")
+
+	app := &supervisor.Supervisor{
+		Command:     command,
+		Dir:         dir,
+		StopTimeout: stopTimeout,
+		MaxCrashes:  maxCrashes,
+		CrashWindow: crashWindow,
+		MinUptime:   minUptime,
+		Stdout:      io.MultiWriter(os.Stdout, appLog),
+		Stderr:      io.MultiWriter(os.Stderr, appLog),
+	}
+	if reloadSignal != "" {
+		sig, err := supervisor.ParseSignal(reloadSignal)
+		if err != nil {
+			logger.Log.Fatal(err.Error())
+		}
+		app.ReloadSignal = sig
+	}
+	if err := app.Start(); err != nil {
+		logger.Log.Fatal(err.Error())
+	}
+	return app
+}
+
+// stopOnSignal handles the container's stop signal, which the agent receives
+// as PID 1: it withdraws the agent from discovery and stops the app (if any)
+// before exiting
+func stopOnSignal(app *supervisor.Supervisor, withdraw func()) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-stop
+		logger.Log.Info("Received " + sig.String() + ", shutting down")
+		withdraw()
+		if app != nil {
+			logger.Log.Info("Stopping application")
+			app.Stop()
+		}
+		logger.Sync()
+		os.Exit(0)
+	}()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/velocity-trinity/core/pkg/discovery"
+	"github.com/velocity-trinity/core/pkg/logger"
+	"github.com/velocity-trinity/core/pkg/transport"
+)
+
+// announce makes the agent discoverable through --registry and --mdns. The
+// returned func withdraws it, waiting briefly for the registry and the mDNS
+// goodbye so the agent disappears from listings right away.
+func announce(cmd *cobra.Command, server *transport.LivePatchServer, port string) func() {
+	registry, _ := cmd.Flags().GetString("registry")
+	useMDNS, _ := cmd.Flags().GetBool("mdns")
+	if registry == "" && !useMDNS {
+		return func() {}
+	}
+	advertise, _ := cmd.Flags().GetString("advertise")
+	interval, _ := cmd.Flags().GetDuration("announce-interval")
+
+	agent := discovery.Agent{
+		Name:    server.Name,
+		Addr:    advertise,
+		Labels:  server.Labels,
+		Version: transport.Version,
+	}
+	if agent.Addr == "" {
+		// The registry and mDNS browsers fill in the address they heard from
+		agent.Addr = ":" + port
+	}
+	agent.BasePath, _ = filepath.Abs(server.BasePath)
+	if err := agent.Validate(); err != nil {
+		logger.Log.Fatal(err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	if registry != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := discovery.NewRegistryClient(registry)
+			if client.Token, _ = cmd.Flags().GetString("registry-token"); client.Token == "" {
+				client.Token = os.Getenv(discovery.TokenEnv)
+			}
+			discovery.Announce(ctx, client, agent, interval)
+		}()
+	}
+	if useMDNS {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logger.Log.Info("Announcing " + agent.Name + " over mDNS")
+			if err := discovery.ServeMDNS(ctx, agent); err != nil {
+				logger.Log.Error("mDNS announcements stopped: " + err.Error())
+			}
+		}()
+	}
+
+	return func() {
+		cancel()
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(3 * time.Second):
+			logger.Log.Warn("Gave up withdrawing from discovery")
+		}
+	}
+}
@@ -1,28 +1,41 @@
 package main
 
 import (
-	"crypto/tls"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/velocity-trinity/core/pkg/config"
+	"github.com/velocity-trinity/core/pkg/discovery"
 	"github.com/velocity-trinity/core/pkg/logger"
+	"github.com/velocity-trinity/core/pkg/reaper"
+	"github.com/velocity-trinity/core/pkg/supervisor"
 	"github.com/velocity-trinity/core/pkg/transport"
 	"github.com/velocity-trinity/core/pkg/utils"
 )
 
 func main() {
 	var rootCmd = &cobra.Command{
-		Use:   "live-patch-agent",
+		Use:   "live-patch-agent [-- command...]",
 		Short: "Agent for receiving hot patches inside containers",
+		Long: `Receives hot patches inside a container.
+Given a command after --, the agent also runs and supervises the application,
+reloading it after every patch. Use it as the container entrypoint:
+  live-patch-agent --reload-signal=SIGHUP -- node server.js`,
 		Run: func(cmd *cobra.Command, args []string) {
 			logger.Log.Info("Starting LivePatch Agent...")
 
+			certPath, _ := cmd.Flags().GetString("cert")
+			keyPath, _ := cmd.Flags().GetString("key")
+			caPath, _ := cmd.Flags().GetString("ca")
+			requireClientCert, _ := cmd.Flags().GetBool("require-client-cert")
+
 			// Development Mode: Generate certificates if they don't exist
-			if _, err := os.Stat("server.crt"); os.IsNotExist(err) {
+			if _, err := os.Stat(certPath); os.IsNotExist(err) && !cmd.Flags().Changed("cert") {
 				logger.Log.Info("Generating self-signed certificates for development...")
-				if err := utils.GenerateSelfSignedCert("server.crt", "server.key"); err != nil {
+				if err := utils.GenerateSelfSignedCert(certPath, keyPath); err != nil {
 					// We can't log fatal here because logger is initialized later? No, it's global.
 					// But for simplicity let's use fmt if logger fails
 					fmt.Println("Failed to generate certs: " + err.Error())
@@ -31,11 +44,13 @@ func main() {
 			}
 
 			// Load TLS Config
-			cert, err := tls.LoadX509KeyPair("server.crt", "server.key")
+			tlsConfig, err := utils.ServerTLSConfig(certPath, keyPath, caPath, requireClientCert)
 			if err != nil {
-				logger.Log.Fatal("Failed to load key pair: " + err.Error())
+				logger.Log.Fatal("Failed to load TLS config: " + err.Error())
+			}
+			if !requireClientCert {
+				logger.Log.Warn("WARNING: LivePatch Agent allows remote command execution and client certificates are not required. Anyone who can reach this port can write files and run commands. Use --ca and --require-client-cert.")
 			}
-			tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
 
 			// Start Server
 			port := os.Getenv("PORT")
@@ -48,12 +63,113 @@ func main() {
 				basePath = "."
 			}
 
-			if err := transport.StartServer(port, basePath, tlsConfig); err != nil {
+			stateDir, _ := cmd.Flags().GetString("state-dir")
+			historyLimit, _ := cmd.Flags().GetInt("history-limit")
+			healthURL, _ := cmd.Flags().GetString("health-url")
+			healthCmd, _ := cmd.Flags().GetString("health-cmd")
+			healthTimeout, _ := cmd.Flags().GetDuration("health-timeout")
+			commandTimeout, _ := cmd.Flags().GetDuration("command-timeout")
+			maxFileSize, _ := cmd.Flags().GetInt64("max-file-size")
+
+			var policy *transport.Policy
+			if policyPath, _ := cmd.Flags().GetString("policy"); policyPath != "" {
+				if policy, err = transport.LoadPolicy(policyPath); err != nil {
+					logger.Log.Fatal("Failed to load policy: " + err.Error())
+				}
+				logger.Log.Info(fmt.Sprintf("Loaded policy %s: %d hook(s), %d command(s), %d writable pattern(s), %d env variable(s)", policyPath, len(policy.Hooks), len(policy.Commands), len(policy.Writable), len(policy.Env)))
+			} else {
+				logger.Log.Warn("WARNING: no --policy given; clients may run any command and write any file below the base path.")
+			}
+
+			var owners *transport.OwnerMap
+			chown, _ := cmd.Flags().GetString("chown")
+			uidMap, _ := cmd.Flags().GetStringArray("map-uid")
+			gidMap, _ := cmd.Flags().GetStringArray("map-gid")
+			if chown != "" || len(uidMap) > 0 || len(gidMap) > 0 {
+				if owners, err = transport.ParseOwnerMap(chown, uidMap, gidMap); err != nil {
+					logger.Log.Fatal(err.Error())
+				}
+			}
+
+			name, _ := cmd.Flags().GetString("name")
+			if name == "" {
+				// A pod's hostname is its name; drop any domain
+				hostname, _ := os.Hostname()
+				name, _, _ = strings.Cut(hostname, ".")
+			}
+			labelPairs, _ := cmd.Flags().GetStringArray("label")
+			labels, err := discovery.ParseLabels(labelPairs)
+			if err != nil {
+				logger.Log.Fatal(err.Error())
+			}
+
+			server := &transport.LivePatchServer{
+				BasePath:      basePath,
+				Name:          name,
+				Labels:        labels,
+				StateDir:      stateDir,
+				HistoryLimit:  historyLimit,
+				HealthURL:     healthURL,
+				HealthCommand: healthCmd,
+				HealthTimeout: healthTimeout,
+
+				CommandTimeout: commandTimeout,
+				Policy:         policy,
+				MaxFileSize:    maxFileSize,
+				Owners:         owners,
+			}
+			logBufferSize, _ := cmd.Flags().GetInt("log-buffer-size")
+			logFiles, _ := cmd.Flags().GetStringArray("log-file")
+			server.LogSources = make(map[string]*transport.LogBuffer)
+			for _, path := range logFiles {
+				buf := transport.NewLogBuffer(logBufferSize)
+				server.LogSources[path] = buf
+				go transport.TailFile(path, buf, nil)
+			}
+			// As a container's entrypoint the agent inherits orphaned processes
+			reaper.ReapOrphans()
+			if len(args) > 0 {
+				appLog := transport.NewLogBuffer(logBufferSize)
+				server.LogSources[transport.AppLogSource] = appLog
+				server.Supervisor = superviseApp(cmd, args, basePath, appLog)
+			}
+			stopOnSignal(server.Supervisor, announce(cmd, server, port))
+			if err := transport.StartServer(port, server, tlsConfig); err != nil {
 				logger.Log.Fatal("Server crashed: " + err.Error())
 			}
 		},
 	}
 
+	rootCmd.Flags().String("cert", "server.crt", "Server certificate (a self-signed one is generated if the default is missing)")
+	rootCmd.Flags().String("key", "server.key", "Private key for --cert")
+	rootCmd.Flags().String("ca", "", "CA that signs client certificates (see live-patch init-ca / issue-cert)")
+	rootCmd.Flags().Bool("require-client-cert", false, "Reject clients without a certificate signed by --ca")
+	rootCmd.Flags().String("state-dir", ".livepatch", "Directory for patch history used by rollbacks (empty disables history)")
+	rootCmd.Flags().Int("history-limit", transport.DefaultHistoryLimit, "Number of patches to keep for rollback")
+	rootCmd.Flags().String("health-url", "", "URL that must return 2xx after each patch, or the patch is rolled back")
+	rootCmd.Flags().String("health-cmd", "", "Command that must succeed after each patch, or the patch is rolled back")
+	rootCmd.Flags().Duration("health-timeout", 10*time.Second, "How long to wait for the health check to pass")
+	rootCmd.Flags().String("policy", "", "YAML file with the allowed commands, named hooks, writable paths and command environment")
+	rootCmd.Flags().Duration("command-timeout", transport.DefaultCommandTimeout, "Kill post-sync, health and exec commands that run longer than this")
+	rootCmd.Flags().Int64("max-file-size", 1<<30, "Largest file clients may sync, in bytes (0 for no limit)")
+	rootCmd.Flags().String("chown", "", "UID:GID that owns synced files (either may be left out); by default they belong to the agent's user")
+	rootCmd.Flags().StringArray("map-uid", nil, "Give files owned by a client UID to an agent UID, as FROM=TO (repeatable; overrides --chown)")
+	rootCmd.Flags().StringArray("map-gid", nil, "Give files owned by a client GID to an agent GID, as FROM=TO (repeatable; overrides --chown)")
+	rootCmd.Flags().String("reload-signal", "", "Signal that makes the supervised app reload (e.g. SIGHUP, SIGUSR2); empty restarts it after each patch")
+	rootCmd.Flags().Duration("stop-timeout", supervisor.DefaultStopTimeout, "How long the supervised app gets to stop before it is killed")
+	rootCmd.Flags().Int("max-crashes", supervisor.DefaultMaxCrashes, "Crashes within --crash-window after which the app is no longer restarted")
+	rootCmd.Flags().Duration("crash-window", supervisor.DefaultCrashWindow, "Window for --max-crashes")
+	rootCmd.Flags().Duration("min-uptime", supervisor.DefaultMinUptime, "How long the app must stay up after a patch for the patch to count as healthy")
+	rootCmd.Flags().StringArray("log-file", nil, "Log file clients can follow with live-patch logs (repeatable)")
+	rootCmd.Flags().Int("log-buffer-size", transport.DefaultLogBufferSize, "Bytes of output kept per log source")
+	rootCmd.Flags().String("name", "", "Name the agent is discovered by (default: the hostname)")
+	rootCmd.Flags().StringArray("label", nil, "Label for discovery as key=value, e.g. app=web (repeatable)")
+	rootCmd.Flags().String("registry", "", "URL of a registry (live-patch registry) to register with")
+	rootCmd.Flags().String("registry-token", "", "Token to register with (default $"+discovery.TokenEnv+")")
+	rootCmd.Flags().Bool("mdns", false, "Announce the agent over mDNS on the local network")
+	rootCmd.Flags().String("advertise", "", "host:port clients should use, if not the address the registry or mDNS sees")
+	rootCmd.Flags().Duration("announce-interval", 10*time.Second, "How often to re-register with --registry")
+
 	// Initialize Config & Logger
 	cfg, _ := config.Load("live-patch-agent")
 	env := "development"
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/velocity-trinity/core/pkg/discovery"
+	"github.com/velocity-trinity/core/pkg/logger"
+	"github.com/velocity-trinity/core/pkg/transport"
+)
+
+var agentsCmd = &cobra.Command{
+	Use:   "agents [selector]",
+	Short: "List the agents found in the registry or over mDNS, and their health",
+	Long: `Lists the agents in the registry (--registry, or live-patch.registry in the
+config file), or without one, the agents announcing themselves over mDNS.
+Each agent is contacted to check that it answers and that its app is up.
+Example: live-patch agents app=web,env=dev`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+
+		var agents []discovery.Agent
+		var err error
+		if len(args) == 1 {
+			agents, err = selectAgents(args[0])
+		} else {
+			agents, err = discoverAgents()
+		}
+		if err != nil {
+			logger.Log.Fatal(err.Error())
+		}
+		if len(agents) == 0 {
+			fmt.Println("No agents found.")
+			return
+		}
+
+		tlsConfig, err := clientTLSConfig()
+		if err != nil {
+			logger.Log.Fatal(err.Error())
+		}
+		transport.DialTimeout = timeout
+
+		health := make([]string, len(agents))
+		var wg sync.WaitGroup
+		for i := range agents {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				health[i] = checkAgent(&agents[i], tlsConfig, timeout)
+			}(i)
+		}
+		wg.Wait()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tADDRESS\tLABELS\tVERSION\tBASE PATH\tHEALTH")
+		for i, agent := range agents {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", agent.Name, agent.Addr, discovery.FormatLabels(agent.Labels), agent.Version, agent.BasePath, health[i])
+		}
+		w.Flush()
+	},
+}
+
+// checkAgent calls the agent and describes its health. What the agent reports
+// about itself replaces what was announced.
+func checkAgent(agent *discovery.Agent, tlsConfig *tls.Config, timeout time.Duration) string {
+	start := time.Now()
+	client, err := dial(agent.Addr, tlsConfig)
+	if err != nil {
+		return "unreachable: " + err.Error()
+	}
+	defer client.Close()
+	client.Timeout = timeout
+
+	info, err := client.Info()
+	latency := time.Since(start).Round(time.Millisecond)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return fmt.Sprintf("reachable in %v (agent too old to report more)", latency)
+	}
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	agent.Version, agent.BasePath = info.Version, info.BasePath
+
+	switch app := info.App; {
+	case app == nil:
+		return fmt.Sprintf("ok in %v", latency)
+	case app.Running:
+		return fmt.Sprintf("ok in %v, app up %s", latency, time.Since(app.Started).Round(time.Second))
+	case app.CrashLoop:
+		return fmt.Sprintf("app crash-looping (%s)", app.LastExit)
+	default:
+		return "app stopped"
+	}
+}
+
+var registryCmd = &cobra.Command{
+	Use:   "registry",
+	Short: "Run a registry that agents register with",
+	Long: `Lists the agents that registered (live-patch-agent --registry=<url>) within
+--ttl, so the CLI can find them by label instead of by address:
+  live-patch sync ./src --registry=http://registry:7070 --target app=web,env=dev
+Only agents with the token (--token, or $` + discovery.TokenEnv + ` for the registry and
+the agents) may register; anyone who can reach it may list them.
+Example: live-patch registry --addr=:7070`,
+	Run: func(cmd *cobra.Command, args []string) {
+		addr, _ := cmd.Flags().GetString("addr")
+		ttl, _ := cmd.Flags().GetDuration("ttl")
+		maxAgents, _ := cmd.Flags().GetInt("max-agents")
+		token, _ := cmd.Flags().GetString("token")
+		if token == "" {
+			token = os.Getenv(discovery.TokenEnv)
+		}
+		if token == "" {
+			logger.Log.Fatal("No --token or $" + discovery.TokenEnv + ": agents would have no way to register")
+		}
+
+		registry := discovery.NewRegistry(ttl)
+		registry.Token = token
+		registry.MaxAgents = maxAgents
+		logger.Log.Info("Agent registry listening on " + addr)
+		if err := http.ListenAndServe(addr, registry.Handler()); err != nil {
+			logger.Log.Fatal("Registry failed: " + err.Error())
+		}
+	},
+}
+
+func init() {
+	agentsCmd.Flags().Duration("timeout", 5*time.Second, "How long each agent gets to answer")
+	registryCmd.Flags().String("addr", ":7070", "Address to listen on")
+	registryCmd.Flags().Duration("ttl", discovery.DefaultTTL, "How long an agent stays listed after it last registered")
+	registryCmd.Flags().Int("max-agents", discovery.DefaultMaxAgents, "Most agents to list at once; new ones are refused beyond it")
+	registryCmd.Flags().String("token", "", "Token agents must send to register (default $"+discovery.TokenEnv+")")
+
+	rootCmd.AddCommand(agentsCmd, registryCmd)
+}
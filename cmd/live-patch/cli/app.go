@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/velocity-trinity/core/pkg/logger"
+	"github.com/velocity-trinity/core/pkg/transport"
+)
+
+var appCmd = &cobra.Command{
+	Use:   "app [status|reload|restart]",
+	Short: "Show, reload or restart the application supervised by the agent",
+	Long: `Works with agents started as the container entrypoint, e.g.
+  live-patch-agent --reload-signal=SIGHUP -- node server.js
+Example: live-patch app restart`,
+	Args:      cobra.MaximumNArgs(1),
+	ValidArgs: []string{transport.AppStatus, transport.AppReload, transport.AppRestart},
+	Run: func(cmd *cobra.Command, args []string) {
+		action := transport.AppStatus
+		if len(args) == 1 {
+			action = args[0]
+		}
+
+		client, err := dialAgent()
+		if err != nil {
+			logger.Log.Fatal("Failed to connect to agent: " + err.Error())
+		}
+		defer client.Close()
+
+		resp, err := client.App(action)
+		if err != nil {
+			logger.Log.Fatal("App " + action + " failed: " + err.Error())
+		}
+
+		status := resp.Status
+		fmt.Printf("Command:   %s\n", strings.Join(status.Command, " "))
+		switch {
+		case status.Running:
+			fmt.Printf("State:     running (pid %d, up %s)\n", status.PID, time.Since(status.Started).Round(time.Second))
+		case status.CrashLoop:
+			fmt.Println("State:     crash-looping (restarts resume with the next patch or `live-patch app restart`)")
+		default:
+			fmt.Println("State:     stopped")
+		}
+		fmt.Printf("Restarts:  %d\n", status.Restarts)
+		fmt.Printf("Reloads:   %d\n", status.Reloads)
+		fmt.Printf("Crashes:   %d recently\n", status.Crashes)
+		if status.LastExit != "" {
+			fmt.Printf("Last exit: %s\n", status.LastExit)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(appCmd)
+}
@@ -13,6 +13,7 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/velocity-trinity/core/pkg/logger"
+	"github.com/velocity-trinity/core/pkg/utils"
 )
 
 var initCACmd = &cobra.Command{
@@ -47,20 +48,76 @@ var initCACmd = &cobra.Command{
 		}
 
 		// Write Files
-		pemToFile("ca.crt", "CERTIFICATE", caBytes)
-		pemToFile("ca.key", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(caPriv))
+		pemToFile("ca.crt", "CERTIFICATE", caBytes, 0644)
+		pemToFile("ca.key", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(caPriv), 0600)
 		
 		fmt.Println("✅ Generated ca.crt and ca.key")
-		fmt.Println("   Next: Generate server/client certs signed by this CA (Not implemented in this CLI yet)")
+		fmt.Println("   Next: live-patch issue-cert --server --hosts=<agent host> and live-patch issue-cert --client")
 	},
 }
 
-func pemToFile(filename, typeName string, bytes []byte) {
-	out, _ := os.Create(filename)
+var issueCertCmd = &cobra.Command{
+	Use:   "issue-cert",
+	Short: "Issue a server or client certificate signed by the init-ca CA",
+	Long: `Creates <name>.crt and <name>.key signed by ca.crt/ca.key.
+Example: live-patch issue-cert --server --hosts=localhost,10.0.0.5
+         live-patch issue-cert --client --name=alice`,
+	Run: func(cmd *cobra.Command, args []string) {
+		server, _ := cmd.Flags().GetBool("server")
+		client, _ := cmd.Flags().GetBool("client")
+		name, _ := cmd.Flags().GetString("name")
+		hosts, _ := cmd.Flags().GetStringSlice("hosts")
+		caCert, _ := cmd.Flags().GetString("ca")
+		caKey, _ := cmd.Flags().GetString("ca-key")
+		days, _ := cmd.Flags().GetInt("days")
+
+		if server == client {
+			logger.Log.Fatal("Specify exactly one of --server or --client")
+		}
+		if name == "" {
+			name = "server"
+			if client {
+				name = "client"
+			}
+		}
+
+		opts := utils.CertOptions{
+			CommonName: name,
+			Client:     client,
+			Validity:   time.Duration(days) * 24 * time.Hour,
+		}
+		if server {
+			opts.Hosts = hosts
+		}
+
+		certPath, keyPath := name+".crt", name+".key"
+		if err := utils.IssueCert(caCert, caKey, certPath, keyPath, opts); err != nil {
+			logger.Log.Fatal("Failed to issue certificate: " + err.Error())
+		}
+
+		fmt.Printf("✅ Generated %s and %s\n", certPath, keyPath)
+		if server {
+			fmt.Printf("   Agent: live-patch-agent --cert=%s --key=%s --ca=%s --require-client-cert\n", certPath, keyPath, caCert)
+		} else {
+			fmt.Printf("   CLI:   live-patch sync ./src --ca=%s --cert=%s --key=%s\n", caCert, certPath, keyPath)
+		}
+	},
+}
+
+func pemToFile(filename, typeName string, bytes []byte, perm os.FileMode) {
+	out, _ := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 	defer out.Close()
 	pem.Encode(out, &pem.Block{Type: typeName, Bytes: bytes})
 }
 
 func init() {
-	rootCmd.AddCommand(initCACmd)
+	issueCertCmd.Flags().Bool("server", false, "Issue a certificate for an agent")
+	issueCertCmd.Flags().Bool("client", false, "Issue a certificate for a CLI user")
+	issueCertCmd.Flags().String("name", "", "Common name, also used for the output files (default \"server\" or \"client\")")
+	issueCertCmd.Flags().StringSlice("hosts", []string{"localhost", "127.0.0.1"}, "DNS names and IPs the agent is reached at (--server only)")
+	issueCertCmd.Flags().String("ca", "ca.crt", "CA certificate")
+	issueCertCmd.Flags().String("ca-key", "ca.key", "CA private key")
+	issueCertCmd.Flags().Int("days", 365, "Validity in days")
+
+	rootCmd.AddCommand(initCACmd, issueCertCmd)
 }
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/velocity-trinity/core/pkg/logger"
+	"github.com/velocity-trinity/core/pkg/textdiff"
+	"github.com/velocity-trinity/core/pkg/transport"
+)
+
+// Kinds of fileChange
+const (
+	changeAdded   = '+' // only local
+	changeUpdated = '~' // local and agent differ
+	changeDeleted = '-' // only on the agent
+)
+
+// fileChange is a difference between a local file and the agent's copy
+type fileChange struct {
+	kind   byte
+	rel    string
+	local  localFile
+	remote transport.RemoteFile
+	// attrs describes changed permission bits or owner (see attrChanges)
+	attrs []string
+}
+
+var diffCmd = &cobra.Command{
+	Use:   "diff [file|dir]",
+	Short: "Show what differs between local files and the remote container",
+	Long: `Compares a local file or directory with the agent's copy and lists the files
+added, changed or deleted locally, followed by a unified diff of each text file.
+Files matched by .gitignore or .livepatchignore are skipped, as in sync.
+Example: live-patch diff ./src`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		path := args[0]
+		nameOnly, _ := cmd.Flags().GetBool("name-only")
+		context, _ := cmd.Flags().GetInt("context")
+		maxSize, _ := cmd.Flags().GetInt64("max-diff-size")
+
+		info, err := os.Lstat(path)
+		if err != nil {
+			logger.Log.Fatal("Failed to stat file: " + err.Error())
+		}
+		client, err := dialAgent()
+		if err != nil {
+			logger.Log.Fatal("Failed to connect to agent: " + err.Error())
+		}
+		defer client.Close()
+
+		changes, unchanged, err := compare(client, path, info)
+		if err != nil {
+			logger.Log.Fatal("Diff failed: " + err.Error())
+		}
+		if len(changes) == 0 {
+			fmt.Printf("No differences between %s and %s (%d files)\n", path, targetAddr, unchanged)
+			return
+		}
+
+		counts := make(map[byte]int)
+		for _, change := range changes {
+			counts[change.kind]++
+			fmt.Printf("%c %s\n", change.kind, change.rel)
+		}
+		if !nameOnly {
+			for _, change := range changes {
+				out, err := diffFile(client, change, context, maxSize)
+				if errors.Is(err, errors.ErrUnsupported) {
+					fmt.Println("\n(the agent is too old to send file content; only names are shown)")
+					break
+				}
+				if err != nil {
+					logger.Log.Fatal("Diff failed: " + err.Error())
+				}
+				fmt.Print("\n" + out)
+			}
+		}
+		fmt.Printf("\n%d added, %d changed, %d deleted, %d unchanged\n", counts[changeAdded], counts[changeUpdated], counts[changeDeleted], unchanged)
+	},
+}
+
+// compare lists how a local file or directory differs from the agent's copy,
+// sorted by path, and counts the files that are the same
+func compare(client *transport.LivePatchClient, path string, info os.FileInfo) ([]fileChange, int, error) {
+	if info.IsDir() {
+		plan, err := planDir(client, path)
+		if err != nil {
+			return nil, 0, err
+		}
+		var changes []fileChange
+		for _, file := range plan.upload {
+			change := fileChange{kind: changeAdded, rel: file.rel, local: file}
+			if remote, ok := plan.remote[file.rel]; ok {
+				change.kind, change.remote = changeUpdated, remote
+				change.attrs = attrChanges(file, remote, plan.owners)
+			}
+			changes = append(changes, change)
+		}
+		for _, file := range plan.stale {
+			changes = append(changes, fileChange{kind: changeDeleted, rel: file.RelativePath, remote: file})
+		}
+		slices.SortFunc(changes, func(a, b fileChange) int { return strings.Compare(a.rel, b.rel) })
+		return changes, plan.unchanged, nil
+	}
+
+	rel, err := remotePath(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	file, ok, err := newLocalFile(path, rel, info)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !ok {
+		return nil, 0, fmt.Errorf("%s is not a regular file or symlink", path)
+	}
+
+	stat, err := statRemote(client, rel)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !stat.Exists {
+		return []fileChange{{kind: changeAdded, rel: rel, local: file}}, 0, nil
+	}
+	attrs := attrChanges(file, stat.File, stat.Owners)
+	if sameContent(file, stat.File) && len(attrs) == 0 {
+		return nil, 1, nil
+	}
+	return []fileChange{{kind: changeUpdated, rel: rel, local: file, remote: stat.File, attrs: attrs}}, 0, nil
+}
+
+// statRemote describes a file on the agent
+func statRemote(client *transport.LivePatchClient, rel string) (*transport.StatResponse, error) {
+	stat, err := client.Stat(rel)
+	if errors.Is(err, errors.ErrUnsupported) {
+		// Older agents can still list the file
+		files, owners, err := client.ListFiles(rel)
+		if err != nil || len(files) == 0 || files[0].RelativePath != rel {
+			return &transport.StatResponse{}, err
+		}
+		return &transport.StatResponse{Exists: true, File: files[0], Owners: owners}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stat.IsDir {
+		return nil, fmt.Errorf("%s is a directory on the agent", rel)
+	}
+	return stat, nil
+}
+
+// diffFile renders one change as a unified diff from the agent's copy to the
+// local file, after a line naming any changed attributes. Binary files and
+// files over maxSize are only named.
+func diffFile(client *transport.LivePatchClient, change fileChange, context int, maxSize int64) (string, error) {
+	var attrs string
+	if len(change.attrs) > 0 {
+		attrs = fmt.Sprintf("%s: %s\n", change.rel, strings.Join(change.attrs, ", "))
+	}
+	if change.kind == changeUpdated && sameContent(change.local, change.remote) {
+		return attrs, nil
+	}
+	out, err := diffContent(client, change, context, maxSize)
+	return attrs + out, err
+}
+
+// diffContent renders the content of one change as a unified diff
+func diffContent(client *transport.LivePatchClient, change fileChange, context int, maxSize int64) (string, error) {
+	fromName, toName := "a/"+change.rel, "b/"+change.rel
+	var from, to []byte
+	fits := true
+	var err error
+
+	if change.kind == changeAdded {
+		fromName = "/dev/null"
+	} else if from, fits, err = remoteContent(client, change.remote, maxSize); err != nil {
+		return "", err
+	}
+	if change.kind == changeDeleted {
+		toName = "/dev/null"
+	} else if fits {
+		if to, fits, err = localContent(change.local, maxSize); err != nil {
+			return "", err
+		}
+	}
+
+	switch {
+	case !fits:
+		return fmt.Sprintf("Files %s and %s differ (too large to diff)\n", fromName, toName), nil
+	case !textdiff.IsText(from) || !textdiff.IsText(to):
+		return fmt.Sprintf("Binary files %s and %s differ\n", fromName, toName), nil
+	}
+	return textdiff.Unified(fromName, toName, from, to, context), nil
+}
+
+// remoteContent fetches a file from the agent; fits is false if it's larger
+// than maxSize. A symlink is shown as a line naming its target.
+func remoteContent(client *transport.LivePatchClient, file transport.RemoteFile, maxSize int64) (content []byte, fits bool, err error) {
+	if file.LinkTarget != "" {
+		return []byte("symlink to " + file.LinkTarget + "\n"), true, nil
+	}
+	if file.Size > maxSize {
+		return nil, false, nil
+	}
+	resp, err := client.ReadFile(file.RelativePath, maxSize)
+	if err != nil {
+		return nil, false, err
+	}
+	return resp.Content, !resp.Truncated, nil
+}
+
+// localContent reads a local file like remoteContent
+func localContent(file localFile, maxSize int64) (content []byte, fits bool, err error) {
+	if file.link != "" {
+		return []byte("symlink to " + file.link + "\n"), true, nil
+	}
+	if file.info.Size() > maxSize {
+		return nil, false, nil
+	}
+	content, err = ioutil.ReadFile(file.path)
+	return content, err == nil, err
+}
+
+// dryRun shows what syncing path would change on each agent, without changing anything
+func dryRun(addrs []string, path string, info os.FileInfo, deleteStale bool) error {
+	tlsConfig, err := clientTLSConfig()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if err := dryRunTarget(addr, tlsConfig, path, info, deleteStale); err != nil {
+			return fmt.Errorf("%s: %w", addr, err)
+		}
+	}
+	return nil
+}
+
+func dryRunTarget(addr string, tlsConfig *tls.Config, path string, info os.FileInfo, deleteStale bool) error {
+	client, err := dial(addr, tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	changes, unchanged, err := compare(client, path, info)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Would sync %s to %s:\n", path, addr)
+	uploads, deletes, kept := 0, 0, 0
+	for _, change := range changes {
+		switch {
+		case change.kind != changeDeleted:
+			uploads++
+			fmt.Println("  ↑ " + change.rel)
+		case deleteStale:
+			deletes++
+			fmt.Println("  ✗ " + change.rel)
+		default:
+			kept++
+		}
+	}
+	if uploads+deletes > 0 && restartCmd != "" {
+		fmt.Printf("  then run: %s\n", restartCmd)
+	}
+	fmt.Printf("🔍 Dry run: %d to upload, %d to delete, %d unchanged", uploads, deletes, unchanged)
+	if kept > 0 {
+		fmt.Printf(", %d only on the agent (pass --delete to remove)", kept)
+	}
+	fmt.Println()
+	return nil
+}
+
+func init() {
+	diffCmd.Flags().Bool("name-only", false, "Only list the files that differ")
+	diffCmd.Flags().IntP("context", "U", 3, "Lines of context around each change")
+	diffCmd.Flags().Int64("max-diff-size", 1<<20, "Files larger than this (in bytes) are listed but not diffed")
+
+	rootCmd.AddCommand(diffCmd)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/spf13/cobra"
+	"github.com/velocity-trinity/core/pkg/logger"
+	"github.com/velocity-trinity/core/pkg/transport"
+)
+
+var execCmd = &cobra.Command{
+	Use:   "exec -- command [args...]",
+	Short: "Run a command in the remote container and stream its output",
+	Long: `Runs the command on the agent without a shell; arguments are passed as-is.
+Exits with the command's exit code.
+Example: live-patch exec --env=NODE_ENV=test --dir=src -- npm test -- --watch=false`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		env, _ := cmd.Flags().GetStringArray("env")
+		dir, _ := cmd.Flags().GetString("dir")
+
+		client, err := dialAgent()
+		if err != nil {
+			logger.Log.Fatal("Failed to connect to agent: " + err.Error())
+		}
+		defer client.Close()
+		// Ctrl-C stops the call on the agent too
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		client = client.WithContext(ctx)
+
+		resp, err := client.Exec(&transport.CommandRequest{
+			Command: args,
+			Timeout: int(timeout.Seconds()),
+			Env:     env,
+			Dir:     dir,
+		}, os.Stdout)
+		if errors.Is(err, context.Canceled) {
+			fmt.Fprintln(os.Stderr, "❌ Interrupted")
+			os.Exit(130)
+		}
+		if err != nil {
+			logger.Log.Fatal("Exec failed: " + err.Error())
+		}
+		if !resp.Success {
+			fmt.Fprintf(os.Stderr, "❌ %s (exit code %d)\n", resp.Error, resp.ExitCode)
+			if resp.ExitCode <= 0 {
+				os.Exit(1)
+			}
+			os.Exit(resp.ExitCode)
+		}
+	},
+}
+
+func init() {
+	execCmd.Flags().Duration("timeout", 0, "Kill the command after this long (default: the agent's --command-timeout)")
+	execCmd.Flags().StringArray("env", nil, "Environment variable as KEY=VALUE (repeatable)")
+	execCmd.Flags().String("dir", "", "Working directory relative to the agent's base path")
+
+	rootCmd.AddCommand(execCmd)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/velocity-trinity/core/pkg/logger"
+	"github.com/velocity-trinity/core/pkg/transport"
+)
+
+var logsCmd = &cobra.Command{
+	Use:   "logs [source]",
+	Short: "Show the logs of the application in the remote container",
+	Long: `Shows the output of the app the agent supervises, or of a log file the agent
+was started with --log-file. The source defaults to the app's output.
+Example: live-patch logs -f --tail 100`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		follow, _ := cmd.Flags().GetBool("follow")
+		tail, _ := cmd.Flags().GetInt("tail")
+		source := ""
+		if len(args) == 1 {
+			source = args[0]
+		}
+
+		client, err := dialAgent()
+		if err != nil {
+			logger.Log.Fatal("Failed to connect to agent: " + err.Error())
+		}
+		defer client.Close()
+		// Ctrl-C stops the call on the agent too
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		client = client.WithContext(ctx)
+
+		req := &transport.LogsRequest{Source: source, Tail: tail}
+		if tail <= 0 {
+			// Everything the agent still has
+			req = &transport.LogsRequest{Source: source}
+		}
+		resp, err := client.Logs(req)
+		if err != nil {
+			logger.Log.Fatal("Failed to read logs: " + err.Error())
+		}
+		os.Stdout.Write(resp.Output)
+		if !follow {
+			return
+		}
+		if err := client.FollowLogs(resp.Source, resp.Offset, time.Time{}, os.Stdout); err != nil && !errors.Is(err, context.Canceled) {
+			logger.Log.Fatal("Lost the log stream: " + err.Error())
+		}
+	},
+}
+
+// followAfterSync notes where the agent's app log is now, and returns a function
+// that shows what the app writes from then on for --follow. Without --follow, or
+// if the agent has no logs, the function does nothing.
+func followAfterSync(client *transport.LivePatchClient, cmd *cobra.Command) func() {
+	duration, _ := cmd.Flags().GetDuration("follow")
+	if duration <= 0 {
+		return func() {}
+	}
+	mark, err := client.Logs(&transport.LogsRequest{Offset: -1})
+	if err != nil {
+		logger.Log.Warn("Not following logs: " + err.Error())
+		return func() {}
+	}
+	return func() {
+		fmt.Printf("📜 Output of %s for the next %s:\n", mark.Source, duration)
+		if err := client.FollowLogs(mark.Source, mark.Offset, time.Now().Add(duration), os.Stdout); err != nil {
+			logger.Log.Warn("Lost the log stream: " + err.Error())
+		}
+	}
+}
+
+func init() {
+	logsCmd.Flags().BoolP("follow", "f", false, "Keep printing new output")
+	logsCmd.Flags().Int("tail", 50, "Number of recent lines to show first (0 for everything kept)")
+
+	rootCmd.AddCommand(logsCmd)
+}
@@ -2,19 +2,43 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/velocity-trinity/core/pkg/config"
 	"github.com/velocity-trinity/core/pkg/logger"
 	"github.com/velocity-trinity/core/pkg/transport"
+	"github.com/velocity-trinity/core/pkg/utils"
 )
 
-var targetAddr string
 var restartCmd string
 
+// Agents to talk to: --target (addresses, config groups or label selectors)
+// and --targets-file. targetAddr is the agent a single-agent command settled on.
+var (
+	targetList  []string
+	targetsFile string
+	targetAddr  string
+
+	registryURL      string
+	discoveryTimeout time.Duration
+	liveConfig       config.LivePatch
+)
+
+// TLS settings shared by every command that talks to an agent
+var (
+	caFile      string
+	certFile    string
+	keyFile     string
+	insecureTLS bool
+	rpcTimeout  time.Duration
+	noCompress  bool
+)
+
 var rootCmd = &cobra.Command{
 	Use:   "live-patch",
 	Short: "LivePatch CLI Tool",
@@ -24,43 +48,80 @@ var rootCmd = &cobra.Command{
 }
 
 var syncCmd = &cobra.Command{
-	Use:   "sync [file]",
-	Short: "Sync a local file to the remote container",
-	Args:  cobra.ExactArgs(1),
+	Use:   "sync [file|dir]",
+	Short: "Sync a local file or directory to the remote container",
+	Long: `Syncs one file, or a whole directory tree in a single session.
+Directories are compared with the agent first, so only new and changed files are sent.
+Files matched by .gitignore or .livepatchignore are skipped.
+With several targets, every agent is synced at once (up to --parallel) and the
+results are shown per target. --mode=all-or-nothing only commits if every agent
+staged its changes, and rolls back the others if one of them fails to commit.
+Example: live-patch sync ./src --delete --restart="npm restart" --follow=10s
+         live-patch sync ./src -t web-0:8443 -t web-1:8443 --mode=all-or-nothing`,
+	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		filePath := args[0]
-		
-		// Read file content
-		content, err := ioutil.ReadFile(filePath)
+		deleteStale, _ := cmd.Flags().GetBool("delete")
+
+		info, err := os.Lstat(filePath)
 		if err != nil {
-			logger.Log.Fatal("Failed to read file: " + err.Error())
+			logger.Log.Fatal("Failed to stat file: " + err.Error())
 		}
 
-		info, err := os.Stat(filePath)
+		addrs, err := targets()
 		if err != nil {
-			logger.Log.Fatal("Failed to stat file: " + err.Error())
+			logger.Log.Fatal(err.Error())
+		}
+		if dry, _ := cmd.Flags().GetBool("dry-run"); dry {
+			if err := dryRun(addrs, filePath, info, deleteStale); err != nil {
+				logger.Log.Fatal("Dry run failed: " + err.Error())
+			}
+			return
+		}
+		if len(addrs) > 1 {
+			if err := syncTargets(cmd, addrs, filePath, info, deleteStale); err != nil {
+				logger.Log.Fatal(err.Error())
+			}
+			return
 		}
 
-		// Connect to Agent
-		// In production, use proper CA verification. For dev, skip verify.
-		tlsConfig := &tls.Config{InsecureSkipVerify: true}
-		
-		client, err := transport.NewClient(targetAddr, tlsConfig)
+		client, err := dialAgent()
 		if err != nil {
 			logger.Log.Fatal("Failed to connect to agent: " + err.Error())
 		}
 		defer client.Close()
+		follow := followAfterSync(client, cmd)
+
+		if info.IsDir() {
+			result, err := inTransaction(client, func(txID string) (*syncResult, error) {
+				return syncDir(client, txID, filePath, deleteStale)
+			})
+			if err != nil {
+				// The app's output usually says why the patch failed
+				follow()
+				logger.Log.Fatal("Sync failed: " + err.Error())
+			}
+			fmt.Printf("✅ Synced %s to %s: %d uploaded, %d deleted, %d unchanged\n", filePath, targetAddr, result.Uploaded, result.Deleted, result.Unchanged)
+			follow()
+			return
+		}
+
+		relPath, err := remotePath(filePath)
+		if err != nil {
+			logger.Log.Fatal(err.Error())
+		}
 
 		// Send Request
-		req := &transport.FileSyncRequest{
-			RelativePath: filePath,
-			Content:      content,
-			Mode:         uint32(info.Mode()),
-			Timestamp:    info.ModTime(),
-			PostSyncCommand: restartCmd,
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = readLink(filePath); err != nil {
+				logger.Log.Fatal("Failed to read symlink: " + err.Error())
+			}
 		}
+		req := syncRequest(localFile{path: filePath, rel: relPath, info: info, link: link})
+		req.PostSyncCommand = restartCmd
 
-		resp, err := client.SyncFile(req)
+		resp, err := sendFile(client, filePath, req, true)
 		if err != nil {
 			logger.Log.Fatal("Sync RPC failed: " + err.Error())
 		}
@@ -73,23 +134,86 @@ var syncCmd = &cobra.Command{
 		} else {
 			fmt.Printf("❌ Sync failed: %s\n", resp.Message)
 		}
+		follow()
 	},
 }
 
+// dialAgent connects to the agent at --target, which must name exactly one
+func dialAgent() (*transport.LivePatchClient, error) {
+	addrs, err := targets()
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) > 1 {
+		return nil, fmt.Errorf("this command talks to one agent, but the targets name %d (%s)", len(addrs), strings.Join(addrs, ", "))
+	}
+	targetAddr = addrs[0]
+
+	tlsConfig, err := clientTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return dial(targetAddr, tlsConfig)
+}
+
+// dial connects to the agent at addr with the shared client settings
+func dial(addr string, tlsConfig *tls.Config) (*transport.LivePatchClient, error) {
+	client, err := transport.NewClient(addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	client.Timeout = rpcTimeout
+	if noCompress {
+		client.Compression = ""
+	}
+	return client, nil
+}
+
+// clientTLSConfig pins the agent's certificate to --ca and presents --cert/--key.
+// Connecting without verifying the agent takes an explicit --insecure.
+func clientTLSConfig() (*tls.Config, error) {
+	if caFile == "" && !insecureTLS {
+		return nil, errors.New("no --ca to verify the agent's certificate against; pass --ca, or --insecure to connect without verifying it")
+	}
+	return utils.ClientTLSConfig(caFile, certFile, keyFile, insecureTLS)
+}
+
 func main() {
-	syncCmd.Flags().StringVarP(&targetAddr, "target", "t", "localhost:8080", "Address of the LivePatch Agent")
-	syncCmd.Flags().StringVarP(&restartCmd, "restart", "r", "", "Command to run after sync (e.g. 'npm restart')")
+	rootCmd.PersistentFlags().StringArrayVarP(&targetList, "target", "t", nil, "Address of the LivePatch Agent, a group of them from the config file, or labels of discovered agents (app=web,env=dev); repeat to sync to several (default localhost:8080)")
+	rootCmd.PersistentFlags().StringVar(&targetsFile, "targets-file", "", "File listing agent addresses (or groups), one per line")
+	rootCmd.PersistentFlags().StringVar(&registryURL, "registry", "", "Agent registry to discover agents in (default: live-patch.registry from the config, else mDNS)")
+	rootCmd.PersistentFlags().DurationVar(&discoveryTimeout, "discovery-timeout", time.Second, "How long to wait for agents to answer over mDNS")
+	rootCmd.PersistentFlags().StringVarP(&restartCmd, "restart", "r", "", "Command to run after sync (e.g. 'npm restart'), or the name of a hook in the agent's policy")
+	rootCmd.PersistentFlags().StringVar(&caFile, "ca", "", "CA certificate the agent's certificate must be signed by")
+	rootCmd.PersistentFlags().StringVar(&certFile, "cert", "", "Client certificate for agents that require one")
+	rootCmd.PersistentFlags().StringVar(&keyFile, "key", "", "Private key for --cert")
+	rootCmd.PersistentFlags().BoolVar(&insecureTLS, "insecure", false, "Skip verifying the agent's certificate")
+	rootCmd.PersistentFlags().DurationVar(&rpcTimeout, "rpc-timeout", 0, "Give up on an agent call after this long (0 for no limit; doesn't apply to exec or following logs)")
+	rootCmd.PersistentFlags().BoolVar(&noCompress, "no-compress", false, "Send file content uncompressed even if the agent supports compression")
+	syncCmd.Flags().Bool("delete", false, "When syncing a directory, delete remote files that no longer exist locally")
+	syncCmd.Flags().Duration("follow", 0, "After syncing, show the app's output for this long (e.g. 10s)")
+	syncCmd.Flags().Bool("dry-run", false, "Show what would be uploaded and deleted without changing anything (see also live-patch diff)")
+	syncCmd.Flags().Int("parallel", 4, "Number of agents to sync at once when there are several targets")
+	syncCmd.Flags().String("mode", modeBestEffort, "With several targets: best-effort commits wherever staging worked; all-or-nothing rolls every target back if one fails")
 
 	rootCmd.AddCommand(syncCmd)
 
 	// Initialize Config & Logger
-	cfg, _ := config.Load("live-patch")
+	cfg, err := config.Load("live-patch")
+	if err == nil {
+		err = cfg.Validate()
+	}
 	env := "development"
 	if cfg != nil {
 		env = cfg.Env
+		liveConfig = cfg.LivePatch
 	}
 	logger.Init(env)
 	defer logger.Sync()
+	if err != nil {
+		// Targets from a config we misread could send the patch to the wrong agents
+		logger.Log.Fatal("Invalid config " + config.File() + ": " + err.Error())
+	}
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/velocity-trinity/core/pkg/logger"
+	"github.com/velocity-trinity/core/pkg/transport"
+)
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Undo patches on the remote container",
+	Long: `Restores the files changed by the latest patch, or by every patch after --to.
+The --restart command runs once the files are restored.
+Example: live-patch rollback --to 12 --restart="npm restart"`,
+	Run: func(cmd *cobra.Command, args []string) {
+		to, _ := cmd.Flags().GetInt("to")
+
+		client, err := dialAgent()
+		if err != nil {
+			logger.Log.Fatal("Failed to connect to agent: " + err.Error())
+		}
+		defer client.Close()
+
+		resp, err := client.Rollback(to, restartCmd)
+		if err != nil {
+			logger.Log.Fatal("Rollback failed: " + err.Error())
+		}
+		if len(resp.RolledBack) == 0 {
+			fmt.Println(resp.Message)
+			return
+		}
+
+		ids := make([]string, len(resp.RolledBack))
+		for i, id := range resp.RolledBack {
+			ids[i] = strconv.Itoa(id)
+		}
+		fmt.Printf("⏪ Rolled back patch(es) %s on %s\n", strings.Join(ids, ", "), targetAddr)
+		if restartCmd != "" {
+			fmt.Println(resp.Message)
+		}
+	},
+}
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "List the patches applied on the remote container",
+	Run: func(cmd *cobra.Command, args []string) {
+		limit, _ := cmd.Flags().GetInt("limit")
+
+		client, err := dialAgent()
+		if err != nil {
+			logger.Log.Fatal("Failed to connect to agent: " + err.Error())
+		}
+		defer client.Close()
+
+		patches, err := client.History(limit)
+		if err != nil {
+			logger.Log.Fatal("Failed to read history: " + err.Error())
+		}
+		if len(patches) == 0 {
+			fmt.Println("No patches applied yet.")
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tTIME\tFILES\tSTATUS\tCOMMAND")
+		for _, patch := range patches {
+			status := patch.Status
+			if patch.Reason != "" {
+				status += " (" + patch.Reason + ")"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", patch.ID, patch.Time.Format("2006-01-02 15:04:05"), describeFiles(patch.Files), status, patch.Command)
+		}
+		w.Flush()
+	},
+}
+
+// describeFiles names the single file a patch changed, or counts them
+func describeFiles(files []transport.PatchFile) string {
+	if len(files) == 1 {
+		return files[0].RelativePath
+	}
+	return fmt.Sprintf("%d files", len(files))
+}
+
+func init() {
+	rollbackCmd.Flags().Int("to", 0, "Patch ID to return to; every later patch is undone (default: undo the latest patch)")
+	historyCmd.Flags().Int("limit", 20, "Number of patches to show (0 for all)")
+
+	rootCmd.AddCommand(rollbackCmd, historyCmd)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/velocity-trinity/core/pkg/ignore"
+	"github.com/velocity-trinity/core/pkg/logger"
+	"github.com/velocity-trinity/core/pkg/transport"
+)
+
+// localFile is a file found while walking the directory being synced
+type localFile struct {
+	path string // path on disk
+	rel  string // slash-separated path sent to the agent
+	info os.FileInfo
+	hash string
+	link string // target of a symlink (which has no hash)
+}
+
+// progress receives a line for each file uploaded or deleted
+var progress io.Writer = os.Stdout
+
+// syncResult counts what a directory sync did
+type syncResult struct {
+	Uploaded, Renamed, Deleted, Unchanged int
+}
+
+// dirPlan is what syncing a directory would change on the agent
+type dirPlan struct {
+	// upload holds the files the agent lacks or has with different content or attributes
+	upload []localFile
+	// stale holds the files the agent has but the directory doesn't
+	stale     []transport.RemoteFile
+	unchanged int
+	remote    map[string]transport.RemoteFile
+	// owners is how the agent picks the owner of synced files
+	owners *transport.OwnerMap
+}
+
+// planDir compares a local directory with the agent's copy. Files matched by
+// .gitignore or .livepatchignore are skipped on both sides.
+func planDir(client *transport.LivePatchClient, dir string) (*dirPlan, error) {
+	prefix, err := remotePath(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	matcher, err := ignore.New(".")
+	if err != nil {
+		return nil, err
+	}
+	// Walk the cleaned relative path, so the local paths are the ones sent to the agent
+	local, err := walkLocal(filepath.FromSlash(prefix), matcher)
+	if err != nil {
+		return nil, err
+	}
+
+	remote, owners, err := client.ListFiles(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list remote files: %w", err)
+	}
+	plan := &dirPlan{remote: make(map[string]transport.RemoteFile, len(remote)), owners: owners}
+	for _, file := range remote {
+		plan.remote[file.RelativePath] = file
+	}
+
+	present := make(map[string]bool, len(local))
+	for _, file := range local {
+		present[file.rel] = true
+		existing, ok := plan.remote[file.rel]
+		if ok && sameContent(file, existing) && len(attrChanges(file, existing, owners)) == 0 {
+			plan.unchanged++
+			continue
+		}
+		plan.upload = append(plan.upload, file)
+	}
+	for _, file := range remote {
+		// Ignored files (build output, node_modules, ...) belong to the agent
+		if !present[file.RelativePath] && !matcher.Ignored(file.RelativePath, false) {
+			plan.stale = append(plan.stale, file)
+		}
+	}
+	return plan, nil
+}
+
+// sameContent reports whether the agent's copy has the content (or link target) of file
+func sameContent(file localFile, remote transport.RemoteFile) bool {
+	return remote.Hash == file.hash && remote.LinkTarget == file.link
+}
+
+// attrChanges describes how syncing file would change the attributes of the
+// agent's copy: its permission bits, and its owner if the agent maps owners.
+// Modification times aren't compared, since checkouts and builds touch files
+// without changing them.
+func attrChanges(file localFile, remote transport.RemoteFile, owners *transport.OwnerMap) []string {
+	var changes []string
+	// Windows has no permission bits to sync
+	if file.link == "" && runtime.GOOS != "windows" {
+		if from, to := os.FileMode(remote.Mode).Perm(), file.info.Mode().Perm(); from != to {
+			changes = append(changes, fmt.Sprintf("mode %04o → %04o", from, to))
+		}
+	}
+	if remote.Owner != nil {
+		if want := owners.Owner(transport.OwnerOf(file.info), *remote.Owner); want != *remote.Owner {
+			changes = append(changes, fmt.Sprintf("owner %d:%d → %d:%d", remote.Owner.UID, remote.Owner.GID, want.UID, want.GID))
+		}
+	}
+	return changes
+}
+
+// syncDir mirrors a local directory to the agent over one connection: files
+// the agent lacks or has with different content or attributes are uploaded
+// (large files whose content is the same as a delta without new data) and, with
+// deleteStale, files the agent has but the directory doesn't are removed.
+// Changes are staged in transaction txID.
+func syncDir(client *transport.LivePatchClient, txID, dir string, deleteStale bool) (*syncResult, error) {
+	plan, err := planDir(client, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &syncResult{Unchanged: plan.unchanged}
+	for _, file := range plan.upload {
+		_, onAgent := plan.remote[file.rel]
+		if err := uploadFile(client, txID, file, onAgent); err != nil {
+			return result, err
+		}
+		result.Uploaded++
+	}
+
+	if !deleteStale {
+		return result, nil
+	}
+	for _, file := range plan.stale {
+		if err := deleteFile(client, txID, file.RelativePath); err != nil {
+			return result, err
+		}
+		result.Deleted++
+	}
+	return result, nil
+}
+
+// inTransaction runs fn in a new transaction and commits it with the --restart
+// command, so the agent sees all of the changes at once or none of them.
+// Nothing is committed (and nothing restarted) if fn changed nothing.
+func inTransaction(client *transport.LivePatchClient, fn func(txID string) (*syncResult, error)) (*syncResult, error) {
+	txID, err := client.BeginTx()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := fn(txID)
+	if err != nil || result.Uploaded+result.Renamed+result.Deleted == 0 {
+		if abortErr := client.AbortTx(txID); abortErr != nil {
+			logger.Log.Warn("Failed to abort transaction: " + abortErr.Error())
+		}
+		return result, err
+	}
+
+	resp, err := client.CommitTx(txID, restartCmd)
+	if err != nil {
+		// A refused commit (e.g. by the agent's policy) leaves the transaction open
+		client.AbortTx(txID)
+		return result, fmt.Errorf("commit failed: %w", err)
+	}
+	if !resp.Success {
+		return result, errors.New(resp.Message)
+	}
+	if restartCmd != "" {
+		fmt.Printf("🔄 Post-sync command output:\n%s\n", resp.Message)
+	}
+	return result, nil
+}
+
+// uploadFile sends one file to the agent. With onAgent set the agent has an
+// older version, so only the changed blocks are sent.
+func uploadFile(client *transport.LivePatchClient, txID string, file localFile, onAgent bool) error {
+	req := syncRequest(file)
+	req.TxID = txID
+	resp, err := sendFile(client, file.path, req, onAgent)
+	if err != nil {
+		return fmt.Errorf("failed to sync %s: %w", file.rel, err)
+	}
+	if !resp.Success {
+		return fmt.Errorf("failed to sync %s: %s", file.rel, resp.Message)
+	}
+	fmt.Fprintln(progress, "  ↑ "+file.rel)
+	return nil
+}
+
+// syncRequest describes a local file to the agent: its permission bits,
+// modification time and owner, and where it points if it's a symlink
+func syncRequest(file localFile) *transport.FileSyncRequest {
+	return &transport.FileSyncRequest{
+		RelativePath: file.rel,
+		Mode:         uint32(file.info.Mode().Perm()),
+		Timestamp:    file.info.ModTime(),
+		LinkTarget:   file.link,
+		Owner:        transport.OwnerOf(file.info),
+	}
+}
+
+// sendFile syncs the file at path. Symlinks are sent as links and large files
+// are streamed in resumable chunks; others are sent whole, or as a delta if
+// the agent has an older version.
+func sendFile(client *transport.LivePatchClient, path string, req *transport.FileSyncRequest, onAgent bool) (*transport.FileSyncResponse, error) {
+	if req.LinkTarget != "" {
+		return client.SyncFile(req)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() >= transport.StreamMinSize {
+		return client.UploadFile(path, req)
+	}
+
+	if req.Content, err = ioutil.ReadFile(path); err != nil {
+		return nil, err
+	}
+	if onAgent {
+		return client.SyncFileDelta(req)
+	}
+	return client.SyncFile(req)
+}
+
+// deleteFile removes one file from the agent
+func deleteFile(client *transport.LivePatchClient, txID, rel string) error {
+	if _, err := client.DeleteFile(rel, txID); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", rel, err)
+	}
+	fmt.Fprintln(progress, "  ✗ "+rel)
+	return nil
+}
+
+// walkLocal lists the files below dir that aren't ignored, loading nested ignore files on the way
+func walkLocal(dir string, matcher *ignore.Matcher) ([]localFile, error) {
+	// Ignore files between the working directory and dir apply too
+	parts := strings.Split(filepath.ToSlash(filepath.Clean(dir)), "/")
+	for i := 1; i < len(parts); i++ {
+		if err := matcher.Load(".", strings.Join(parts[:i], "/")); err != nil {
+			return nil, err
+		}
+	}
+
+	var files []localFile
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := filepath.ToSlash(filepath.Clean(path))
+
+		if info.IsDir() {
+			if matcher.Ignored(rel, true) {
+				return filepath.SkipDir
+			}
+			return matcher.Load(".", rel)
+		}
+		if matcher.Ignored(rel, false) {
+			return nil
+		}
+		file, ok, err := newLocalFile(path, rel, info)
+		if ok {
+			files = append(files, file)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger.Log.Debug(fmt.Sprintf("Found %d local files in %s", len(files), dir))
+	return files, nil
+}
+
+// newLocalFile hashes a regular file or reads a symlink; ok is false for anything else
+func newLocalFile(path, rel string, info os.FileInfo) (file localFile, ok bool, err error) {
+	file = localFile{path: path, rel: rel, info: info}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		file.link, err = readLink(path)
+	case info.Mode().IsRegular():
+		file.hash, err = hashFile(path)
+	default:
+		return file, false, nil
+	}
+	return file, err == nil, err
+}
+
+// readLink returns the slash-separated target of the symlink at path. The agent
+// only accepts relative links, so absolute ones into the working directory
+// are made relative.
+func readLink(path string) (string, error) {
+	target, err := os.Readlink(path)
+	if err != nil || !filepath.IsAbs(target) {
+		return filepath.ToSlash(target), err
+	}
+	if _, err := remotePath(target); err == nil {
+		dir, err := filepath.Abs(filepath.Dir(path))
+		if err != nil {
+			return "", err
+		}
+		if rel, err := filepath.Rel(dir, target); err == nil {
+			target = rel
+		}
+	}
+	return filepath.ToSlash(target), nil
+}
+
+// remotePath turns a local path into the path sent to the agent.
+// The agent mirrors the working directory, so paths must stay inside it.
+func remotePath(local string) (string, error) {
+	if filepath.IsAbs(local) {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		if local, err = filepath.Rel(cwd, local); err != nil {
+			return "", err
+		}
+	}
+	rel := filepath.ToSlash(filepath.Clean(local))
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s is outside the current directory", local)
+	}
+	return rel, nil
+}
+
+// hashFile hashes a file without reading it all into memory
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
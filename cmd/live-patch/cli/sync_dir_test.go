@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/velocity-trinity/core/pkg/transport"
+)
+
+func TestAttrChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := localFile{path: path, rel: "run.sh", info: info}
+	local := transport.OwnerOf(info)
+
+	tests := []struct {
+		name   string
+		remote transport.RemoteFile
+		owners *transport.OwnerMap
+		want   []string
+	}{
+		{"same mode", transport.RemoteFile{Mode: 0755}, nil, nil},
+		{"mode differs", transport.RemoteFile{Mode: 0644}, nil, []string{"mode 0644 → 0755"}},
+		// the agent reports the full mode, type bits included
+		{"only permission bits count", transport.RemoteFile{Mode: uint32(os.ModeSetuid | 0755)}, nil, nil},
+		{"owner not mapped", transport.RemoteFile{Mode: 0755, Owner: &transport.FileOwner{UID: 5, GID: 5}},
+			&transport.OwnerMap{UID: -1, GID: -1}, nil},
+		{"owner mapped and matching", transport.RemoteFile{Mode: 0755, Owner: &transport.FileOwner{UID: 33, GID: 5}},
+			&transport.OwnerMap{UID: 33, GID: -1}, nil},
+		{"owner mapped and differing", transport.RemoteFile{Mode: 0755, Owner: &transport.FileOwner{UID: 5, GID: 5}},
+			&transport.OwnerMap{UID: 33, GID: 34}, []string{"owner 5:5 → 33:34"}},
+		{"translated owner", transport.RemoteFile{Mode: 0755, Owner: &transport.FileOwner{UID: 5, GID: 5}},
+			&transport.OwnerMap{UID: -1, GID: -1, UIDs: map[int]int{local.UID: 7}}, []string{"owner 5:5 → 7:5"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := attrChanges(file, tt.remote, tt.owners); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("attrChanges = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
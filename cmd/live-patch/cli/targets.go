@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/velocity-trinity/core/pkg/discovery"
+	"github.com/velocity-trinity/core/pkg/logger"
+	"github.com/velocity-trinity/core/pkg/transport"
+)
+
+const defaultTarget = "localhost:8080"
+
+// Ways to sync several targets (--mode)
+const (
+	modeBestEffort   = "best-effort"
+	modeAllOrNothing = "all-or-nothing"
+)
+
+// targets lists the agent addresses named by --target and --targets-file, in
+// order and without duplicates. A name with '=' selects discovered agents by
+// label; one without a port is a group from the live-patch.targets section of
+// the config file.
+func targets() ([]string, error) {
+	names := slices.Clone(targetList)
+	if targetsFile != "" {
+		listed, err := readTargetsFile(targetsFile)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, listed...)
+	}
+	if len(names) == 0 {
+		return []string{defaultTarget}, nil
+	}
+
+	var addrs []string
+	for _, name := range names {
+		expanded := []string{name}
+		switch {
+		case discovery.IsSelector(name):
+			agents, err := selectAgents(name)
+			if err != nil {
+				return nil, err
+			}
+			expanded = nil
+			for _, agent := range agents {
+				expanded = append(expanded, agent.Addr)
+			}
+		case !strings.Contains(name, ":"):
+			// Viper lowercases config keys
+			group, ok := liveConfig.Targets[strings.ToLower(name)]
+			if !ok {
+				return nil, fmt.Errorf("target %q is neither host:port nor a group in the config's live-patch.targets", name)
+			}
+			expanded = group
+		}
+		for _, addr := range expanded {
+			if !slices.Contains(addrs, addr) {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// selectAgents returns the discovered agents that have the labels in selector
+func selectAgents(selector string) ([]discovery.Agent, error) {
+	sel, err := discovery.ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	agents, err := discoverAgents()
+	if err != nil {
+		return nil, err
+	}
+	matched := sel.Select(agents)
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("no agent matches %s (found %d; see live-patch agents)", selector, len(agents))
+	}
+	return matched, nil
+}
+
+// discovered caches the agents found by discoverAgents
+var discovered []discovery.Agent
+
+// discoverAgents lists the agents in the registry (--registry, or
+// live-patch.registry in the config), or without one, those that answer over mDNS
+func discoverAgents() ([]discovery.Agent, error) {
+	if discovered != nil {
+		return discovered, nil
+	}
+	url := registryURL
+	if url == "" {
+		url = liveConfig.Registry
+	}
+
+	var err error
+	if url != "" {
+		discovered, err = discovery.NewRegistryClient(url).Agents()
+	} else {
+		discovered, err = discovery.Browse(discoveryTimeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover agents: %w", err)
+	}
+	if discovered == nil {
+		discovered = []discovery.Agent{}
+	}
+	return discovered, nil
+}
+
+// readTargetsFile reads one target per line; blank lines and # comments are skipped
+func readTargetsFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read targets: %w", err)
+	}
+	defer f.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			names = append(names, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read targets: %w", err)
+	}
+	return names, nil
+}
+
+// Outcomes of syncing one target
+const (
+	statusSynced         = "synced"
+	statusUnchanged      = "unchanged"
+	statusFailed         = "failed"
+	statusAborted        = "aborted"
+	statusRolledBack     = "rolled back"
+	statusRollbackFailed = "rollback failed"
+	// statusUnknown is a commit given up on that may or may not have been applied
+	statusUnknown = "unknown"
+)
+
+// targetSync is one agent's part in a multi-target sync
+type targetSync struct {
+	addr    string
+	client  *transport.LivePatchClient
+	txID    string
+	result  *syncResult
+	patchID int
+	output  string // post-sync command output
+	status  string
+	err     error
+	elapsed time.Duration
+}
+
+// syncTargets syncs path to every agent in addrs, up to --parallel at once,
+// and prints a table of the results. Each agent gets its own transaction.
+// In best-effort mode each one commits as soon as its changes are staged; in
+// all-or-nothing mode nothing commits until every agent has staged, and the
+// agents that did commit are rolled back if another one's commit fails.
+func syncTargets(cmd *cobra.Command, addrs []string, path string, info os.FileInfo, deleteStale bool) error {
+	parallel, _ := cmd.Flags().GetInt("parallel")
+	mode, _ := cmd.Flags().GetString("mode")
+	if mode != modeBestEffort && mode != modeAllOrNothing {
+		return fmt.Errorf("unknown --mode %q (want %s or %s)", mode, modeBestEffort, modeAllOrNothing)
+	}
+	if follow, _ := cmd.Flags().GetDuration("follow"); follow > 0 {
+		return errors.New("--follow needs a single target")
+	}
+
+	tlsConfig, err := clientTLSConfig()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("🚀 Syncing %s to %d targets (%s)\n", path, len(addrs), mode)
+	syncs := syncAll(addrs, mode, parallel, tlsConfig, path, info, deleteStale)
+	printTargets(syncs)
+
+	if n := countFunc(syncs, failed); n > 0 {
+		return fmt.Errorf("sync failed on %d of %d targets", n, len(syncs))
+	}
+	fmt.Printf("✅ Synced %s to %d targets\n", path, len(syncs))
+	return nil
+}
+
+// syncAll stages path on every agent and commits, aborts or rolls back as
+// mode says, returning how each target fared
+func syncAll(addrs []string, mode string, parallel int, tlsConfig *tls.Config, path string, info os.FileInfo, deleteStale bool) []*targetSync {
+	// Per-file progress from several agents at once would be unreadable
+	progress = io.Discard
+	defer func() { progress = os.Stdout }()
+
+	syncs := make([]*targetSync, len(addrs))
+	for i, addr := range addrs {
+		syncs[i] = &targetSync{addr: addr, result: &syncResult{}}
+	}
+	defer func() {
+		for _, t := range syncs {
+			if t.client != nil {
+				t.client.Close()
+			}
+		}
+	}()
+
+	forEachTarget(syncs, parallel, func(t *targetSync) {
+		t.stage(tlsConfig, path, info, deleteStale)
+		if mode == modeBestEffort {
+			t.finish(true)
+		}
+	})
+
+	if mode == modeAllOrNothing {
+		commit := !slices.ContainsFunc(syncs, failed)
+		forEachTarget(syncs, parallel, func(t *targetSync) { t.finish(commit) })
+
+		if commit && slices.ContainsFunc(syncs, failed) {
+			forEachTarget(syncs, parallel, func(t *targetSync) {
+				if t.status == statusSynced {
+					t.rollback()
+				}
+			})
+		}
+	}
+	return syncs
+}
+
+// failed reports whether the target ended in an error
+func failed(t *targetSync) bool {
+	return t.err != nil
+}
+
+// countFunc counts the targets fn holds for
+func countFunc(syncs []*targetSync, fn func(t *targetSync) bool) int {
+	n := 0
+	for _, t := range syncs {
+		if fn(t) {
+			n++
+		}
+	}
+	return n
+}
+
+// forEachTarget runs fn for every target, at most parallel at a time
+func forEachTarget(syncs []*targetSync, parallel int, fn func(t *targetSync)) {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallel)
+	for _, t := range syncs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(t *targetSync) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			start := time.Now()
+			fn(t)
+			t.elapsed += time.Since(start)
+		}(t)
+	}
+	wg.Wait()
+}
+
+// stage connects to the agent and stages the changes in a new transaction
+func (t *targetSync) stage(tlsConfig *tls.Config, path string, info os.FileInfo, deleteStale bool) {
+	var err error
+	if t.client, err = dial(t.addr, tlsConfig); err != nil {
+		t.fail(err)
+		return
+	}
+	if t.txID, err = t.client.BeginTx(); err != nil {
+		t.fail(err)
+		return
+	}
+
+	if info.IsDir() {
+		var result *syncResult
+		result, err = syncDir(t.client, t.txID, path, deleteStale)
+		if result != nil {
+			t.result = result
+		}
+	} else {
+		err = stageFile(t.client, t.txID, path, info)
+		if err == nil {
+			t.result.Uploaded = 1
+		}
+	}
+	if err != nil {
+		t.fail(err)
+	}
+}
+
+// stageFile stages a single file, which is sent whether or not the agent already has it
+func stageFile(client *transport.LivePatchClient, txID, path string, info os.FileInfo) error {
+	rel, err := remotePath(path)
+	if err != nil {
+		return err
+	}
+	file, ok, err := newLocalFile(path, rel, info)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s is not a regular file or symlink", path)
+	}
+	return uploadFile(client, txID, file, true)
+}
+
+// finish commits the staged transaction, or aborts it if commit is false, the
+// target already failed, or there is nothing to commit
+func (t *targetSync) finish(commit bool) {
+	if t.txID == "" {
+		return
+	}
+	txID := t.txID
+	t.txID = ""
+
+	if !commit || t.err != nil || t.result.Uploaded+t.result.Renamed+t.result.Deleted == 0 {
+		if err := t.client.AbortTx(txID); err != nil {
+			logger.Log.Warn(fmt.Sprintf("Failed to abort transaction on %s: %s", t.addr, err.Error()))
+		}
+		switch {
+		case t.err != nil:
+		case !commit:
+			t.status = statusAborted
+		default:
+			t.status = statusUnchanged
+		}
+		return
+	}
+
+	// Only a call with a timeout can be given up on
+	before, history := 0, false
+	if t.client.Timeout > 0 {
+		before, history = t.latestPatch()
+	}
+	resp, err := t.client.CommitTx(txID, restartCmd)
+	if errors.Is(err, transport.ErrOutcomeUnknown) && history {
+		t.settle(before, err)
+		return
+	}
+	if errors.Is(err, transport.ErrOutcomeUnknown) {
+		// Without a history there is no telling whether it was applied
+		t.status, t.err = statusUnknown, err
+		return
+	}
+	if err != nil {
+		// A refused commit (e.g. by the agent's policy) leaves the transaction open
+		t.client.AbortTx(txID)
+		t.fail(fmt.Errorf("commit failed: %w", err))
+		return
+	}
+	if !resp.Success {
+		// The agent rolled the patch back itself
+		t.fail(errors.New(resp.Message))
+		return
+	}
+	t.status, t.patchID, t.output = statusSynced, resp.PatchID, resp.Message
+}
+
+// latestPatch returns the ID of the newest patch on the agent (0 if there is
+// none), and false if the agent keeps no history
+func (t *targetSync) latestPatch() (int, bool) {
+	patches, err := t.client.History(1)
+	if err != nil {
+		return 0, false
+	}
+	if len(patches) == 0 {
+		return 0, true
+	}
+	return patches[0].ID, true
+}
+
+// settle finds out from the agent's history what became of a commit the
+// client gave up on: a patch newer than before is this one. The agent stops
+// an abandoned commit and rolls it back where it can, and History waits for
+// that to finish.
+func (t *targetSync) settle(before int, commitErr error) {
+	patches, err := t.client.History(1)
+	switch {
+	case err != nil:
+		t.status, t.err = statusUnknown, fmt.Errorf("%v; reading the agent's history failed: %v", commitErr, err)
+	case len(patches) == 0 || patches[0].ID <= before:
+		t.fail(fmt.Errorf("commit abandoned before it was applied: %v", commitErr))
+	case patches[0].Status != transport.PatchApplied:
+		t.fail(fmt.Errorf("commit abandoned and patch %d rolled back: %s", patches[0].ID, patches[0].Reason))
+	default:
+		// It went through after all, so it takes part in an all-or-nothing rollback
+		t.status, t.patchID = statusSynced, patches[0].ID
+	}
+}
+
+// rollback undoes the patch this sync committed, which has to still be the
+// latest one on the agent
+func (t *targetSync) rollback() {
+	if t.patchID != 0 {
+		patches, err := t.client.History(1)
+		if err == nil && (len(patches) == 0 || patches[0].ID != t.patchID || patches[0].Status != transport.PatchApplied) {
+			err = fmt.Errorf("patch %d is no longer the latest, roll it back with `live-patch rollback --to`", t.patchID)
+		}
+		if err != nil {
+			t.status, t.err = statusRollbackFailed, err
+			return
+		}
+	}
+	if _, err := t.client.Rollback(0, restartCmd); err != nil {
+		t.status, t.err = statusRollbackFailed, err
+		return
+	}
+	t.status, t.output = statusRolledBack, ""
+}
+
+func (t *targetSync) fail(err error) {
+	t.status, t.err = statusFailed, err
+}
+
+// printTargets shows how each target fared, then the post-sync command output
+func printTargets(syncs []*targetSync) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tSTATUS\tUPLOADED\tDELETED\tUNCHANGED\tTIME\tERROR")
+	for _, t := range syncs {
+		errMsg := ""
+		if t.err != nil {
+			// Keep the table on one line per target
+			errMsg = strings.ReplaceAll(t.err.Error(), "\n", " ")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%v\t%s\n", t.addr, t.status, t.result.Uploaded+t.result.Renamed,
+			t.result.Deleted, t.result.Unchanged, t.elapsed.Round(time.Millisecond), errMsg)
+	}
+	w.Flush()
+
+	if restartCmd == "" {
+		return
+	}
+	for _, t := range syncs {
+		if t.output != "" {
+			fmt.Printf("🔄 Post-sync command output on %s:\n%s\n", t.addr, t.output)
+		}
+	}
+}
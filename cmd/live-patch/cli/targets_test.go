@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/velocity-trinity/core/pkg/config"
+	"github.com/velocity-trinity/core/pkg/discovery"
+	"github.com/velocity-trinity/core/pkg/logger"
+	"github.com/velocity-trinity/core/pkg/transport"
+	"github.com/velocity-trinity/core/pkg/utils"
+	"go.uber.org/zap"
+)
+
+// withTargets sets the target flags and config for one test
+func withTargets(t *testing.T, list []string, file string, cfg config.LivePatch, agents []discovery.Agent) {
+	t.Helper()
+	oldList, oldFile, oldCfg, oldDiscovered := targetList, targetsFile, liveConfig, discovered
+	t.Cleanup(func() {
+		targetList, targetsFile, liveConfig, discovered = oldList, oldFile, oldCfg, oldDiscovered
+	})
+	targetList, targetsFile, liveConfig, discovered = list, file, cfg, agents
+}
+
+func TestTargets(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "targets")
+	if err := os.WriteFile(file, []byte("# staging\nweb-0:8443\n\n  web-1:8443  # second\nworkers\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.LivePatch{Targets: map[string][]string{
+		"workers": {"worker-0:8443", "worker-1:8443"},
+		"all":     {"web-0:8443", "worker-0:8443"},
+	}}
+	agents := []discovery.Agent{
+		{Name: "web-0", Addr: "web-0:8443", Labels: map[string]string{"app": "web"}},
+		{Name: "web-1", Addr: "web-1:8443", Labels: map[string]string{"app": "web"}},
+		{Name: "api-0", Addr: "api-0:8443", Labels: map[string]string{"app": "api"}},
+	}
+
+	tests := []struct {
+		name    string
+		list    []string
+		file    string
+		want    []string
+		wantErr string
+	}{
+		{name: "default", want: []string{defaultTarget}},
+		{name: "addresses", list: []string{"b:1", "a:1"}, want: []string{"b:1", "a:1"}},
+		{name: "group", list: []string{"workers"}, want: []string{"worker-0:8443", "worker-1:8443"}},
+		{name: "group is case-insensitive", list: []string{"Workers"}, want: []string{"worker-0:8443", "worker-1:8443"}},
+		{name: "unknown group", list: []string{"nope"}, wantErr: `target "nope" is neither host:port nor a group`},
+		{name: "selector", list: []string{"app=web"}, want: []string{"web-0:8443", "web-1:8443"}},
+		{name: "selector by name", list: []string{"name=api-0"}, want: []string{"api-0:8443"}},
+		{name: "selector matches nothing", list: []string{"app=db"}, wantErr: "no agent matches app=db (found 3"},
+		{name: "bad selector", list: []string{"app=web,"}, wantErr: "invalid label"},
+		{name: "file", file: file, want: []string{"web-0:8443", "web-1:8443", "worker-0:8443", "worker-1:8443"}},
+		{name: "flags before file", list: []string{"api-0:8443"}, file: file, want: []string{"api-0:8443", "web-0:8443", "web-1:8443", "worker-0:8443", "worker-1:8443"}},
+		{name: "missing file", file: file + ".missing", wantErr: "failed to read targets"},
+		{
+			name: "duplicates",
+			list: []string{"web-0:8443", "all", "app=web", "workers"},
+			want: []string{"web-0:8443", "worker-0:8443", "web-1:8443", "worker-1:8443"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTargets(t, tt.list, tt.file, cfg, agents)
+			got, err := targets()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("targets() error = %v, want it to mention %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("targets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// testAgent runs an agent in-process and returns its address and base path
+func testAgent(t *testing.T, configure func(s *transport.LivePatchServer)) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	base := filepath.Join(dir, "app")
+	if err := os.Mkdir(base, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := utils.GenerateSelfSignedCert(cert, key); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := utils.ServerTLSConfig(cert, key, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// StartServer picks the port itself, so find a free one first
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	server := &transport.LivePatchServer{BasePath: base, StateDir: filepath.Join(dir, "state")}
+	if configure != nil {
+		configure(server)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- transport.StartServer(port, server, tlsConfig) }()
+
+	addr := net.JoinHostPort("127.0.0.1", port)
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		select {
+		case err := <-errc:
+			t.Fatalf("agent failed to start: %v", err)
+		default:
+		}
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return addr, base
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("agent didn't start listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// failingHealth makes every patch on the agent fail its health check, so the
+// agent rolls it back itself and the commit fails
+func failingHealth(s *transport.LivePatchServer) {
+	s.HealthCommand = "exit 1"
+	s.HealthTimeout = time.Nanosecond
+}
+
+func TestSyncTargets(t *testing.T) {
+	logger.Log = zap.NewNop()
+
+	// An address nothing listens on fails while staging
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := l.Addr().String()
+	l.Close()
+
+	tests := []struct {
+		name string
+		mode string
+		// agents are configured in order; "down" is the unreachable address
+		agents []string
+		// want is each target's status and whether it ends up with the new content
+		want []string
+		has  []bool
+	}{
+		{
+			name:   "all or nothing commits everywhere",
+			mode:   modeAllOrNothing,
+			agents: []string{"ok", "ok"},
+			want:   []string{statusSynced, statusSynced},
+			has:    []bool{true, true},
+		},
+		{
+			name:   "all or nothing aborts when staging fails",
+			mode:   modeAllOrNothing,
+			agents: []string{"ok", "down", "ok"},
+			want:   []string{statusAborted, statusFailed, statusAborted},
+			has:    []bool{false, false, false},
+		},
+		{
+			name:   "all or nothing rolls back when a commit fails",
+			mode:   modeAllOrNothing,
+			agents: []string{"ok", "unhealthy", "ok"},
+			want:   []string{statusRolledBack, statusFailed, statusRolledBack},
+			has:    []bool{false, false, false},
+		},
+		{
+			name:   "best effort keeps what succeeded",
+			mode:   modeBestEffort,
+			agents: []string{"ok", "down", "unhealthy"},
+			want:   []string{statusSynced, statusFailed, statusFailed},
+			has:    []bool{true, false, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var addrs, bases []string
+			for _, kind := range tt.agents {
+				switch kind {
+				case "down":
+					addrs, bases = append(addrs, unreachable), append(bases, "")
+				case "unhealthy":
+					addr, base := testAgent(t, failingHealth)
+					addrs, bases = append(addrs, addr), append(bases, base)
+				default:
+					addr, base := testAgent(t, nil)
+					addrs, bases = append(addrs, addr), append(bases, base)
+				}
+			}
+			// The agents start with the old content, so a rollback has something to restore
+			for _, base := range bases {
+				if base == "" {
+					continue
+				}
+				if err := os.MkdirAll(filepath.Join(base, "src"), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(base, "src", "main.go"), []byte("old\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			t.Chdir(t.TempDir())
+			if err := os.Mkdir("src", 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join("src", "main.go"), []byte("new\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Lstat("src")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			syncs := syncAll(addrs, tt.mode, 2, insecureConfig(t), "src", info, false)
+			for i, ts := range syncs {
+				if ts.status != tt.want[i] {
+					t.Errorf("target %d (%s) status = %q (%v), want %q", i, tt.agents[i], ts.status, ts.err, tt.want[i])
+				}
+				if bases[i] == "" {
+					continue
+				}
+				data, err := os.ReadFile(filepath.Join(bases[i], "src", "main.go"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := string(data) == "new\n"; got != tt.has[i] {
+					t.Errorf("target %d (%s) has the new content = %v, want %v", i, tt.agents[i], got, tt.has[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFinishWithoutChanges(t *testing.T) {
+	logger.Log = zap.NewNop()
+	addr, _ := testAgent(t, nil)
+	client, err := transport.NewClient(addr, insecureConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	tests := []struct {
+		name     string
+		commit   bool
+		uploaded int
+		want     string
+	}{
+		{name: "nothing to commit", commit: true, want: statusUnchanged},
+		{name: "abort", commit: false, uploaded: 1, want: statusAborted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			txID, err := client.BeginTx()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ts := &targetSync{addr: addr, client: client, txID: txID, result: &syncResult{Uploaded: tt.uploaded}}
+			ts.finish(tt.commit)
+			if ts.status != tt.want || ts.err != nil {
+				t.Errorf("status = %q (%v), want %q", ts.status, ts.err, tt.want)
+			}
+			if ts.txID != "" {
+				t.Error("finish left the transaction ID set")
+			}
+			// The transaction is gone either way
+			if err := client.AbortTx(txID); err == nil {
+				t.Error("transaction still open after finish")
+			}
+		})
+	}
+}
+
+// insecureConfig connects to test agents without verifying them
+func insecureConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	config, err := utils.ClientTLSConfig("", "", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
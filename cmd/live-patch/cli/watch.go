@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/velocity-trinity/core/pkg/ignore"
+	"github.com/velocity-trinity/core/pkg/logger"
+	"github.com/velocity-trinity/core/pkg/transport"
+	"github.com/velocity-trinity/core/pkg/watcher"
+)
+
+var watchCmd = &cobra.Command{
+	Use:   "watch [dir]",
+	Short: "Sync a directory to the remote container whenever files change",
+	Long: `Syncs the directory once, then watches it and sends each burst of changes as one batch.
+The restart command runs once per batch. The connection is kept open and re-established if it drops.
+Example: live-patch watch ./src --restart="npm restart"`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		rel, err := remotePath(args[0])
+		if err != nil {
+			logger.Log.Fatal(err.Error())
+		}
+		dir := filepath.FromSlash(rel)
+		debounce, _ := cmd.Flags().GetDuration("debounce")
+		deleteStale, _ := cmd.Flags().GetBool("delete")
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		session := &agentSession{}
+		defer session.Close()
+
+		// Converge first so the watcher only has to send what changes from now on
+		err = session.Do(ctx, func(client *transport.LivePatchClient) error {
+			result, err := inTransaction(client, func(txID string) (*syncResult, error) {
+				return syncDir(client, txID, dir, deleteStale)
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Printf("✅ Synced %s to %s: %d uploaded, %d deleted, %d unchanged\n", dir, targetAddr, result.Uploaded, result.Deleted, result.Unchanged)
+			return nil
+		})
+		if err != nil {
+			logger.Log.Fatal("Initial sync failed: " + err.Error())
+		}
+
+		matcher, err := newMatcher(dir)
+		if err != nil {
+			logger.Log.Fatal("Failed to read ignore files: " + err.Error())
+		}
+
+		w, err := watcher.New(dir, debounce)
+		if err != nil {
+			logger.Log.Fatal("Failed to start watcher: " + err.Error())
+		}
+		defer w.Close()
+		w.Ignore = func(rel string, isDir bool) bool {
+			return watcher.DefaultIgnore(rel, isDir) || matcher.Ignored(path.Join(filepath.ToSlash(dir), filepath.ToSlash(rel)), isDir)
+		}
+
+		fmt.Printf("👀 Watching %s (Ctrl+C to stop)\n", dir)
+
+		w.Run(ctx, func(paths []string) {
+			var rels []string
+			for _, p := range paths {
+				rel := path.Join(filepath.ToSlash(filepath.Clean(dir)), filepath.ToSlash(p))
+				rels = append(rels, rel)
+				if slices.Contains(ignore.Files, path.Base(rel)) {
+					if m, err := newMatcher(dir); err == nil {
+						matcher = m
+					}
+				}
+			}
+
+			stamp := time.Now().Format("15:04:05")
+			start := time.Now()
+			err := session.Do(ctx, func(client *transport.LivePatchClient) error {
+				result, err := inTransaction(client, func(txID string) (*syncResult, error) {
+					return syncPaths(client, txID, rels, matcher)
+				})
+				if err != nil {
+					return err
+				}
+				if result.Uploaded+result.Renamed+result.Deleted > 0 {
+					fmt.Printf("[%s] %d uploaded, %d moved, %d deleted in %v\n", stamp, result.Uploaded, result.Renamed, result.Deleted, time.Since(start).Round(time.Millisecond))
+				}
+				return nil
+			})
+			if err != nil && ctx.Err() == nil {
+				fmt.Printf("[%s] ❌ Sync failed: %s\n", stamp, err.Error())
+			}
+		})
+	},
+}
+
+// syncPaths sends a batch of changed paths (relative to the working directory):
+// existing files are uploaded, and files that are gone locally are deleted on
+// the agent along with everything below them if they were directories. A file
+// or directory that is gone while one with the same content appeared was
+// moved, and is moved on the agent too rather than uploaded again.
+func syncPaths(client *transport.LivePatchClient, txID string, rels []string, matcher *ignore.Matcher) (*syncResult, error) {
+	result := &syncResult{}
+	var changed []localFile
+	seen := make(map[string]bool)
+	// What the agent has at each path that's gone: a file, or a whole directory
+	gone := make(map[string][]transport.RemoteFile)
+	var goneOrder []string
+
+	for _, rel := range rels {
+		info, err := os.Lstat(filepath.FromSlash(rel))
+		switch {
+		case err == nil && info.IsDir():
+			files, err := walkLocal(rel, matcher)
+			if err != nil {
+				return result, err
+			}
+			for _, file := range files {
+				if !seen[file.rel] {
+					seen[file.rel] = true
+					changed = append(changed, file)
+				}
+			}
+
+		case err == nil:
+			if seen[rel] || matcher.Ignored(rel, false) {
+				continue
+			}
+			file, ok, err := newLocalFile(rel, rel, info)
+			if err != nil {
+				return result, err
+			}
+			if ok {
+				seen[rel] = true
+				changed = append(changed, file)
+			}
+
+		case os.IsNotExist(err):
+			// Could have been a file or a whole directory; the agent knows which
+			remote, _, err := client.ListFiles(rel)
+			if err != nil {
+				return result, err
+			}
+			var files []transport.RemoteFile
+			for _, file := range remote {
+				if !matcher.Ignored(file.RelativePath, false) {
+					files = append(files, file)
+				}
+			}
+			if len(files) > 0 {
+				gone[rel] = files
+				goneOrder = append(goneOrder, rel)
+			}
+
+		default:
+			return result, err
+		}
+	}
+
+	for _, from := range goneOrder {
+		to, moved := findMove(from, gone[from], changed)
+		if to == "" {
+			continue
+		}
+		_, err := client.Rename(from, to, txID)
+		if errors.Is(err, errors.ErrUnsupported) {
+			// An older agent: upload and delete instead
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to move %s to %s: %w", from, to, err)
+		}
+		fmt.Printf("  → %s → %s\n", from, to)
+		result.Renamed++
+		delete(gone, from)
+		changed = slices.DeleteFunc(changed, func(file localFile) bool { return moved[file.rel] })
+	}
+
+	for _, file := range changed {
+		if err := uploadFile(client, txID, file, true); err != nil {
+			return result, err
+		}
+		result.Uploaded++
+	}
+	for _, from := range goneOrder {
+		for _, file := range gone[from] {
+			if err := deleteFile(client, txID, file.RelativePath); err != nil {
+				return result, err
+			}
+			result.Deleted++
+		}
+	}
+	return result, nil
+}
+
+// findMove looks for where the file or directory the agent has at from was
+// moved to: changed files with the same names (below it) and content. It
+// returns the new path and the files found there.
+func findMove(from string, remote []transport.RemoteFile, changed []localFile) (string, map[string]bool) {
+	byRel := make(map[string]localFile, len(changed))
+	for _, file := range changed {
+		byRel[file.rel] = file
+	}
+
+	// "" if from was a file, "/sub/name" for a file in a directory
+	suffix := strings.TrimPrefix(remote[0].RelativePath, from)
+	for _, candidate := range changed {
+		to, ok := strings.CutSuffix(candidate.rel, suffix)
+		if !ok || to == "" || to == from {
+			continue
+		}
+		moved := make(map[string]bool, len(remote))
+		for _, file := range remote {
+			local, ok := byRel[to+strings.TrimPrefix(file.RelativePath, from)]
+			if !ok || local.hash != file.Hash || local.link != file.LinkTarget {
+				moved = nil
+				break
+			}
+			moved[local.rel] = true
+		}
+		if moved != nil {
+			return to, moved
+		}
+	}
+	return "", nil
+}
+
+// newMatcher loads the ignore files that apply to dir and everything below it
+func newMatcher(dir string) (*ignore.Matcher, error) {
+	matcher, err := ignore.New(".")
+	if err != nil {
+		return nil, err
+	}
+	// walkLocal loads ignore files as it goes; the files themselves aren't needed
+	if _, err := walkLocal(dir, matcher); err != nil {
+		return nil, err
+	}
+	return matcher, nil
+}
+
+// agentSession keeps one connection to the agent open and re-dials it when it drops
+type agentSession struct {
+	client *transport.LivePatchClient
+}
+
+// Do runs fn with a connected client. If the connection turns out to be dead,
+// Do reconnects (backing off up to 30s) and runs fn again until ctx is cancelled.
+func (s *agentSession) Do(ctx context.Context, fn func(*transport.LivePatchClient) error) error {
+	backoff := time.Second
+	for {
+		if s.client == nil {
+			client, err := dialAgent()
+			if err == nil {
+				s.client = client
+				backoff = time.Second
+			} else {
+				logger.Log.Warn(fmt.Sprintf("Agent unreachable, retrying in %v: %s", backoff, err.Error()))
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(backoff):
+				}
+				backoff = min(backoff*2, 30*time.Second)
+				continue
+			}
+		}
+
+		err := fn(s.client)
+		if err == nil || !isConnectionError(err) {
+			return err
+		}
+		logger.Log.Warn("Lost connection to agent, reconnecting: " + err.Error())
+		s.client.Close()
+		s.client = nil
+	}
+}
+
+// Close closes the current connection, if any
+func (s *agentSession) Close() error {
+	if s.client == nil {
+		return nil
+	}
+	return s.client.Close()
+}
+
+// isConnectionError reports whether err means the connection is unusable
+// (as opposed to the agent rejecting a request)
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, rpc.ErrShutdown) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+func init() {
+	watchCmd.Flags().Duration("debounce", 200*time.Millisecond, "How long to wait for more changes before syncing a batch")
+	watchCmd.Flags().Bool("delete", false, "Delete remote files that no longer exist locally during the initial sync")
+
+	rootCmd.AddCommand(watchCmd)
+}
@@ -6,11 +6,17 @@ import (
 	"strings"
 
 	"github.com/velocity-trinity/core/pkg/analyzer/languages"
+	"github.com/velocity-trinity/core/pkg/cache"
 )
 
 // LanguageParser is a generic interface for language parsers
 type LanguageParser interface {
 	Parse(filePath string) ([]string, error)
+	// ParseImports also records which exported names each import uses
+	ParseImports(filePath string) ([]languages.Import, error)
+	ParseSource(src []byte) []languages.Import
+	// Symbols lists the top-level declarations in a file's contents
+	Symbols(src []byte) []languages.Symbol
 }
 
 // GetParser returns the appropriate parser for the file extension
@@ -29,9 +35,11 @@ func GetParser(filePath string) (LanguageParser, error) {
 // BuildDependencyGraph walks a directory and builds a dependency map
 // Map format: File -> List of Files that import it
 func BuildDependencyGraph(root string) (map[string][]string, error) {
-	// Not implemented yet - this will be the core of Phase 2
-	// For now, let's just return a placeholder
-	return nil, nil
+	g, err := BuildGraph(root, Options{})
+	if err != nil {
+		return nil, err
+	}
+	return g.ImporterMap(), nil
 }
 
 // AnalyzeFile returns the direct dependencies of a single file
@@ -56,3 +64,44 @@ func AnalyzeFile(filePath string) ([]string, error) {
 	}
 	return relativeDeps, nil
 }
+
+// Options tunes how the import graph is built and how tests are selected
+type Options struct {
+	// SourceRoots are extra roots for non-relative imports (Python packages, TS baseUrl)
+	SourceRoots []string
+	// Aliases rewrite import prefixes before resolution, e.g. "@/" -> "src/"
+	Aliases map[string]string
+	// Ignore globs are left out of the graph
+	Ignore []string
+	// RunAllTriggers are globs for files that invalidate every test when changed
+	RunAllTriggers []string
+	// TestLayouts override DefaultLayouts per language
+	TestLayouts map[string]TestLayout
+
+	// Cache stores parse results and whole graphs; nil disables caching
+	Cache cache.Store
+	// CacheRefresh ignores existing cache entries (they are still rewritten)
+	CacheRefresh bool
+}
+
+// layouts merges configured test layouts over the defaults, field by field
+func (o *Options) layouts() map[string]TestLayout {
+	layouts := make(map[string]TestLayout, len(DefaultLayouts))
+	for lang, layout := range DefaultLayouts {
+		layouts[lang] = layout
+	}
+	for lang, custom := range o.TestLayouts {
+		layout := layouts[lang]
+		if len(custom.Patterns) > 0 {
+			layout.Patterns = custom.Patterns
+		}
+		if len(custom.TestDirs) > 0 {
+			layout.TestDirs = custom.TestDirs
+		}
+		if len(custom.Mirrors) > 0 {
+			layout.Mirrors = custom.Mirrors
+		}
+		layouts[lang] = layout
+	}
+	return layouts
+}
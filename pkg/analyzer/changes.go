@@ -0,0 +1,247 @@
+package analyzer
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/velocity-trinity/core/pkg/analyzer/languages"
+)
+
+// Change is a modified file and, when known, the top-level symbols that changed in it
+type Change struct {
+	File string
+	// Symbols is nil when the change can't be narrowed down (new or deleted
+	// file, module-level code, a symbol only used inside the file), in which
+	// case every importer is affected. It includes the exported symbols that
+	// use a changed one elsewhere in the file.
+	Symbols []string
+}
+
+// DiffChanges lists the files under root that changed since base, narrowed
+// down to the top-level symbols each diff touches where possible
+func DiffChanges(root, base string) ([]Change, error) {
+	files, err := ChangedFiles(root, base)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]Change, 0, len(files))
+	for _, file := range files {
+		symbols, err := changedSymbols(root, base, file)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, Change{File: key(file), Symbols: symbols})
+	}
+	return changes, nil
+}
+
+// changedSymbols maps the diff of one file to the top-level symbols it touches.
+// Both sides of the diff are checked so deleted and renamed symbols count too.
+func changedSymbols(root, base, file string) ([]string, error) {
+	parser, err := GetParser(file)
+	if err != nil {
+		return nil, nil
+	}
+
+	newSrc, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(file)))
+	if err != nil {
+		// Deleted
+		return nil, nil
+	}
+	oldSrc, err := showFile(root, base, file)
+	if err != nil {
+		// Added since base
+		return nil, nil
+	}
+
+	hunks, err := diffHunks(root, base, file)
+	if err != nil {
+		return nil, err
+	}
+	if len(hunks) == 0 {
+		return nil, nil
+	}
+
+	return hunkSymbols(parser, oldSrc, newSrc, hunks), nil
+}
+
+// hunkSymbols maps hunks to the exported symbols they change, directly or
+// through other declarations in the file that refer to a changed one. It
+// returns nil when the change has to be treated as affecting the whole file.
+func hunkSymbols(parser LanguageParser, oldSrc, newSrc []byte, hunks []hunk) []string {
+	oldSymbols := parser.Symbols(oldSrc)
+	newSymbols := parser.Symbols(newSrc)
+	changed := make(map[string]bool)
+
+	for _, h := range hunks {
+		if !markSymbols(changed, oldSymbols, h.oldStart, h.oldCount) {
+			return nil
+		}
+		if !markSymbols(changed, newSymbols, h.newStart, h.newCount) {
+			return nil
+		}
+	}
+
+	// An exported function calling a changed one behaves differently too,
+	// on either side of the diff. Keep going until nothing new turns up.
+	for grown := true; grown; {
+		grown = false
+		for _, side := range []struct {
+			src     []byte
+			symbols []languages.Symbol
+		}{{oldSrc, oldSymbols}, {newSrc, newSymbols}} {
+			added, ok := addReferrers(side.src, side.symbols, changed)
+			if !ok {
+				return nil
+			}
+			grown = grown || added
+		}
+	}
+
+	exported := make(map[string]bool)
+	for _, symbol := range append(oldSymbols, newSymbols...) {
+		exported[symbol.Name] = exported[symbol.Name] || symbol.Exported
+	}
+	var symbols []string
+	for _, name := range sortedKeys(changed) {
+		// Unexported referrers only matter through the exported ones they lead to
+		if exported[name] {
+			symbols = append(symbols, name)
+		}
+	}
+	if len(symbols) == 0 {
+		return nil
+	}
+	return symbols
+}
+
+// moduleDeclarations are module-level lines that name symbols without running
+// anything: imports and export lists
+var moduleDeclarations = []string{"import ", "from ", "export {", "export type {", "export *"}
+
+// addReferrers adds every symbol in src whose declaration mentions a changed
+// one to changed, and reports whether it added any. It returns false when
+// module-level code mentions a changed symbol: that code runs for every
+// importer of the file, whatever names they import.
+func addReferrers(src []byte, symbols []languages.Symbol, changed map[string]bool) (added, ok bool) {
+	idents := make(map[string]string, len(changed))
+	for name := range changed {
+		idents[name] = name
+	}
+	for _, symbol := range symbols {
+		if changed[symbol.Name] && symbol.Local != "" {
+			idents[symbol.Name] = symbol.Local
+		}
+	}
+	// An anonymous default export can't be referred to from its own file
+	if idents["default"] == "default" {
+		delete(idents, "default")
+	}
+	mentions := func(text string) bool {
+		for _, ident := range idents {
+			if mentionsIdent(text, ident) {
+				return true
+			}
+		}
+		return false
+	}
+
+	lines := strings.Split(string(src), "\n")
+	moduleLevel := func(from, to int) bool {
+		for _, line := range lines[min(from, len(lines)):min(to, len(lines))] {
+			line = strings.TrimSpace(line)
+			if hasAnyPrefix(line, moduleDeclarations) || hasAnyPrefix(line, commentPrefixes) {
+				continue
+			}
+			if mentions(line) {
+				return true
+			}
+		}
+		return false
+	}
+
+	covered := 0
+	for _, symbol := range symbols {
+		if moduleLevel(covered, symbol.StartLine-1) {
+			return false, false
+		}
+		covered = max(covered, symbol.EndLine)
+		if !changed[symbol.Name] && mentions(strings.Join(lines[symbol.StartLine-1:min(symbol.EndLine, len(lines))], "\n")) {
+			changed[symbol.Name] = true
+			added = true
+		}
+	}
+	if moduleLevel(covered, len(lines)) {
+		return false, false
+	}
+	return added, true
+}
+
+var commentPrefixes = []string{"//", "/*", "*", "#"}
+
+// mentionsIdent reports whether text contains ident as a whole identifier
+func mentionsIdent(text, ident string) bool {
+	for i := 0; ; {
+		j := strings.Index(text[i:], ident)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(ident)
+		if (start == 0 || !isIdentByte(text[start-1])) && (end == len(text) || !isIdentByte(text[end])) {
+			return true
+		}
+		i = start + 1
+	}
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// markSymbols records the symbols covering a changed line range. It returns
+// false if any line falls outside every symbol (imports, module-level code) or
+// in one that isn't exported: exported code may use it, and no importer names it.
+func markSymbols(changed map[string]bool, symbols []languages.Symbol, start, count int) bool {
+	if count == 0 {
+		// Pure insertion/deletion between `start` and the next line: the other
+		// side of the diff has the content, this side only matters if the gap
+		// is inside a symbol
+		if a, b := symbolAt(symbols, start), symbolAt(symbols, start+1); a != nil && a == b {
+			if !a.Exported {
+				return false
+			}
+			changed[a.Name] = true
+		}
+		return true
+	}
+
+	for line := start; line < start+count; line++ {
+		symbol := symbolAt(symbols, line)
+		if symbol == nil || !symbol.Exported {
+			return false
+		}
+		changed[symbol.Name] = true
+	}
+	return true
+}
+
+// symbolAt returns the symbol spanning line, if any. symbols must be sorted by position.
+func symbolAt(symbols []languages.Symbol, line int) *languages.Symbol {
+	idx := sort.Search(len(symbols), func(i int) bool { return symbols[i].EndLine >= line })
+	if idx < len(symbols) && symbols[idx].StartLine <= line {
+		return &symbols[idx]
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package analyzer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const tsLib = `import { log } from './log'
+
+export function A() {
+  return 1
+}
+
+export function B() {
+  return A() + 1
+}
+
+export function C() {
+  return 3
+}
+
+function helper() {
+  return C()
+}
+
+export function D() {
+  return helper()
+}
+
+export default function App() {
+  return B()
+}
+
+export function E() {
+  return 5
+}
+`
+
+const pyLib = `import os
+
+def a():
+    return 1
+
+def _helper():
+    return a()
+
+def b():
+    return _helper()
+
+def c():
+    return 3
+
+register(c)
+`
+
+func TestHunkSymbols(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		src  string
+		line int
+		want []string
+	}{
+		{"caller in the same file", "lib.ts", tsLib, 4, []string{"A", "B", "default"}},
+		{"no callers", "lib.ts", tsLib, 20, []string{"D"}},
+		{"through an unexported helper", "lib.ts", tsLib, 12, []string{"C", "D"}},
+		{"default export", "lib.ts", tsLib, 24, []string{"default"}},
+		{"unexported symbol", "lib.ts", tsLib, 16, nil},
+		{"module-level import", "lib.ts", tsLib, 1, nil},
+		{"not mentioned in comments", "lib.ts", tsLib + "// E() is unused\n", 28, []string{"E"}},
+
+		{"python caller through helper", "lib.py", pyLib, 4, []string{"a", "b"}},
+		{"python module-level use", "lib.py", pyLib, 13, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser, err := GetParser(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := hunk{oldStart: tt.line, oldCount: 1, newStart: tt.line, newCount: 1}
+			got := hunkSymbols(parser, []byte(tt.src), []byte(tt.src), []hunk{h})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hunkSymbols = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestAffectedTestsThroughCallers covers an exported function whose importers
+// don't name it but call another export that uses it
+func TestAffectedTestsThroughCallers(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"lib.ts":      tsLib,
+		"log.ts":      "export function log() {}\n",
+		"a.test.ts":   "import { A } from './lib'\n",
+		"b.test.ts":   "import { B } from './lib'\n",
+		"app.test.ts": "import App from './lib'\n",
+		"e.test.ts":   "import { E } from './lib'\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g, err := BuildGraph(root, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parser, _ := GetParser("lib.ts")
+	symbols := hunkSymbols(parser, []byte(tsLib), []byte(tsLib), []hunk{{oldStart: 4, oldCount: 1, newStart: 4, newCount: 1}})
+	got := g.AffectedTestsForChanges([]Change{{File: "lib.ts", Symbols: symbols}})
+	want := []string{"a.test.ts", "app.test.ts", "b.test.ts"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("AffectedTestsForChanges = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,107 @@
+package analyzer
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// hunk is one changed region of a unified diff (1-based line numbers)
+type hunk struct {
+	oldStart, oldCount int
+	newStart, newCount int
+}
+
+var hunkHeaderRegex = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// git runs a git command in dir and returns its stdout
+func git(dir string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// ChangedFiles lists files under root that differ from base, including
+// uncommitted and untracked files. Paths are relative to root.
+func ChangedFiles(root, base string) ([]string, error) {
+	diff, err := git(root, "diff", "--name-only", "--relative", base)
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := git(root, "ls-files", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, err
+	}
+	return unique(splitLines(diff + untracked)), nil
+}
+
+// CurrentCommit returns the commit checked out in root
+func CurrentCommit(root string) (string, error) {
+	out, err := git(root, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// diffHunks returns the changed regions of file (relative to root) since base
+func diffHunks(root, base, file string) ([]hunk, error) {
+	out, err := git(root, "diff", "-U0", "--relative", base, "--", file)
+	if err != nil {
+		return nil, err
+	}
+
+	var hunks []hunk
+	for _, line := range splitLines(out) {
+		m := hunkHeaderRegex.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		hunks = append(hunks, hunk{
+			oldStart: atoiDefault(m[1], 0),
+			oldCount: atoiDefault(m[2], 1),
+			newStart: atoiDefault(m[3], 0),
+			newCount: atoiDefault(m[4], 1),
+		})
+	}
+	return hunks, nil
+}
+
+// showFile returns the contents of file (relative to root) at revision base
+func showFile(root, base, file string) ([]byte, error) {
+	out, err := git(root, "show", base+":./"+file)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(out), nil
+}
+
+func splitLines(s string) []string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func atoiDefault(s string, def int) int {
+	if s == "" {
+		return def
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return def
+	}
+	return n
+}
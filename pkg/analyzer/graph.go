@@ -0,0 +1,477 @@
+package analyzer
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/velocity-trinity/core/pkg/analyzer/languages"
+	"github.com/velocity-trinity/core/pkg/glob"
+)
+
+// Directories that never contain project sources
+var skipDirs = map[string]bool{
+	"node_modules": true,
+	"vendor":       true,
+	"__pycache__":  true,
+}
+
+// Graph is an in-memory import graph of a source tree.
+// All paths are slash-separated and relative to Root; use Rel to convert others.
+type Graph struct {
+	Root    string
+	Options Options
+	// Finder decides which files are tests and where co-located tests live
+	Finder *TestFinder
+
+	mu        sync.RWMutex
+	specs     map[string][]languages.Import // file -> raw import statements
+	imports   map[string][]string           // file -> files it imports
+	importers map[string]map[string]*usage  // file -> files that import it
+}
+
+// usage records which exports of a file an importer uses
+type usage struct {
+	all   bool // namespace import, require(), import *, ...
+	names map[string]bool
+}
+
+func (u *usage) add(names []string) {
+	if names == nil {
+		u.all = true
+		return
+	}
+	for _, name := range names {
+		u.names[name] = true
+	}
+}
+
+// uses reports whether the importer depends on any of the given symbols
+func (u *usage) uses(symbols []string) bool {
+	if u.all {
+		return true
+	}
+	for _, symbol := range symbols {
+		if u.names[symbol] {
+			return true
+		}
+	}
+	return false
+}
+
+// NewGraph creates an empty graph rooted at root
+func NewGraph(root string, opts Options) *Graph {
+	g := &Graph{
+		Root:      root,
+		Options:   opts,
+		specs:     make(map[string][]languages.Import),
+		imports:   make(map[string][]string),
+		importers: make(map[string]map[string]*usage),
+	}
+	g.Finder = &TestFinder{Root: root, Layouts: opts.layouts(), Exists: g.Has}
+	return g
+}
+
+// BuildGraph walks root and parses every supported source file.
+// With a cache configured, a graph for the same tree (or parse results for
+// identical files) is reused instead of parsing again.
+func BuildGraph(root string, opts Options) (*Graph, error) {
+	g := NewGraph(root, opts)
+
+	files, err := g.sourceFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Cache != nil {
+		if err := g.loadCached(files); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, rel := range files {
+			specs, err := g.parse(rel)
+			if err != nil {
+				return nil, err
+			}
+			g.specs[rel] = specs
+		}
+	}
+
+	g.relinkAll()
+	return g, nil
+}
+
+// sourceFiles lists every parseable file under the root that isn't ignored
+func (g *Graph) sourceFiles() ([]string, error) {
+	var files []string
+	err := filepath.Walk(g.Root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := g.Rel(path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != g.Root && (skipDirs[info.Name()] || strings.HasPrefix(info.Name(), ".") || g.Ignored(rel)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if _, err := GetParser(path); err != nil || g.Ignored(rel) {
+			return nil
+		}
+		files = append(files, rel)
+		return nil
+	})
+	return files, err
+}
+
+// Update re-parses a single file after it was created, changed or deleted
+func (g *Graph) Update(file string) error {
+	rel := key(file)
+	if _, err := os.Stat(filepath.Join(g.Root, filepath.FromSlash(rel))); os.IsNotExist(err) {
+		g.Remove(rel)
+		return nil
+	}
+	if _, err := GetParser(rel); err != nil || g.Ignored(rel) {
+		return nil
+	}
+
+	specs, err := g.parse(rel)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	_, known := g.specs[rel]
+	g.specs[rel] = specs
+	if known {
+		g.relink(rel)
+	} else {
+		// A new file may satisfy imports that were unresolved until now
+		g.relinkAll()
+	}
+	return nil
+}
+
+// Remove drops a file, or every file below a directory, from the graph
+func (g *Graph) Remove(file string) {
+	rel := key(file)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	removed := false
+	for known := range g.specs {
+		if known == rel || strings.HasPrefix(known, rel+"/") {
+			delete(g.specs, known)
+			removed = true
+		}
+	}
+	if removed {
+		g.relinkAll()
+	}
+}
+
+// Ignored reports whether a file is excluded by the Ignore globs
+func (g *Graph) Ignored(file string) bool {
+	return glob.MatchAny(g.Options.Ignore, key(file))
+}
+
+// Has reports whether the graph knows about a file
+func (g *Graph) Has(file string) bool {
+	rel := key(file)
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	_, ok := g.specs[rel]
+	return ok
+}
+
+// Files returns every file in the graph, sorted
+func (g *Graph) Files() []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	files := make([]string, 0, len(g.specs))
+	for file := range g.specs {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// Tests returns every test file in the graph, sorted
+func (g *Graph) Tests() []string {
+	var tests []string
+	for _, file := range g.Files() {
+		if g.Finder.IsTest(file) {
+			tests = append(tests, file)
+		}
+	}
+	return tests
+}
+
+// Imports returns the files directly imported by path
+func (g *Graph) Imports(file string) []string {
+	rel := key(file)
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return append([]string(nil), g.imports[rel]...)
+}
+
+// Importers returns the files that directly import path
+func (g *Graph) Importers(file string) []string {
+	rel := key(file)
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return importerKeys(g.importers[rel])
+}
+
+// Dependents returns the changed files plus everything that transitively imports them
+func (g *Graph) Dependents(changed []string) []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	queue := []string{}
+	for _, file := range changed {
+		rel := key(file)
+		if seen[rel] {
+			continue
+		}
+		seen[rel] = true
+		queue = append(queue, rel)
+	}
+
+	for len(queue) > 0 {
+		file := queue[0]
+		queue = queue[1:]
+		for importer := range g.importers[file] {
+			if !seen[importer] {
+				seen[importer] = true
+				queue = append(queue, importer)
+			}
+		}
+	}
+	return sortedKeys(seen)
+}
+
+// AffectedTests returns the test files that exercise any of the changed files
+func (g *Graph) AffectedTests(changed []string) []string {
+	changes := make([]Change, len(changed))
+	for i, file := range changed {
+		changes[i] = Change{File: file}
+	}
+	return g.AffectedTestsForChanges(changes)
+}
+
+// AffectedTestsForChanges selects tests at symbol granularity: when a change
+// names the symbols it touched, only importers of those symbols are affected.
+// Changes without symbols, or with a symbol no importer names (code in the
+// file may still use it), fall back to every importer of the file. Tests next
+// to a changed file are always included, and a change matching a run-all
+// trigger selects the whole suite.
+func (g *Graph) AffectedTestsForChanges(changes []Change) []string {
+	for _, change := range changes {
+		if glob.MatchAny(g.Options.RunAllTriggers, key(change.File)) {
+			return g.Tests()
+		}
+	}
+
+	var seeds, files []string
+
+	g.mu.RLock()
+	for _, change := range changes {
+		rel := key(change.File)
+		files = append(files, rel)
+		if change.Symbols == nil || g.Finder.IsTest(rel) || !g.imported(rel, change.Symbols) {
+			seeds = append(seeds, rel)
+			continue
+		}
+		for importer, u := range g.importers[rel] {
+			// Importers changed behaviour, so everything above them is affected as a whole
+			if u.uses(change.Symbols) {
+				seeds = append(seeds, importer)
+			}
+		}
+	}
+	g.mu.RUnlock()
+
+	var tests []string
+	for _, file := range g.Dependents(seeds) {
+		if g.Finder.IsTest(file) && g.Has(file) {
+			tests = append(tests, file)
+		}
+	}
+
+	// Co-located tests that don't import the file directly (e.g. fixtures, snapshots)
+	candidates, _ := g.Finder.Find(files)
+	tests = append(tests, candidates...)
+
+	tests = unique(tests)
+	sort.Strings(tests)
+	return tests
+}
+
+// imported reports whether every symbol is imported by name from file by some
+// importer. Caller must hold g.mu.
+func (g *Graph) imported(file string, symbols []string) bool {
+	for _, symbol := range symbols {
+		named := false
+		for _, u := range g.importers[file] {
+			if u.names[symbol] {
+				named = true
+				break
+			}
+		}
+		if !named {
+			return false
+		}
+	}
+	return true
+}
+
+// ImporterMap returns the graph as File -> List of Files that import it
+func (g *Graph) ImporterMap() map[string][]string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	out := make(map[string][]string, len(g.importers))
+	for file, importers := range g.importers {
+		out[file] = importerKeys(importers)
+	}
+	return out
+}
+
+func (g *Graph) parse(rel string) ([]languages.Import, error) {
+	parser, err := GetParser(rel)
+	if err != nil {
+		return nil, err
+	}
+	return parser.ParseImports(filepath.Join(g.Root, filepath.FromSlash(rel)))
+}
+
+// relink re-resolves the imports of one file. Caller must hold g.mu.
+func (g *Graph) relink(file string) {
+	for _, dep := range g.imports[file] {
+		delete(g.importers[dep], file)
+	}
+	delete(g.imports, file)
+
+	exists := func(candidate string) bool {
+		_, ok := g.specs[candidate]
+		return ok
+	}
+
+	for _, imp := range g.specs[file] {
+		for _, target := range g.resolve(file, imp, exists) {
+			if target.file == file {
+				continue
+			}
+			if g.importers[target.file] == nil {
+				g.importers[target.file] = make(map[string]*usage)
+			}
+			u := g.importers[target.file][file]
+			if u == nil {
+				u = &usage{names: make(map[string]bool)}
+				g.importers[target.file][file] = u
+				g.imports[file] = append(g.imports[file], target.file)
+			}
+			u.add(target.names)
+		}
+	}
+}
+
+// importTarget is a file an import statement points at and the names it uses from it
+type importTarget struct {
+	file  string
+	names []string
+}
+
+// resolve finds the files an import statement points at
+func (g *Graph) resolve(file string, imp languages.Import, exists func(string) bool) []importTarget {
+	var targets []importTarget
+	names := imp.Names
+
+	if path.Ext(file) == ".py" && len(imp.Names) > 0 {
+		// "from pkg import mod" imports a submodule rather than a name defined in pkg
+		names = nil
+		for _, name := range imp.Names {
+			sub := imp.Path + "." + name
+			if strings.HasSuffix(imp.Path, ".") {
+				sub = imp.Path + name
+			}
+			if dep, ok := resolveImport(file, sub, &g.Options, exists); ok {
+				targets = append(targets, importTarget{file: dep})
+			} else {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			return targets
+		}
+	}
+
+	if dep, ok := resolveImport(file, imp.Path, &g.Options, exists); ok {
+		targets = append(targets, importTarget{file: dep, names: names})
+	}
+	return targets
+}
+
+// relinkAll rebuilds every edge from the raw specifiers. Caller must hold g.mu.
+func (g *Graph) relinkAll() {
+	g.imports = make(map[string][]string)
+	g.importers = make(map[string]map[string]*usage)
+	for file := range g.specs {
+		g.relink(file)
+	}
+}
+
+// Rel converts a path relative to the working directory (or absolute) to a graph key
+func (g *Graph) Rel(file string) (string, error) {
+	absRoot, err := filepath.Abs(g.Root)
+	if err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absRoot, absPath)
+	if err != nil {
+		return "", err
+	}
+	return key(rel), nil
+}
+
+// key normalizes a root-relative path into the form used by the graph
+func key(p string) string {
+	return path.Clean(filepath.ToSlash(p))
+}
+
+func importerKeys(importers map[string]*usage) []string {
+	keys := make([]string, 0, len(importers))
+	for key := range importers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,152 @@
+package analyzer
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/velocity-trinity/core/pkg/analyzer/languages"
+	"github.com/velocity-trinity/core/pkg/cache"
+	"github.com/velocity-trinity/core/pkg/logger"
+)
+
+// cacheVersion is mixed into every key. Bump it when parser output changes.
+const cacheVersion = "1"
+
+// graphSnapshot is the cached form of a graph: edges are cheap to rebuild from the imports
+type graphSnapshot struct {
+	Files map[string][]languages.Import `json:"files"`
+}
+
+// loadCached fills g.specs for files, preferring a cached graph for the
+// whole tree, then cached parse results per file content
+func (g *Graph) loadCached(files []string) error {
+	store := g.Options.Cache
+
+	treeKey, err := g.treeKey(files)
+	if err != nil {
+		// Not a git checkout (or git is missing): per-file caching still works
+		logger.Log.Debug("No tree hash for graph cache: " + err.Error())
+	}
+
+	if treeKey != "" && !g.Options.CacheRefresh {
+		if data, err := store.Get(treeKey); err == nil {
+			var snapshot graphSnapshot
+			if err := json.Unmarshal(data, &snapshot); err == nil && sameFiles(snapshot.Files, files) {
+				logger.Log.Debug("Loaded dependency graph from cache")
+				g.specs = snapshot.Files
+				return nil
+			}
+		} else if !errors.Is(err, cache.ErrNotFound) {
+			logger.Log.Warn("Graph cache lookup failed: " + err.Error())
+		}
+	}
+
+	hits := 0
+	for _, rel := range files {
+		specs, hit, err := g.parseCached(rel)
+		if err != nil {
+			return err
+		}
+		if hit {
+			hits++
+		}
+		g.specs[rel] = specs
+	}
+	logger.Log.Debug("Parse cache hits: " + strconv.Itoa(hits) + "/" + strconv.Itoa(len(files)))
+
+	if treeKey != "" {
+		data, err := json.Marshal(graphSnapshot{Files: g.specs})
+		if err == nil {
+			err = store.Put(treeKey, data)
+		}
+		if err != nil {
+			logger.Log.Warn("Failed to store graph in cache: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// parseCached parses one file, keyed by its content so identical files share an entry
+func (g *Graph) parseCached(rel string) ([]languages.Import, bool, error) {
+	parser, err := GetParser(rel)
+	if err != nil {
+		return nil, false, err
+	}
+	content, err := os.ReadFile(filepath.Join(g.Root, filepath.FromSlash(rel)))
+	if err != nil {
+		return nil, false, err
+	}
+
+	key := cache.Key("file", cacheVersion, Language(rel), string(content))
+	if !g.Options.CacheRefresh {
+		if data, err := g.Options.Cache.Get(key); err == nil {
+			var specs []languages.Import
+			if json.Unmarshal(data, &specs) == nil {
+				return specs, true, nil
+			}
+		}
+	}
+
+	specs := parser.ParseSource(content)
+	if data, err := json.Marshal(specs); err == nil {
+		if err := g.Options.Cache.Put(key, data); err != nil {
+			logger.Log.Debug("Failed to cache parse result for " + rel + ": " + err.Error())
+		}
+	}
+	return specs, false, nil
+}
+
+// treeKey identifies the exact contents of files: the git tree of the root
+// plus the contents of anything modified, untracked or ignored by git
+func (g *Graph) treeKey(files []string) (string, error) {
+	tree, err := git(g.Root, "rev-parse", "HEAD:./")
+	if err != nil {
+		return "", err
+	}
+	tracked, err := git(g.Root, "ls-files")
+	if err != nil {
+		return "", err
+	}
+	modified, err := git(g.Root, "diff", "--name-only", "--relative", "HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	clean := make(map[string]bool)
+	for _, file := range splitLines(tracked) {
+		clean[file] = true
+	}
+	for _, file := range splitLines(modified) {
+		delete(clean, file)
+	}
+
+	parts := []string{"graph", cacheVersion, strings.TrimSpace(tree), strings.Join(g.Options.Ignore, "\n")}
+	for _, rel := range files {
+		if clean[rel] {
+			parts = append(parts, rel)
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(g.Root, filepath.FromSlash(rel)))
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, rel, cache.Key(string(content)))
+	}
+	return cache.Key(parts...), nil
+}
+
+func sameFiles(cached map[string][]languages.Import, files []string) bool {
+	if len(cached) != len(files) {
+		return false
+	}
+	for _, file := range files {
+		if _, ok := cached[file]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -1,7 +1,6 @@
 package languages
 
 import (
-	"bufio"
 	"os"
 	"regexp"
 	"strings"
@@ -10,38 +9,122 @@ import (
 // PythonParser handles .py files
 type PythonParser struct{}
 
+var (
+	// Regex for: import module[, other]
+	// Regex for: from module import a, b / from module import (a,\n b)
+	pyImportRegex      = regexp.MustCompile(`(?m)^\s*import\s+([\w., \t]+)`)
+	pyFromRegex        = regexp.MustCompile(`(?m)^\s*from\s+([\w.]+)\s+import\s+(\([^)]*\)|[^\n#]+)`)
+	pyDeclarationRegex = regexp.MustCompile(`^(?:async\s+)?(?:def|class)\s+(\w+)`)
+	pyAssignmentRegex  = regexp.MustCompile(`^(\w+)\s*(?::[^=]*)?=[^=]`)
+)
+
 func (p *PythonParser) Parse(filePath string) ([]string, error) {
-	file, err := os.Open(filePath)
+	imports, err := p.ParseImports(filePath)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	return importPaths(imports), nil
+}
 
-	var dependencies []string
-	scanner := bufio.NewScanner(file)
+// ParseImports returns every import in the file along with the names it uses.
+// `import x` and `from x import *` use the whole module.
+func (p *PythonParser) ParseImports(filePath string) ([]Import, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return p.ParseSource(content), nil
+}
 
-	// Regex for: import module
-	// Regex for: from module import ...
-	importRegex := regexp.MustCompile(`^\s*import\s+([\w.]+)`)
-	fromRegex := regexp.MustCompile(`^\s*from\s+([\w.]+)\s+import`)
+// ParseSource extracts the imports from file contents
+func (p *PythonParser) ParseSource(content []byte) []Import {
+	src := stripPythonComments(string(content))
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		// Skip comments
-		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+	var imports []Import
+	for _, m := range pyImportRegex.FindAllStringSubmatch(src, -1) {
+		for _, part := range strings.Split(m[1], ",") {
+			// import a.b as c
+			if fields := strings.Fields(part); len(fields) > 0 {
+				imports = append(imports, Import{Path: fields[0]})
+			}
+		}
+	}
+	for _, m := range pyFromRegex.FindAllStringSubmatch(src, -1) {
+		imports = append(imports, Import{Path: m[1], Names: pythonImportNames(m[2])})
+	}
+	return imports
+}
+
+func pythonImportNames(clause string) []string {
+	clause = strings.Trim(strings.TrimSpace(clause), "()")
+	if strings.TrimSpace(clause) == "*" {
+		return nil
+	}
+
+	var names []string
+	for _, part := range strings.Split(clause, ",") {
+		if fields := strings.Fields(part); len(fields) > 0 && fields[0] != "\\" {
+			names = append(names, strings.TrimSuffix(fields[0], "\\"))
+		}
+	}
+	return names
+}
+
+// Symbols returns the top-level functions, classes and assignments in src.
+// A declaration (including its decorators) ends at the next line in column 0.
+// Names starting with an underscore are private by convention, so they don't
+// count as exported.
+func (p *PythonParser) Symbols(src []byte) []Symbol {
+	var symbols []Symbol
+	lines := strings.Split(string(src), "\n")
+
+	closeLast := func(end int) {
+		if n := len(symbols); n > 0 && symbols[n-1].EndLine == 0 {
+			symbols[n-1].EndLine = end
+		}
+	}
+
+	decoratorStart := 0
+	for i, line := range lines {
+		lineNo := i + 1
+		if line == "" || line[0] == ' ' || line[0] == '\t' || line[0] == '#' || line[0] == ')' || line[0] == ']' || line[0] == '}' {
 			continue
 		}
 
-		matches := importRegex.FindStringSubmatch(line)
-		if len(matches) > 1 {
-			dependencies = append(dependencies, matches[1])
+		if strings.HasPrefix(line, "@") {
+			if decoratorStart == 0 {
+				closeLast(lineNo - 1)
+				decoratorStart = lineNo
+			}
+			continue
 		}
 
-		matches = fromRegex.FindStringSubmatch(line)
-		if len(matches) > 1 {
-			dependencies = append(dependencies, matches[1])
+		start := lineNo
+		if decoratorStart != 0 {
+			start = decoratorStart
+			decoratorStart = 0
+		}
+		closeLast(start - 1)
+
+		m := pyDeclarationRegex.FindStringSubmatch(line)
+		if m == nil {
+			m = pyAssignmentRegex.FindStringSubmatch(line)
+		}
+		if m != nil {
+			symbols = append(symbols, Symbol{Name: m[1], StartLine: start, Exported: !strings.HasPrefix(m[1], "_")})
 		}
 	}
+	closeLast(len(lines))
+	return symbols
+}
 
-	return dependencies, scanner.Err()
+// Skip comments
+func stripPythonComments(src string) string {
+	lines := strings.Split(src, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			lines[i] = ""
+		}
+	}
+	return strings.Join(lines, "\n")
 }
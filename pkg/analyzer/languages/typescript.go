@@ -1,7 +1,6 @@
 package languages
 
 import (
-	"bufio"
 	"os"
 	"regexp"
 	"strings"
@@ -10,50 +9,198 @@ import (
 // Parser interface for different languages
 type Parser interface {
 	Parse(filePath string) ([]string, error)
+	ParseImports(filePath string) ([]Import, error)
+	ParseSource(src []byte) []Import
+	Symbols(src []byte) []Symbol
+}
+
+// Import is a single import statement and the exported names it uses
+type Import struct {
+	Path string
+	// Names is nil when the whole module is used (namespace import, require, side-effect import)
+	Names []string
+}
+
+// Symbol is a top-level declaration and the lines it spans (1-based, inclusive)
+type Symbol struct {
+	Name      string
+	StartLine int
+	EndLine   int
+	// Exported is whether other files can import it by Name. Exported code may
+	// still use symbols that aren't, so changes to those affect the whole file.
+	Exported bool
+	// Local is the name code in the same file uses for it, when that isn't
+	// Name (`export default function App` is imported as default, called as App)
+	Local string
 }
 
 // TypeScriptParser handles .ts, .tsx, .js, .jsx files
 type TypeScriptParser struct{}
 
+var (
+	// Regex for: import ... from '...' / export ... from '...'
+	// Matched against the whole file so multiline import lists work
+	tsImportRegex = regexp.MustCompile(`(?m)^\s*(?:import|export)\s+(?:type\s+)?([\w$*{}\s,]+?)\s+from\s+['"]([^'"]+)['"]`)
+	// Regex for: import './side-effect'
+	tsSideEffectRegex = regexp.MustCompile(`(?m)^\s*import\s+['"]([^'"]+)['"]`)
+	// Regex for: const { a, b } = require('...') / require('...')
+	tsRequireRegex       = regexp.MustCompile(`(?:\{([\w$\s,:]+)\}\s*=\s*)?require\(['"]([^'"]+)['"]\)`)
+	tsDynamicImportRegex = regexp.MustCompile(`import\(['"]([^'"]+)['"]\)`)
+	tsLineCommentRegex   = regexp.MustCompile(`(?m)^\s*//.*$`)
+	tsDeclarationRegex   = regexp.MustCompile(`^(?:export\s+)?(?:declare\s+)?(?:async\s+)?(?:abstract\s+)?(?:function\*?|class|const|let|var|type|interface|enum|namespace)\s+([\w$]+)`)
+	tsDefaultExportRegex = regexp.MustCompile(`^export\s+default\b(?:\s+(?:async\s+)?(?:function\*?|class)\s+([\w$]+))?`)
+	// Regex for: export { a, b } (without "from", which re-exports another module)
+	tsExportListRegex    = regexp.MustCompile(`(?m)^\s*export\s+(?:type\s+)?\{([^}]*)\}\s*;?\s*$`)
+	tsContinuationPrefix = []string{"}", ")", "]", "//", "/*", "*"}
+)
+
 func (p *TypeScriptParser) Parse(filePath string) ([]string, error) {
-	file, err := os.Open(filePath)
+	imports, err := p.ParseImports(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return importPaths(imports), nil
+}
+
+// ParseImports returns every import in the file along with the names it uses
+func (p *TypeScriptParser) ParseImports(filePath string) ([]Import, error) {
+	content, err := os.ReadFile(filePath)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	return p.ParseSource(content), nil
+}
+
+// ParseSource extracts the imports from file contents.
+// This is a simplified regex approach and might miss edge cases (e.g. imports inside template strings)
+func (p *TypeScriptParser) ParseSource(content []byte) []Import {
+	// Skip comments (very basic check)
+	src := tsLineCommentRegex.ReplaceAllString(string(content), "")
+
+	var imports []Import
+	for _, m := range tsImportRegex.FindAllStringSubmatch(src, -1) {
+		imports = append(imports, Import{Path: m[2], Names: tsClauseNames(m[1])})
+	}
+	for _, m := range tsSideEffectRegex.FindAllStringSubmatch(src, -1) {
+		imports = append(imports, Import{Path: m[1]})
+	}
+	for _, m := range tsRequireRegex.FindAllStringSubmatch(src, -1) {
+		var names []string
+		if m[1] != "" {
+			// const { a: local, b } = require(...) uses a and b
+			for _, part := range strings.Split(m[1], ",") {
+				if name := strings.TrimSpace(strings.Split(part, ":")[0]); name != "" {
+					names = append(names, name)
+				}
+			}
+		}
+		imports = append(imports, Import{Path: m[2], Names: names})
+	}
+	for _, m := range tsDynamicImportRegex.FindAllStringSubmatch(src, -1) {
+		imports = append(imports, Import{Path: m[1]})
+	}
+	return imports
+}
+
+// tsClauseNames extracts the imported names from `def, { a, b as c }` style clauses.
+// Namespace imports and `export *` use the whole module and return nil.
+func tsClauseNames(clause string) []string {
+	if strings.Contains(clause, "*") {
+		return nil
+	}
 
-	var dependencies []string
-	scanner := bufio.NewScanner(file)
+	var names []string
+	named := ""
+	if open := strings.Index(clause, "{"); open >= 0 {
+		named = strings.Trim(clause[open:], "{} \t\n")
+		clause = clause[:open]
+	}
 
-	// Regex for: import ... from '...'
-	// Regex for: require('...')
-	// This is a simplified regex and might miss edge cases (e.g. multiline imports)
-	importRegex := regexp.MustCompile(`(?:import|export)\s+.*\s+from\s+['"]([^'"]+)['"]`)
-	requireRegex := regexp.MustCompile(`require\(['"]([^'"]+)['"]\)`)
-	dynamicImportRegex := regexp.MustCompile(`import\(['"]([^'"]+)['"]\)`)
+	// Anything before the braces is a default import
+	if strings.TrimSpace(strings.Trim(clause, ", \t\n")) != "" {
+		names = append(names, "default")
+	}
+	for _, part := range strings.Split(named, ",") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "type" && len(fields) > 1 {
+			fields = fields[1:]
+		}
+		names = append(names, fields[0])
+	}
+	return names
+}
+
+// Symbols returns the top-level declarations in src. A declaration ends at the
+// next line that starts in column 0 and isn't a closing bracket or comment.
+func (p *TypeScriptParser) Symbols(src []byte) []Symbol {
+	var symbols []Symbol
+	lines := strings.Split(string(src), "\n")
+	listed := tsExportedNames(src)
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		// Skip comments (very basic check)
-		if strings.HasPrefix(strings.TrimSpace(line), "//") {
+	closeLast := func(end int) {
+		if n := len(symbols); n > 0 && symbols[n-1].EndLine == 0 {
+			symbols[n-1].EndLine = end
+		}
+	}
+
+	for i, line := range lines {
+		lineNo := i + 1
+		if line == "" || line[0] == ' ' || line[0] == '\t' || hasAnyPrefix(line, tsContinuationPrefix) {
 			continue
 		}
 
-		matches := importRegex.FindStringSubmatch(line)
-		if len(matches) > 1 {
-			dependencies = append(dependencies, matches[1])
+		name, local := "", ""
+		if m := tsDeclarationRegex.FindStringSubmatch(line); m != nil {
+			name = m[1]
+		} else if m := tsDefaultExportRegex.FindStringSubmatch(line); m != nil {
+			name, local = "default", m[1]
 		}
 
-		matches = requireRegex.FindStringSubmatch(line)
-		if len(matches) > 1 {
-			dependencies = append(dependencies, matches[1])
+		closeLast(lineNo - 1)
+		if name != "" {
+			exported := strings.HasPrefix(line, "export") || listed[name]
+			symbols = append(symbols, Symbol{Name: name, StartLine: lineNo, Exported: exported, Local: local})
 		}
-		
-		matches = dynamicImportRegex.FindStringSubmatch(line)
-		if len(matches) > 1 {
-			dependencies = append(dependencies, matches[1])
+	}
+	closeLast(len(lines))
+	return symbols
+}
+
+// tsExportedNames lists the names exported under their own name by
+// `export { a, b }`. A name exported as something else (`a as b`) can't be
+// matched to its importers, so it's left out.
+func tsExportedNames(src []byte) map[string]bool {
+	names := make(map[string]bool)
+	for _, m := range tsExportListRegex.FindAllStringSubmatch(string(src), -1) {
+		for _, part := range strings.Split(m[1], ",") {
+			fields := strings.Fields(part)
+			if len(fields) > 0 && fields[0] == "type" {
+				fields = fields[1:]
+			}
+			if len(fields) == 1 {
+				names[fields[0]] = true
+			}
 		}
 	}
+	return names
+}
+
+func importPaths(imports []Import) []string {
+	var paths []string
+	for _, imp := range imports {
+		paths = append(paths, imp.Path)
+	}
+	return paths
+}
 
-	return dependencies, scanner.Err()
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
 }
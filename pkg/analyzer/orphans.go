@@ -0,0 +1,115 @@
+package analyzer
+
+import (
+	"path"
+	"strings"
+
+	"github.com/velocity-trinity/core/pkg/glob"
+)
+
+// DefaultEntrypoints are the globs treated as program entrypoints when none are configured
+var DefaultEntrypoints = []string{
+	"index.*", "main.*", "app.*", "server.*", "cli.*",
+	"__main__.py", "manage.py", "setup.py", "conftest.py",
+	"*.config.*",
+}
+
+// Directory names that hold test support code
+var testDirs = map[string]bool{
+	"test":      true,
+	"tests":     true,
+	"__tests__": true,
+	"spec":      true,
+	"testing":   true,
+	"testutils": true,
+	"fixtures":  true,
+}
+
+// OrphanReport lists files the import graph can't reach
+type OrphanReport struct {
+	// Modules are source files not reachable from any entrypoint or test
+	Modules []string
+	// TestHelpers are support files under test directories that no test imports
+	TestHelpers []string
+	// HollowTests are tests that don't import a single project file
+	HollowTests []string
+}
+
+// FindOrphans walks the graph forward from entrypoints and tests and reports what's left over
+func (g *Graph) FindOrphans(entrypoints []string) OrphanReport {
+	var report OrphanReport
+
+	files := g.Files()
+	var roots, tests []string
+	for _, file := range files {
+		switch {
+		case g.Finder.IsTest(file):
+			tests = append(tests, file)
+			roots = append(roots, file)
+		case glob.MatchAny(entrypoints, file):
+			roots = append(roots, file)
+		}
+	}
+
+	fromTests := g.reachable(tests)
+	fromRoots := g.reachable(roots)
+
+	for _, file := range files {
+		if g.Finder.IsTest(file) {
+			if len(g.Imports(file)) == 0 {
+				report.HollowTests = append(report.HollowTests, file)
+			}
+			continue
+		}
+		if isImplicitModule(file) {
+			continue
+		}
+
+		if isTestHelper(file) {
+			if !fromTests[file] {
+				report.TestHelpers = append(report.TestHelpers, file)
+			}
+			continue
+		}
+		if !fromRoots[file] {
+			report.Modules = append(report.Modules, file)
+		}
+	}
+	return report
+}
+
+// reachable returns every file imported, directly or transitively, by roots (roots included)
+func (g *Graph) reachable(roots []string) map[string]bool {
+	seen := make(map[string]bool)
+	queue := append([]string(nil), roots...)
+	for _, root := range roots {
+		seen[root] = true
+	}
+
+	for len(queue) > 0 {
+		file := queue[0]
+		queue = queue[1:]
+		for _, dep := range g.Imports(file) {
+			if !seen[dep] {
+				seen[dep] = true
+				queue = append(queue, dep)
+			}
+		}
+	}
+	return seen
+}
+
+func isTestHelper(file string) bool {
+	for _, dir := range strings.Split(path.Dir(file), "/") {
+		if testDirs[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// isImplicitModule reports files loaded by the runtime rather than imported
+func isImplicitModule(file string) bool {
+	base := path.Base(file)
+	return base == "__init__.py" || strings.HasSuffix(base, ".d.ts")
+}
@@ -0,0 +1,119 @@
+package analyzer
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// Extensions tried (in order) when a TS/JS import omits the file extension
+var scriptExtensions = []string{".ts", ".tsx", ".js", ".jsx"}
+
+// resolveImport maps an import specifier found in `from` to a file in the graph.
+// Paths are slash-separated and relative to the graph root.
+// exists reports whether a candidate file is known.
+func resolveImport(from, spec string, opts *Options, exists func(string) bool) (string, bool) {
+	switch path.Ext(from) {
+	case ".py":
+		return resolvePythonImport(from, spec, opts, exists)
+	default:
+		return resolveScriptImport(from, spec, opts, exists)
+	}
+}
+
+func resolveScriptImport(from, spec string, opts *Options, exists func(string) bool) (string, bool) {
+	if strings.HasPrefix(spec, ".") {
+		return scriptFile(path.Join(path.Dir(from), spec), exists)
+	}
+
+	// Path aliases ("@/utils" -> "src/utils")
+	if target, ok := applyAlias(spec, opts.Aliases); ok {
+		return scriptFile(target, exists)
+	}
+
+	// Bare specifiers ("react", "@scope/pkg") point at node_modules unless they live under a source root
+	for _, root := range opts.SourceRoots {
+		if file, ok := scriptFile(path.Join(root, spec), exists); ok {
+			return file, true
+		}
+	}
+	return "", false
+}
+
+// scriptFile finds the file a TS/JS module path refers to
+func scriptFile(base string, exists func(string) bool) (string, bool) {
+	if exists(base) {
+		return base, true
+	}
+
+	// Strip a .js suffix: TS allows importing "./foo.js" for "./foo.ts"
+	trimmed := strings.TrimSuffix(base, ".js")
+	for _, ext := range scriptExtensions {
+		if exists(trimmed + ext) {
+			return trimmed + ext, true
+		}
+	}
+	for _, ext := range scriptExtensions {
+		if exists(base + "/index" + ext) {
+			return base + "/index" + ext, true
+		}
+	}
+	return "", false
+}
+
+// applyAlias rewrites spec using the longest matching alias prefix.
+// Trailing "*" is ignored on both sides, so tsconfig-style "@/*": "src/*" works too.
+func applyAlias(spec string, aliases map[string]string) (string, bool) {
+	prefixes := make([]string, 0, len(aliases))
+	for prefix := range aliases {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+
+	for _, prefix := range prefixes {
+		trimmed := strings.TrimSuffix(prefix, "*")
+		if spec != strings.TrimSuffix(trimmed, "/") && !strings.HasPrefix(spec, trimmed) {
+			continue
+		}
+		target := strings.TrimSuffix(aliases[prefix], "*")
+		return path.Clean(target + strings.TrimPrefix(spec, trimmed)), true
+	}
+	return "", false
+}
+
+func resolvePythonImport(from, spec string, opts *Options, exists func(string) bool) (string, bool) {
+	if strings.HasPrefix(spec, ".") {
+		// Relative import: one dot is the current package, each extra dot goes up one level
+		dots := len(spec) - len(strings.TrimLeft(spec, "."))
+		dir := path.Dir(from)
+		for i := 1; i < dots; i++ {
+			dir = path.Dir(dir)
+		}
+		return pythonModule(dir, spec[dots:], exists)
+	}
+
+	// Absolute imports resolve from the project root, then each source root
+	for _, root := range append([]string{"."}, opts.SourceRoots...) {
+		if file, ok := pythonModule(root, spec, exists); ok {
+			return file, true
+		}
+	}
+	return "", false
+}
+
+// pythonModule finds the file for a dotted module name below dir
+func pythonModule(dir, module string, exists func(string) bool) (string, bool) {
+	// "from . import x" has an empty module and refers to the package itself
+	base := path.Join(dir, strings.ReplaceAll(module, ".", "/"))
+	candidates := []string{path.Join(base, "__init__.py")}
+	if module != "" {
+		candidates = append([]string{base + ".py"}, candidates...)
+	}
+
+	for _, candidate := range candidates {
+		if exists(candidate) {
+			return candidate, true
+		}
+	}
+	return "", false
+}
@@ -1,48 +1,185 @@
 package analyzer
 
 import (
+	"os"
+	"path"
 	"path/filepath"
 	"strings"
 )
 
-// FindTestFiles returns a list of test files that *might* be affected by the changes in `files`
+// TestLayout describes where a language keeps the tests for a source file.
+// Patterns use {name} for the file name without extension and {ext} for the extension.
+type TestLayout struct {
+	// Patterns are test file names, e.g. "{name}.test{ext}" or "test_{name}.py"
+	Patterns []string
+	// TestDirs are folders next to the source file that hold its tests, e.g. "__tests__"
+	TestDirs []string
+	// Mirrors map a source root to a test root with the same sub-directories,
+	// e.g. src/app/foo.py -> tests/unit/app/test_foo.py
+	Mirrors []Mirror
+}
+
+// Mirror maps a source directory to the directory mirroring it with tests ("." is the project root)
+type Mirror struct {
+	Source string
+	Tests  string
+}
+
+// DefaultLayouts are the conventions used when none are configured, keyed by language
+var DefaultLayouts = map[string]TestLayout{
+	"typescript": {
+		Patterns: []string{"{name}.test{ext}", "{name}.spec{ext}", "{name}_test{ext}"},
+		TestDirs: []string{"__tests__"},
+		Mirrors:  []Mirror{{Source: "src", Tests: "test"}, {Source: "src", Tests: "tests"}},
+	},
+	"python": {
+		Patterns: []string{"test_{name}.py", "{name}_test.py"},
+		TestDirs: []string{"tests"},
+		Mirrors:  []Mirror{{Source: ".", Tests: "tests"}, {Source: "src", Tests: "tests"}},
+	},
+}
+
+// Language returns the layout key for a file, or "" if it isn't a supported source file
+func Language(file string) string {
+	switch filepath.Ext(file) {
+	case ".ts", ".tsx", ".js", ".jsx":
+		return "typescript"
+	case ".py":
+		return "python"
+	default:
+		return ""
+	}
+}
+
+// TestFinder locates the existing test files for changed source files.
+// Paths are slash-separated and relative to Root.
+type TestFinder struct {
+	Root    string
+	Layouts map[string]TestLayout
+	// Exists reports whether a root-relative file exists. Defaults to checking the filesystem.
+	Exists func(rel string) bool
+}
+
+// NewTestFinder creates a finder using the default layouts and the filesystem
+func NewTestFinder(root string) *TestFinder {
+	f := &TestFinder{Root: root, Layouts: DefaultLayouts}
+	f.Exists = func(rel string) bool {
+		info, err := os.Stat(filepath.Join(f.Root, filepath.FromSlash(rel)))
+		return err == nil && !info.IsDir()
+	}
+	return f
+}
+
+// FindTestFiles returns the test files that exist for the changes in `files`
 func FindTestFiles(files []string) ([]string, error) {
+	return NewTestFinder(".").Find(files)
+}
+
+// Find returns the existing test files for `files`. Changed tests are returned as-is.
+func (f *TestFinder) Find(files []string) ([]string, error) {
 	var tests []string
-	
+
 	for _, file := range files {
+		file = key(file)
+
 		// Heuristic 1: If file is itself a test, add it
-		if isTestFile(file) {
-			tests = append(tests, file)
+		if f.IsTest(file) {
+			if f.Exists(file) {
+				tests = append(tests, file)
+			}
 			continue
 		}
 
-		// Heuristic 2: Check for co-located test files
-		// file: src/foo.ts
-		// test: src/foo.test.ts or src/foo.spec.ts
-		ext := filepath.Ext(file)
-		base := strings.TrimSuffix(file, ext)
-		
-		candidates := []string{
-			base + ".test" + ext,
-			base + ".spec" + ext,
-			base + "_test" + ext,
+		// Heuristic 2: Look for tests next to the file, in test folders and in mirrored trees
+		for _, candidate := range f.candidates(file) {
+			if f.Exists(candidate) {
+				tests = append(tests, candidate)
+			}
+		}
+	}
+
+	return unique(tests), nil
+}
+
+// IsTest reports whether a file is a test according to the configured patterns.
+// Everything inside a __tests__ folder counts as a test (the Jest convention).
+func (f *TestFinder) IsTest(file string) bool {
+	file = key(file)
+	layout, ok := f.Layouts[Language(file)]
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(file, "__tests__/") || strings.Contains(file, "/__tests__/") {
+		return true
+	}
+
+	ext := path.Ext(file)
+	for _, pattern := range layout.Patterns {
+		glob := expandPattern(pattern, "*", ext)
+		if ok, _ := path.Match(glob, path.Base(file)); ok {
+			return true
 		}
+	}
+	return false
+}
+
+// candidates lists every place a test for file could live
+func (f *TestFinder) candidates(file string) []string {
+	layout, ok := f.Layouts[Language(file)]
+	if !ok {
+		return nil
+	}
+
+	dir := path.Dir(file)
+	ext := path.Ext(file)
+	name := strings.TrimSuffix(path.Base(file), ext)
+
+	var names []string
+	for _, pattern := range layout.Patterns {
+		names = append(names, expandPattern(pattern, name, ext))
+	}
 
-		for _, candidate := range candidates {
-			// In a real system, use os.Stat to check if file exists
-			// For MVP, we'll assume it exists if the naming matches our convention
-			// or just return the candidate and let the test runner handle "file not found"
-			tests = append(tests, candidate)
+	var candidates []string
+	for _, n := range names {
+		// file: src/foo.ts -> test: src/foo.test.ts
+		candidates = append(candidates, path.Join(dir, n))
+	}
+	for _, testDir := range layout.TestDirs {
+		// file: src/foo.ts -> test: src/__tests__/foo.test.ts or src/__tests__/foo.ts
+		candidates = append(candidates, path.Join(dir, testDir, name+ext))
+		for _, n := range names {
+			candidates = append(candidates, path.Join(dir, testDir, n))
+		}
+	}
+	for _, mirror := range layout.Mirrors {
+		// file: src/app/foo.py -> test: tests/unit/app/test_foo.py (or tests/unit/test_foo.py)
+		sub, ok := relativeTo(dir, key(mirror.Source))
+		if !ok {
+			continue
+		}
+		for _, n := range names {
+			candidates = append(candidates, path.Join(mirror.Tests, sub, n), path.Join(mirror.Tests, n))
 		}
 	}
+	return unique(candidates)
+}
 
-	return unique(tests), nil
+// relativeTo returns dir relative to base if dir is inside base
+func relativeTo(dir, base string) (string, bool) {
+	if base == "." {
+		return dir, true
+	}
+	if dir == base {
+		return ".", true
+	}
+	if strings.HasPrefix(dir, base+"/") {
+		return strings.TrimPrefix(dir, base+"/"), true
+	}
+	return "", false
 }
 
-func isTestFile(path string) bool {
-	return strings.Contains(path, ".test.") || 
-		strings.Contains(path, ".spec.") || 
-		strings.Contains(path, "_test.py")
+func expandPattern(pattern, name, ext string) string {
+	return strings.NewReplacer("{name}", name, "{ext}", ext).Replace(pattern)
 }
 
 func unique(slice []string) []string {
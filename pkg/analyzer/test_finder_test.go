@@ -0,0 +1,112 @@
+package analyzer
+
+import (
+	"reflect"
+	"testing"
+)
+
+// finderWith returns a finder whose filesystem holds exactly files
+func finderWith(layouts map[string]TestLayout, files ...string) *TestFinder {
+	exists := make(map[string]bool)
+	for _, file := range files {
+		exists[file] = true
+	}
+	return &TestFinder{Root: ".", Layouts: layouts, Exists: func(rel string) bool { return exists[rel] }}
+}
+
+func TestFindDefaultLayouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   []string
+		changed []string
+		want    []string
+	}{
+		{"ts next to the source", []string{"src/foo.test.ts", "src/foo.spec.ts"}, []string{"src/foo.ts"}, []string{"src/foo.test.ts", "src/foo.spec.ts"}},
+		{"ts with underscore", []string{"lib/foo_test.js"}, []string{"lib/foo.js"}, []string{"lib/foo_test.js"}},
+		{"ts in __tests__", []string{"src/__tests__/foo.ts", "src/__tests__/foo.test.ts"}, []string{"src/foo.ts"}, []string{"src/__tests__/foo.ts", "src/__tests__/foo.test.ts"}},
+		{"ts mirrored", []string{"test/app/foo.test.tsx", "tests/foo.spec.tsx"}, []string{"src/app/foo.tsx"}, []string{"test/app/foo.test.tsx", "tests/foo.spec.tsx"}},
+		{"ts mirror needs src", []string{"test/foo.test.ts"}, []string{"lib/foo.ts"}, []string{}},
+		{"py next to the source", []string{"app/test_foo.py", "app/foo_test.py"}, []string{"app/foo.py"}, []string{"app/test_foo.py", "app/foo_test.py"}},
+		{"py in tests", []string{"app/tests/test_foo.py"}, []string{"app/foo.py"}, []string{"app/tests/test_foo.py"}},
+		{"py mirrored from the root", []string{"tests/app/test_foo.py"}, []string{"app/foo.py"}, []string{"tests/app/test_foo.py"}},
+		{"py mirrored from src", []string{"tests/app/test_foo.py"}, []string{"src/app/foo.py"}, []string{"tests/app/test_foo.py"}},
+		{"py flat tests", []string{"tests/test_foo.py"}, []string{"src/app/foo.py"}, []string{"tests/test_foo.py"}},
+		{"changed test", []string{"src/foo.test.ts"}, []string{"src/foo.test.ts"}, []string{"src/foo.test.ts"}},
+		{"deleted test", nil, []string{"src/foo.test.ts", "tests/test_foo.py"}, []string{}},
+		{"no test", []string{"src/bar.test.ts"}, []string{"src/foo.ts"}, []string{}},
+		{"unsupported language", []string{"main_test.go"}, []string{"main.go"}, []string{}},
+		{"duplicates", []string{"src/foo.test.ts"}, []string{"src/foo.ts", "./src/foo.ts", "src/foo.test.ts"}, []string{"src/foo.test.ts"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := finderWith(DefaultLayouts, tt.files...).Find(tt.changed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Find(%v) = %v, want %v", tt.changed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindConfiguredLayout(t *testing.T) {
+	layouts := map[string]TestLayout{
+		"python": {
+			Patterns: []string{"check_{name}.py"},
+			Mirrors:  []Mirror{{Source: "src/app", Tests: "tests/unit"}},
+		},
+	}
+	tests := []struct {
+		name    string
+		files   []string
+		changed []string
+		want    []string
+	}{
+		{"mirrored", []string{"tests/unit/models/check_user.py"}, []string{"src/app/models/user.py"}, []string{"tests/unit/models/check_user.py"}},
+		{"mirror root", []string{"tests/unit/check_user.py"}, []string{"src/app/user.py"}, []string{"tests/unit/check_user.py"}},
+		{"outside the mirror", []string{"tests/unit/check_user.py"}, []string{"lib/user.py"}, []string{}},
+		// The defaults no longer apply
+		{"default pattern", []string{"src/app/test_user.py", "src/app/tests/check_user.py"}, []string{"src/app/user.py"}, []string{}},
+		{"typescript not configured", []string{"src/foo.test.ts"}, []string{"src/foo.ts"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := finderWith(layouts, tt.files...).Find(tt.changed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Find(%v) = %v, want %v", tt.changed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsTest(t *testing.T) {
+	tests := []struct {
+		file string
+		want bool
+	}{
+		{"src/foo.test.ts", true},
+		{"src/foo.spec.jsx", true},
+		{"src/foo_test.js", true},
+		{"src/__tests__/helpers.ts", true},
+		{"__tests__/foo.ts", true},
+		{"src/foo.ts", false},
+		{"src/testing.ts", false},
+		{"tests/test_foo.py", true},
+		{"app/foo_test.py", true},
+		{"tests/conftest.py", false},
+		{"app/foo.py", false},
+		{"main_test.go", false},
+	}
+	f := finderWith(DefaultLayouts)
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			if got := f.IsTest(tt.file); got != tt.want {
+				t.Errorf("IsTest(%q) = %v, want %v", tt.file, got, tt.want)
+			}
+		})
+	}
+}
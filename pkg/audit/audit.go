@@ -0,0 +1,125 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Record is the outcome of one audit: a full test run compared against the
+// tests smart selection would have picked for the same change
+type Record struct {
+	Timestamp time.Time `json:"timestamp"`
+	Commit    string    `json:"commit,omitempty"`
+	Base      string    `json:"base,omitempty"`
+
+	Total    int      `json:"total"`
+	Selected int      `json:"selected"`
+	Failing  []string `json:"failing"`
+	// Missed are failing tests the selection would have skipped (false negatives)
+	Missed []string `json:"missed"`
+
+	// Recall is the share of failing tests that were selected (1 when nothing failed)
+	Recall float64 `json:"recall"`
+	// Precision is the share of selected tests that failed (0 when nothing was selected)
+	Precision float64 `json:"precision"`
+	// Savings is the share of the suite selection skipped
+	Savings float64 `json:"savings"`
+}
+
+// Evaluate compares the failing tests of a full run against a selection
+func Evaluate(all, failing, selected []string) Record {
+	chosen := make(map[string]bool, len(selected))
+	for _, test := range selected {
+		chosen[test] = true
+	}
+
+	record := Record{
+		Timestamp: time.Now(),
+		Total:     len(all),
+		Selected:  len(selected),
+		Failing:   sorted(failing),
+		Missed:    []string{},
+		Recall:    1,
+	}
+
+	caught := 0
+	for _, test := range failing {
+		if chosen[test] {
+			caught++
+		} else {
+			record.Missed = append(record.Missed, test)
+		}
+	}
+	sort.Strings(record.Missed)
+
+	if len(failing) > 0 {
+		record.Recall = float64(caught) / float64(len(failing))
+	}
+	if len(selected) > 0 {
+		record.Precision = float64(caught) / float64(len(selected))
+	}
+	if len(all) > 0 {
+		record.Savings = 1 - float64(len(selected))/float64(len(all))
+	}
+	return record
+}
+
+// Store appends audit records to a JSON-lines file
+type Store struct {
+	Path string
+}
+
+// Append adds a record to the store, creating it if needed
+func (s *Store) Append(record Record) error {
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// Load returns every stored record, oldest first
+func (s *Store) Load() ([]Record, error) {
+	f, err := os.Open(s.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+func sorted(list []string) []string {
+	out := append([]string{}, list...)
+	sort.Strings(out)
+	return out
+}
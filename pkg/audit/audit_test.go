@@ -0,0 +1,93 @@
+package audit
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	all := []string{"a", "b", "c", "d"}
+	tests := []struct {
+		name      string
+		failing   []string
+		selected  []string
+		missed    []string
+		recall    float64
+		precision float64
+		savings   float64
+	}{
+		{"nothing failed or selected", nil, nil, []string{}, 1, 0, 1},
+		{"nothing failed", nil, []string{"a"}, []string{}, 1, 0, 0.75},
+		{"every failure selected", []string{"b", "a"}, []string{"a", "b"}, []string{}, 1, 1, 0.5},
+		{"some failures missed", []string{"d", "a", "c"}, []string{"a", "b"}, []string{"c", "d"}, 1.0 / 3, 0.5, 0.5},
+		{"nothing selected", []string{"a"}, nil, []string{"a"}, 0, 0, 1},
+		{"everything selected", []string{"c"}, all, []string{}, 1, 0.25, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := Evaluate(all, tt.failing, tt.selected)
+			if record.Total != len(all) || record.Selected != len(tt.selected) {
+				t.Errorf("total/selected = %d/%d, want %d/%d", record.Total, record.Selected, len(all), len(tt.selected))
+			}
+			if !reflect.DeepEqual(record.Missed, tt.missed) {
+				t.Errorf("missed = %v, want %v", record.Missed, tt.missed)
+			}
+			if record.Recall != tt.recall {
+				t.Errorf("recall = %v, want %v", record.Recall, tt.recall)
+			}
+			if record.Precision != tt.precision {
+				t.Errorf("precision = %v, want %v", record.Precision, tt.precision)
+			}
+			if record.Savings != tt.savings {
+				t.Errorf("savings = %v, want %v", record.Savings, tt.savings)
+			}
+		})
+	}
+}
+
+func TestEvaluateSortsFailingWithoutChangingInput(t *testing.T) {
+	failing := []string{"z", "a"}
+	record := Evaluate([]string{"a", "z"}, failing, nil)
+	if !reflect.DeepEqual(record.Failing, []string{"a", "z"}) {
+		t.Errorf("failing = %v, want sorted", record.Failing)
+	}
+	if failing[0] != "z" {
+		t.Errorf("Evaluate reordered its input: %v", failing)
+	}
+}
+
+func TestStore(t *testing.T) {
+	store := &Store{Path: filepath.Join(t.TempDir(), "nested", "audit.jsonl")}
+
+	records, err := store.Load()
+	if err != nil || records != nil {
+		t.Fatalf("Load of a missing store = %v, %v; want nothing", records, err)
+	}
+
+	first := Evaluate([]string{"a", "b"}, []string{"a"}, []string{"b"})
+	first.Commit = "abc"
+	second := Evaluate([]string{"a"}, nil, []string{"a"})
+	for _, record := range []Record{first, second} {
+		if err := store.Append(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err = store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("loaded %d records, want 2", len(records))
+	}
+	if records[0].Commit != "abc" || !reflect.DeepEqual(records[0].Missed, []string{"a"}) {
+		t.Errorf("first record = %+v", records[0])
+	}
+	if !records[0].Timestamp.Equal(first.Timestamp) {
+		t.Errorf("timestamp = %v, want %v", records[0].Timestamp, first.Timestamp)
+	}
+	if records[1].Recall != 1 || records[1].Savings != 0 {
+		t.Errorf("second record = %+v", records[1])
+	}
+}
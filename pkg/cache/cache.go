@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrNotFound is returned by Get when the store has no entry for a key
+var ErrNotFound = errors.New("cache: not found")
+
+// Store is a content-addressed blob store
+type Store interface {
+	Get(key string) ([]byte, error)
+	Put(key string, data []byte) error
+}
+
+var keyRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Key hashes its parts into a store key
+func Key(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		// Length-prefix each part so ("ab","c") and ("a","bc") differ
+		fmt.Fprintf(h, "%d:%s;", len(part), part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ValidKey reports whether key looks like a key produced by Key
+func ValidKey(key string) bool {
+	return keyRegex.MatchString(key)
+}
+
+// Open creates a store from a location: an http(s) URL or a local directory
+func Open(location string) (Store, error) {
+	switch {
+	case location == "":
+		return nil, errors.New("cache: empty location")
+	case strings.HasPrefix(location, "http://"), strings.HasPrefix(location, "https://"):
+		return NewHTTPStore(location), nil
+	default:
+		return &DirStore{Dir: location}, nil
+	}
+}
+
+// Layered reads through a list of stores, fastest first. A hit in a later
+// store is copied into the earlier ones; writes go to every store.
+// A store that fails (e.g. an unreachable server) is skipped like a miss; an
+// HTTPStore that can't reach its server fails fast from then on.
+type Layered []Store
+
+func (l Layered) Get(key string) ([]byte, error) {
+	var errs []error
+	for i, store := range l {
+		data, err := store.Get(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, earlier := range l[:i] {
+			earlier.Put(key, data)
+		}
+		return data, nil
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return nil, ErrNotFound
+}
+
+func (l Layered) Put(key string, data []byte) error {
+	var errs []error
+	for _, store := range l {
+		if err := store.Put(key, data); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
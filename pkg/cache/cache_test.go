@@ -0,0 +1,212 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKey(t *testing.T) {
+	if Key("ab", "c") == Key("a", "bc") {
+		t.Error(`Key("ab", "c") == Key("a", "bc"), want them to differ`)
+	}
+	if Key("a", "b") != Key("a", "b") {
+		t.Error("Key isn't deterministic")
+	}
+	if k := Key("a"); !ValidKey(k) {
+		t.Errorf("ValidKey(%q) = false, want true", k)
+	}
+}
+
+func TestValidKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{Key("x"), true},
+		{"", false},
+		{Key("x")[:63], false},
+		{Key("x") + "0", false},
+		{"../" + Key("x")[3:], false},
+		{"A" + Key("x")[1:], false},
+	}
+	for _, tt := range tests {
+		if got := ValidKey(tt.key); got != tt.want {
+			t.Errorf("ValidKey(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestDirStore(t *testing.T) {
+	dir := t.TempDir()
+	store := &DirStore{Dir: dir}
+	key := Key("entry")
+
+	if _, err := store.Get(key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get before Put error = %v, want ErrNotFound", err)
+	}
+	if err := store.Put(key, []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(key, []byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := store.Get(key)
+	if err != nil || string(data) != "two" {
+		t.Errorf("Get = %q, %v, want two", data, err)
+	}
+
+	// Entries are sharded by prefix, and no temp files are left behind
+	entries, err := os.ReadDir(filepath.Join(dir, key[:2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != key {
+		t.Errorf("shard holds %v, want only %s", entries, key)
+	}
+
+	for _, bad := range []string{"", "../escape", "ab"} {
+		if _, err := store.Get(bad); err == nil || errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%q) error = %v, want an invalid key error", bad, err)
+		}
+		if err := store.Put(bad, nil); err == nil {
+			t.Errorf("Put(%q) succeeded, want an invalid key error", bad)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		location string
+		want     string
+	}{
+		{"http://cache:8090", "*cache.HTTPStore"},
+		{"https://cache:8090", "*cache.HTTPStore"},
+		{".dep-ci/cache", "*cache.DirStore"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		store, err := Open(tt.location)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("Open(%q) succeeded, want an error", tt.location)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Open(%q): %v", tt.location, err)
+		}
+		if got := typeName(store); got != tt.want {
+			t.Errorf("Open(%q) = %s, want %s", tt.location, got, tt.want)
+		}
+	}
+}
+
+func typeName(v interface{}) string {
+	return fmt.Sprintf("%T", v)
+}
+
+// memStore is an in-memory store that can be made to fail
+type memStore struct {
+	entries map[string][]byte
+	err     error
+	puts    int
+}
+
+func newMemStore() *memStore {
+	return &memStore{entries: make(map[string][]byte)}
+}
+
+func (m *memStore) Get(key string) ([]byte, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	data, ok := m.entries[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+func (m *memStore) Put(key string, data []byte) error {
+	m.puts++
+	if m.err != nil {
+		return m.err
+	}
+	m.entries[key] = data
+	return nil
+}
+
+func TestLayered(t *testing.T) {
+	key := Key("entry")
+	down := errors.New("unreachable")
+
+	tests := []struct {
+		name string
+		// has says which stores hold the entry, fails which ones error
+		has     []bool
+		fails   []bool
+		want    string
+		wantErr error
+		// filled says which stores hold the entry afterwards
+		filled []bool
+	}{
+		{"hit in the first", []bool{true, true}, []bool{false, false}, "data", nil, []bool{true, true}},
+		{"hit in the last copies it forward", []bool{false, false, true}, []bool{false, false, false}, "data", nil, []bool{true, true, true}},
+		{"miss everywhere", []bool{false, false}, []bool{false, false}, "", ErrNotFound, []bool{false, false}},
+		{"failing store is skipped", []bool{false, false, true}, []bool{false, true, false}, "data", nil, []bool{true, false, true}},
+		{"failure and miss", []bool{false, false}, []bool{true, false}, "", down, []bool{false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var layered Layered
+			var stores []*memStore
+			for i := range tt.has {
+				m := newMemStore()
+				if tt.has[i] {
+					m.entries[key] = []byte("data")
+				}
+				if tt.fails[i] {
+					m.err = down
+				}
+				stores = append(stores, m)
+				layered = append(layered, m)
+			}
+
+			data, err := layered.Get(key)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("Get error = %v, want %v", err, tt.wantErr)
+			}
+			if string(data) != tt.want {
+				t.Errorf("Get = %q, want %q", data, tt.want)
+			}
+			for i, m := range stores {
+				if _, ok := m.entries[key]; ok != tt.filled[i] {
+					t.Errorf("store %d has the entry = %v, want %v", i, ok, tt.filled[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLayeredPut(t *testing.T) {
+	key := Key("entry")
+	first, failing, last := newMemStore(), newMemStore(), newMemStore()
+	failing.err = errors.New("unreachable")
+
+	err := Layered{first, failing, last}.Put(key, []byte("data"))
+	if !errors.Is(err, failing.err) {
+		t.Errorf("Put error = %v, want the failing store's", err)
+	}
+	// The failure doesn't keep the others from being written
+	for i, m := range []*memStore{first, failing, last} {
+		if m.puts != 1 {
+			t.Errorf("store %d got %d puts, want 1", i, m.puts)
+		}
+	}
+	if string(first.entries[key]) != "data" || string(last.entries[key]) != "data" {
+		t.Error("Put didn't write to every working store")
+	}
+}
@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// DirStore keeps entries as files in a local directory, sharded by key prefix
+type DirStore struct {
+	Dir string
+}
+
+func (s *DirStore) path(key string) string {
+	return filepath.Join(s.Dir, key[:2], key)
+}
+
+func (s *DirStore) Get(key string) ([]byte, error) {
+	if !ValidKey(key) {
+		return nil, fmt.Errorf("cache: invalid key %q", key)
+	}
+	data, err := os.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// Put writes through a temp file so concurrent readers never see partial entries
+func (s *DirStore) Put(key string, data []byte) error {
+	if !ValidKey(key) {
+		return fmt.Errorf("cache: invalid key %q", key)
+	}
+	target := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), key+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
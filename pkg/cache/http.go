@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/velocity-trinity/core/pkg/logger"
+)
+
+// TokenEnv names the environment variable holding the token for writing to a
+// remote cache, both for `cache serve` and for clients
+const TokenEnv = "DEPENDENCY_CI_CACHE_TOKEN"
+
+// HTTPStore talks to a remote cache with a minimal protocol:
+// GET <base>/<key> returns the entry (404 if missing), PUT <base>/<key> stores
+// it, with the Token as a bearer token.
+//
+// Once a request fails to reach the server, the store stops trying for the
+// rest of the run: every later call fails at once instead of waiting out the
+// timeout again.
+type HTTPStore struct {
+	BaseURL string
+	Token   string
+	Client  *http.Client
+
+	mu   sync.Mutex
+	down error
+}
+
+// NewHTTPStore creates a store for the cache server at baseURL
+func NewHTTPStore(baseURL string) *HTTPStore {
+	return &HTTPStore{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *HTTPStore) Get(key string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, s.BaseURL+"/"+key, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	default:
+		return nil, fmt.Errorf("cache: GET %s: %s", key, resp.Status)
+	}
+}
+
+func (s *HTTPStore) Put(key string, data []byte) error {
+	req, err := http.NewRequest(http.MethodPut, s.BaseURL+"/"+key, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("cache: PUT %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+// do sends a request unless the server was found unreachable before
+func (s *HTTPStore) do(req *http.Request) (*http.Response, error) {
+	s.mu.Lock()
+	down := s.down
+	s.mu.Unlock()
+	if down != nil {
+		return nil, down
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		s.mu.Lock()
+		if s.down == nil {
+			s.down = fmt.Errorf("cache: %s is unavailable: %w", s.BaseURL, err)
+			logger.Log.Warn(fmt.Sprintf("Remote cache %s is unavailable, continuing without it: %v", s.BaseURL, err))
+		}
+		s.mu.Unlock()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Handler serves a Store over the GET/PUT protocol used by HTTPStore. Anyone
+// may read; writing requires token, so nobody else can poison the cache.
+// Without a token the cache is read-only.
+func Handler(store Store, maxEntrySize int64, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/")
+		if !ValidKey(key) {
+			http.Error(w, "invalid key", http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			data, err := store.Get(key)
+			if errors.Is(err, ErrNotFound) {
+				http.NotFound(w, r)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(data)
+
+		case http.MethodPut:
+			if !authorized(r, token) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "a valid token is required to write", http.StatusUnauthorized)
+				return
+			}
+			data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxEntrySize))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err := store.Put(key, data); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// authorized reports whether the request carries token as a bearer token
+func authorized(r *http.Request, token string) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/velocity-trinity/core/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// testServer serves a DirStore with the token "secret"
+func testServer(t *testing.T, maxEntrySize int64) (*DirStore, *httptest.Server) {
+	t.Helper()
+	logger.Log = zap.NewNop()
+	store := &DirStore{Dir: t.TempDir()}
+	srv := httptest.NewServer(Handler(store, maxEntrySize, "secret"))
+	t.Cleanup(srv.Close)
+	return store, srv
+}
+
+func TestHTTPStore(t *testing.T) {
+	backing, srv := testServer(t, 1<<20)
+	store := NewHTTPStore(srv.URL + "/")
+	store.Token = "secret"
+	key := Key("entry")
+
+	if _, err := store.Get(key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get before Put error = %v, want ErrNotFound", err)
+	}
+	if err := store.Put(key, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := store.Get(key)
+	if err != nil || string(data) != "data" {
+		t.Errorf("Get = %q, %v, want data", data, err)
+	}
+	if data, _ := backing.Get(key); string(data) != "data" {
+		t.Errorf("server stored %q, want data", data)
+	}
+}
+
+func TestHandlerAuth(t *testing.T) {
+	_, srv := testServer(t, 1<<20)
+	key := Key("entry")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		auth   string
+		body   string
+		want   int
+	}{
+		{"put without token", http.MethodPut, key, "", "x", http.StatusUnauthorized},
+		{"put with wrong token", http.MethodPut, key, "Bearer nope", "x", http.StatusUnauthorized},
+		{"put without bearer", http.MethodPut, key, "secret", "x", http.StatusUnauthorized},
+		{"put", http.MethodPut, key, "Bearer secret", "x", http.StatusCreated},
+		{"get without token", http.MethodGet, key, "", "", http.StatusOK},
+		{"get missing", http.MethodGet, Key("missing"), "", "", http.StatusNotFound},
+		{"invalid key", http.MethodGet, "../etc/passwd", "", "", http.StatusBadRequest},
+		{"too large", http.MethodPut, Key("large"), "Bearer secret", strings.Repeat("x", 2<<20), http.StatusRequestEntityTooLarge},
+		{"delete", http.MethodDelete, key, "Bearer secret", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, srv.URL+"/"+tt.path, strings.NewReader(tt.body))
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlerWithoutTokenIsReadOnly(t *testing.T) {
+	logger.Log = zap.NewNop()
+	srv := httptest.NewServer(Handler(&DirStore{Dir: t.TempDir()}, 1<<20, ""))
+	defer srv.Close()
+
+	store := NewHTTPStore(srv.URL)
+	if err := store.Put(Key("entry"), []byte("data")); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Put without a token = %v, want 401", err)
+	}
+	store.Token = "anything"
+	if err := store.Put(Key("entry"), []byte("data")); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Put with a token the server doesn't have = %v, want 401", err)
+	}
+}
+
+func TestHTTPStoreFailsFastWhenDown(t *testing.T) {
+	logger.Log = zap.NewNop()
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	calls := 0
+	store := NewHTTPStore(url)
+	store.Client.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		return http.DefaultTransport.RoundTrip(req)
+	})
+
+	if _, err := store.Get(Key("a")); err == nil || errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get from a closed server error = %v, want a connection error", err)
+	}
+	if err := store.Put(Key("a"), []byte("x")); err == nil || !strings.Contains(err.Error(), "is unavailable") {
+		t.Errorf("Put after the server went away error = %v, want it to say the cache is unavailable", err)
+	}
+	if calls != 1 {
+		t.Errorf("%d requests sent, want only the first", calls)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
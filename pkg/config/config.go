@@ -11,15 +11,27 @@ import (
 type Config struct {
 	Env      string `mapstructure:"env"`
 	LogLevel string `mapstructure:"log_level"`
+
+	DependencyCI DependencyCI `mapstructure:"dependency-ci"`
+	LivePatch    LivePatch    `mapstructure:"live-patch"`
 }
 
 // Load loads configuration from a file or environment variables
 func Load(appName string) (*Config, error) {
-	viper.SetConfigName("config")
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath(".")
-	viper.AddConfigPath(fmt.Sprintf("$HOME/.%s", appName))
-	viper.AddConfigPath("/etc/" + appName)
+	return LoadFile(appName, "")
+}
+
+// LoadFile is like Load but reads an explicit config file when path is not empty
+func LoadFile(appName string, path string) (*Config, error) {
+	if path != "" {
+		viper.SetConfigFile(path)
+	} else {
+		viper.SetConfigName("config")
+		viper.SetConfigType("yaml")
+		viper.AddConfigPath(".")
+		viper.AddConfigPath(fmt.Sprintf("$HOME/.%s", appName))
+		viper.AddConfigPath("/etc/" + appName)
+	}
 
 	viper.SetEnvPrefix(strings.ToUpper(appName))
 	viper.AutomaticEnv()
@@ -27,6 +39,7 @@ func Load(appName string) (*Config, error) {
 	// Defaults
 	viper.SetDefault("env", "development")
 	viper.SetDefault("log_level", "info")
+	viper.SetDefault("dependency-ci.cache_dir", ".dep-ci")
 
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
@@ -42,3 +55,8 @@ func Load(appName string) (*Config, error) {
 
 	return &cfg, nil
 }
+
+// File returns the path of the config file that was loaded, if any
+func File() string {
+	return viper.ConfigFileUsed()
+}
@@ -0,0 +1,153 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// load reads yaml as the config file
+func load(t *testing.T, yaml string) (*Config, error) {
+	t.Helper()
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadFile("test", path)
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		// want lists what the errors must mention, in order; empty means valid
+		want []string
+	}{
+		{
+			name: "valid",
+			yaml: `
+dependency-ci:
+  source_roots: [src]
+  ignore: ["dist/**"]
+  aliases: {"@/": "src/"}
+  test_layouts:
+    python:
+      patterns: ["test_{name}.py"]
+      mirrors: [{source: src/app, tests: tests/unit}]
+  runners:
+    jest: {command: "npx jest", match: ["**/*.test.ts"]}
+  remote_cache: https://cache.internal:8090
+live-patch:
+  targets:
+    web: ["web-0:8443", "web-1:8443"]
+  registry: http://registry:7070
+`,
+		},
+		{name: "empty sections", yaml: "dependency-ci:\nlive-patch:\n"},
+		{
+			name: "unknown keys",
+			yaml: "dependency-ci:\n  ignored: [x]\n  runners:\n    jest: {command: jest, cmd: jest}\nlive-patch:\n  target: x\n",
+			want: []string{"dependency-ci.ignored: unknown key", "dependency-ci.runners.jest.cmd: unknown key", "live-patch.target: unknown key"},
+		},
+		{
+			name: "string for a list",
+			yaml: "dependency-ci:\n  ignore: \"dist/**\"\n",
+			want: []string{"dependency-ci.ignore: expected a list, got a string"},
+		},
+		{
+			name: "bool for a string",
+			yaml: "dependency-ci:\n  cache_dir: true\n",
+			want: []string{"dependency-ci.cache_dir: expected a string, got true or false"},
+		},
+		{
+			// The decoder refuses what it can't convert at all
+			name: "list for a string",
+			yaml: "dependency-ci:\n  runners:\n    jest: {command: [npx, jest]}\n",
+			want: []string{"'dependency-ci.runners[jest].command' expected type 'string'"},
+		},
+		{
+			name: "number for a string",
+			yaml: "dependency-ci:\n  aliases: {\"@/\": 1}\n",
+			want: []string{"dependency-ci.aliases.@/: expected a string, got a number"},
+		},
+		{
+			name: "invalid values",
+			yaml: `
+dependency-ci:
+  source_roots: [../up]
+  ignore: ["[a"]
+  test_layouts:
+    cobol:
+      patterns: ["test.py"]
+  runners:
+    jest: {command: " "}
+  remote_cache: ftp://cache
+live-patch:
+  targets:
+    "web:1": []
+  registry: registry:7070
+`,
+			want: []string{
+				"dependency-ci.source_roots[0]: must be a path inside the project",
+				"dependency-ci.ignore[0]: invalid glob",
+				"dependency-ci.test_layouts.cobol: unsupported language",
+				"dependency-ci.test_layouts.cobol.patterns[0]: pattern \"test.py\" must be a file name containing {name}",
+				"dependency-ci.runners.jest.command: must not be empty",
+				"dependency-ci.remote_cache: must be an http(s) URL",
+				"live-patch.targets.web:1: group names can't contain ':'",
+				"live-patch.targets.web:1: must list at least one address",
+				"live-patch.registry: must be an http(s) URL",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := load(t, tt.yaml)
+			if err == nil {
+				err = cfg.Validate()
+			}
+			var got []string
+			if joined, ok := err.(interface{ Unwrap() []error }); ok {
+				for _, e := range joined.Unwrap() {
+					got = append(got, e.Error())
+				}
+			} else if err != nil {
+				got = []string{err.Error()}
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("errors = %q, want %d of them", got, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(got[i], want) {
+					t.Errorf("error %d = %q, want it to mention %q", i, got[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := load(t, "live-patch:\n  targets:\n    Web: [web-0:8443]\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Env != "development" || cfg.DependencyCI.CacheDir != ".dep-ci" {
+		t.Errorf("defaults = env %q, cache_dir %q, want development and .dep-ci", cfg.Env, cfg.DependencyCI.CacheDir)
+	}
+	// Viper lowercases keys, which is why the CLI looks groups up lowercased
+	if _, ok := cfg.LivePatch.Targets["web"]; !ok {
+		t.Errorf("Targets = %v, want the group under \"web\"", cfg.LivePatch.Targets)
+	}
+}
+
+func TestLoadBadFile(t *testing.T) {
+	if _, err := load(t, "dependency-ci: [unclosed\n"); err == nil || !strings.Contains(err.Error(), "error reading config file") {
+		t.Errorf("error = %v, want a read error", err)
+	}
+}
@@ -0,0 +1,151 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/velocity-trinity/core/pkg/glob"
+)
+
+// Languages the analyzer can parse, used to validate test_layouts keys
+var SupportedLanguages = []string{"typescript", "python"}
+
+// DependencyCI is the `dependency-ci` section of the config file
+//
+//	dependency-ci:
+//	  source_roots: [src]
+//	  ignore: ["dist/**"]
+//	  run_all_triggers: [package.json, "requirements*.txt"]
+//	  aliases: {"@/": "src/"}
+//	  test_layouts:
+//	    python:
+//	      patterns: ["test_{name}.py"]
+//	      mirrors: [{source: src/app, tests: tests/unit}]
+//	  runners:
+//	    jest: {command: "npx jest", match: ["**/*.test.ts"]}
+//	  cache_dir: .dep-ci
+//	  remote_cache: https://cache.internal:8090
+type DependencyCI struct {
+	// SourceRoots are extra roots for non-relative imports (Python packages, TS baseUrl)
+	SourceRoots []string `mapstructure:"source_roots"`
+	// TestLayouts override where tests live, keyed by language
+	TestLayouts map[string]TestLayout `mapstructure:"test_layouts"`
+	// Ignore globs are left out of the import graph
+	Ignore []string `mapstructure:"ignore"`
+	// RunAllTriggers are globs for files that invalidate every test when changed
+	RunAllTriggers []string `mapstructure:"run_all_triggers"`
+	// Aliases rewrite import prefixes, e.g. "@/" -> "src/"
+	Aliases map[string]string `mapstructure:"aliases"`
+	// Runners map test files to the command that runs them
+	Runners map[string]Runner `mapstructure:"runners"`
+	// CacheDir holds the parse cache and audit history
+	CacheDir string `mapstructure:"cache_dir"`
+	// RemoteCache is the URL of a shared cache (`dependency-ci cache serve`), empty to
+	// disable. Uploading to it needs the token in $DEPENDENCY_CI_CACHE_TOKEN.
+	RemoteCache string `mapstructure:"remote_cache"`
+}
+
+// TestLayout describes where a language keeps its tests
+type TestLayout struct {
+	Patterns []string `mapstructure:"patterns"`
+	TestDirs []string `mapstructure:"test_dirs"`
+	Mirrors  []Mirror `mapstructure:"mirrors"`
+}
+
+// Mirror maps a source directory to a test directory with the same structure
+type Mirror struct {
+	Source string `mapstructure:"source"`
+	Tests  string `mapstructure:"tests"`
+}
+
+// Runner is a test command and the test files it accepts
+type Runner struct {
+	Command string   `mapstructure:"command"`
+	Match   []string `mapstructure:"match"`
+}
+
+// Validate checks the loaded config against the schema. Every error names the offending key.
+func (c *Config) Validate() error {
+	var errs []error
+	if raw := viper.Get("dependency-ci"); raw != nil {
+		errs = append(errs, checkKeys("dependency-ci", raw, DependencyCI{})...)
+	}
+	errs = append(errs, c.DependencyCI.validate("dependency-ci")...)
+	if raw := viper.Get("live-patch"); raw != nil {
+		errs = append(errs, checkKeys("live-patch", raw, LivePatch{})...)
+	}
+	errs = append(errs, c.LivePatch.validate("live-patch")...)
+	return errors.Join(errs...)
+}
+
+func (d *DependencyCI) validate(prefix string) []error {
+	var errs []error
+	fail := func(key, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s.%s: %s", prefix, key, fmt.Sprintf(format, args...)))
+	}
+
+	for i, root := range d.SourceRoots {
+		if root == "" || filepath.IsAbs(root) || strings.HasPrefix(filepath.Clean(root), "..") {
+			fail(fmt.Sprintf("source_roots[%d]", i), "must be a path inside the project, got %q", root)
+		}
+	}
+	for i, pattern := range d.Ignore {
+		if !glob.Valid(pattern) {
+			fail(fmt.Sprintf("ignore[%d]", i), "invalid glob %q", pattern)
+		}
+	}
+	for i, pattern := range d.RunAllTriggers {
+		if !glob.Valid(pattern) {
+			fail(fmt.Sprintf("run_all_triggers[%d]", i), "invalid glob %q", pattern)
+		}
+	}
+	for _, alias := range slices.Sorted(maps.Keys(d.Aliases)) {
+		if d.Aliases[alias] == "" {
+			fail("aliases."+alias, "target must not be empty")
+		}
+	}
+
+	for _, lang := range slices.Sorted(maps.Keys(d.TestLayouts)) {
+		layout := d.TestLayouts[lang]
+		key := "test_layouts." + lang
+		if !slices.Contains(SupportedLanguages, lang) {
+			fail(key, "unsupported language (expected one of %s)", strings.Join(SupportedLanguages, ", "))
+		}
+		for i, pattern := range layout.Patterns {
+			if !strings.Contains(pattern, "{name}") || !glob.Valid(strings.ReplaceAll(pattern, "{name}", "x")) {
+				fail(fmt.Sprintf("%s.patterns[%d]", key, i), "pattern %q must be a file name containing {name}", pattern)
+			}
+		}
+		for i, mirror := range layout.Mirrors {
+			if mirror.Source == "" || mirror.Tests == "" {
+				fail(fmt.Sprintf("%s.mirrors[%d]", key, i), "both source and tests are required")
+			}
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(d.Runners)) {
+		runner := d.Runners[name]
+		key := "runners." + name
+		if strings.TrimSpace(runner.Command) == "" {
+			fail(key+".command", "must not be empty")
+		}
+		for i, pattern := range runner.Match {
+			if !glob.Valid(pattern) {
+				fail(fmt.Sprintf("%s.match[%d]", key, i), "invalid glob %q", pattern)
+			}
+		}
+	}
+
+	if d.RemoteCache != "" {
+		if u, err := url.Parse(d.RemoteCache); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("remote_cache", "must be an http(s) URL, got %q", d.RemoteCache)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// LivePatch is the `live-patch` section of the config file
+//
+//	live-patch:
+//	  targets:
+//	    web: [web-0.dev:8443, web-1.dev:8443, web-sidecar.dev:8443]
+//	  registry: http://registry.dev:7070
+type LivePatch struct {
+	// Targets are named groups of agent addresses; `--target web` syncs to all of them
+	Targets map[string][]string `mapstructure:"targets"`
+	// Registry is the URL of the agent registry (`live-patch registry`); without
+	// it, `--target app=web` finds agents over mDNS
+	Registry string `mapstructure:"registry"`
+}
+
+func (l *LivePatch) validate(prefix string) []error {
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(l.Targets)) {
+		key := prefix + ".targets." + name
+		if strings.Contains(name, ":") {
+			errs = append(errs, fmt.Errorf("%s: group names can't contain ':', which marks an address", key))
+		}
+		if len(l.Targets[name]) == 0 {
+			errs = append(errs, fmt.Errorf("%s: must list at least one address", key))
+		}
+		for i, addr := range l.Targets[name] {
+			if strings.TrimSpace(addr) == "" {
+				errs = append(errs, fmt.Errorf("%s[%d]: address must not be empty", key, i))
+			}
+		}
+	}
+	if l.Registry != "" {
+		if u, err := url.Parse(l.Registry); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s.registry: must be an http(s) URL, got %q", prefix, l.Registry))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// checkKeys walks raw config data alongside the struct it decodes into and
+// reports keys the struct doesn't declare and values of the wrong type. The
+// decoder would quietly convert many of those, e.g. a string into a one-item list.
+func checkKeys(prefix string, raw interface{}, schema interface{}) []error {
+	return checkValue(prefix, raw, reflect.TypeOf(schema))
+}
+
+func checkValue(prefix string, raw interface{}, t reflect.Type) []error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if raw == nil {
+		// An empty value decodes to the zero value
+		return nil
+	}
+	if want := kindOf(t); want != kindOfValue(raw) {
+		return []error{fmt.Errorf("%s: expected %s, got %s", prefix, want, kindOfValue(raw))}
+	}
+
+	var errs []error
+	switch t.Kind() {
+	case reflect.Struct:
+		m := raw.(map[string]interface{})
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("mapstructure"), ",")[0]
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			fields[name] = field.Type
+		}
+		for _, key := range slices.Sorted(maps.Keys(m)) {
+			fieldType, ok := fields[key]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s.%s: unknown key", prefix, key))
+				continue
+			}
+			errs = append(errs, checkValue(prefix+"."+key, m[key], fieldType)...)
+		}
+
+	case reflect.Map:
+		m := raw.(map[string]interface{})
+		for _, key := range slices.Sorted(maps.Keys(m)) {
+			errs = append(errs, checkValue(prefix+"."+key, m[key], t.Elem())...)
+		}
+
+	case reflect.Slice:
+		items := raw.([]interface{})
+		for i, item := range items {
+			errs = append(errs, checkValue(fmt.Sprintf("%s[%d]", prefix, i), item, t.Elem())...)
+		}
+	}
+	return errs
+}
+
+// kindOf names the kind of value a field of type t takes in the config file
+func kindOf(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return "a map"
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	}
+	return t.Kind().String()
+}
+
+// kindOfValue names the kind of a value read from the config file
+func kindOfValue(raw interface{}) string {
+	switch raw.(type) {
+	case map[string]interface{}:
+		return "a map"
+	case []interface{}:
+		return "a list"
+	case string:
+		return "a string"
+	case bool:
+		return "true or false"
+	case int, int64, uint64, float64:
+		return "a number"
+	}
+	return fmt.Sprintf("%T", raw)
+}
@@ -0,0 +1,249 @@
+// Package delta implements rsync-style delta transfer: the receiver describes
+// the file it has as a list of block checksums, the sender finds those blocks
+// in the new content with a rolling checksum and only sends what doesn't match.
+package delta
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	// MinBlockSize and MaxBlockSize bound the block size picked by BlockSizeFor
+	MinBlockSize = 512
+	MaxBlockSize = 64 * 1024
+
+	// MaxOps caps the ops Apply accepts. Diff emits at most two per block of
+	// new content, so this covers files of 256 MiB even at MinBlockSize.
+	MaxOps = 1 << 20
+)
+
+// Signature lists the checksums of each block of a file.
+// The last block may be shorter than BlockSize.
+type Signature struct {
+	BlockSize int
+	Size      int64
+	Blocks    []Block
+}
+
+// Block is the weak (rolling) and strong checksum of one block
+type Block struct {
+	Weak   uint32
+	Strong []byte
+}
+
+// Op is one instruction for rebuilding a file: either literal Data, or
+// Count blocks of the old file starting at Block
+type Op struct {
+	Data  []byte
+	Block int
+	Count int
+}
+
+// BlockSizeFor picks a block size for a file of the given size, like rsync:
+// roughly the square root, so the signature and the matching cost stay balanced
+func BlockSizeFor(size int64) int {
+	n := int(math.Sqrt(float64(size)))
+	n = (n + 7) &^ 7
+	if n < MinBlockSize {
+		return MinBlockSize
+	}
+	if n > MaxBlockSize {
+		return MaxBlockSize
+	}
+	return n
+}
+
+// Sign computes the signature of old, split into blocks of blockSize bytes
+func Sign(old []byte, blockSize int) *Signature {
+	if blockSize <= 0 {
+		blockSize = BlockSizeFor(int64(len(old)))
+	}
+	sig := &Signature{BlockSize: blockSize, Size: int64(len(old))}
+	for start := 0; start < len(old); start += blockSize {
+		end := min(start+blockSize, len(old))
+		block := old[start:end]
+		sig.Blocks = append(sig.Blocks, Block{Weak: weakSum(block), Strong: strongSum(block)})
+	}
+	return sig
+}
+
+// Diff returns the ops that turn the file described by sig into content.
+// Adjacent matched blocks and adjacent literal bytes are merged.
+func Diff(sig *Signature, content []byte) []Op {
+	var ops []Op
+	if sig == nil || len(sig.Blocks) == 0 {
+		if len(content) > 0 {
+			ops = append(ops, Op{Data: content})
+		}
+		return ops
+	}
+
+	// Only full-size blocks can be found by the rolling window; the short
+	// tail block is matched separately at the end of content
+	bs := sig.BlockSize
+	byWeak := make(map[uint32][]int)
+	for i, block := range sig.Blocks {
+		if int64(i+1)*int64(bs) <= sig.Size {
+			byWeak[block.Weak] = append(byWeak[block.Weak], i)
+		}
+	}
+
+	literalStart := 0
+	emitCopy := func(pos, block int) {
+		if literalStart < pos {
+			ops = append(ops, Op{Data: content[literalStart:pos]})
+		}
+		if n := len(ops); n > 0 && ops[n-1].Data == nil && ops[n-1].Block+ops[n-1].Count == block {
+			ops[n-1].Count++
+		} else {
+			ops = append(ops, Op{Block: block, Count: 1})
+		}
+	}
+
+	pos := 0
+	var r rolling
+	if len(content) >= bs {
+		r = newRolling(content[:bs])
+	}
+	for pos+bs <= len(content) {
+		if block, ok := findBlock(sig, byWeak, r.sum(), content[pos:pos+bs]); ok {
+			emitCopy(pos, block)
+			pos += bs
+			literalStart = pos
+			if pos+bs <= len(content) {
+				r = newRolling(content[pos : pos+bs])
+			}
+			continue
+		}
+		if pos+bs < len(content) {
+			r.roll(content[pos], content[pos+bs])
+		}
+		pos++
+	}
+
+	// A short last block can only match the end of the new content
+	last := len(sig.Blocks) - 1
+	tail := int(sig.Size) - last*bs
+	if tail < bs && len(content)-literalStart >= tail && tail > 0 {
+		end := content[len(content)-tail:]
+		if bytes.Equal(strongSum(end), sig.Blocks[last].Strong) {
+			emitCopy(len(content)-tail, last)
+			literalStart = len(content)
+		}
+	}
+
+	if literalStart < len(content) {
+		ops = append(ops, Op{Data: content[literalStart:]})
+	}
+	return ops
+}
+
+// Apply rebuilds the new content from the old file and ops
+func Apply(old []byte, blockSize int, ops []Op) ([]byte, error) {
+	size, err := OutputSize(int64(len(old)), blockSize, ops)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, size)
+	for _, op := range ops {
+		if op.Data != nil {
+			out = append(out, op.Data...)
+			continue
+		}
+		start := int64(op.Block) * int64(blockSize)
+		end := min(start+int64(op.Count)*int64(blockSize), int64(len(old)))
+		out = append(out, old[start:end]...)
+	}
+	return out, nil
+}
+
+// OutputSize checks ops against an old file of oldSize bytes and returns the
+// size of the content Apply would build, without building it
+func OutputSize(oldSize int64, blockSize int, ops []Op) (int64, error) {
+	if blockSize <= 0 {
+		return 0, errors.New("delta: invalid block size")
+	}
+	if len(ops) > MaxOps {
+		return 0, fmt.Errorf("delta: %d ops exceed the limit of %d", len(ops), MaxOps)
+	}
+	blocks := (oldSize + int64(blockSize) - 1) / int64(blockSize)
+
+	var size int64
+	for _, op := range ops {
+		if op.Data != nil {
+			size += int64(len(op.Data))
+			continue
+		}
+		if op.Block < 0 || op.Count <= 0 || int64(op.Block) >= blocks || int64(op.Count) > blocks {
+			return 0, fmt.Errorf("delta: block %d+%d out of range", op.Block, op.Count)
+		}
+		start := int64(op.Block) * int64(blockSize)
+		size += min(start+int64(op.Count)*int64(blockSize), oldSize) - start
+	}
+	return size, nil
+}
+
+// LiteralSize returns the number of bytes the ops carry
+func LiteralSize(ops []Op) int {
+	n := 0
+	for _, op := range ops {
+		n += len(op.Data)
+	}
+	return n
+}
+
+func findBlock(sig *Signature, byWeak map[uint32][]int, weak uint32, window []byte) (int, bool) {
+	candidates, ok := byWeak[weak]
+	if !ok {
+		return 0, false
+	}
+	strong := strongSum(window)
+	for _, i := range candidates {
+		if bytes.Equal(sig.Blocks[i].Strong, strong) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func strongSum(block []byte) []byte {
+	sum := sha256.Sum256(block)
+	return sum[:16]
+}
+
+func weakSum(block []byte) uint32 {
+	r := newRolling(block)
+	return r.sum()
+}
+
+// rolling is the rsync weak checksum: a is the sum of the bytes and b the
+// sum of the running a values, both mod 2^16. It can slide one byte in O(1).
+type rolling struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRolling(block []byte) rolling {
+	r := rolling{n: uint32(len(block))}
+	for i, c := range block {
+		r.a += uint32(c)
+		r.b += uint32(len(block)-i) * uint32(c)
+	}
+	r.a &= 0xffff
+	r.b &= 0xffff
+	return r
+}
+
+// roll drops out from the front of the window and adds in at the back
+func (r *rolling) roll(out, in byte) {
+	r.a = (r.a - uint32(out) + uint32(in)) & 0xffff
+	r.b = (r.b - r.n*uint32(out) + r.a) & 0xffff
+}
+
+func (r rolling) sum() uint32 {
+	return r.a | r.b<<16
+}
@@ -0,0 +1,134 @@
+package delta
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rng.Read(b)
+		return b
+	}
+	cat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	const bs = 16
+	old := random(10*bs + 5)
+	tests := []struct {
+		name    string
+		old     []byte
+		content []byte
+		// maxLiteral bounds the bytes Diff may send instead of copying
+		maxLiteral int
+	}{
+		{"both empty", nil, nil, 0},
+		{"new file", nil, []byte("hello"), 5},
+		{"truncated", old, nil, 0},
+		{"unchanged", old, old, 0},
+		// the short last block no longer ends the content, so it is resent
+		{"appended", old, cat(old, []byte("tail")), 5 + 4},
+		{"prepended", old, cat([]byte("head"), old), 4},
+		{"byte changed in middle", old, cat(old[:5*bs], []byte{^old[5*bs]}, old[5*bs+1:]), bs},
+		{"blocks reordered", old, cat(old[3*bs:6*bs], old[:3*bs]), 0},
+		{"block repeated", old, cat(old[:bs], old[:bs], old[:bs]), 0},
+		{"short tail kept", old, cat([]byte("x"), old[10*bs:]), 1},
+		{"unrelated", old, random(7 * bs), 7 * bs},
+		{"shorter than a block", []byte("abc"), []byte("abd"), 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig := Sign(tt.old, bs)
+			ops := Diff(sig, tt.content)
+			got, err := Apply(tt.old, bs, ops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.content) {
+				t.Fatalf("Apply(Diff) = %d bytes, want %d", len(got), len(tt.content))
+			}
+			if n := LiteralSize(ops); n > tt.maxLiteral {
+				t.Errorf("%d literal bytes sent, want at most %d", n, tt.maxLiteral)
+			}
+			size, err := OutputSize(int64(len(tt.old)), bs, ops)
+			if err != nil || size != int64(len(tt.content)) {
+				t.Errorf("OutputSize = %d, %v; want %d", size, err, len(tt.content))
+			}
+		})
+	}
+}
+
+func TestDiffMergesAdjacentBlocks(t *testing.T) {
+	old := []byte("0123456789abcdef" + "fedcba9876543210" + "ghijklmnopqrstuv")
+	ops := Diff(Sign(old, 16), old)
+	if len(ops) != 1 || ops[0].Data != nil || ops[0].Block != 0 || ops[0].Count != 3 {
+		t.Errorf("ops = %+v, want a single copy of 3 blocks", ops)
+	}
+}
+
+func TestRolling(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	const n = 8
+	r := newRolling(data[:n])
+	for pos := 1; pos+n <= len(data); pos++ {
+		r.roll(data[pos-1], data[pos+n-1])
+		if want := weakSum(data[pos : pos+n]); r.sum() != want {
+			t.Fatalf("rolled sum at %d = %x, want %x", pos, r.sum(), want)
+		}
+	}
+}
+
+func TestOutputSizeRejects(t *testing.T) {
+	tests := []struct {
+		name      string
+		oldSize   int64
+		blockSize int
+		ops       []Op
+	}{
+		{"zero block size", 10, 0, nil},
+		{"negative block", 64, 16, []Op{{Block: -1, Count: 1}}},
+		{"zero count", 64, 16, []Op{{Block: 0, Count: 0}}},
+		{"block past end", 64, 16, []Op{{Block: 4, Count: 1}}},
+		{"count past end", 64, 16, []Op{{Block: 0, Count: 5}}},
+		{"copy from empty file", 0, 16, []Op{{Block: 0, Count: 1}}},
+		{"too many ops", 64, 16, make([]Op, MaxOps+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := OutputSize(tt.oldSize, tt.blockSize, tt.ops); err == nil {
+				t.Error("expected an error")
+			}
+			if _, err := Apply(make([]byte, tt.oldSize), tt.blockSize, tt.ops); err == nil {
+				t.Error("Apply accepted it")
+			}
+		})
+	}
+}
+
+func TestOutputSizeClampsToOldFile(t *testing.T) {
+	// a run that covers the short last block only copies what is there
+	size, err := OutputSize(40, 16, []Op{{Block: 1, Count: 2}, {Data: []byte("ab")}})
+	if err != nil || size != 26 {
+		t.Errorf("OutputSize = %d, %v; want 26", size, err)
+	}
+}
+
+func TestBlockSizeFor(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int
+	}{
+		{0, MinBlockSize},
+		{1000, MinBlockSize},
+		{1 << 20, 1024},
+		{1000 * 1000, 1000},
+		{1 << 40, MaxBlockSize},
+	}
+	for _, tt := range tests {
+		if got := BlockSizeFor(tt.size); got != tt.want {
+			t.Errorf("BlockSizeFor(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
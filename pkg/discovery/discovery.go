@@ -0,0 +1,138 @@
+// Package discovery lets live-patch agents make themselves known, either to a
+// small registry service or over mDNS on the local network, so the CLI can pick
+// them by name and labels instead of by address.
+package discovery
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Agent is what an agent announces about itself
+type Agent struct {
+	Name string `json:"name"`
+	// Addr is host:port of the agent's RPC port. An empty host is filled in
+	// with the address the announcement came from.
+	Addr     string            `json:"addr"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	BasePath string            `json:"base_path"`
+	Version  string            `json:"version"`
+	// Seen is when the agent was last heard from
+	Seen time.Time `json:"seen"`
+}
+
+// validName keeps names usable as a DNS label in mDNS announcements
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,62}$`)
+
+// Validate checks that the agent can be announced
+func (a *Agent) Validate() error {
+	if !validName.MatchString(a.Name) {
+		return fmt.Errorf("invalid agent name %q (use letters, digits, '-' and '_', up to 63 characters)", a.Name)
+	}
+	if _, _, err := net.SplitHostPort(a.Addr); err != nil {
+		return fmt.Errorf("invalid agent address %q: %v", a.Addr, err)
+	}
+	for key := range a.Labels {
+		if key == "" || strings.ContainsAny(key, "=,") {
+			return fmt.Errorf("invalid label %q", key)
+		}
+	}
+	return nil
+}
+
+// hasHost reports whether the agent's address names a host others can reach
+func (a *Agent) hasHost() bool {
+	host, _, err := net.SplitHostPort(a.Addr)
+	return err == nil && host != "" && host != "0.0.0.0" && host != "::"
+}
+
+// withHost fills in a missing host in the agent's address
+func (a *Agent) withHost(host string) {
+	if _, port, err := net.SplitHostPort(a.Addr); err == nil && !a.hasHost() {
+		a.Addr = net.JoinHostPort(host, port)
+	}
+}
+
+// FormatLabels renders labels as "k=v,k=v", sorted by key
+func FormatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for _, key := range slices.Sorted(maps.Keys(labels)) {
+		pairs = append(pairs, key+"="+labels[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// ParseLabels reads "k=v" pairs, given separately or comma-separated
+func ParseLabels(pairs []string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, arg := range pairs {
+		for _, pair := range strings.Split(arg, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || key == "" {
+				return nil, fmt.Errorf("invalid label %q (want key=value)", pair)
+			}
+			labels[key] = value
+		}
+	}
+	return labels, nil
+}
+
+// Selector picks agents by label, e.g. "app=web,env=dev". The key "name"
+// matches the agent's name.
+type Selector map[string]string
+
+// IsSelector reports whether a target names agents by label rather than by address
+func IsSelector(target string) bool {
+	return strings.Contains(target, "=")
+}
+
+// ParseSelector reads a selector such as "app=web,env=dev"
+func ParseSelector(s string) (Selector, error) {
+	labels, err := ParseLabels([]string{s})
+	if err != nil {
+		return nil, err
+	}
+	return Selector(labels), nil
+}
+
+// Matches reports whether the agent has every label in the selector
+func (s Selector) Matches(agent Agent) bool {
+	for key, value := range s {
+		if key == "name" {
+			if agent.Name != value {
+				return false
+			}
+			continue
+		}
+		if got, ok := agent.Labels[key]; !ok || got != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Select returns the agents the selector matches, sorted by name
+func (s Selector) Select(agents []Agent) []Agent {
+	var matched []Agent
+	for _, agent := range agents {
+		if s.Matches(agent) {
+			matched = append(matched, agent)
+		}
+	}
+	sortAgents(matched)
+	return matched
+}
+
+func sortAgents(agents []Agent) {
+	slices.SortFunc(agents, func(a, b Agent) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Addr, b.Addr)
+	})
+}
@@ -0,0 +1,100 @@
+package discovery
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Selector
+		wantErr bool
+	}{
+		{in: "app=web", want: Selector{"app": "web"}},
+		{in: "app=web,env=dev", want: Selector{"app": "web", "env": "dev"}},
+		{in: " app=web , env=dev ", want: Selector{"app": "web", "env": "dev"}},
+		{in: "name=api-1", want: Selector{"name": "api-1"}},
+		{in: "app=", want: Selector{"app": ""}},
+		{in: "app", wantErr: true},
+		{in: "=web", wantErr: true},
+		{in: "app=web,", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseSelector(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSelector(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("ParseSelector(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelect(t *testing.T) {
+	agents := []Agent{
+		{Name: "web-2", Addr: "10.0.0.2:7000", Labels: map[string]string{"app": "web", "env": "prod"}},
+		{Name: "web-1", Addr: "10.0.0.1:7000", Labels: map[string]string{"app": "web", "env": "dev"}},
+		{Name: "api-1", Addr: "10.0.0.3:7000", Labels: map[string]string{"app": "api", "env": "dev"}},
+		{Name: "bare", Addr: "10.0.0.4:7000"},
+	}
+	tests := []struct {
+		selector Selector
+		want     []string
+	}{
+		{selector: Selector{"app": "web"}, want: []string{"web-1", "web-2"}},
+		{selector: Selector{"env": "dev"}, want: []string{"api-1", "web-1"}},
+		{selector: Selector{"app": "web", "env": "dev"}, want: []string{"web-1"}},
+		{selector: Selector{"name": "api-1"}, want: []string{"api-1"}},
+		{selector: Selector{"name": "api-1", "env": "prod"}, want: nil},
+		{selector: Selector{"app": ""}, want: nil},
+		{selector: Selector{"team": "x"}, want: nil},
+		{selector: Selector{}, want: []string{"api-1", "bare", "web-1", "web-2"}},
+	}
+	for _, tt := range tests {
+		t.Run(FormatLabels(tt.selector), func(t *testing.T) {
+			var got []string
+			for _, agent := range tt.selector.Select(agents) {
+				got = append(got, agent.Name)
+			}
+			if !equalStrings(got, tt.want) {
+				t.Errorf("Select = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		agent   Agent
+		wantErr bool
+	}{
+		{name: "ok", agent: Agent{Name: "web-1", Addr: ":7000", Labels: map[string]string{"app": "web"}}},
+		{name: "empty name", agent: Agent{Addr: ":7000"}, wantErr: true},
+		{name: "dotted name", agent: Agent{Name: "web.1", Addr: ":7000"}, wantErr: true},
+		{name: "no port", agent: Agent{Name: "web", Addr: "10.0.0.1"}, wantErr: true},
+		{name: "bad label", agent: Agent{Name: "web", Addr: ":7000", Labels: map[string]string{"a,b": "c"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.agent.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,410 @@
+package discovery
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Agents advertise the DNS-SD service type below over multicast DNS (RFC 6762,
+// RFC 6763). An agent answers PTR queries for the service with a PTR to its
+// instance, plus SRV (port) and TXT (version, base path, labels) records.
+// Browsers query from an ephemeral port, so agents answer them directly.
+const (
+	mdnsService = "_livepatch._tcp.local."
+	// mdnsTTL is how long (in seconds) browsers may cache an announcement
+	mdnsTTL = 120
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// DNS record types and classes
+const (
+	typePTR uint16 = 12
+	typeTXT uint16 = 16
+	typeSRV uint16 = 33
+	typeANY uint16 = 255
+
+	classIN uint16 = 1
+	// classFlush marks records that replace, rather than add to, what a cache holds (RFC 6762 10.2)
+	classFlush uint16 = 0x8000
+)
+
+// TXT keys
+const (
+	txtVersion = "version="
+	txtBase    = "base="
+	txtAddr    = "addr="
+	txtLabel   = "label:"
+)
+
+var errMalformed = errors.New("malformed DNS message")
+
+type dnsQuestion struct {
+	name  string
+	qtype uint16
+}
+
+// dnsRecord is a resource record of one of the types DNS-SD uses
+type dnsRecord struct {
+	name   string
+	rtype  uint16
+	class  uint16
+	ttl    uint32
+	target string   // PTR and SRV
+	port   uint16   // SRV
+	txt    []string // TXT
+}
+
+type dnsMessage struct {
+	id        uint16
+	response  bool
+	questions []dnsQuestion
+	// records holds the answer, authority and additional sections
+	records []dnsRecord
+}
+
+// asks reports whether the message is a query for name
+func (m *dnsMessage) asks(name string) bool {
+	if m.response {
+		return false
+	}
+	return slices.ContainsFunc(m.questions, func(q dnsQuestion) bool {
+		return (q.qtype == typePTR || q.qtype == typeANY) && strings.EqualFold(q.name, name)
+	})
+}
+
+func (m *dnsMessage) pack() ([]byte, error) {
+	b := binary.BigEndian.AppendUint16(nil, m.id)
+	var flags uint16
+	if m.response {
+		flags = 0x8400 // response, authoritative
+	}
+	b = binary.BigEndian.AppendUint16(b, flags)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(m.questions)))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(m.records)))
+	b = binary.BigEndian.AppendUint32(b, 0) // no authority or additional records
+
+	var err error
+	for _, q := range m.questions {
+		if b, err = appendName(b, q.name); err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint16(b, q.qtype)
+		b = binary.BigEndian.AppendUint16(b, classIN)
+	}
+	for _, r := range m.records {
+		if b, err = appendName(b, r.name); err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint16(b, r.rtype)
+		b = binary.BigEndian.AppendUint16(b, r.class)
+		b = binary.BigEndian.AppendUint32(b, r.ttl)
+
+		var data []byte
+		switch r.rtype {
+		case typePTR:
+			data, err = appendName(nil, r.target)
+		case typeSRV:
+			data = binary.BigEndian.AppendUint32(nil, 0) // priority and weight
+			data = binary.BigEndian.AppendUint16(data, r.port)
+			data, err = appendName(data, r.target)
+		case typeTXT:
+			for _, s := range r.txt {
+				if len(s) > 255 {
+					return nil, fmt.Errorf("TXT entry %.20q... is longer than 255 bytes", s)
+				}
+				data = append(append(data, byte(len(s))), s...)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+		b = append(b, data...)
+	}
+	return b, nil
+}
+
+// appendName encodes a dotted name as DNS labels, without compression
+func appendName(b []byte, name string) ([]byte, error) {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return nil, fmt.Errorf("invalid DNS name %q", name)
+		}
+		b = append(append(b, byte(len(label))), label...)
+	}
+	return append(b, 0), nil
+}
+
+func parseMessage(b []byte) (*dnsMessage, error) {
+	if len(b) < 12 {
+		return nil, errMalformed
+	}
+	m := &dnsMessage{id: binary.BigEndian.Uint16(b), response: b[2]&0x80 != 0}
+	questions := int(binary.BigEndian.Uint16(b[4:]))
+	records := int(binary.BigEndian.Uint16(b[6:])) + int(binary.BigEndian.Uint16(b[8:])) + int(binary.BigEndian.Uint16(b[10:]))
+
+	off := 12
+	for i := 0; i < questions; i++ {
+		name, next, err := readName(b, off)
+		if err != nil || next+4 > len(b) {
+			return nil, errMalformed
+		}
+		m.questions = append(m.questions, dnsQuestion{name: name, qtype: binary.BigEndian.Uint16(b[next:])})
+		off = next + 4
+	}
+	for i := 0; i < records; i++ {
+		name, next, err := readName(b, off)
+		if err != nil || next+10 > len(b) {
+			return nil, errMalformed
+		}
+		r := dnsRecord{
+			name:  name,
+			rtype: binary.BigEndian.Uint16(b[next:]),
+			class: binary.BigEndian.Uint16(b[next+2:]),
+			ttl:   binary.BigEndian.Uint32(b[next+4:]),
+		}
+		start := next + 10
+		end := start + int(binary.BigEndian.Uint16(b[next+8:]))
+		if end > len(b) {
+			return nil, errMalformed
+		}
+
+		switch r.rtype {
+		case typePTR:
+			r.target, _, err = readName(b, start)
+		case typeSRV:
+			if end-start < 7 {
+				return nil, errMalformed
+			}
+			r.port = binary.BigEndian.Uint16(b[start+4:])
+			r.target, _, err = readName(b, start+6)
+		case typeTXT:
+			for p := start; p < end; {
+				n := int(b[p])
+				if p+1+n > end {
+					return nil, errMalformed
+				}
+				r.txt = append(r.txt, string(b[p+1:p+1+n]))
+				p += 1 + n
+			}
+		}
+		if err != nil {
+			return nil, errMalformed
+		}
+		m.records = append(m.records, r)
+		off = end
+	}
+	return m, nil
+}
+
+// readName decodes the possibly compressed name at off and returns it with the
+// offset just past it
+func readName(b []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(b) {
+			return "", 0, errMalformed
+		}
+		n := int(b[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(b) || jumps > 16 {
+				return "", 0, errMalformed
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3FFF)
+			jumps++
+		case n > 63 || off+1+n > len(b):
+			return "", 0, errMalformed
+		default:
+			labels = append(labels, string(b[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// mdnsRecords describes the agent as a DNS-SD service instance
+func (a *Agent) mdnsRecords(ttl uint32) []dnsRecord {
+	instance := a.Name + "." + mdnsService
+	_, portStr, _ := net.SplitHostPort(a.Addr)
+	port, _ := strconv.Atoi(portStr)
+
+	txt := []string{txtVersion + a.Version, txtBase + a.BasePath}
+	if a.hasHost() {
+		txt = append(txt, txtAddr+a.Addr)
+	}
+	for _, key := range slices.Sorted(maps.Keys(a.Labels)) {
+		txt = append(txt, txtLabel+key+"="+a.Labels[key])
+	}
+	return []dnsRecord{
+		{name: mdnsService, rtype: typePTR, class: classIN, ttl: ttl, target: instance},
+		{name: instance, rtype: typeSRV, class: classIN | classFlush, ttl: ttl, port: uint16(port), target: a.Name + ".local."},
+		{name: instance, rtype: typeTXT, class: classIN | classFlush, ttl: ttl, txt: txt},
+	}
+}
+
+// agentsIn returns the agents announced in a response that came from ip.
+// Goodbye announcements (TTL 0) are left out.
+func agentsIn(m *dnsMessage, ip net.IP) []Agent {
+	srv := make(map[string]dnsRecord)
+	txt := make(map[string][]string)
+	for _, r := range m.records {
+		switch r.rtype {
+		case typeSRV:
+			srv[strings.ToLower(r.name)] = r
+		case typeTXT:
+			txt[strings.ToLower(r.name)] = r.txt
+		}
+	}
+
+	var agents []Agent
+	for _, r := range m.records {
+		if r.rtype != typePTR || r.ttl == 0 || !strings.EqualFold(r.name, mdnsService) {
+			continue
+		}
+		instance := strings.ToLower(r.target)
+		s, ok := srv[instance]
+		if !ok {
+			continue
+		}
+		name, _, _ := strings.Cut(r.target, ".")
+		agent := Agent{
+			Name:   name,
+			Addr:   net.JoinHostPort(ip.String(), strconv.Itoa(int(s.port))),
+			Labels: make(map[string]string),
+			Seen:   time.Now(),
+		}
+		for _, entry := range txt[instance] {
+			switch {
+			case strings.HasPrefix(entry, txtVersion):
+				agent.Version = strings.TrimPrefix(entry, txtVersion)
+			case strings.HasPrefix(entry, txtBase):
+				agent.BasePath = strings.TrimPrefix(entry, txtBase)
+			case strings.HasPrefix(entry, txtAddr):
+				agent.Addr = strings.TrimPrefix(entry, txtAddr)
+			case strings.HasPrefix(entry, txtLabel):
+				key, value, _ := strings.Cut(strings.TrimPrefix(entry, txtLabel), "=")
+				agent.Labels[key] = value
+			}
+		}
+		agents = append(agents, agent)
+	}
+	return agents
+}
+
+// ServeMDNS announces the agent on the local network and answers queries for
+// it until ctx is done, when it says goodbye
+func ServeMDNS(ctx context.Context, agent Agent) error {
+	if err := agent.Validate(); err != nil {
+		return err
+	}
+	announcement, err := (&dnsMessage{response: true, records: agent.mdnsRecords(mdnsTTL)}).pack()
+	if err != nil {
+		return err
+	}
+	goodbye, _ := (&dnsMessage{response: true, records: agent.mdnsRecords(0)}).pack()
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.WriteToUDP(goodbye, mdnsGroup)
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	if _, err := conn.WriteToUDP(announcement, mdnsGroup); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		query, err := parseMessage(buf[:n])
+		if err != nil || !query.asks(mdnsService) {
+			continue
+		}
+		reply, dest := announcement, mdnsGroup
+		if from.Port != mdnsGroup.Port {
+			// A one-shot query from an ephemeral port gets a direct answer echoing its ID (RFC 6762 6.7)
+			direct := &dnsMessage{id: query.id, response: true, questions: query.questions, records: agent.mdnsRecords(mdnsTTL)}
+			if reply, err = direct.pack(); err != nil {
+				continue
+			}
+			dest = from
+		}
+		conn.WriteToUDP(reply, dest)
+	}
+}
+
+// Browse asks the local network for agents and collects the answers that
+// arrive within timeout
+func Browse(timeout time.Duration) ([]Agent, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	query, err := (&dnsMessage{questions: []dnsQuestion{{name: mdnsService, qtype: typePTR}}}).pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteToUDP(query, mdnsGroup); err != nil {
+		return nil, fmt.Errorf("mDNS query failed: %w", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	found := make(map[string]Agent)
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		m, err := parseMessage(buf[:n])
+		if err != nil || !m.response {
+			continue
+		}
+		for _, agent := range agentsIn(m, from.IP) {
+			found[agent.Name+"@"+agent.Addr] = agent
+		}
+	}
+
+	agents := slices.Collect(maps.Values(found))
+	sortAgents(agents)
+	return agents, nil
+}
@@ -0,0 +1,94 @@
+package discovery
+
+import (
+	"maps"
+	"net"
+	"testing"
+)
+
+func TestMDNSRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		agent    Agent
+		wantAddr string
+	}{
+		{
+			name:     "no host",
+			agent:    Agent{Name: "web-1", Addr: ":7000", BasePath: "/app", Version: "1.2.3", Labels: map[string]string{"app": "web", "env": "dev"}},
+			wantAddr: "192.168.1.5:7000",
+		},
+		{
+			name:     "advertised host",
+			agent:    Agent{Name: "api", Addr: "10.0.0.9:7001", BasePath: "/srv", Version: "dev"},
+			wantAddr: "10.0.0.9:7001",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &dnsMessage{id: 0, response: true, records: tt.agent.mdnsRecords(mdnsTTL)}
+			b, err := msg.pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := parseMessage(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			agents := agentsIn(parsed, net.ParseIP("192.168.1.5"))
+			if len(agents) != 1 {
+				t.Fatalf("agentsIn = %v, want one agent", agents)
+			}
+			got := agents[0]
+			if got.Name != tt.agent.Name || got.Addr != tt.wantAddr || got.BasePath != tt.agent.BasePath || got.Version != tt.agent.Version {
+				t.Errorf("agent = %+v, want %s at %s, base %s, version %s", got, tt.agent.Name, tt.wantAddr, tt.agent.BasePath, tt.agent.Version)
+			}
+			if len(got.Labels) != len(tt.agent.Labels) || !maps.Equal(got.Labels, tt.agent.Labels) {
+				t.Errorf("Labels = %v, want %v", got.Labels, tt.agent.Labels)
+			}
+		})
+	}
+}
+
+func TestMDNSGoodbye(t *testing.T) {
+	agent := Agent{Name: "web", Addr: ":7000"}
+	b, err := (&dnsMessage{response: true, records: agent.mdnsRecords(0)}).pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agents := agentsIn(parsed, net.ParseIP("192.168.1.5")); len(agents) != 0 {
+		t.Errorf("agentsIn = %v, want none for a goodbye", agents)
+	}
+}
+
+func TestMDNSQuery(t *testing.T) {
+	b, err := (&dnsMessage{id: 7, questions: []dnsQuestion{{name: mdnsService, qtype: typePTR}}}).pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.id != 7 || !parsed.asks(mdnsService) {
+		t.Errorf("parsed = %+v, want query 7 for %s", parsed, mdnsService)
+	}
+	if parsed.asks("_other._tcp.local.") {
+		t.Error("asks(_other._tcp.local.) = true, want false")
+	}
+}
+
+func TestParseMessageMalformed(t *testing.T) {
+	good, err := (&dnsMessage{response: true, records: (&Agent{Name: "web", Addr: ":7000"}).mdnsRecords(mdnsTTL)}).pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{0, 5, 12, 20, len(good) - 1} {
+		if _, err := parseMessage(good[:n]); err == nil {
+			t.Errorf("parseMessage(%d of %d bytes) succeeded, want an error", n, len(good))
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/velocity-trinity/core/pkg/logger"
+)
+
+// DefaultTTL is how long the registry keeps an agent that stopped re-registering
+const DefaultTTL = 30 * time.Second
+
+// DefaultMaxAgents caps how many agents a registry lists at once
+const DefaultMaxAgents = 1000
+
+// TokenEnv names the environment variable holding the token agents register
+// with, both for `live-patch registry` and for agents
+const TokenEnv = "LIVE_PATCH_REGISTRY_TOKEN"
+
+// maxAgentSize caps a registration body
+const maxAgentSize = 64 << 10
+
+// Registry keeps the agents that registered recently. Its HTTP API:
+//
+//	GET    /agents         lists the live agents
+//	PUT    /agents/{name}  registers or refreshes an agent (JSON body)
+//	DELETE /agents/{name}  removes an agent
+//
+// Anyone may list the agents; registering and removing them requires Token as
+// a bearer token, so nobody else can point the CLI at their own address.
+// Without a token the registry is read-only.
+type Registry struct {
+	// TTL is how long an agent stays listed after it last registered
+	TTL time.Duration
+	// Token authorizes registrations
+	Token string
+	// MaxAgents caps the agents listed at once; new ones are refused beyond it
+	MaxAgents int
+
+	mu     sync.Mutex
+	agents map[string]Agent
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry(ttl time.Duration) *Registry {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	return &Registry{TTL: ttl, MaxAgents: DefaultMaxAgents, agents: make(map[string]Agent)}
+}
+
+// Agents lists the agents that registered within the TTL, sorted by name
+func (r *Registry) Agents() []Agent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire()
+
+	var agents []Agent
+	for _, agent := range r.agents {
+		agents = append(agents, agent)
+	}
+	sortAgents(agents)
+	return agents
+}
+
+// expire forgets the agents that stopped registering. Caller must hold r.mu.
+func (r *Registry) expire() {
+	for name, agent := range r.agents {
+		if time.Since(agent.Seen) > r.TTL {
+			delete(r.agents, name)
+		}
+	}
+}
+
+// add registers or refreshes an agent; known is false if it's new
+func (r *Registry) add(agent Agent) (known bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, known = r.agents[agent.Name]; !known {
+		r.expire()
+		if r.MaxAgents > 0 && len(r.agents) >= r.MaxAgents {
+			return false, fmt.Errorf("registry is full (%d agents)", r.MaxAgents)
+		}
+	}
+	r.agents[agent.Name] = agent
+	return known, nil
+}
+
+// Handler serves the registry's HTTP API
+func (r *Registry) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /agents", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		agents := r.Agents()
+		if agents == nil {
+			agents = []Agent{}
+		}
+		json.NewEncoder(w).Encode(agents)
+	})
+	mux.HandleFunc("PUT /agents/{name}", func(w http.ResponseWriter, req *http.Request) {
+		if !r.authorized(w, req) {
+			return
+		}
+		var agent Agent
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxAgentSize)).Decode(&agent); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if agent.Name != req.PathValue("name") {
+			http.Error(w, "agent name doesn't match the URL", http.StatusBadRequest)
+			return
+		}
+		if err := agent.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			agent.withHost(host)
+		}
+		agent.Seen = time.Now()
+
+		known, err := r.add(agent)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+		if !known {
+			logger.Log.Info(fmt.Sprintf("Registered agent %s at %s", agent.Name, agent.Addr))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("DELETE /agents/{name}", func(w http.ResponseWriter, req *http.Request) {
+		if !r.authorized(w, req) {
+			return
+		}
+		name := req.PathValue("name")
+		r.mu.Lock()
+		_, known := r.agents[name]
+		delete(r.agents, name)
+		r.mu.Unlock()
+		if known {
+			logger.Log.Info("Deregistered agent " + name)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+// authorized checks that the request carries the registry's token, and answers it if not
+func (r *Registry) authorized(w http.ResponseWriter, req *http.Request) bool {
+	got, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if r.Token != "" && ok && subtle.ConstantTimeCompare([]byte(got), []byte(r.Token)) == 1 {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "a valid token is required to register", http.StatusUnauthorized)
+	return false
+}
+
+// RegistryClient talks to a registry over its HTTP API
+type RegistryClient struct {
+	BaseURL string
+	// Token is sent as a bearer token when registering
+	Token  string
+	Client *http.Client
+}
+
+// NewRegistryClient creates a client for the registry at baseURL
+func NewRegistryClient(baseURL string) *RegistryClient {
+	return &RegistryClient{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Register adds the agent to the registry, or refreshes it
+func (c *RegistryClient) Register(agent Agent) error {
+	body, err := json.Marshal(agent)
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodPut, "/agents/"+url.PathEscape(agent.Name), body, nil)
+}
+
+// Deregister removes the agent from the registry
+func (c *RegistryClient) Deregister(name string) error {
+	return c.do(http.MethodDelete, "/agents/"+url.PathEscape(name), nil, nil)
+}
+
+// Agents lists the live agents
+func (c *RegistryClient) Agents() ([]Agent, error) {
+	var agents []Agent
+	err := c.do(http.MethodGet, "/agents", nil, &agents)
+	return agents, err
+}
+
+func (c *RegistryClient) do(method, path string, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, c.BaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("registry: %s %s: %s %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Announce registers the agent every interval until ctx is done, then
+// deregisters it. Failures are logged and retried at the next interval.
+func Announce(ctx context.Context, c *RegistryClient, agent Agent, interval time.Duration) {
+	registered, failing := false, false
+	for {
+		if err := c.Register(agent); err != nil {
+			// Warn once, not at every interval while the registry is down
+			if !failing {
+				logger.Log.Warn("Failed to register with " + c.BaseURL + ": " + err.Error())
+			}
+			failing = true
+		} else {
+			if !registered || failing {
+				logger.Log.Info(fmt.Sprintf("Registered as %s with %s", agent.Name, c.BaseURL))
+			}
+			registered, failing = true, false
+		}
+
+		select {
+		case <-ctx.Done():
+			if err := c.Deregister(agent.Name); err != nil {
+				logger.Log.Warn("Failed to deregister from " + c.BaseURL + ": " + err.Error())
+			}
+			return
+		case <-time.After(interval):
+		}
+	}
+}
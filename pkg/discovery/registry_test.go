@@ -0,0 +1,131 @@
+package discovery
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/velocity-trinity/core/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// testRegistry serves a registry with the token "secret"
+func testRegistry(t *testing.T, ttl time.Duration) (*Registry, *httptest.Server) {
+	t.Helper()
+	logger.Log = zap.NewNop()
+	r := NewRegistry(ttl)
+	r.Token = "secret"
+	srv := httptest.NewServer(r.Handler())
+	t.Cleanup(srv.Close)
+	return r, srv
+}
+
+func TestRegistryExpiresAgents(t *testing.T) {
+	r, srv := testRegistry(t, 50*time.Millisecond)
+	client := NewRegistryClient(srv.URL)
+	client.Token = "secret"
+
+	if err := client.Register(Agent{Name: "web", Addr: ":7000"}); err != nil {
+		t.Fatal(err)
+	}
+	agents, err := client.Agents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != 1 || agents[0].Name != "web" {
+		t.Fatalf("Agents = %v, want web", agents)
+	}
+	// The registry fills in the host the agent registered from
+	if !strings.HasPrefix(agents[0].Addr, "127.0.0.1:") {
+		t.Errorf("Addr = %q, want the loopback host", agents[0].Addr)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if agents := r.Agents(); len(agents) != 0 {
+		t.Errorf("Agents after the TTL = %v, want none", agents)
+	}
+}
+
+func TestRegistryAuth(t *testing.T) {
+	_, srv := testRegistry(t, time.Minute)
+	body := `{"name":"web","addr":":7000"}`
+	tests := []struct {
+		name   string
+		method string
+		auth   string
+		want   int
+	}{
+		{name: "no token", method: http.MethodPut, want: http.StatusUnauthorized},
+		{name: "wrong token", method: http.MethodPut, auth: "Bearer nope", want: http.StatusUnauthorized},
+		{name: "not bearer", method: http.MethodPut, auth: "secret", want: http.StatusUnauthorized},
+		{name: "register", method: http.MethodPut, auth: "Bearer secret", want: http.StatusNoContent},
+		{name: "delete without token", method: http.MethodDelete, want: http.StatusUnauthorized},
+		{name: "delete", method: http.MethodDelete, auth: "Bearer secret", want: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, srv.URL+"/agents/web", strings.NewReader(body))
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryWithoutTokenIsReadOnly(t *testing.T) {
+	r, srv := testRegistry(t, time.Minute)
+	r.Token = ""
+	client := NewRegistryClient(srv.URL)
+
+	if err := client.Register(Agent{Name: "web", Addr: ":7000"}); err == nil {
+		t.Error("Register succeeded on a registry without a token")
+	}
+	if _, err := client.Agents(); err != nil {
+		t.Errorf("Agents: %v", err)
+	}
+}
+
+func TestRegistryRejects(t *testing.T) {
+	r, srv := testRegistry(t, time.Minute)
+	r.MaxAgents = 1
+	client := NewRegistryClient(srv.URL)
+	client.Token = "secret"
+	if err := client.Register(Agent{Name: "web", Addr: ":7000"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		path  string
+		agent Agent
+		want  string
+	}{
+		{name: "full", path: "db", agent: Agent{Name: "db", Addr: ":7000"}, want: "507"},
+		{name: "name mismatch", path: "other", agent: Agent{Name: "web", Addr: ":7000"}, want: "doesn't match"},
+		{name: "invalid", path: "web", agent: Agent{Name: "web", Addr: "nope"}, want: "invalid agent address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"name":"` + tt.agent.Name + `","addr":"` + tt.agent.Addr + `"}`
+			err := client.do(http.MethodPut, "/agents/"+tt.path, []byte(body), nil)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+
+	// Refreshing a known agent still works when the registry is full
+	if err := client.Register(Agent{Name: "web", Addr: ":7001"}); err != nil {
+		t.Errorf("refreshing a known agent: %v", err)
+	}
+}
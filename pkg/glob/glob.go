@@ -0,0 +1,71 @@
+package glob
+
+import (
+	"path"
+	"strings"
+)
+
+// Match reports whether a slash-separated path matches pattern.
+// Patterns use path.Match syntax, plus "**" which matches any number of
+// directories (including none). A pattern without a slash matches the base
+// name at any depth, so "*.py" matches "a/b/c.py".
+func Match(pattern, name string) bool {
+	pattern = strings.TrimPrefix(pattern, "./")
+	name = strings.TrimPrefix(name, "./")
+
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(name))
+		return ok
+	}
+	return matchParts(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// MatchAny reports whether name matches at least one of the patterns
+func MatchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if Match(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Valid reports whether pattern is well-formed
+func Valid(pattern string) bool {
+	for _, part := range strings.Split(pattern, "/") {
+		if part == "**" {
+			continue
+		}
+		if _, err := path.Match(part, ""); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func matchParts(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			if len(rest) == 0 {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchParts(rest, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
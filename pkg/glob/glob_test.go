@@ -0,0 +1,100 @@
+package glob
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		// Without a slash the pattern matches the base name at any depth
+		{"*.py", "c.py", true},
+		{"*.py", "a/b/c.py", true},
+		{"*.py", "a/b/c.pyc", false},
+		{"test_*.py", "tests/test_app.py", true},
+		{"package.json", "web/package.json", true},
+		{"requirements*.txt", "requirements-dev.txt", true},
+
+		// With a slash it matches the whole path
+		{"src/*.ts", "src/app.ts", true},
+		{"src/*.ts", "src/lib/app.ts", false},
+		{"src/*.ts", "web/src/app.ts", false},
+		{"./src/*.ts", "src/app.ts", true},
+		{"src/*.ts", "./src/app.ts", true},
+
+		// ** matches any number of directories, including none
+		{"**/*.test.ts", "app.test.ts", true},
+		{"**/*.test.ts", "a/b/app.test.ts", true},
+		{"src/**/*.ts", "src/app.ts", true},
+		{"src/**/*.ts", "src/a/b/app.ts", true},
+		{"src/**/*.ts", "lib/a/app.ts", false},
+		{"dist/**", "dist", true},
+		{"dist/**", "dist/a/b.js", true},
+		{"dist/**", "distro/a.js", false},
+		{"a/**/b/**/c", "a/x/b/y/z/c", true},
+		{"a/**/b/**/c", "a/x/y/c", false},
+
+		// path.Match syntax within a segment
+		{"src/?.ts", "src/a.ts", true},
+		{"src/?.ts", "src/ab.ts", false},
+		{"src/[ab].ts", "src/b.ts", true},
+		{"src/[^ab].ts", "src/b.ts", false},
+		{"src/[^ab].ts", "src/c.ts", true},
+		{"*/*.ts", "src/a.ts", true},
+		{"*/*.ts", "a.ts", false},
+
+		{"[", "[", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.name, func(t *testing.T) {
+			if got := Match(tt.pattern, tt.name); got != tt.want {
+				t.Errorf("Match(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchAny(t *testing.T) {
+	patterns := []string{"dist/**", "*.min.js"}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"dist/app.js", true},
+		{"web/app.min.js", true},
+		{"web/app.js", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MatchAny(patterns, tt.name); got != tt.want {
+				t.Errorf("MatchAny(%v, %q) = %v, want %v", patterns, tt.name, got, tt.want)
+			}
+		})
+	}
+	if MatchAny(nil, "a") {
+		t.Error("MatchAny(nil) = true, want false")
+	}
+}
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    bool
+	}{
+		{"*.py", true},
+		{"src/**/*.ts", true},
+		{"**", true},
+		{"[a-z]*.go", true},
+		{"[", false},
+		{"src/[a-/x", false},
+		{`a\`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			if got := Valid(tt.pattern); got != tt.want {
+				t.Errorf("Valid(%q) = %v, want %v", tt.pattern, got, tt.want)
+			}
+		})
+	}
+}
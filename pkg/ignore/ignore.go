@@ -0,0 +1,158 @@
+package ignore
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/velocity-trinity/core/pkg/glob"
+)
+
+// Files are the ignore files read in every directory, in order of precedence (last wins)
+var Files = []string{".gitignore", ".livepatchignore"}
+
+// Matcher answers whether a path is excluded by .gitignore-style rules.
+// Paths are slash-separated and relative to the directory the matcher was created for.
+type Matcher struct {
+	rules  []rule
+	loaded map[string]bool
+}
+
+type rule struct {
+	// base is the directory holding the ignore file ("." for the root)
+	base     string
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// New returns a matcher with the rules from the ignore files in root.
+// .git is always ignored.
+func New(root string) (*Matcher, error) {
+	m := &Matcher{
+		rules:  []rule{{base: ".", pattern: ".git", dirOnly: true}},
+		loaded: make(map[string]bool),
+	}
+	if err := m.Load(root, "."); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Load adds the rules from the ignore files in dir (relative to root).
+// Rules from a nested directory only apply below it. Missing files are fine,
+// and a directory that was already loaded is skipped.
+func (m *Matcher) Load(root, dir string) error {
+	dir = path.Clean(dir)
+	if m.loaded[dir] {
+		return nil
+	}
+	m.loaded[dir] = true
+
+	for _, name := range Files {
+		f, err := os.Open(filepath.Join(root, filepath.FromSlash(dir), name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			m.Add(dir, scanner.Text())
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add parses one ignore-file line found in dir
+func (m *Matcher) Add(dir, line string) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+
+	r := rule{base: path.Clean(dir)}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	}
+	// "\#foo" and "\!foo" escape a leading special character
+	line = strings.TrimPrefix(line, "\\")
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// A slash anywhere but the end ties the pattern to the ignore file's directory
+	if strings.Contains(line, "/") {
+		r.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return
+	}
+	r.pattern = line
+	m.rules = append(m.rules, r)
+}
+
+// Ignored reports whether rel is excluded, either directly or because one of
+// its parent directories is
+func (m *Matcher) Ignored(rel string, isDir bool) bool {
+	rel = path.Clean(strings.TrimPrefix(rel, "./"))
+	if rel == "." {
+		return false
+	}
+
+	parts := strings.Split(rel, "/")
+	for i := 1; i < len(parts); i++ {
+		if m.match(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return m.match(rel, isDir)
+}
+
+// match applies the rules to a single path; the last matching rule decides
+func (m *Matcher) match(rel string, isDir bool) bool {
+	ignored := false
+	for _, r := range m.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		sub, ok := below(rel, r.base)
+		if !ok {
+			continue
+		}
+		var matched bool
+		if r.anchored && !strings.Contains(r.pattern, "/") {
+			// "/name" only matches directly in base; glob.Match would try every depth
+			matched, _ = path.Match(r.pattern, sub)
+		} else if r.anchored {
+			matched = glob.Match(r.pattern, sub)
+		} else {
+			matched = glob.Match(r.pattern, path.Base(sub))
+		}
+		if matched {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// below returns rel relative to dir if it is inside dir
+func below(rel, dir string) (string, bool) {
+	if dir == "." {
+		return rel, true
+	}
+	if strings.HasPrefix(rel, dir+"/") {
+		return strings.TrimPrefix(rel, dir+"/"), true
+	}
+	return "", false
+}
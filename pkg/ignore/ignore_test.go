@@ -0,0 +1,118 @@
+package ignore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnored(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules map[string][]string
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"git dir", nil, ".git", true, true},
+		{"inside git dir", nil, ".git/config", false, true},
+		{"root", map[string][]string{".": {"*"}}, ".", true, false},
+		{"name anywhere", map[string][]string{".": {"*.log"}}, "a/b/c.log", false, true},
+		{"no match", map[string][]string{".": {"*.log"}}, "a/b/c.txt", false, false},
+		{"comment", map[string][]string{".": {"# c.txt"}}, "# c.txt", false, false},
+		{"escaped hash", map[string][]string{".": {`\#c.txt`}}, "#c.txt", false, true},
+		{"trailing spaces", map[string][]string{".": {"c.txt  "}}, "c.txt", false, true},
+
+		{"negation", map[string][]string{".": {"*.log", "!keep.log"}}, "keep.log", false, false},
+		{"negation keeps others", map[string][]string{".": {"*.log", "!keep.log"}}, "drop.log", false, true},
+		{"last rule wins", map[string][]string{".": {"!keep.log", "*.log"}}, "keep.log", false, true},
+		{"negation cannot reach into ignored dir", map[string][]string{".": {"build/", "!build/keep"}}, "build/keep", false, true},
+		{"escaped bang", map[string][]string{".": {`\!x`}}, "!x", false, true},
+
+		{"dir only matches dir", map[string][]string{".": {"out/"}}, "out", true, true},
+		{"dir only skips file", map[string][]string{".": {"out/"}}, "out", false, false},
+		{"dir only covers contents", map[string][]string{".": {"out/"}}, "a/out/b.txt", false, true},
+
+		{"anchored at root", map[string][]string{".": {"/c.txt"}}, "c.txt", false, true},
+		{"anchored not below", map[string][]string{".": {"/c.txt"}}, "a/c.txt", false, false},
+		{"middle slash anchors", map[string][]string{".": {"a/c.txt"}}, "x/a/c.txt", false, false},
+		{"double star", map[string][]string{".": {"a/**/c.txt"}}, "a/b/d/c.txt", false, true},
+
+		{"nested applies below", map[string][]string{"sub": {"*.tmp"}}, "sub/x/y.tmp", false, true},
+		{"nested not outside", map[string][]string{"sub": {"*.tmp"}}, "y.tmp", false, false},
+		{"nested not in sibling", map[string][]string{"sub": {"*.tmp"}}, "subway/y.tmp", false, false},
+		{"nested anchored to its dir", map[string][]string{"sub": {"/y.tmp"}}, "sub/y.tmp", false, true},
+		{"nested anchored not deeper", map[string][]string{"sub": {"/y.tmp"}}, "sub/x/y.tmp", false, false},
+		{"nested negation overrides root", map[string][]string{".": {"*.tmp"}, "sub": {"!y.tmp"}}, "sub/y.tmp", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Matcher{rules: []rule{{base: ".", pattern: ".git", dirOnly: true}}}
+			// the root's rules come first, as New and Load would add them
+			for _, dir := range []string{".", "sub"} {
+				for _, line := range tt.rules[dir] {
+					m.Add(dir, line)
+				}
+			}
+			if got := m.Ignored(tt.path, tt.isDir); got != tt.want {
+				t.Errorf("Ignored(%q, %v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		".gitignore":          "*.log\nbuild/\n",
+		".livepatchignore":    "!keep.log\n",
+		"sub/.gitignore":      "/local.txt\n",
+		"sub/deep/.gitignore": "",
+	}
+	for name, content := range files {
+		full := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := New(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Ignored("sub/local.txt", false) {
+		t.Error("nested rules applied before the directory was loaded")
+	}
+	for _, dir := range []string{"sub", "sub", "missing"} {
+		if err := m.Load(root, dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"a.log", false, true},
+		// .livepatchignore is read after .gitignore and takes precedence
+		{"keep.log", false, false},
+		{"build", true, true},
+		{"sub/local.txt", false, true},
+		{"local.txt", false, false},
+		{"sub/deep/local.txt", false, false},
+	}
+	for _, tt := range tests {
+		if got := m.Ignored(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("Ignored(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	// loading the same directory twice must not duplicate its rules
+	if len(m.rules) != 5 {
+		t.Errorf("%d rules loaded, want 5", len(m.rules))
+	}
+}
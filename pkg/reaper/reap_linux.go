@@ -0,0 +1,83 @@
+package reaper
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/velocity-trinity/core/pkg/logger"
+)
+
+// ReapOrphans reaps orphaned processes whenever a child exits, if the agent
+// is PID 1. Anywhere else orphans go to init, and it does nothing.
+func ReapOrphans() {
+	if os.Getpid() != 1 {
+		return
+	}
+	children := make(chan os.Signal, 1)
+	signal.Notify(children, syscall.SIGCHLD)
+	go func() {
+		// Signals that arrive together are delivered once, so each pass reaps every zombie
+		for range children {
+			reap()
+		}
+	}()
+}
+
+// reap waits for every exited child that isn't a command of the agent's own.
+// Wait4(-1) would also reap those, out from under exec.Cmd.Wait, so zombies
+// are found in /proc and waited for one by one.
+func reap() {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, pid := range zombies() {
+		if owned[pid] {
+			continue
+		}
+		var status syscall.WaitStatus
+		if reaped, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); err == nil && reaped == pid {
+			logger.Log.Debug(fmt.Sprintf("Reaped orphaned process %d (exit status %d)", pid, status.ExitStatus()))
+		}
+	}
+}
+
+// zombies lists the agent's children that have exited and not been waited for
+func zombies() []int {
+	paths, _ := filepath.Glob("/proc/[0-9]*/stat")
+	self := os.Getpid()
+	var pids []int
+	for _, path := range paths {
+		stat, err := os.ReadFile(path)
+		if err != nil {
+			// It was reaped meanwhile
+			continue
+		}
+		if state, ppid, ok := parseStat(stat); ok && state == 'Z' && ppid == self {
+			pid, _ := strconv.Atoi(filepath.Base(filepath.Dir(path)))
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// parseStat reads the state and parent PID from /proc/<pid>/stat:
+// "pid (comm) state ppid ...". comm may itself contain spaces and parentheses.
+func parseStat(stat []byte) (byte, int, bool) {
+	end := bytes.LastIndexByte(stat, ')')
+	if end < 0 {
+		return 0, 0, false
+	}
+	fields := bytes.Fields(stat[end+1:])
+	if len(fields) < 2 || len(fields[0]) != 1 {
+		return 0, 0, false
+	}
+	ppid, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return 0, 0, false
+	}
+	return fields[0][0], ppid, true
+}
@@ -0,0 +1,65 @@
+package reaper
+
+import (
+	"os/exec"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/velocity-trinity/core/pkg/logger"
+	"go.uber.org/zap"
+)
+
+func TestParseStat(t *testing.T) {
+	tests := []struct {
+		stat  string
+		state byte
+		ppid  int
+		ok    bool
+	}{
+		{"42 (sh) Z 1 42 42 0 -1", 'Z', 1, true},
+		{"42 (my (odd) name) S 7 42 42 0 -1", 'S', 7, true},
+		{"42 (sh", 0, 0, false},
+		{"42 (sh) Z", 0, 0, false},
+	}
+	for _, tt := range tests {
+		state, ppid, ok := parseStat([]byte(tt.stat))
+		if state != tt.state || ppid != tt.ppid || ok != tt.ok {
+			t.Errorf("parseStat(%q) = %c, %d, %v; want %c, %d, %v", tt.stat, state, ppid, ok, tt.state, tt.ppid, tt.ok)
+		}
+	}
+}
+
+func TestReapLeavesOwnedCommands(t *testing.T) {
+	logger.Log = zap.NewNop()
+
+	ours := exec.Command("true")
+	if err := Start(ours); err != nil {
+		t.Fatal(err)
+	}
+	// Started behind the reaper's back, like an orphan it inherits
+	orphan := exec.Command("true")
+	if err := orphan.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		found := zombies()
+		if slices.Contains(found, ours.Process.Pid) && slices.Contains(found, orphan.Process.Pid) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("zombies = %v, want %d and %d", found, ours.Process.Pid, orphan.Process.Pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	reap()
+	if err := Wait(ours); err != nil {
+		t.Errorf("Wait = %v; the reaper took the exit status of a command it should leave alone", err)
+	}
+	if err := orphan.Wait(); err == nil {
+		t.Error("the orphan wasn't reaped")
+	}
+}
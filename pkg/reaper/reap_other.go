@@ -0,0 +1,6 @@
+//go:build !linux
+
+package reaper
+
+// ReapOrphans does nothing outside Linux, where the agent isn't run as a container's PID 1
+func ReapOrphans() {}
@@ -0,0 +1,57 @@
+// Package reaper reaps orphaned processes when the live-patch agent is a
+// container's PID 1, which inherits every process whose parent exits first.
+//
+// Processes the agent starts itself are reaped by exec.Cmd.Wait. The reaper
+// must not take their exit status first, so they are started and waited for
+// through this package, which keeps a list of them.
+package reaper
+
+import (
+	"bytes"
+	"os/exec"
+	"sync"
+)
+
+var (
+	// mu is held while starting a command and while reaping, so a command that
+	// exits at once is on the list before the reaper can see it
+	mu    sync.Mutex
+	owned = make(map[int]bool)
+)
+
+// Start starts cmd and leaves it for Wait to reap
+func Start(cmd *exec.Cmd) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	owned[cmd.Process.Pid] = true
+	return nil
+}
+
+// Wait waits for a command started with Start
+func Wait(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	mu.Lock()
+	delete(owned, cmd.Process.Pid)
+	mu.Unlock()
+	return err
+}
+
+// Run is exec.Cmd.Run for a command the reaper leaves alone
+func Run(cmd *exec.Cmd) error {
+	if err := Start(cmd); err != nil {
+		return err
+	}
+	return Wait(cmd)
+}
+
+// CombinedOutput is exec.Cmd.CombinedOutput for a command the reaper leaves alone
+func CombinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	var b bytes.Buffer
+	cmd.Stdout = &b
+	cmd.Stderr = &b
+	err := Run(cmd)
+	return b.Bytes(), err
+}
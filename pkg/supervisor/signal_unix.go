@@ -0,0 +1,43 @@
+//go:build !windows
+
+package supervisor
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// ParseSignal turns a name like "SIGHUP" or "usr2" into a signal
+func ParseSignal(name string) (os.Signal, error) {
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return nil, fmt.Errorf("unknown signal %q (use HUP, INT, QUIT, TERM, USR1 or USR2)", name)
+	}
+	return sig, nil
+}
+
+// setProcAttr puts the app in its own process group, so stopping it also stops
+// the processes it started (e.g. npm's child node process)
+func setProcAttr(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func terminate(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+}
+
+func kill(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
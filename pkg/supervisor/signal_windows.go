@@ -0,0 +1,26 @@
+//go:build windows
+
+package supervisor
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// ParseSignal fails on Windows, which can't deliver signals to other processes;
+// without a reload signal the app is restarted instead
+func ParseSignal(name string) (os.Signal, error) {
+	return nil, fmt.Errorf("reload signals are not supported on Windows (got %q); leave it empty to restart the app instead", name)
+}
+
+func setProcAttr(cmd *exec.Cmd) {}
+
+// terminate can't stop a process gracefully on Windows, so it kills it
+func terminate(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+func kill(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,363 @@
+// Package supervisor runs an application process on behalf of the live-patch
+// agent, so the agent can be a container's entrypoint and reload the app after
+// a patch without killing PID 1.
+package supervisor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/velocity-trinity/core/pkg/logger"
+	"github.com/velocity-trinity/core/pkg/reaper"
+)
+
+const (
+	// DefaultStopTimeout is how long a graceful stop waits before killing the process
+	DefaultStopTimeout = 10 * time.Second
+	// DefaultMaxCrashes crashes within DefaultCrashWindow mean the app is crash-looping
+	DefaultMaxCrashes  = 5
+	DefaultCrashWindow = time.Minute
+	// DefaultMinUptime is how long the app must stay up after a (re)start or reload to count as healthy
+	DefaultMinUptime = 2 * time.Second
+
+	maxBackoff = 30 * time.Second
+)
+
+// baseBackoff is the delay before restarting after the first crash; it doubles with each further crash
+var baseBackoff = time.Second
+
+// Supervisor starts a command, restarts it when it crashes and reloads it on
+// request. After MaxCrashes crashes within CrashWindow it stops restarting the
+// process until the next Reload or Restart (usually the next patch).
+type Supervisor struct {
+	Command []string
+	Dir     string
+	Env     []string
+
+	// ReloadSignal is sent on Reload; nil means Reload stops and starts the process
+	ReloadSignal os.Signal
+	StopTimeout  time.Duration
+
+	MaxCrashes  int
+	CrashWindow time.Duration
+	MinUptime   time.Duration
+
+	// Stdout and Stderr receive the process output (default: the agent's)
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// opMu serializes Reload, Restart and Stop
+	opMu sync.Mutex
+
+	mu        sync.Mutex
+	cmd       *exec.Cmd
+	exited    chan struct{}
+	started   time.Time
+	changed   time.Time
+	stopping  bool
+	closed    bool
+	restarts  int
+	reloads   int
+	crashes   []time.Time
+	crashLoop bool
+	lastExit  string
+	// pending is the timer that restarts the process after a crash
+	pending *time.Timer
+}
+
+// Status describes the supervised process
+type Status struct {
+	Command   []string
+	Running   bool
+	PID       int
+	Started   time.Time
+	Restarts  int
+	Reloads   int
+	Crashes   int
+	CrashLoop bool
+	LastExit  string
+}
+
+// Start starts the process
+func (s *Supervisor) Start() error {
+	if len(s.Command) == 0 {
+		return errors.New("supervisor: no command to run")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.start()
+}
+
+// start launches the command. Caller must hold s.mu.
+func (s *Supervisor) start() error {
+	cmd := exec.Command(s.Command[0], s.Command[1:]...)
+	cmd.Dir = s.Dir
+	cmd.Env = append(os.Environ(), s.Env...)
+	cmd.Stdout = s.Stdout
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	cmd.Stderr = s.Stderr
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	setProcAttr(cmd)
+
+	if err := reaper.Start(cmd); err != nil {
+		return fmt.Errorf("supervisor: failed to start %s: %v", s.Command[0], err)
+	}
+	logger.Log.Info(fmt.Sprintf("Started %s (pid %d)", strings.Join(s.Command, " "), cmd.Process.Pid))
+
+	exited := make(chan struct{})
+	s.cmd = cmd
+	s.exited = exited
+	s.started = time.Now()
+	s.changed = s.started
+	go s.wait(cmd, exited)
+	return nil
+}
+
+// wait reaps the process and restarts it if it exited on its own
+func (s *Supervisor) wait(cmd *exec.Cmd, exited chan struct{}) {
+	err := reaper.Wait(cmd)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(exited)
+	if s.cmd != cmd {
+		return
+	}
+	s.cmd = nil
+	s.lastExit = describeExit(cmd, err)
+	if s.stopping || s.closed {
+		logger.Log.Info("Application stopped: " + s.lastExit)
+		return
+	}
+
+	now := time.Now()
+	s.crashes = append(s.crashes, now)
+	window := s.CrashWindow
+	if window <= 0 {
+		window = DefaultCrashWindow
+	}
+	for len(s.crashes) > 0 && now.Sub(s.crashes[0]) > window {
+		s.crashes = s.crashes[1:]
+	}
+	maxCrashes := s.MaxCrashes
+	if maxCrashes <= 0 {
+		maxCrashes = DefaultMaxCrashes
+	}
+	if len(s.crashes) >= maxCrashes {
+		s.crashLoop = true
+		logger.Log.Error(fmt.Sprintf("Application is crash-looping (%d crashes in %s); not restarting until the next patch. Last exit: %s", len(s.crashes), window, s.lastExit))
+		return
+	}
+
+	backoff := backoffFor(len(s.crashes))
+	logger.Log.Warn(fmt.Sprintf("Application exited (%s); restarting in %s", s.lastExit, backoff))
+	var timer *time.Timer
+	timer = time.AfterFunc(backoff, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// A Restart or Stop since then has cancelled this restart
+		if s.pending != timer {
+			return
+		}
+		s.pending = nil
+		if s.cmd != nil || s.stopping || s.closed || s.crashLoop {
+			return
+		}
+		if err := s.start(); err != nil {
+			logger.Log.Error(err.Error())
+			return
+		}
+		s.restarts++
+	})
+	s.pending = timer
+}
+
+// backoffFor is the delay before restarting after the given number of recent crashes
+func backoffFor(crashes int) time.Duration {
+	if crashes < 1 {
+		crashes = 1
+	}
+	backoff := baseBackoff
+	for i := 1; i < crashes && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxBackoff)
+}
+
+// cancelRestart cancels a pending restart after a crash. Caller must hold s.mu.
+func (s *Supervisor) cancelRestart() {
+	if s.pending != nil {
+		s.pending.Stop()
+		s.pending = nil
+	}
+}
+
+// Reload sends ReloadSignal to the running process, or restarts it if there
+// is no reload signal or the process isn't running
+func (s *Supervisor) Reload() error {
+	s.opMu.Lock()
+	defer s.opMu.Unlock()
+
+	s.mu.Lock()
+	if s.ReloadSignal != nil && s.cmd != nil {
+		defer s.mu.Unlock()
+		if err := s.cmd.Process.Signal(s.ReloadSignal); err != nil {
+			return fmt.Errorf("supervisor: failed to send %v: %v", s.ReloadSignal, err)
+		}
+		s.reloads++
+		s.changed = time.Now()
+		logger.Log.Info(fmt.Sprintf("Sent %v to pid %d", s.ReloadSignal, s.cmd.Process.Pid))
+		return nil
+	}
+	s.mu.Unlock()
+	return s.restart()
+}
+
+// Restart gracefully stops the process and starts it again. It also clears a
+// crash loop, giving the (presumably fixed) app another chance.
+func (s *Supervisor) Restart() error {
+	s.opMu.Lock()
+	defer s.opMu.Unlock()
+	return s.restart()
+}
+
+func (s *Supervisor) restart() error {
+	for {
+		s.stop()
+		s.mu.Lock()
+		s.cancelRestart()
+		// The crash backoff may have started the process again since stop returned
+		if s.cmd == nil {
+			break
+		}
+		s.mu.Unlock()
+	}
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errors.New("supervisor: stopped")
+	}
+	s.crashes = nil
+	s.crashLoop = false
+	if err := s.start(); err != nil {
+		return err
+	}
+	s.restarts++
+	return nil
+}
+
+// Stop gracefully stops the process for good
+func (s *Supervisor) Stop() {
+	s.opMu.Lock()
+	defer s.opMu.Unlock()
+
+	s.mu.Lock()
+	s.closed = true
+	s.cancelRestart()
+	s.mu.Unlock()
+	s.stop()
+}
+
+// stop terminates the process, killing it if it doesn't exit within StopTimeout.
+// Caller must hold s.opMu.
+func (s *Supervisor) stop() {
+	s.mu.Lock()
+	cmd, exited := s.cmd, s.exited
+	if cmd == nil {
+		s.mu.Unlock()
+		return
+	}
+	s.stopping = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.stopping = false
+		s.mu.Unlock()
+	}()
+
+	timeout := s.StopTimeout
+	if timeout <= 0 {
+		timeout = DefaultStopTimeout
+	}
+	if err := terminate(cmd); err != nil {
+		kill(cmd)
+	}
+	select {
+	case <-exited:
+		return
+	case <-time.After(timeout):
+	}
+	logger.Log.Warn(fmt.Sprintf("Application did not stop within %s; killing it", timeout))
+	kill(cmd)
+	<-exited
+}
+
+// Signal forwards a signal to the process, e.g. when the agent itself is asked to stop
+func (s *Supervisor) Signal(sig os.Signal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cmd == nil {
+		return errors.New("supervisor: application is not running")
+	}
+	return s.cmd.Process.Signal(sig)
+}
+
+// Healthy returns an error unless the process has been running for MinUptime
+// since it was last started or reloaded
+func (s *Supervisor) Healthy() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	minUptime := s.MinUptime
+	if minUptime <= 0 {
+		minUptime = DefaultMinUptime
+	}
+	switch {
+	case s.crashLoop:
+		return fmt.Errorf("application is crash-looping (last exit: %s)", s.lastExit)
+	case s.cmd == nil:
+		return fmt.Errorf("application is not running (last exit: %s)", s.lastExit)
+	case time.Since(s.changed) < minUptime:
+		return fmt.Errorf("application has been up for less than %s", minUptime)
+	}
+	return nil
+}
+
+// Status reports the state of the process
+func (s *Supervisor) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := Status{
+		Command:   s.Command,
+		Running:   s.cmd != nil,
+		Restarts:  s.restarts,
+		Reloads:   s.reloads,
+		Crashes:   len(s.crashes),
+		CrashLoop: s.crashLoop,
+		LastExit:  s.lastExit,
+	}
+	if s.cmd != nil {
+		status.PID = s.cmd.Process.Pid
+		status.Started = s.started
+	}
+	return status
+}
+
+func describeExit(cmd *exec.Cmd, err error) string {
+	if cmd.ProcessState != nil {
+		return cmd.ProcessState.String()
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return "exited"
+}
@@ -0,0 +1,189 @@
+package supervisor
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/velocity-trinity/core/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// testSupervisor starts s with a short crash backoff and stops it when the test ends
+func testSupervisor(t *testing.T, backoff time.Duration, s *Supervisor) *Supervisor {
+	logger.Log = zap.NewNop()
+	saved := baseBackoff
+	baseBackoff = backoff
+	t.Cleanup(func() { baseBackoff = saved })
+
+	if s.Dir == "" {
+		s.Dir = t.TempDir()
+	}
+	s.StopTimeout = time.Second
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// waitFor polls the supervisor's status until ok accepts it
+func waitFor(t *testing.T, s *Supervisor, what string, ok func(Status) bool) Status {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := s.Status()
+		if ok(status) {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s; status %+v", what, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBackoffFor(t *testing.T) {
+	saved := baseBackoff
+	baseBackoff = time.Second
+	defer func() { baseBackoff = saved }()
+
+	tests := []struct {
+		crashes int
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{6, maxBackoff},
+		{100, maxBackoff},
+	}
+	for _, tt := range tests {
+		if got := backoffFor(tt.crashes); got != tt.want {
+			t.Errorf("backoffFor(%d) = %s, want %s", tt.crashes, got, tt.want)
+		}
+	}
+}
+
+func TestCrashLoop(t *testing.T) {
+	s := testSupervisor(t, 20*time.Millisecond, &Supervisor{Command: []string{"sh", "-c", "exit 3"}, MaxCrashes: 3})
+
+	status := waitFor(t, s, "it is crash-looping", func(st Status) bool { return st.CrashLoop })
+	if status.Crashes != 3 || status.Restarts != 2 || status.Running {
+		t.Errorf("status = %+v, want 3 crashes, 2 restarts and nothing running", status)
+	}
+	if !strings.Contains(status.LastExit, "exit status 3") {
+		t.Errorf("LastExit = %q", status.LastExit)
+	}
+	if err := s.Healthy(); err == nil || !strings.Contains(err.Error(), "crash-looping") {
+		t.Errorf("Healthy = %v", err)
+	}
+
+	// Nothing restarts it on its own any more
+	time.Sleep(10 * baseBackoff)
+	if got := s.Status(); got.Restarts != 2 {
+		t.Errorf("restarted while crash-looping: %+v", got)
+	}
+
+	// Restart gives it another chance
+	if err := s.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if status := s.Status(); status.CrashLoop || status.Restarts != 3 {
+		t.Errorf("after Restart status = %+v, want the crash loop cleared", status)
+	}
+}
+
+func TestCrashesOutsideWindowDontCount(t *testing.T) {
+	s := testSupervisor(t, 20*time.Millisecond, &Supervisor{Command: []string{"sh", "-c", "exit 1"}, MaxCrashes: 2, CrashWindow: time.Nanosecond})
+
+	waitFor(t, s, "it restarted a few times", func(st Status) bool { return st.Restarts >= 3 })
+	if status := s.Status(); status.CrashLoop || status.Crashes > 1 {
+		t.Errorf("status = %+v, want old crashes forgotten", status)
+	}
+}
+
+// TestRestartCancelsPendingRestart restarts the app while a restart after a
+// crash is pending, which must not leave a second process running
+func TestRestartCancelsPendingRestart(t *testing.T) {
+	// Crashes the first time, then keeps running
+	s := testSupervisor(t, 200*time.Millisecond, &Supervisor{
+		Command: []string{"sh", "-c", "[ -e crashed ] && exec sleep 30; touch crashed; exit 1"},
+	})
+
+	waitFor(t, s, "it crashed", func(st Status) bool { return st.Crashes == 1 && !st.Running })
+	if err := s.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	pid := s.Status().PID
+
+	time.Sleep(3 * baseBackoff)
+	status := s.Status()
+	if status.PID != pid || status.Restarts != 1 {
+		t.Errorf("status = %+v, want pid %d started once by Restart", status, pid)
+	}
+}
+
+func TestReload(t *testing.T) {
+	t.Run("with a reload signal", func(t *testing.T) {
+		dir := t.TempDir()
+		s := testSupervisor(t, 20*time.Millisecond, &Supervisor{
+			Command:      []string{"sh", "-c", "trap 'touch reloaded' HUP; while :; do sleep 0.05; done"},
+			Dir:          dir,
+			ReloadSignal: syscall.SIGHUP,
+		})
+		pid := s.Status().PID
+		// Let the shell install its trap
+		time.Sleep(100 * time.Millisecond)
+
+		if err := s.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		status := waitFor(t, s, "it reloaded", func(Status) bool {
+			matches, _ := filepath.Glob(filepath.Join(dir, "reloaded"))
+			return len(matches) == 1
+		})
+		if status.PID != pid || status.Reloads != 1 || status.Restarts != 0 {
+			t.Errorf("status = %+v, want pid %d signalled, not restarted", status, pid)
+		}
+	})
+
+	t.Run("without one", func(t *testing.T) {
+		s := testSupervisor(t, 20*time.Millisecond, &Supervisor{Command: []string{"sleep", "30"}})
+		pid := s.Status().PID
+
+		if err := s.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		status := s.Status()
+		if !status.Running || status.PID == pid || status.Reloads != 0 || status.Restarts != 1 {
+			t.Errorf("status = %+v, want a new process instead of pid %d", status, pid)
+		}
+	})
+
+	t.Run("with a reload signal but not running", func(t *testing.T) {
+		s := testSupervisor(t, 20*time.Millisecond, &Supervisor{Command: []string{"sh", "-c", "exit 1"}, MaxCrashes: 1, ReloadSignal: syscall.SIGHUP})
+		waitFor(t, s, "it is crash-looping", func(st Status) bool { return st.CrashLoop })
+
+		if err := s.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		if status := s.Status(); status.Reloads != 0 || status.Restarts != 1 {
+			t.Errorf("status = %+v, want it started instead of signalled", status)
+		}
+	})
+}
+
+func TestStopIsFinal(t *testing.T) {
+	s := testSupervisor(t, 20*time.Millisecond, &Supervisor{Command: []string{"sleep", "30"}})
+	s.Stop()
+	if status := s.Status(); status.Running {
+		t.Errorf("still running after Stop: %+v", status)
+	}
+	if err := s.Restart(); err == nil {
+		t.Error("Restart after Stop started the app")
+	}
+}
@@ -0,0 +1,239 @@
+// Package textdiff compares text line by line (Myers' algorithm) and renders
+// the differences as a unified diff, like diff -u.
+package textdiff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// maxEdits bounds the work (and memory) spent looking for a minimal diff.
+// Inputs that differ by more are shown as all of a replaced by all of b.
+const maxEdits = 2000
+
+// binarySniffLen is how much of the content IsText looks at, as in git
+const binarySniffLen = 8000
+
+// IsText reports whether data looks like text, i.e. has no NUL byte near the start
+func IsText(data []byte) bool {
+	if len(data) > binarySniffLen {
+		data = data[:binarySniffLen]
+	}
+	return bytes.IndexByte(data, 0) < 0
+}
+
+// edit is one line of an edit script: ' ' kept, '-' removed from a, '+' added from b
+type edit struct {
+	kind byte
+	line string
+}
+
+// Unified returns the differences between a and b as a unified diff with
+// context lines around each change, or "" if they are the same
+func Unified(fromName, toName string, a, b []byte, context int) string {
+	edits := diff(splitLines(a), splitLines(b))
+
+	var out strings.Builder
+	for _, h := range hunks(edits, context) {
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", h.fromRange(), h.toRange())
+		for _, e := range edits[h.start:h.end] {
+			out.WriteByte(e.kind)
+			out.WriteString(e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+	return out.String()
+}
+
+// splitLines splits text after each newline; the last line may lack one
+func splitLines(text []byte) []string {
+	var lines []string
+	for len(text) > 0 {
+		i := bytes.IndexByte(text, '\n') + 1
+		if i == 0 {
+			i = len(text)
+		}
+		lines = append(lines, string(text[:i]))
+		text = text[i:]
+	}
+	return lines
+}
+
+// diff finds a shortest edit script turning a into b
+func diff(a, b []string) []edit {
+	// Common leading and trailing lines don't need the search
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var edits []edit
+	for _, line := range a[:prefix] {
+		edits = append(edits, edit{' ', line})
+	}
+	edits = append(edits, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		edits = append(edits, edit{' ', line})
+	}
+	return edits
+}
+
+// myers is the greedy O(ND) algorithm from "An O(ND) Difference Algorithm and
+// Its Variations". trace[d] keeps the furthest x reached on diagonals -d-1..d+1
+// before step d, for walking the path back.
+func myers(a, b []string) []edit {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	var trace [][]int
+
+	for d := 0; d <= n+m; d++ {
+		if d > maxEdits {
+			return replaceAll(a, b)
+		}
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1] // down: insert from b
+			} else {
+				x = v[offset+k-1] + 1 // right: delete from a
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(trace, a, b)
+			}
+		}
+	}
+	return replaceAll(a, b)
+}
+
+func backtrack(trace [][]int, a, b []string) []edit {
+	var reversed []edit
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		at := func(k int) int { return trace[d][k+d+1] }
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			reversed = append(reversed, edit{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				reversed = append(reversed, edit{'+', b[y-1]})
+			} else {
+				reversed = append(reversed, edit{'-', a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	edits := make([]edit, len(reversed))
+	for i, e := range reversed {
+		edits[len(reversed)-1-i] = e
+	}
+	return edits
+}
+
+func replaceAll(a, b []string) []edit {
+	edits := make([]edit, 0, len(a)+len(b))
+	for _, line := range a {
+		edits = append(edits, edit{'-', line})
+	}
+	for _, line := range b {
+		edits = append(edits, edit{'+', line})
+	}
+	return edits
+}
+
+// hunk is a run of edits[start:end] shown together; fromLine and toLine are
+// the 0-based lines of a and b it starts at
+type hunk struct {
+	start, end       int
+	fromLine, toLine int
+	fromLen, toLen   int
+}
+
+func (h hunk) fromRange() string { return formatRange(h.fromLine, h.fromLen) }
+func (h hunk) toRange() string   { return formatRange(h.toLine, h.toLen) }
+
+// formatRange writes "line,count" as diff -u does: 1-based, and an empty
+// range names the line before it
+func formatRange(line, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", line)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", line+1)
+	}
+	return fmt.Sprintf("%d,%d", line+1, count)
+}
+
+// hunks groups the changes in edits, with up to context unchanged lines
+// around each; changes closer than twice that share a hunk
+func hunks(edits []edit, context int) []hunk {
+	var result []hunk
+	fromLine, toLine := 0, 0
+	var cur *hunk
+	lastChange := -1
+
+	for i, e := range edits {
+		if e.kind != ' ' {
+			if cur == nil || i-lastChange-1 > 2*context {
+				if cur != nil {
+					result = append(result, closeHunk(*cur, edits, lastChange, context))
+				}
+				start := max(i-context, 0)
+				cur = &hunk{start: start, fromLine: fromLine - (i - start), toLine: toLine - (i - start)}
+			}
+			lastChange = i
+		}
+		if e.kind != '+' {
+			fromLine++
+		}
+		if e.kind != '-' {
+			toLine++
+		}
+	}
+	if cur != nil {
+		result = append(result, closeHunk(*cur, edits, lastChange, context))
+	}
+	return result
+}
+
+// closeHunk ends the hunk context lines after its last change and counts its lines
+func closeHunk(h hunk, edits []edit, lastChange, context int) hunk {
+	h.end = min(lastChange+context+1, len(edits))
+	for _, e := range edits[h.start:h.end] {
+		if e.kind != '+' {
+			h.fromLen++
+		}
+		if e.kind != '-' {
+			h.toLen++
+		}
+	}
+	return h
+}
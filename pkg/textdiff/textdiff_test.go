@@ -0,0 +1,156 @@
+package textdiff
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// lines joins numbered lines "01\n".."n\n", replacing the ones in changed
+func lines(n int, changed map[int]string) string {
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		if line, ok := changed[i]; ok {
+			b.WriteString(line + "\n")
+		} else {
+			fmt.Fprintf(&b, "%02d\n", i)
+		}
+	}
+	return b.String()
+}
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    string
+		context int
+		want    string
+	}{
+		{"identical", "a\nb\n", "a\nb\n", 3, ""},
+		{"both empty", "", "", 3, ""},
+		{"change with context", lines(5, nil), lines(5, map[int]string{3: "X"}), 1,
+			"@@ -2,3 +2,3 @@\n 02\n-03\n+X\n 04\n"},
+		{"context clipped at edges", lines(3, nil), lines(3, map[int]string{1: "A", 3: "C"}), 3,
+			"@@ -1,3 +1,3 @@\n-01\n+A\n 02\n-03\n+C\n"},
+		{"near changes share a hunk", lines(10, nil), lines(10, map[int]string{2: "B", 4: "D"}), 1,
+			"@@ -1,5 +1,5 @@\n 01\n-02\n+B\n 03\n-04\n+D\n 05\n"},
+		{"far changes split hunks", lines(10, nil), lines(10, map[int]string{2: "B", 9: "I"}), 1,
+			"@@ -1,3 +1,3 @@\n 01\n-02\n+B\n 03\n@@ -8,3 +8,3 @@\n 08\n-09\n+I\n 10\n"},
+		{"insert without context", "1\n2\n3\n", "1\n2\nX\n3\n", 0,
+			"@@ -2,0 +3 @@\n+X\n"},
+		{"delete without context", "1\n2\n3\n", "1\n3\n", 0,
+			"@@ -2 +1,0 @@\n-2\n"},
+		{"added file", "", "a\nb\n", 3,
+			"@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"removed file", "a\nb\n", "", 3,
+			"@@ -1,2 +0,0 @@\n-a\n-b\n"},
+		{"newline added at end", "a\nb", "a\nb\n", 3,
+			"@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n"},
+		{"no newline on either side", "a\nb", "a\nc", 3,
+			"@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Unified("a/f", "b/f", []byte(tt.a), []byte(tt.b), tt.context)
+			want := tt.want
+			if want != "" {
+				want = "--- a/f\n+++ b/f\n" + want
+			}
+			if got != want {
+				t.Errorf("Unified =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestUnifiedNewFileHeader(t *testing.T) {
+	got := Unified("/dev/null", "b/f", nil, []byte("x\n"), 3)
+	if !strings.HasPrefix(got, "--- /dev/null\n+++ b/f\n@@ -0,0 +1 @@\n") {
+		t.Errorf("Unified =\n%s", got)
+	}
+}
+
+// TestDiffIsMinimal checks the edit script rebuilds both sides and changes
+// no more lines than a longest common subsequence allows
+func TestDiffIsMinimal(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := func() []string {
+		out := make([]string, rng.Intn(30))
+		for i := range out {
+			out[i] = string(rune('a'+rng.Intn(4))) + "\n"
+		}
+		return out
+	}
+	for i := 0; i < 200; i++ {
+		a, b := random(), random()
+		edits := diff(a, b)
+
+		var fromA, fromB []string
+		changes := 0
+		for _, e := range edits {
+			if e.kind != '+' {
+				fromA = append(fromA, e.line)
+			}
+			if e.kind != '-' {
+				fromB = append(fromB, e.line)
+			}
+			if e.kind != ' ' {
+				changes++
+			}
+		}
+		if strings.Join(fromA, "") != strings.Join(a, "") || strings.Join(fromB, "") != strings.Join(b, "") {
+			t.Fatalf("edits don't rebuild the inputs:\na=%q\nb=%q", a, b)
+		}
+		if want := len(a) + len(b) - 2*lcs(a, b); changes != want {
+			t.Fatalf("%d changed lines, want %d:\na=%q\nb=%q", changes, want, a, b)
+		}
+	}
+}
+
+func lcs(a, b []string) int {
+	prev := make([]int, len(b)+1)
+	for i := range a {
+		cur := make([]int, len(b)+1)
+		for j := range b {
+			if a[i] == b[j] {
+				cur[j+1] = prev[j] + 1
+			} else {
+				cur[j+1] = max(prev[j+1], cur[j])
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func TestDiffFallsBackWhenTooDifferent(t *testing.T) {
+	var a, b []string
+	for i := 0; i <= maxEdits; i++ {
+		a = append(a, "a\n")
+		b = append(b, "b\n")
+	}
+	edits := diff(a, b)
+	if len(edits) != len(a)+len(b) || edits[0].kind != '-' || edits[len(edits)-1].kind != '+' {
+		t.Errorf("expected all of a replaced by all of b, got %d edits", len(edits))
+	}
+}
+
+func TestIsText(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"empty", nil, true},
+		{"text", []byte("hello\nworld\n"), true},
+		{"utf-8", []byte("héllo ✓\n"), true},
+		{"nul", []byte("PNG\x00\x01"), false},
+		{"nul past sniff length", append([]byte(strings.Repeat("a", binarySniffLen)), 0), true},
+	}
+	for _, tt := range tests {
+		if got := IsText(tt.data); got != tt.want {
+			t.Errorf("%s: IsText = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
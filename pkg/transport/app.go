@@ -0,0 +1,41 @@
+package transport
+
+import (
+	"fmt"
+
+	"github.com/velocity-trinity/core/pkg/logger"
+)
+
+// App is the RPC method that reports on, reloads or restarts the supervised application
+func (s *LivePatchServer) App(req *AppRequest, resp *AppResponse) error {
+	if s.Supervisor == nil {
+		return fmt.Errorf("this agent does not supervise an application (start it with live-patch-agent -- <command>)")
+	}
+
+	var err error
+	switch req.Action {
+	case "", AppStatus:
+	case AppReload:
+		logger.Log.Info("Reloading application on request")
+		err = s.Supervisor.Reload()
+	case AppRestart:
+		logger.Log.Info("Restarting application on request")
+		err = s.Supervisor.Restart()
+	default:
+		return fmt.Errorf("unknown app action %q", req.Action)
+	}
+	resp.Status = s.Supervisor.Status()
+	return err
+}
+
+// reloadApp reloads the supervised application after a patch, if there is one
+func (s *LivePatchServer) reloadApp() error {
+	if s.Supervisor == nil {
+		return nil
+	}
+	logger.Log.Info("Reloading application")
+	if err := s.Supervisor.Reload(); err != nil {
+		return fmt.Errorf("reload failed: %v", err)
+	}
+	return nil
+}
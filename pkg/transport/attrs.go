@@ -0,0 +1,166 @@
+package transport
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileOwner is the numeric owner of a file on the machine it comes from
+type FileOwner struct {
+	UID int
+	GID int
+}
+
+// OwnerMap decides who owns the files the agent writes. Owners found in UIDs
+// and GIDs are translated; everything else gets UID and GID, where -1 keeps
+// the agent's own user or group.
+type OwnerMap struct {
+	UID  int
+	GID  int
+	UIDs map[int]int
+	GIDs map[int]int
+}
+
+// ParseOwnerMap builds an OwnerMap from a default "UID:GID" (either may be
+// empty) and "FROM=TO" translations of client UIDs and GIDs
+func ParseOwnerMap(chown string, uids, gids []string) (*OwnerMap, error) {
+	m := &OwnerMap{UID: -1, GID: -1, UIDs: make(map[int]int), GIDs: make(map[int]int)}
+	if chown != "" {
+		uid, gid, _ := strings.Cut(chown, ":")
+		var err error
+		if m.UID, err = parseID(uid); err != nil {
+			return nil, fmt.Errorf("invalid owner %q: %v", chown, err)
+		}
+		if m.GID, err = parseID(gid); err != nil {
+			return nil, fmt.Errorf("invalid owner %q: %v", chown, err)
+		}
+	}
+	for _, mapping := range uids {
+		if err := parseMapping(m.UIDs, mapping); err != nil {
+			return nil, err
+		}
+	}
+	for _, mapping := range gids {
+		if err := parseMapping(m.GIDs, mapping); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func parseID(s string) (int, error) {
+	if s == "" {
+		return -1, nil
+	}
+	id, err := strconv.Atoi(s)
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("%q is not a numeric ID", s)
+	}
+	return id, nil
+}
+
+func parseMapping(ids map[int]int, mapping string) error {
+	from, to, _ := strings.Cut(mapping, "=")
+	fromID, fromErr := strconv.Atoi(from)
+	toID, toErr := strconv.Atoi(to)
+	if fromErr != nil || toErr != nil || fromID < 0 || toID < 0 {
+		return fmt.Errorf("invalid ID mapping %q (want FROM=TO, e.g. 1000=33)", mapping)
+	}
+	ids[fromID] = toID
+	return nil
+}
+
+// lookup returns the owner a file from the client gets on the agent; -1 means unchanged
+func (m *OwnerMap) lookup(owner *FileOwner) (int, int) {
+	if m == nil {
+		return -1, -1
+	}
+	uid, gid := m.UID, m.GID
+	if owner != nil {
+		if id, ok := m.UIDs[owner.UID]; ok {
+			uid = id
+		}
+		if id, ok := m.GIDs[owner.GID]; ok {
+			gid = id
+		}
+	}
+	return uid, gid
+}
+
+// Owner returns the owner a file owned by local on the client gets on the
+// agent, where its copy is owned by remote. It's remote if syncing the file
+// leaves the owner alone.
+func (m *OwnerMap) Owner(local *FileOwner, remote FileOwner) FileOwner {
+	uid, gid := m.lookup(local)
+	if uid == -1 {
+		uid = remote.UID
+	}
+	if gid == -1 {
+		gid = remote.GID
+	}
+	return FileOwner{UID: uid, GID: gid}
+}
+
+// setAttrs gives a staged file the client's modification time and the owner
+// the OwnerMap picks. Renaming the file into place keeps both.
+func (s *LivePatchServer) setAttrs(path string, mtime time.Time, owner *FileOwner) error {
+	if uid, gid := s.Owners.lookup(owner); uid != -1 || gid != -1 {
+		if err := s.base.Lchown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	if mtime.IsZero() {
+		return nil
+	}
+	// Chtimes follows symlinks, whose own times don't matter
+	if info, err := s.base.Lstat(path); err != nil || info.Mode()&os.ModeSymlink != 0 {
+		return err
+	}
+	return s.base.Chtimes(path, mtime, mtime)
+}
+
+// checkLink refuses a symlink at fullPath that would point outside the base
+// path (or into the agent's state), since the agent would then follow it. With
+// a policy, the link must also point into the writable subtrees, so that it
+// can't become a way into a protected one.
+func (s *LivePatchServer) checkLink(fullPath, target string) error {
+	if filepath.IsAbs(target) {
+		return fmt.Errorf("symlink %s points to the absolute path %s; only relative links can be synced", s.relPath(fullPath), target)
+	}
+	dest := filepath.Join(filepath.Dir(fullPath), target)
+	rel, err := s.base.rel(dest)
+	if err == nil {
+		// The link may lead on through other symlinks
+		err = s.base.contains(rel)
+	}
+	if err != nil || s.internal(dest) {
+		return fmt.Errorf("symlink %s points to %s, outside the base path", s.relPath(fullPath), target)
+	}
+	if s.Policy == nil || len(s.Policy.Writable) == 0 {
+		return nil
+	}
+	real, err := s.base.evalSymlinks(dest)
+	if err == nil {
+		rel, err = s.base.rel(real)
+	}
+	if err == nil {
+		err = s.Policy.CheckWritable(filepath.ToSlash(rel))
+	}
+	if err != nil {
+		return fmt.Errorf("symlink %s points to %s: %v", s.relPath(fullPath), target, err)
+	}
+	return nil
+}
+
+// writeLink creates a symlink to target next to path and returns its name
+func writeLink(dir *baseDir, path, target string) (string, error) {
+	temp := tempName(path)
+	if err := dir.Symlink(target, temp); err != nil {
+		return "", err
+	}
+	return temp, nil
+}
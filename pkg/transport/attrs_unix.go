@@ -0,0 +1,17 @@
+//go:build !windows
+
+package transport
+
+import (
+	"os"
+	"syscall"
+)
+
+// OwnerOf returns the owner of a file, or nil if the platform doesn't say
+func OwnerOf(info os.FileInfo) *FileOwner {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return &FileOwner{UID: int(stat.Uid), GID: int(stat.Gid)}
+}
@@ -0,0 +1,8 @@
+package transport
+
+import "os"
+
+// OwnerOf returns nil: Windows files have no numeric owner to carry over
+func OwnerOf(info os.FileInfo) *FileOwner {
+	return nil
+}
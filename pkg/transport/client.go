@@ -1,28 +1,139 @@
 package transport
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"strings"
+	"io/ioutil"
+	"net"
 	"net/rpc"
 	"time"
 
+	"github.com/velocity-trinity/core/pkg/delta"
 	"github.com/velocity-trinity/core/pkg/logger"
 )
 
-// LivePatchClient handles RPC connections to the agent
+// DeltaMinSize is the smallest file SyncFileDelta sends as a delta
+const DeltaMinSize = 16 * 1024
+
+// DialTimeout bounds connecting to an agent, TLS handshake included
+var DialTimeout = 10 * time.Second
+
+// LivePatchClient handles RPC connections to the agent. It speaks the
+// multiplexed protocol, or the legacy net/rpc one with agents that predate it.
 type LivePatchClient struct {
+	mux    *muxClient
 	client *rpc.Client
+
+	// Timeout bounds each call whose context has no deadline; 0 means no limit
+	Timeout time.Duration
+	// Compression is the algorithm agreed on with the agent for file content;
+	// set it to "" to send content uncompressed
+	Compression string
+	ctx     context.Context
 }
 
 // NewClient creates a new LivePatchClient
 func NewClient(addr string, tlsConfig *tls.Config) (*LivePatchClient, error) {
-	conn, err := tls.Dial("tcp", addr, tlsConfig)
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: DialTimeout}, "tcp", addr, tlsConfig)
 	if err != nil {
 		return nil, fmt.Errorf("connection error: %v", err)
 	}
 
-	client := rpc.NewClient(conn)
-	return &LivePatchClient{client: client}, nil
+	mux, err := handshake(conn)
+	if err == nil {
+		return &LivePatchClient{mux: mux, Compression: mux.compression}, nil
+	}
+	conn.Close()
+	if !errors.Is(err, errNotMultiplexed) {
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+
+	// The agent hung up on the hello, so it predates the multiplexed protocol
+	logger.Log.Debug("Agent only speaks the legacy protocol; reconnecting with net/rpc")
+	if conn, err = tls.DialWithDialer(&net.Dialer{Timeout: DialTimeout}, "tcp", addr, tlsConfig); err != nil {
+		return nil, fmt.Errorf("connection error: %v", err)
+	}
+	return &LivePatchClient{client: rpc.NewClient(conn)}, nil
+}
+
+// Protocol reports the protocol version spoken with the agent
+func (c *LivePatchClient) Protocol() int {
+	if c.mux != nil {
+		return ProtocolVersion
+	}
+	return ProtocolLegacy
+}
+
+// WithContext returns a client whose calls stop when ctx is done. With the
+// multiplexed protocol the agent is told to abandon the call as well.
+func (c *LivePatchClient) WithContext(ctx context.Context) *LivePatchClient {
+	bound := *c
+	bound.ctx = ctx
+	return &bound
+}
+
+// context returns the context for one call and its cancel function. Timeout
+// doesn't apply to streaming calls, which last as long as the command or log.
+func (c *LivePatchClient) context(streaming bool) (context.Context, context.CancelFunc) {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if _, ok := ctx.Deadline(); !ok && c.Timeout > 0 && !streaming {
+		return context.WithTimeout(ctx, c.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// ErrOutcomeUnknown means a call that changes the agent was given up on after
+// it was sent, so the change may or may not have been made
+var ErrOutcomeUnknown = errors.New("gave up waiting for the agent, which may still have applied the change (check live-patch history)")
+
+// changing lists the methods that write files, commit or restart the app
+var changing = map[string]bool{
+	"LivePatchServer.SyncFile":     true,
+	"LivePatchServer.ApplyDelta":   true,
+	"LivePatchServer.FinishUpload": true,
+	"LivePatchServer.DeleteFile":   true,
+	"LivePatchServer.Rename":       true,
+	"LivePatchServer.CommitTx":     true,
+	"LivePatchServer.Rollback":     true,
+	"LivePatchServer.App":          true,
+}
+
+// call makes one call with either protocol
+func (c *LivePatchClient) call(method string, args, reply interface{}) error {
+	ctx, cancel := c.context(false)
+	defer cancel()
+	// A call that was never sent certainly changed nothing
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var err error
+	if c.mux != nil {
+		err = c.mux.call(ctx, method, args, reply, nil)
+	} else {
+		// net/rpc can't cancel a call, but we can stop waiting for it
+		call := c.client.Go(method, args, reply, make(chan *rpc.Call, 1))
+		select {
+		case <-call.Done:
+			err = call.Error
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if changing[method] && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		return fmt.Errorf("%s: %w (%v)", strings.TrimPrefix(method, "LivePatchServer."), ErrOutcomeUnknown, err)
+	}
+	return err
 }
 
 // SyncFile syncs a local file to the remote agent
@@ -30,7 +141,9 @@ func (c *LivePatchClient) SyncFile(req *FileSyncRequest) (*FileSyncResponse, err
 	var resp FileSyncResponse
 	
 	start := time.Now()
-	err := c.client.Call("LivePatchServer.SyncFile", req, &resp)
+	sent := *req
+	sent.Content, sent.Compression = c.pack(req.RelativePath, req.Content)
+	err := c.call("LivePatchServer.SyncFile", &sent, &resp)
 	duration := time.Since(start)
 
 	if err != nil {
@@ -38,11 +151,367 @@ func (c *LivePatchClient) SyncFile(req *FileSyncRequest) (*FileSyncResponse, err
 		return nil, err
 	}
 
-	logger.Log.Info(fmt.Sprintf("Synced %s in %v", req.RelativePath, duration))
+	logger.Log.Info(fmt.Sprintf("Synced %s in %v (%s)", req.RelativePath, duration, describeTransfer(len(req.Content), len(sent.Content), sent.Compression)))
+	return &resp, nil
+}
+
+// pack compresses content from the named file if the agent agreed to a
+// compression and it's worth it, returning what to send and the algorithm used
+func (c *LivePatchClient) pack(name string, content []byte) ([]byte, string) {
+	if c.Compression == "" || !worthCompressing(name, len(content)) {
+		return content, ""
+	}
+	packed, err := compress(c.Compression, content)
+	if err != nil || len(packed) >= len(content) {
+		return content, ""
+	}
+	return packed, c.Compression
+}
+
+// describeTransfer says how many bytes were sent, before and after compression
+func describeTransfer(raw, sent int, compression string) string {
+	if compression == "" {
+		return fmt.Sprintf("%d bytes", raw)
+	}
+	return fmt.Sprintf("%d → %d bytes, %s", raw, sent, compression)
+}
+
+// SyncFileDelta syncs a file like SyncFile, but when the agent already has a
+// version of it only the changed blocks are sent. Small files, new files and
+// failed delta updates fall back to sending the whole content.
+func (c *LivePatchClient) SyncFileDelta(req *FileSyncRequest) (*FileSyncResponse, error) {
+	if len(req.Content) < DeltaMinSize {
+		return c.SyncFile(req)
+	}
+
+	start := time.Now()
+	var sig SignatureResponse
+	if err := c.call("LivePatchServer.Signature", &SignatureRequest{RelativePath: req.RelativePath}, &sig); err != nil {
+		return nil, err
+	}
+	if !sig.Exists {
+		return c.SyncFile(req)
+	}
+
+	ops := delta.Diff(&sig.Signature, req.Content)
+	literal := delta.LiteralSize(ops)
+	if literal >= len(req.Content)*9/10 {
+		// Mostly new content: the delta wouldn't save anything
+		return c.SyncFile(req)
+	}
+
+	sum := sha256.Sum256(req.Content)
+	var resp FileSyncResponse
+	err := c.call("LivePatchServer.ApplyDelta", &DeltaSyncRequest{
+		RelativePath:    req.RelativePath,
+		BlockSize:       sig.Signature.BlockSize,
+		Ops:             ops,
+		Hash:            hex.EncodeToString(sum[:]),
+		Mode:            req.Mode,
+		Timestamp:       req.Timestamp,
+		Owner:           req.Owner,
+		PostSyncCommand: req.PostSyncCommand,
+		TxID:            req.TxID,
+	}, &resp)
+	if err != nil {
+		logger.Log.Warn("Delta sync failed, sending whole file: " + err.Error())
+		return c.SyncFile(req)
+	}
+
+	logger.Log.Info(fmt.Sprintf("Synced %s in %v (sent %d of %d bytes)", req.RelativePath, time.Since(start), literal, len(req.Content)))
 	return &resp, nil
 }
 
+// UploadFile syncs a file like SyncFile without holding it in memory: it is sent
+// in chunks, each checked by the agent, and an upload of the same content that
+// was interrupted earlier continues where it stopped. req.Content is ignored.
+// Agents that predate chunked uploads get the whole file through SyncFile.
+func (c *LivePatchClient) UploadFile(path string, req *FileSyncRequest) (*FileSyncResponse, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	var begun UploadResponse
+	err = c.call("LivePatchServer.BeginUpload", &UploadRequest{
+		RelativePath: req.RelativePath,
+		Size:         info.Size(),
+		Hash:         hex.EncodeToString(h.Sum(nil)),
+		ChunkSize:    DefaultChunkSize,
+		Mode:         req.Mode,
+		Timestamp:    req.Timestamp,
+		Owner:        req.Owner,
+	}, &begun)
+	if methodMissing(err) {
+		logger.Log.Debug("Agent doesn't support chunked uploads; sending " + req.RelativePath + " whole")
+		whole := *req
+		if whole.Content, err = ioutil.ReadFile(path); err != nil {
+			return nil, err
+		}
+		return c.SyncFile(&whole)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if begun.Offset > 0 {
+		logger.Log.Info(fmt.Sprintf("Resuming upload of %s at %d of %d bytes", req.RelativePath, begun.Offset, info.Size()))
+	}
+
+	var raw, sent int
+	compression := ""
+	for offset := begun.Offset; offset < info.Size(); {
+		data, err := readChunk(f, offset, DefaultChunkSize)
+		if err != nil {
+			return nil, err
+		}
+		chunk := &ChunkRequest{UploadID: begun.UploadID, Offset: offset, Hash: sha256Hex(data)}
+		chunk.Data, chunk.Compression = c.pack(req.RelativePath, data)
+		raw += len(data)
+		sent += len(chunk.Data)
+		if chunk.Compression != "" {
+			compression = chunk.Compression
+		}
+
+		var ack ChunkResponse
+		if err := c.call("LivePatchServer.UploadChunk", chunk, &ack); err != nil {
+			return nil, fmt.Errorf("upload of %s stopped at %d of %d bytes (sync again to resume): %w", req.RelativePath, offset, info.Size(), err)
+		}
+		offset = ack.Offset
+	}
+
+	var resp FileSyncResponse
+	if err := c.call("LivePatchServer.FinishUpload", &FinishUploadRequest{UploadID: begun.UploadID, TxID: req.TxID, PostSyncCommand: req.PostSyncCommand}, &resp); err != nil {
+		return nil, err
+	}
+	logger.Log.Info(fmt.Sprintf("Uploaded %s in %v (%s)", req.RelativePath, time.Since(start), describeTransfer(raw, sent, compression)))
+	return &resp, nil
+}
+
+// readChunk reads the chunk at offset, which is shorter than size only at the end of the file
+func readChunk(f io.ReaderAt, offset int64, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	n, err := f.ReadAt(buf, offset)
+	if err == io.EOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+// BeginTx starts a transaction on the agent. Pass the ID as TxID to stage
+// syncs and deletions, then CommitTx or AbortTx.
+func (c *LivePatchClient) BeginTx() (string, error) {
+	var resp BeginTxResponse
+	if err := c.call("LivePatchServer.BeginTx", &BeginTxRequest{}, &resp); err != nil {
+		return "", err
+	}
+	return resp.TxID, nil
+}
+
+// CommitTx applies every change staged in the transaction, then runs postSyncCommand (if set)
+func (c *LivePatchClient) CommitTx(txID, postSyncCommand string) (*FileSyncResponse, error) {
+	var resp FileSyncResponse
+	if err := c.call("LivePatchServer.CommitTx", &TxRequest{TxID: txID, PostSyncCommand: postSyncCommand}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// AbortTx discards the changes staged in the transaction
+func (c *LivePatchClient) AbortTx(txID string) error {
+	var resp FileSyncResponse
+	return c.call("LivePatchServer.AbortTx", &TxRequest{TxID: txID}, &resp)
+}
+
+// Rollback undoes the latest patch on the agent, or every patch after `to` if it's non-zero
+func (c *LivePatchClient) Rollback(to int, postSyncCommand string) (*RollbackResponse, error) {
+	var resp RollbackResponse
+	if err := c.call("LivePatchServer.Rollback", &RollbackRequest{To: to, PostSyncCommand: postSyncCommand}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// History returns up to limit recent patches from the agent, newest first (0 for all)
+func (c *LivePatchClient) History(limit int) ([]Patch, error) {
+	var resp HistoryResponse
+	if err := c.call("LivePatchServer.History", &HistoryRequest{Limit: limit}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Patches, nil
+}
+
+// App reports on the application the agent supervises; action may also be AppReload or AppRestart
+func (c *LivePatchClient) App(action string) (*AppResponse, error) {
+	var resp AppResponse
+	if err := c.call("LivePatchServer.App", &AppRequest{Action: action}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Logs reads a log source once; see LogsRequest
+func (c *LivePatchClient) Logs(req *LogsRequest) (*LogsResponse, error) {
+	var resp LogsResponse
+	if err := c.call("LivePatchServer.Logs", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// FollowLogs copies a log source to out from offset on, until the deadline
+// (forever if it is zero)
+func (c *LivePatchClient) FollowLogs(source string, offset int64, deadline time.Time, out io.Writer) error {
+	if c.mux != nil {
+		ctx, cancel := c.context(true)
+		defer cancel()
+		if !deadline.IsZero() {
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+		var resp LogsResponse
+		err := c.mux.call(ctx, "LivePatchServer.FollowLogs", &LogsRequest{Source: source, Offset: offset}, &resp, func(data []byte) error {
+			_, err := out.Write(data)
+			return err
+		})
+		if errors.Is(err, context.DeadlineExceeded) && !deadline.IsZero() && !time.Now().Before(deadline) {
+			return nil
+		}
+		return err
+	}
+
+	for deadline.IsZero() || time.Now().Before(deadline) {
+		resp, err := c.Logs(&LogsRequest{Source: source, Offset: offset})
+		if err != nil {
+			return err
+		}
+		if resp.Dropped {
+			fmt.Fprintln(out, "... (older output dropped)")
+		}
+		if _, err := out.Write(resp.Output); err != nil {
+			return err
+		}
+		source, offset = resp.Source, resp.Offset
+	}
+	return nil
+}
+
+// ListFiles returns the files the agent has below a directory, and how it
+// picks the owner of synced files (nil if it leaves them alone)
+func (c *LivePatchClient) ListFiles(relativePath string) ([]RemoteFile, *OwnerMap, error) {
+	var resp ListFilesResponse
+	if err := c.call("LivePatchServer.ListFiles", &ListFilesRequest{RelativePath: relativePath}, &resp); err != nil {
+		return nil, nil, err
+	}
+	return resp.Files, resp.Owners, nil
+}
+
+// Stat describes a path on the agent. Agents that predate it return errors.ErrUnsupported.
+func (c *LivePatchClient) Stat(relativePath string) (*StatResponse, error) {
+	var resp StatResponse
+	err := c.call("LivePatchServer.Stat", &StatRequest{RelativePath: relativePath}, &resp)
+	if methodMissing(err) {
+		return nil, fmt.Errorf("%w: %v", errors.ErrUnsupported, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ReadFile returns up to limit bytes of a file on the agent (0 for MaxReadSize).
+// Agents that predate it return errors.ErrUnsupported.
+func (c *LivePatchClient) ReadFile(relativePath string, limit int64) (*ReadFileResponse, error) {
+	var resp ReadFileResponse
+	err := c.call("LivePatchServer.ReadFile", &ReadFileRequest{RelativePath: relativePath, Limit: limit}, &resp)
+	if methodMissing(err) {
+		return nil, fmt.Errorf("%w: %v", errors.ErrUnsupported, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DeleteFile removes a file on the agent, or stages the removal if txID is set
+func (c *LivePatchClient) DeleteFile(relativePath, txID string) (*FileSyncResponse, error) {
+	var resp FileSyncResponse
+	if err := c.call("LivePatchServer.DeleteFile", &DeleteFileRequest{RelativePath: relativePath, TxID: txID}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Rename moves a file or directory on the agent, staged in txID if set. With
+// agents that can't move files the error wraps errors.ErrUnsupported.
+func (c *LivePatchClient) Rename(from, to, txID string) (*FileSyncResponse, error) {
+	var resp FileSyncResponse
+	err := c.call("LivePatchServer.Rename", &RenameRequest{From: from, To: to, TxID: txID}, &resp)
+	if methodMissing(err) {
+		return nil, fmt.Errorf("%w: %v", errors.ErrUnsupported, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// methodMissing reports whether err means the agent predates the method called
+func methodMissing(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "can't find method")
+}
+
+// Exec runs a command on the agent, copying its output to out as it's produced,
+// and returns once it exits. A non-zero exit code is not an error.
+func (c *LivePatchClient) Exec(req *CommandRequest, out io.Writer) (*CommandResponse, error) {
+	if c.mux != nil {
+		// Streamed over one call; cancelling it kills the command
+		ctx, cancel := c.context(true)
+		defer cancel()
+		var resp CommandResponse
+		if err := c.mux.call(ctx, "LivePatchServer.ExecStream", req, &resp, func(data []byte) error {
+			_, err := out.Write(data)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		return &resp, nil
+	}
+
+	var started ExecResponse
+	if err := c.call("LivePatchServer.Exec", req, &started); err != nil {
+		return nil, err
+	}
+
+	offset := 0
+	for {
+		var resp ExecOutputResponse
+		if err := c.call("LivePatchServer.ExecOutput", &ExecOutputRequest{ExecID: started.ExecID, Offset: offset}, &resp); err != nil {
+			return nil, err
+		}
+		if _, err := out.Write(resp.Output); err != nil {
+			return nil, err
+		}
+		offset = resp.Offset
+		if resp.Done {
+			return &resp.Result, nil
+		}
+	}
+}
+
 // Close closes the client connection
 func (c *LivePatchClient) Close() error {
+	if c.mux != nil {
+		return c.mux.Close()
+	}
 	return c.client.Close()
 }
@@ -1,28 +1,50 @@
 package transport
 
-import "time"
+import (
+	"time"
+
+	"github.com/velocity-trinity/core/pkg/delta"
+	"github.com/velocity-trinity/core/pkg/supervisor"
+)
 
 // FileSyncRequest represents a request to sync a file
 type FileSyncRequest struct {
 	RelativePath string
 	Content      []byte
-	Mode         uint32
-	Timestamp    time.Time
+	// Mode holds the permission bits; Timestamp becomes the file's modification time
+	Mode      uint32
+	Timestamp time.Time
+	// Compression is the algorithm Content is compressed with, if any
+	Compression string
+	// LinkTarget makes the file a symlink to this slash-separated path instead
+	// of a file with Content; it must stay inside the base path
+	LinkTarget string
+	// Owner is the file's owner on the client, mapped by the agent's OwnerMap
+	Owner *FileOwner
 	
 	// PostSyncCommand: Command to execute after file sync
 	PostSyncCommand string
+
+	// TxID stages the file in a transaction instead of writing it (see BeginTx)
+	TxID string
 }
 
 // FileSyncResponse represents the result of a sync operation
 type FileSyncResponse struct {
 	Success bool
 	Message string
+	// PatchID is the patch CommitTx recorded (0 without history)
+	PatchID int
 }
 
 // CommandRequest represents a request to run a command (e.g. restart server)
 type CommandRequest struct {
 	Command []string
 	Timeout int // seconds
+	// Env adds KEY=VALUE pairs to the agent's environment
+	Env []string
+	// Dir is the working directory relative to the base path (default: the base path)
+	Dir string
 }
 
 // CommandResponse represents the result of a command execution
@@ -32,3 +54,286 @@ type CommandResponse struct {
 	Output   string
 	Error    string
 }
+
+// ExecResponse identifies a started command
+type ExecResponse struct {
+	ExecID string
+}
+
+// ExecOutputRequest asks for a command's output from Offset on
+type ExecOutputRequest struct {
+	ExecID string
+	Offset int
+}
+
+// ExecOutputResponse carries new output; Result is set once Done
+type ExecOutputResponse struct {
+	Output []byte
+	// Offset to pass to the next call
+	Offset int
+	Done   bool
+	Result CommandResponse
+}
+
+// ListFilesRequest asks for every file below a directory on the agent
+type ListFilesRequest struct {
+	// RelativePath is the directory to list, relative to the agent's base path
+	RelativePath string
+}
+
+// RemoteFile describes a file on the agent
+type RemoteFile struct {
+	RelativePath string
+	Size         int64
+	Mode         uint32
+	ModTime      time.Time
+	// Hash is the hex SHA-256 of the content; symlinks have LinkTarget instead
+	Hash       string
+	LinkTarget string
+	// Owner is only reported by agents that map owners (see OwnerMap)
+	Owner *FileOwner
+}
+
+// ListFilesResponse holds the files found on the agent
+type ListFilesResponse struct {
+	Files []RemoteFile
+	// Owners is how the agent picks the owner of synced files; nil if it leaves them alone
+	Owners *OwnerMap
+}
+
+// StatRequest asks about one path on the agent
+type StatRequest struct {
+	RelativePath string
+}
+
+// StatResponse describes the path; Exists is false if there is nothing there.
+// File.Hash is only set for regular files.
+type StatResponse struct {
+	Exists bool
+	IsDir  bool
+	File   RemoteFile
+	// Owners is as in ListFilesResponse
+	Owners *OwnerMap
+}
+
+// ReadFileRequest asks for the content of a file on the agent
+type ReadFileRequest struct {
+	RelativePath string
+	// Limit is the most content to return; 0 means MaxReadSize
+	Limit int64
+}
+
+// ReadFileResponse holds the start of the file, all of it unless Truncated
+type ReadFileResponse struct {
+	Content   []byte
+	Size      int64
+	Truncated bool
+}
+
+// DeleteFileRequest represents a request to remove a file from the agent
+type DeleteFileRequest struct {
+	RelativePath string
+
+	// TxID stages the deletion in a transaction instead of deleting right away
+	TxID string
+}
+
+// RenameRequest moves a file, symlink or directory on the agent
+type RenameRequest struct {
+	From string
+	To   string
+
+	// TxID stages the move in a transaction instead of moving right away
+	TxID string
+}
+
+// SignatureRequest asks for the block checksums of a file on the agent
+type SignatureRequest struct {
+	RelativePath string
+}
+
+// SignatureResponse holds the signature, if the agent has the file
+type SignatureResponse struct {
+	Exists    bool
+	Signature delta.Signature
+}
+
+// DeltaSyncRequest updates a file from the agent's current copy plus the changed blocks
+type DeltaSyncRequest struct {
+	RelativePath string
+	BlockSize    int
+	Ops          []delta.Op
+	// Hash is the hex SHA-256 of the rebuilt file; the agent rejects the update if it differs
+	Hash      string
+	Mode      uint32
+	Timestamp time.Time
+	Owner     *FileOwner
+
+	PostSyncCommand string
+	TxID            string
+}
+
+// BeginTxRequest starts a transaction
+type BeginTxRequest struct {
+	// Timeout is how long (in seconds) the agent keeps the transaction after
+	// its last use if it is never committed or aborted; 0 uses the agent default
+	Timeout int
+}
+
+// BeginTxResponse identifies a new transaction
+type BeginTxResponse struct {
+	TxID string
+}
+
+// TxRequest commits or aborts a transaction
+type TxRequest struct {
+	TxID string
+
+	// PostSyncCommand runs once after a successful commit
+	PostSyncCommand string
+}
+
+// Patch statuses
+const (
+	PatchApplied    = "applied"
+	PatchRolledBack = "rolled-back"
+)
+
+// Patch is one change applied by the agent (a synced file, deletion or committed
+// transaction), with what's needed to undo it
+type Patch struct {
+	ID      int
+	Time    time.Time
+	Files   []PatchFile
+	Command string
+	Status  string
+	// Reason explains why a patch was rolled back
+	Reason string
+}
+
+// PatchFile is the state of a file before a patch changed it
+type PatchFile struct {
+	RelativePath string
+	// Existed is false for files the patch created
+	Existed bool
+	Mode    uint32
+	ModTime time.Time
+	Owner   *FileOwner
+	// Object is the hash of the previous content in the agent's state dir
+	Object string
+	// LinkTarget is set (instead of Object) if the file was a symlink
+	LinkTarget string
+}
+
+// RollbackRequest undoes patches on the agent
+type RollbackRequest struct {
+	// To is the patch to go back to: every applied patch after it is undone.
+	// 0 undoes only the latest applied patch.
+	To int
+
+	// PostSyncCommand runs once after the files are restored
+	PostSyncCommand string
+}
+
+// RollbackResponse lists the patches that were undone
+type RollbackResponse struct {
+	RolledBack []int
+	Message    string
+}
+
+// HistoryRequest asks for the most recent patches
+type HistoryRequest struct {
+	Limit int
+}
+
+// HistoryResponse holds patches, newest first
+type HistoryResponse struct {
+	Patches []Patch
+}
+
+// UploadRequest starts or resumes a chunked upload of a file of Size bytes with sha256 Hash
+type UploadRequest struct {
+	RelativePath string
+	Size         int64
+	Hash         string
+	ChunkSize    int
+	Mode         uint32
+	Timestamp    time.Time
+	Owner        *FileOwner
+}
+
+// UploadResponse says where the upload continues; Offset is 0 for a new upload
+type UploadResponse struct {
+	UploadID string
+	Offset   int64
+}
+
+// ChunkRequest carries the chunk at Offset with its sha256 Hash
+type ChunkRequest struct {
+	UploadID string
+	Offset   int64
+	Data     []byte
+	// Hash is of the uncompressed data
+	Hash        string
+	Compression string
+}
+
+// ChunkResponse acknowledges a chunk; Offset is where the next one starts
+type ChunkResponse struct {
+	Offset int64
+}
+
+// FinishUploadRequest applies a complete upload, staged into TxID if set
+type FinishUploadRequest struct {
+	UploadID        string
+	TxID            string
+	PostSyncCommand string
+}
+
+// LogsRequest reads a log source from Offset on; Tail > 0 reads its last
+// Tail lines instead and a negative Offset just returns the current end
+type LogsRequest struct {
+	Source string
+	Offset int64
+	Tail   int
+}
+
+// LogsResponse holds output and the offset to continue from
+type LogsResponse struct {
+	Source  string
+	Output  []byte
+	Offset  int64
+	Dropped bool
+	Sources []string
+}
+
+// App actions
+const (
+	AppStatus  = "status"
+	AppReload  = "reload"
+	AppRestart = "restart"
+)
+
+// AppRequest asks the agent about (or to reload or restart) the application it supervises
+type AppRequest struct {
+	Action string
+}
+
+// AppResponse describes the supervised application after the action
+type AppResponse struct {
+	Status supervisor.Status
+}
+
+// InfoRequest asks the agent to describe itself
+type InfoRequest struct{}
+
+// InfoResponse is what the agent announces to discovery, plus its uptime and
+// the state of the app it supervises (nil if none)
+type InfoResponse struct {
+	Name     string
+	Labels   map[string]string
+	BasePath string
+	Version  string
+	Started  time.Time
+	App      *supervisor.Status
+}
@@ -0,0 +1,106 @@
+package transport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms, agreed on in the handshake
+const (
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+)
+
+// supportedCompression lists the algorithms this build speaks, preferred first
+var supportedCompression = []string{CompressionZstd, CompressionGzip}
+
+// minCompressSize is the smallest content worth compressing
+const minCompressSize = 512
+
+// compressedExts are file types that are already compressed, so compressing them again only costs CPU
+var compressedExts = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true, ".avif": true, ".ico": true,
+	".mp3": true, ".mp4": true, ".m4a": true, ".mov": true, ".webm": true, ".ogg": true,
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true, ".7z": true, ".rar": true, ".br": true,
+	".jar": true, ".war": true, ".whl": true, ".woff": true, ".woff2": true, ".pdf": true,
+}
+
+// zstdEncoder is shared; EncodeAll is safe for concurrent use
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+
+// pickCompression chooses the first of our algorithms the client offered, or ""
+func pickCompression(offered []string) string {
+	for _, ours := range supportedCompression {
+		for _, theirs := range offered {
+			if ours == theirs {
+				return ours
+			}
+		}
+	}
+	return ""
+}
+
+// worthCompressing reports whether content from the named file is likely to shrink
+func worthCompressing(name string, size int) bool {
+	return size >= minCompressSize && !compressedExts[strings.ToLower(filepath.Ext(name))]
+}
+
+// compress returns data compressed with algorithm
+func compress(algorithm string, data []byte) ([]byte, error) {
+	switch algorithm {
+	case CompressionZstd:
+		return zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/2)), nil
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w, _ := gzip.NewWriterLevel(&buf, gzip.DefaultCompression)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", algorithm)
+	}
+}
+
+// decompress undoes compress, refusing output larger than limit bytes
+func decompress(algorithm string, data []byte, limit int64) ([]byte, error) {
+	var r io.Reader
+	switch algorithm {
+	case "":
+		return data, nil
+	case CompressionZstd:
+		d, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(limit)+1))
+		if err != nil {
+			return nil, err
+		}
+		defer d.Close()
+		r = d
+	case CompressionGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", algorithm)
+	}
+
+	out, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("corrupt %s data: %v", algorithm, err)
+	}
+	if int64(len(out)) > limit {
+		return nil, fmt.Errorf("%s data expands beyond %d bytes", algorithm, limit)
+	}
+	return out, nil
+}
@@ -0,0 +1,96 @@
+package transport
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPickCompression(t *testing.T) {
+	tests := []struct {
+		offered []string
+		want    string
+	}{
+		{nil, ""},
+		{[]string{"brotli"}, ""},
+		{[]string{CompressionGzip}, CompressionGzip},
+		// ours are preferred first, whatever order the client offers them in
+		{[]string{CompressionGzip, CompressionZstd}, CompressionZstd},
+		{[]string{"brotli", CompressionZstd}, CompressionZstd},
+	}
+	for _, tt := range tests {
+		if got := pickCompression(tt.offered); got != tt.want {
+			t.Errorf("pickCompression(%v) = %q, want %q", tt.offered, got, tt.want)
+		}
+	}
+}
+
+func TestWorthCompressing(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		want bool
+	}{
+		{"main.go", minCompressSize, true},
+		{"main.go", minCompressSize - 1, false},
+		{"logo.PNG", 1 << 20, false},
+		{"dist/app.tar.gz", 1 << 20, false},
+		{"Makefile", 1 << 20, true},
+	}
+	for _, tt := range tests {
+		if got := worthCompressing(tt.name, tt.size); got != tt.want {
+			t.Errorf("worthCompressing(%q, %d) = %v, want %v", tt.name, tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("package main\n\nfunc main() {}\n"), 200)
+	for _, algorithm := range supportedCompression {
+		t.Run(algorithm, func(t *testing.T) {
+			packed, err := compress(algorithm, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(packed) >= len(data) {
+				t.Errorf("compressed to %d bytes from %d", len(packed), len(data))
+			}
+			got, err := decompress(algorithm, packed, int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("round trip changed the content")
+			}
+		})
+	}
+}
+
+func TestDecompressRejects(t *testing.T) {
+	data := bytes.Repeat([]byte{0}, 4096)
+	for _, algorithm := range supportedCompression {
+		packed, err := compress(algorithm, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(algorithm+" over limit", func(t *testing.T) {
+			if _, err := decompress(algorithm, packed, int64(len(data))-1); err == nil {
+				t.Error("expected output beyond the limit to be refused")
+			}
+		})
+		t.Run(algorithm+" corrupt", func(t *testing.T) {
+			if _, err := decompress(algorithm, packed[:len(packed)/2], int64(len(data))); err == nil {
+				t.Error("expected truncated data to be refused")
+			}
+		})
+	}
+
+	if _, err := compress("brotli", data); err == nil {
+		t.Error("compress accepted an unknown algorithm")
+	}
+	if _, err := decompress("brotli", data, 1<<20); err == nil {
+		t.Error("decompress accepted an unknown algorithm")
+	}
+	if got, err := decompress("", data, 1<<20); err != nil || !bytes.Equal(got, data) {
+		t.Error("uncompressed data was not passed through")
+	}
+}
@@ -0,0 +1,296 @@
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/velocity-trinity/core/pkg/logger"
+	"github.com/velocity-trinity/core/pkg/reaper"
+)
+
+const (
+	// DefaultCommandTimeout bounds commands that don't set their own timeout
+	DefaultCommandTimeout = 5 * time.Minute
+	// execPollWait is how long ExecOutput waits for new output before returning empty
+	execPollWait = time.Second
+	// execRetention is how long finished executions are kept for a client to collect
+	execRetention = 5 * time.Minute
+	// execOutputSize is how much of a command's output is kept for ExecOutput;
+	// a client that falls further behind misses the oldest
+	execOutputSize = 4 << 20
+)
+
+// execution is a running (or finished) command whose output is collected for ExecOutput
+type execution struct {
+	output *LogBuffer
+
+	mu       sync.Mutex
+	done     bool
+	finished time.Time
+	exitCode int
+	err      string
+}
+
+func newExecution() *execution {
+	return &execution{output: NewLogBuffer(execOutputSize)}
+}
+
+// Write appends output and wakes up waiting ExecOutput calls
+func (e *execution) Write(p []byte) (int, error) {
+	return e.output.Write(p)
+}
+
+func (e *execution) finish(exitCode int, err error) {
+	e.mu.Lock()
+	e.done = true
+	e.finished = time.Now()
+	e.exitCode = exitCode
+	if err != nil {
+		e.err = err.Error()
+	}
+	e.mu.Unlock()
+	e.output.wake()
+}
+
+// Exec is the RPC method that starts a command. Its output is read with ExecOutput.
+func (s *LivePatchServer) Exec(req *CommandRequest, resp *ExecResponse) error {
+	argv, err := s.Policy.Command(req.Command)
+	if err != nil {
+		return err
+	}
+	allowed := *req
+	allowed.Command = argv
+
+	cmd, ctx, cancel, err := s.command(context.Background(), &allowed)
+	if err != nil {
+		return err
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		cancel()
+		return err
+	}
+	e := newExecution()
+	cmd.Stdout = e
+	cmd.Stderr = e
+
+	logger.Log.Info("Executing command: " + strings.Join(argv, " "))
+	if err := reaper.Start(cmd); err != nil {
+		cancel()
+		return err
+	}
+
+	resp.ExecID = hex.EncodeToString(id)
+	s.mu.Lock()
+	if s.execs == nil {
+		s.execs = make(map[string]*execution)
+	}
+	s.expireExecs()
+	s.execs[resp.ExecID] = e
+	s.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		err := reaper.Wait(cmd)
+		e.finish(exitCode(cmd, err), timedOut(ctx, err))
+	}()
+	return nil
+}
+
+// ExecOutput is the RPC method that returns a command's output from req.Offset on.
+// It waits briefly for new output, so clients can poll it in a loop without
+// busy-waiting. The final call has Done set along with the exit code. Only the
+// last execOutputSize bytes are kept; output dropped before the client read it
+// is replaced with a note saying so.
+func (s *LivePatchServer) ExecOutput(req *ExecOutputRequest, resp *ExecOutputResponse) error {
+	s.mu.Lock()
+	e, ok := s.execs[req.ExecID]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown execution %s", req.ExecID)
+	}
+
+	// Once done, all the output is in the buffer: read it after checking
+	e.mu.Lock()
+	done := e.done
+	e.mu.Unlock()
+	wait := execPollWait
+	if done {
+		wait = 0
+	}
+
+	output, next, dropped := e.output.read(int64(req.Offset), wait)
+	if dropped {
+		resp.Output = fmt.Appendf(nil, "... (older output dropped: the agent keeps the last %d MiB)\n", execOutputSize>>20)
+	}
+	resp.Output = append(resp.Output, output...)
+	resp.Offset = int(next)
+	if done {
+		e.mu.Lock()
+		resp.Done = true
+		resp.Result = CommandResponse{Success: e.err == "", ExitCode: e.exitCode, Error: e.err}
+		e.mu.Unlock()
+	}
+	return nil
+}
+
+// expireExecs forgets executions that finished a while ago. Caller must hold s.mu.
+func (s *LivePatchServer) expireExecs() {
+	for id, e := range s.execs {
+		e.mu.Lock()
+		expired := e.done && time.Since(e.finished) > execRetention
+		e.mu.Unlock()
+		if expired {
+			delete(s.execs, id)
+		}
+	}
+}
+
+// command builds an exec.Cmd for req: Dir is resolved below BasePath, Env is
+// added to the agent's environment and Timeout (or CommandTimeout) kills the
+// process, as does cancelling parent. The policy must allow Dir and Env.
+func (s *LivePatchServer) command(parent context.Context, req *CommandRequest) (*exec.Cmd, context.Context, context.CancelFunc, error) {
+	if len(req.Command) == 0 {
+		return nil, nil, nil, errors.New("empty command")
+	}
+	if err := s.Policy.CheckEnv(req.Env); err != nil {
+		return nil, nil, nil, err
+	}
+
+	dir := s.BasePath
+	if req.Dir != "" {
+		var err error
+		if dir, err = s.resolve(req.Dir); err != nil {
+			return nil, nil, nil, err
+		}
+		// Check where the command really runs, not a symlink to it
+		real, err := s.base.evalSymlinks(dir)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if err := s.Policy.CheckDir(s.relPath(real)); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	timeout := s.CommandTimeout
+	if timeout <= 0 {
+		timeout = DefaultCommandTimeout
+	}
+	if req.Timeout > 0 {
+		timeout = time.Duration(req.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+
+	cmd := exec.CommandContext(ctx, req.Command[0], req.Command[1:]...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), req.Env...)
+	killGroupOnCancel(cmd)
+	// Children that keep the output pipes open must not block Wait forever after a kill
+	cmd.WaitDelay = 5 * time.Second
+	return cmd, ctx, cancel, nil
+}
+
+// timedOut replaces the "signal: killed" error of a command that hit its timeout
+func timedOut(ctx context.Context, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errors.New("timed out")
+	}
+	return err
+}
+
+// runCommand runs a trusted command string from the agent's own configuration
+// (the health check), bypassing the policy, and returns its combined output
+func (s *LivePatchServer) runCommand(parent context.Context, command string) (string, error) {
+	argv, err := splitCommand(command)
+	if err != nil {
+		return "", err
+	}
+	return s.run(parent, argv)
+}
+
+// run runs argv in the base path and returns its combined output; ending
+// parent kills it
+func (s *LivePatchServer) run(parent context.Context, argv []string) (string, error) {
+	cmd, ctx, cancel, err := s.command(parent, &CommandRequest{Command: argv})
+	if err != nil {
+		return "", err
+	}
+	defer cancel()
+
+	output, err := reaper.CombinedOutput(cmd)
+	return string(output), timedOut(ctx, err)
+}
+
+func exitCode(cmd *exec.Cmd, err error) int {
+	if cmd.ProcessState != nil {
+		return cmd.ProcessState.ExitCode()
+	}
+	if err != nil {
+		return -1
+	}
+	return 0
+}
+
+// splitCommand splits a command line into argv like a POSIX shell would,
+// honouring single quotes, double quotes and backslash escapes (but nothing else:
+// no variables, globs or pipes)
+func splitCommand(command string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range command {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in %q", quote, command)
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash in %q", command)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package transport
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// killGroupOnCancel puts the command in its own process group and kills the
+// whole group when its context ends, so `sh -c` doesn't leave children running
+func killGroupOnCancel(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
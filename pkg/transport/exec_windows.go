@@ -0,0 +1,8 @@
+//go:build windows
+
+package transport
+
+import "os/exec"
+
+// killGroupOnCancel leaves the default on Windows: only the command itself is killed
+func killGroupOnCancel(cmd *exec.Cmd) {}
@@ -0,0 +1,507 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/velocity-trinity/core/pkg/logger"
+)
+
+// DefaultHistoryLimit is how many patches the agent remembers
+const DefaultHistoryLimit = 50
+
+// patchHistory keeps applied patches and the previous content of the files they
+// changed in a state directory:
+//
+//	<dir>/history.json        patches, oldest first
+//	<dir>/objects/<sha256>    file contents, shared between patches
+type patchHistory struct {
+	dir     *baseDir
+	limit   int
+	patches []Patch
+}
+
+// openHistory loads the history in dir, creating it if needed
+func openHistory(dir string, limit int) (*patchHistory, error) {
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "objects"), 0700); err != nil {
+		return nil, err
+	}
+	root, err := openBaseDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	h := &patchHistory{dir: root, limit: limit}
+
+	data, err := root.ReadFile(h.path("history.json"))
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &h.patches); err != nil {
+		return nil, fmt.Errorf("corrupt patch history: %v", err)
+	}
+	return h, nil
+}
+
+// path returns the path of a file in the state directory
+func (h *patchHistory) path(elem ...string) string {
+	return filepath.Join(append([]string{h.dir.path}, elem...)...)
+}
+
+// record saves the current content of files (absolute path below base ->
+// relative path) and returns the patch that will replace them
+func (h *patchHistory) record(base *baseDir, files map[string]string, command string) (Patch, error) {
+	patch := Patch{ID: h.nextID(), Time: time.Now(), Command: command, Status: PatchApplied}
+	for fullPath, rel := range files {
+		file := PatchFile{RelativePath: rel}
+		info, err := base.Lstat(fullPath)
+		switch {
+		case err == nil && info.Mode()&os.ModeSymlink != 0:
+			if file.LinkTarget, err = base.Readlink(fullPath); err != nil {
+				return patch, err
+			}
+			file.Existed = true
+		case err == nil && info.Mode().IsRegular():
+			if file.Object, err = h.storeFile(base, fullPath); err != nil {
+				return patch, err
+			}
+			file.Existed = true
+			file.Mode = uint32(info.Mode().Perm())
+			file.ModTime = info.ModTime()
+			file.Owner = OwnerOf(info)
+		case err != nil && !os.IsNotExist(err):
+			return patch, err
+		}
+		patch.Files = append(patch.Files, file)
+	}
+	return patch, nil
+}
+
+// add appends a patch, forgetting the oldest ones beyond the limit
+func (h *patchHistory) add(patch Patch) error {
+	h.patches = append(h.patches, patch)
+	if extra := len(h.patches) - h.limit; extra > 0 {
+		h.patches = h.patches[extra:]
+	}
+	if err := h.save(); err != nil {
+		return err
+	}
+	h.collect()
+	return nil
+}
+
+// restore puts the files of patch back the way they were before it was applied
+func (h *patchHistory) restore(s *LivePatchServer, patch Patch) error {
+	var errs []error
+	for _, file := range patch.Files {
+		fullPath, err := s.resolve(file.RelativePath)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !file.Existed {
+			if err := s.base.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+			s.pruneEmptyDirs(filepath.Dir(fullPath))
+			continue
+		}
+
+		err = s.base.MkdirAll(filepath.Dir(fullPath), 0755)
+		if err == nil && file.LinkTarget != "" {
+			err = replaceLink(s.base, fullPath, file.LinkTarget)
+		} else if err == nil {
+			err = copyFileAtomic(s.base, fullPath, h.dir, h.path("objects", file.Object), os.FileMode(file.Mode))
+		}
+		if err == nil {
+			restoreAttrs(s.base, fullPath, file)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", file.RelativePath, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// restoreAttrs puts back a restored file's modification time and owner. The
+// agent may not be allowed to give a file away, so failing isn't fatal.
+func restoreAttrs(base *baseDir, fullPath string, file PatchFile) {
+	if file.Owner != nil {
+		if err := base.Lchown(fullPath, file.Owner.UID, file.Owner.GID); err != nil {
+			logger.Log.Warn(fmt.Sprintf("Failed to restore the owner of %s: %v", file.RelativePath, err))
+		}
+	}
+	if !file.ModTime.IsZero() {
+		base.Chtimes(fullPath, file.ModTime, file.ModTime)
+	}
+}
+
+// markRolledBack updates the status of a patch and saves the history
+func (h *patchHistory) markRolledBack(id int, reason string) error {
+	for i := range h.patches {
+		if h.patches[i].ID == id {
+			h.patches[i].Status = PatchRolledBack
+			h.patches[i].Reason = reason
+		}
+	}
+	return h.save()
+}
+
+func (h *patchHistory) nextID() int {
+	if len(h.patches) == 0 {
+		return 1
+	}
+	return h.patches[len(h.patches)-1].ID + 1
+}
+
+func (h *patchHistory) save() error {
+	data, err := json.MarshalIndent(h.patches, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(h.dir, h.path("history.json"), data, 0600)
+}
+
+// storeFile copies a file into the object store, streaming so large files fit
+func (h *patchHistory) storeFile(base *baseDir, src string) (string, error) {
+	sum, err := hashFile(base, src)
+	if err != nil {
+		return "", err
+	}
+	path := h.path("objects", sum)
+	if _, err := h.dir.Stat(path); err == nil {
+		return sum, nil
+	}
+	return sum, copyFileAtomic(h.dir, path, base, src, 0600)
+}
+
+// collect deletes objects no remembered patch refers to
+func (h *patchHistory) collect() {
+	used := make(map[string]bool)
+	for _, patch := range h.patches {
+		for _, file := range patch.Files {
+			used[file.Object] = true
+		}
+	}
+	entries, err := h.dir.ReadDir(h.path("objects"))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !used[entry.Name()] {
+			h.dir.Remove(h.path("objects", entry.Name()))
+		}
+	}
+}
+
+// commitResult is the outcome of applying a patch and restarting
+type commitResult struct {
+	PatchID int
+	Command string
+	Output  string
+	// Failure is the post-sync command or health check error that triggered a rollback
+	Failure    error
+	RolledBack bool
+	// RollbackErr is set if the previous files could not be restored
+	RollbackErr error
+	// RestartErr is set if the command failed again after the files were restored
+	RestartErr error
+	// CleanupErr is set if a deleted directory couldn't be removed completely
+	CleanupErr error
+}
+
+// describe turns the result into a response; action says what was done ("File synced")
+func (r *commitResult) describe(action string) (bool, string) {
+	if r.CleanupErr != nil {
+		action += fmt.Sprintf(" (%v)", r.CleanupErr)
+	}
+	if r.Failure == nil {
+		if r.Command == "" {
+			return true, action
+		}
+		return true, fmt.Sprintf("%s and command executed: %s", action, r.Output)
+	}
+
+	msg := fmt.Sprintf("%s, but %v", action, r.Failure)
+	switch {
+	case r.RollbackErr != nil:
+		msg += fmt.Sprintf("; rollback failed: %v", r.RollbackErr)
+	case r.RolledBack:
+		msg += fmt.Sprintf("; rolled back patch %d", r.PatchID)
+		if r.RestartErr != nil {
+			msg += fmt.Sprintf(" (command failed again: %v)", r.RestartErr)
+		}
+	}
+	if r.Output != "" {
+		msg += "\nOutput: " + r.Output
+	}
+	return false, msg
+}
+
+// commit applies a transaction as one patch, runs the post-sync command and the
+// health check, and rolls the patch back if either fails. An error means the
+// files could not be applied and nothing changed. When ctx ends first the
+// transaction is discarded, or if it was already applied, the command and
+// health check are stopped and the patch is rolled back, so a client that gave
+// up on the call isn't left with a change it was told failed.
+func (s *LivePatchServer) commit(ctx context.Context, tx *transaction, command string) (*commitResult, error) {
+	s.patchMu.Lock()
+	defer s.patchMu.Unlock()
+
+	// Waiting for another commit may have taken a while
+	if err := ctx.Err(); err != nil {
+		tx.discard()
+		return nil, fmt.Errorf("not applied: %w", err)
+	}
+	patch, err := s.applyTx(tx, command)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &commitResult{PatchID: patch.ID, Command: command, CleanupErr: tx.cleanupErr}
+	if result.CleanupErr != nil {
+		logger.Log.Warn(result.CleanupErr.Error())
+	}
+	if s.history != nil {
+		if err := s.history.add(patch); err != nil {
+			logger.Log.Warn("Failed to save patch history: " + err.Error())
+		}
+	}
+
+	if command != "" {
+		var err error
+		if result.Output, err = s.runPostSync(ctx, command); err != nil {
+			result.Failure = fmt.Errorf("command failed: %v", err)
+		}
+	}
+	if result.Failure == nil {
+		if err := s.reloadApp(); err != nil {
+			result.Failure = err
+		}
+	}
+	if result.Failure == nil {
+		if err := s.checkHealth(ctx); err != nil {
+			result.Failure = err
+		}
+	}
+	if ctx.Err() != nil && result.Failure != nil {
+		result.Failure = fmt.Errorf("%v (the client gave up on the call: %v)", result.Failure, ctx.Err())
+	}
+	if result.Failure == nil || s.history == nil {
+		return result, nil
+	}
+
+	logger.Log.Warn(fmt.Sprintf("Rolling back patch %d: %v", patch.ID, result.Failure))
+	if result.RollbackErr = s.undo([]Patch{patch}, result.Failure.Error()); result.RollbackErr != nil {
+		return result, nil
+	}
+	result.RolledBack = true
+	// Restart again so the previous version is what's running, even if the client is gone
+	if command != "" {
+		_, result.RestartErr = s.runPostSync(context.Background(), command)
+	}
+	if result.RestartErr == nil {
+		result.RestartErr = s.reloadApp()
+	}
+	return result, nil
+}
+
+// applyTx ends the transaction and moves its files into place, recording the
+// previous versions in the history. Caller must hold s.patchMu.
+func (s *LivePatchServer) applyTx(tx *transaction, command string) (Patch, error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.closed {
+		return Patch{}, errTxClosed
+	}
+	tx.closed = true
+
+	var patch Patch
+	if s.history != nil {
+		files := make(map[string]string)
+		for _, target := range tx.targets() {
+			files[target] = s.relPath(target)
+		}
+		var err error
+		if patch, err = s.history.record(s.base, files, command); err != nil {
+			tx.removeTemps()
+			return Patch{}, fmt.Errorf("failed to back up previous versions: %v", err)
+		}
+	}
+
+	if err := tx.apply(); err != nil {
+		tx.removeTemps()
+		return Patch{}, err
+	}
+	for target := range tx.deletes {
+		s.pruneEmptyDirs(filepath.Dir(target))
+	}
+	return patch, nil
+}
+
+// undo restores patches, newest first. Caller must hold s.patchMu.
+func (s *LivePatchServer) undo(patches []Patch, reason string) error {
+	for _, patch := range patches {
+		if err := s.history.restore(s, patch); err != nil {
+			return err
+		}
+		if err := s.history.markRolledBack(patch.ID, reason); err != nil {
+			logger.Log.Warn("Failed to save patch history: " + err.Error())
+		}
+		logger.Log.Info(fmt.Sprintf("Rolled back patch %d", patch.ID))
+	}
+	return nil
+}
+
+// Rollback is the RPC method that undoes the latest patch, or every patch after req.To
+func (s *LivePatchServer) Rollback(req *RollbackRequest, resp *RollbackResponse) error {
+	return s.rollback(context.Background(), req, resp)
+}
+
+// rollback is Rollback for a call that stops when ctx ends. Once files are
+// restored the post-sync command runs to the end, so the restored version is
+// what's running.
+func (s *LivePatchServer) rollback(ctx context.Context, req *RollbackRequest, resp *RollbackResponse) error {
+	if s.history == nil {
+		return fmt.Errorf("patch history is disabled on this agent")
+	}
+	if err := s.allowed(req.PostSyncCommand); err != nil {
+		return err
+	}
+
+	s.patchMu.Lock()
+	defer s.patchMu.Unlock()
+
+	var undo []Patch
+	found := req.To == 0
+	for i := len(s.history.patches) - 1; i >= 0; i-- {
+		patch := s.history.patches[i]
+		if req.To != 0 && patch.ID <= req.To {
+			found = found || patch.ID == req.To
+			break
+		}
+		if patch.Status != PatchApplied {
+			continue
+		}
+		undo = append(undo, patch)
+		if req.To == 0 {
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("patch %d is not in the history", req.To)
+	}
+	if len(undo) == 0 {
+		resp.Message = "Nothing to roll back"
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("nothing rolled back: %w", err)
+	}
+
+	if err := s.undo(undo, "manual rollback"); err != nil {
+		return err
+	}
+	for _, patch := range undo {
+		resp.RolledBack = append(resp.RolledBack, patch.ID)
+	}
+	resp.Message = fmt.Sprintf("Rolled back %d patch(es)", len(undo))
+
+	if req.PostSyncCommand != "" {
+		output, err := s.runPostSync(context.Background(), req.PostSyncCommand)
+		if err != nil {
+			resp.Message += fmt.Sprintf(", but command failed: %v\nOutput: %s", err, output)
+			return nil
+		}
+		resp.Message += " and command executed: " + output
+	}
+	if err := s.reloadApp(); err != nil {
+		resp.Message += fmt.Sprintf(", but %v", err)
+	}
+	return nil
+}
+
+// History is the RPC method that lists recent patches, newest first
+func (s *LivePatchServer) History(req *HistoryRequest, resp *HistoryResponse) error {
+	if s.history == nil {
+		return fmt.Errorf("patch history is disabled on this agent")
+	}
+
+	s.patchMu.Lock()
+	defer s.patchMu.Unlock()
+	for i := len(s.history.patches) - 1; i >= 0; i-- {
+		if req.Limit > 0 && len(resp.Patches) == req.Limit {
+			break
+		}
+		resp.Patches = append(resp.Patches, s.history.patches[i])
+	}
+	return nil
+}
+
+// checkHealth polls the configured health URL and/or command until they pass,
+// HealthTimeout runs out or ctx ends
+func (s *LivePatchServer) checkHealth(ctx context.Context) error {
+	if s.HealthURL == "" && s.HealthCommand == "" && s.Supervisor == nil {
+		return nil
+	}
+	timeout := s.HealthTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := s.probe(ctx)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("health check failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("health check stopped: %v", err)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+func (s *LivePatchServer) probe(ctx context.Context) error {
+	if s.Supervisor != nil {
+		if err := s.Supervisor.Healthy(); err != nil {
+			return err
+		}
+	}
+	if s.HealthURL != "" {
+		client := &http.Client{Timeout: 2 * time.Second}
+		resp, err := client.Get(s.HealthURL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("%s returned %s", s.HealthURL, resp.Status)
+		}
+	}
+	if s.HealthCommand != "" {
+		if output, err := s.runCommand(ctx, s.HealthCommand); err != nil {
+			if out := strings.TrimSpace(output); out != "" {
+				return fmt.Errorf("%s: %v: %s", s.HealthCommand, err, out)
+			}
+			return fmt.Errorf("%s: %v", s.HealthCommand, err)
+		}
+	}
+	return nil
+}
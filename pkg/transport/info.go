@@ -0,0 +1,37 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Version identifies the build; releases set it with
+// -ldflags "-X github.com/velocity-trinity/core/pkg/transport.Version=v1.2.3"
+var Version = "dev"
+
+// Info is the RPC method that describes the agent, for `live-patch agents`
+func (s *LivePatchServer) Info(req *InfoRequest, resp *InfoResponse) error {
+	resp.Name = s.Name
+	resp.Labels = s.Labels
+	resp.BasePath = s.base.path
+	resp.Version = Version
+	resp.Started = s.started
+	if s.Supervisor != nil {
+		status := s.Supervisor.Status()
+		resp.App = &status
+	}
+	return nil
+}
+
+// Info describes the agent. Agents that predate it return errors.ErrUnsupported.
+func (c *LivePatchClient) Info() (*InfoResponse, error) {
+	var resp InfoResponse
+	err := c.call("LivePatchServer.Info", &InfoRequest{}, &resp)
+	if methodMissing(err) {
+		return nil, fmt.Errorf("%w: %v", errors.ErrUnsupported, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
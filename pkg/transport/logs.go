@@ -0,0 +1,237 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/velocity-trinity/core/pkg/logger"
+)
+
+const (
+	// DefaultLogBufferSize is how much output the agent keeps per log source
+	DefaultLogBufferSize = 1 << 20
+	// AppLogSource is the name of the supervised application's stdout/stderr
+	AppLogSource = "app"
+
+	logPollWait     = time.Second
+	logFileInterval = 500 * time.Millisecond
+)
+
+// LogBuffer keeps the latest output of a log source. Offsets count every byte
+// ever written, so a client can resume where it stopped and tell when older
+// output was dropped.
+type LogBuffer struct {
+	size int
+	mu   sync.Mutex
+	// buf is a ring: the byte at offset o is at buf[o%size]. It's allocated on the first write.
+	buf []byte
+	// start is the offset of the oldest byte kept, n the number of bytes kept
+	start   int64
+	n       int
+	changed chan struct{}
+}
+
+// NewLogBuffer creates a buffer that keeps the last size bytes
+func NewLogBuffer(size int) *LogBuffer {
+	if size <= 0 {
+		size = DefaultLogBufferSize
+	}
+	return &LogBuffer{size: size, changed: make(chan struct{})}
+}
+
+// Write appends output, dropping the oldest beyond the buffer size
+func (b *LogBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.buf == nil {
+		b.buf = make([]byte, b.size)
+	}
+	end := b.end() + int64(len(p))
+	kept := p
+	if len(kept) > b.size {
+		kept = kept[len(kept)-b.size:]
+	}
+	pos := int((end - int64(len(kept))) % int64(b.size))
+	if copied := copy(b.buf[pos:], kept); copied < len(kept) {
+		copy(b.buf, kept[copied:])
+	}
+	b.n = min(b.n+len(p), b.size)
+	b.start = end - int64(b.n)
+	b.notify()
+	return len(p), nil
+}
+
+// slice copies out the bytes from offset from to offset to, which must both
+// be between start and end. Caller must hold b.mu.
+func (b *LogBuffer) slice(from, to int64) []byte {
+	out := make([]byte, 0, to-from)
+	if from == to {
+		return out
+	}
+	i, j := int(from%int64(b.size)), int(to%int64(b.size))
+	if i < j {
+		return append(out, b.buf[i:j]...)
+	}
+	return append(append(out, b.buf[i:]...), b.buf[:j]...)
+}
+
+// notify wakes up readers waiting for output. Caller must hold b.mu.
+func (b *LogBuffer) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// wake wakes up readers waiting for output even though there's none, e.g.
+// because the command writing it has finished
+func (b *LogBuffer) wake() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.notify()
+}
+
+// end returns the offset after the last byte written. Caller must hold b.mu.
+func (b *LogBuffer) end() int64 {
+	return b.start + int64(b.n)
+}
+
+// read returns the output from offset on, waiting up to wait for some to arrive.
+// An offset past the end (from before an agent restart) reads from the start.
+func (b *LogBuffer) read(offset int64, wait time.Duration) (output []byte, next int64, dropped bool) {
+	b.mu.Lock()
+	if offset == b.end() && wait > 0 {
+		changed := b.changed
+		b.mu.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		}
+		b.mu.Lock()
+	}
+	defer b.mu.Unlock()
+
+	if offset > b.end() {
+		offset = b.start
+	}
+	if offset < b.start {
+		offset, dropped = b.start, true
+	}
+	return b.slice(offset, b.end()), b.end(), dropped
+}
+
+// tail returns the last n lines and the offset after them
+func (b *LogBuffer) tail(n int) ([]byte, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	kept := b.slice(b.start, b.end())
+	start, end := 0, len(kept)
+	// A trailing newline ends the last line rather than starting a new one
+	if end > 0 && kept[end-1] == '\n' {
+		end--
+	}
+	for ; n > 0; n-- {
+		i := bytes.LastIndexByte(kept[:end], '\n')
+		if i < 0 {
+			start = 0
+			break
+		}
+		start, end = i+1, i
+	}
+	return kept[start:], b.end()
+}
+
+// TailFile copies what is appended to a log file into buf until stop is closed.
+// It follows the file across truncation and rotation (a new file at the same path).
+func TailFile(path string, buf *LogBuffer, stop <-chan struct{}) {
+	var (
+		f    *os.File
+		info os.FileInfo
+		pos  int64
+	)
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	first := true
+	ticker := time.NewTicker(logFileInterval)
+	defer ticker.Stop()
+	for {
+		current, err := os.Stat(path)
+		if err == nil && (f == nil || !os.SameFile(info, current)) {
+			if f != nil {
+				f.Close()
+			}
+			if f, err = os.Open(path); err != nil {
+				logger.Log.Warn("Failed to open log file: " + err.Error())
+				f = nil
+			} else {
+				info, pos = current, 0
+				// Start with the recent part of a file that existed before the agent
+				if first && current.Size() > int64(buf.size) {
+					pos = current.Size() - int64(buf.size)
+				}
+			}
+		}
+		first = false
+
+		if f != nil {
+			if err == nil && current.Size() < pos {
+				// Truncated in place
+				pos = 0
+			}
+			n, _ := io.Copy(buf, io.NewSectionReader(f, pos, 1<<62))
+			pos += n
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Logs is the RPC method that returns a log source's output from req.Offset on,
+// or its last req.Tail lines. Like ExecOutput it waits briefly for new output,
+// so clients can follow a log by polling.
+func (s *LivePatchServer) Logs(req *LogsRequest, resp *LogsResponse) error {
+	if len(s.LogSources) == 0 {
+		return fmt.Errorf("this agent has no logs (supervise the app with live-patch-agent -- <command>, or pass --log-file)")
+	}
+	for name := range s.LogSources {
+		resp.Sources = append(resp.Sources, name)
+	}
+	sort.Strings(resp.Sources)
+
+	source := req.Source
+	if source == "" {
+		source = AppLogSource
+		if _, ok := s.LogSources[source]; !ok {
+			source = resp.Sources[0]
+		}
+	}
+	buf, ok := s.LogSources[source]
+	if !ok {
+		return fmt.Errorf("unknown log source %q (available: %v)", source, resp.Sources)
+	}
+	resp.Source = source
+
+	switch {
+	case req.Tail > 0:
+		resp.Output, resp.Offset = buf.tail(req.Tail)
+	case req.Offset < 0:
+		// Just the current position, so a client can follow what comes next
+		buf.mu.Lock()
+		resp.Offset = buf.end()
+		buf.mu.Unlock()
+	default:
+		resp.Output, resp.Offset, resp.Dropped = buf.read(req.Offset, logPollWait)
+	}
+	return nil
+}
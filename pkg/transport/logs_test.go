@@ -0,0 +1,66 @@
+package transport
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// TestLogBufferKeepsLatest checks the ring against the plain last size bytes
+// of everything written, with writes smaller and larger than the buffer
+func TestLogBufferKeepsLatest(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	const size = 64
+	b := NewLogBuffer(size)
+	var all []byte
+	for i := 0; i < 500; i++ {
+		p := make([]byte, rng.Intn(size*3/2))
+		for j := range p {
+			p[j] = byte('a' + rng.Intn(26))
+		}
+		if n, err := b.Write(p); n != len(p) || err != nil {
+			t.Fatalf("Write = %d, %v", n, err)
+		}
+		all = append(all, p...)
+
+		want := all[max(0, len(all)-size):]
+		start := int64(len(all) - len(want))
+		output, next, dropped := b.read(0, 0)
+		if !bytes.Equal(output, want) || next != int64(len(all)) || dropped != (start > 0) {
+			t.Fatalf("after %d bytes read(0) = %q, %d, %v; want %q, %d", len(all), output, next, dropped, want, len(all))
+		}
+		offset := start + rng.Int63n(int64(len(want))+1)
+		if output, _, dropped := b.read(offset, 0); !bytes.Equal(output, all[offset:]) || dropped {
+			t.Fatalf("read(%d) = %q, want %q", offset, output, all[offset:])
+		}
+	}
+}
+
+func TestLogBufferTail(t *testing.T) {
+	b := NewLogBuffer(16)
+	b.Write([]byte("one\ntwo\nthree\nfour\n"))
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{1, "four\n"},
+		{2, "three\nfour\n"},
+		// "one" was dropped for the buffer size, so there are fewer lines than asked for
+		{5, "\ntwo\nthree\nfour\n"},
+	}
+	for _, tt := range tests {
+		output, next := b.tail(tt.n)
+		if string(output) != tt.want || next != 19 {
+			t.Errorf("tail(%d) = %q, %d; want %q, 19", tt.n, output, next, tt.want)
+		}
+	}
+}
+
+func TestLogBufferOffsetPastEnd(t *testing.T) {
+	b := NewLogBuffer(16)
+	b.Write([]byte("abc"))
+	// An offset from before an agent restart reads from the start
+	if output, next, _ := b.read(100, 0); string(output) != "abc" || next != 3 {
+		t.Errorf("read(100) = %q, %d", output, next)
+	}
+}
@@ -0,0 +1,276 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// handshakeTimeout bounds the hello exchange, in case a peer neither answers nor hangs up
+const handshakeTimeout = 10 * time.Second
+
+// maxQueuedData caps the streamed output buffered for one call whose caller
+// isn't keeping up. Past it that call fails; the others carry on.
+const maxQueuedData = 16 << 20
+
+// muxClient makes concurrent calls over one multiplexed connection
+type muxClient struct {
+	conn net.Conn
+	wmu  sync.Mutex
+	// compression is the algorithm the agent picked for file content, if any
+	compression string
+
+	mu    sync.Mutex
+	next  uint32
+	calls map[uint32]*clientCall
+	err   error
+}
+
+type clientCall struct {
+	// queue holds streamed output the caller hasn't consumed yet. It isn't a
+	// channel so that a slow caller never blocks the reader, and with it every
+	// other call on the connection.
+	mu       sync.Mutex
+	queue    [][]byte
+	queued   int
+	overflow bool
+	// more is signalled when output is queued
+	more chan struct{}
+
+	reply chan []byte
+	// done is closed when the caller stops waiting
+	done chan struct{}
+	// failed is closed when the connection is lost before the reply arrives
+	failed chan struct{}
+}
+
+// handshake opens the multiplexed protocol on conn. errNotMultiplexed means
+// the agent hung up without a hello, i.e. it only speaks the legacy protocol.
+func handshake(conn net.Conn) (*muxClient, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := writeHello(conn, hello{Versions: supportedVersions, Compression: supportedCompression}); err != nil {
+		return nil, err
+	}
+	theirs, err := readHello(conn)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, errNotMultiplexed
+	}
+	if err != nil {
+		return nil, err
+	}
+	if theirs.Version == 0 {
+		return nil, fmt.Errorf("incompatible agent: it speaks protocol versions %v, this client speaks %v; upgrade the older of the two", theirs.Versions, supportedVersions)
+	}
+	conn.SetDeadline(time.Time{})
+
+	m := &muxClient{conn: conn, compression: theirs.Compress, calls: make(map[uint32]*clientCall)}
+	go m.read()
+	return m, nil
+}
+
+// read dispatches frames to their calls until the connection fails
+func (m *muxClient) read() {
+	pending := newReassembler()
+	var err error
+	for {
+		var f frame
+		if f, err = readFrame(m.conn); err != nil {
+			break
+		}
+
+		m.mu.Lock()
+		call, ok := m.calls[f.stream]
+		m.mu.Unlock()
+		if !ok {
+			// A call we gave up on
+			pending.drop(f.stream)
+			continue
+		}
+
+		switch f.typ {
+		case frameData:
+			if !call.push(f.payload) {
+				// Frames still on their way are dropped like those of any abandoned call
+				m.forget(f.stream)
+				go m.write(frame{typ: frameCancel, stream: f.stream})
+			}
+		case frameReply:
+			var msg []byte
+			var complete bool
+			if msg, complete, err = pending.add(f); err != nil {
+				break
+			}
+			if complete {
+				m.mu.Lock()
+				delete(m.calls, f.stream)
+				m.mu.Unlock()
+				call.reply <- msg
+			}
+		default:
+			err = fmt.Errorf("unexpected frame type %d", f.typ)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// Fail every waiting call the way net/rpc does, so callers can spot a lost connection
+	m.mu.Lock()
+	m.err = fmt.Errorf("%w: %v", rpc.ErrShutdown, err)
+	for id, call := range m.calls {
+		close(call.failed)
+		delete(m.calls, id)
+	}
+	m.mu.Unlock()
+	m.conn.Close()
+}
+
+// call invokes method and decodes its reply. Output of streaming methods goes
+// to onData. When ctx ends first the agent is told to abandon the call.
+func (m *muxClient) call(ctx context.Context, method string, args, reply interface{}, onData func([]byte) error) error {
+	header := callHeader{Method: method}
+	if deadline, ok := ctx.Deadline(); ok {
+		if header.Timeout = time.Until(deadline); header.Timeout <= 0 {
+			return context.DeadlineExceeded
+		}
+	}
+	msg, err := encodeMessage(header, args)
+	if err != nil {
+		return err
+	}
+
+	call := &clientCall{more: make(chan struct{}, 1), reply: make(chan []byte, 1), done: make(chan struct{}), failed: make(chan struct{})}
+	defer close(call.done)
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return m.err
+	}
+	m.next++
+	id := m.next
+	m.calls[id] = call
+	m.mu.Unlock()
+
+	for _, f := range fragments(frameCall, id, msg) {
+		if err := m.write(f); err != nil {
+			m.forget(id)
+			return fmt.Errorf("%w: %v", rpc.ErrShutdown, err)
+		}
+	}
+
+	for {
+		select {
+		case <-call.more:
+			queue, overflow := call.take()
+			if overflow {
+				return fmt.Errorf("output arrived faster than it was consumed (more than %d bytes queued)", maxQueuedData)
+			}
+			if err := deliver(queue, onData); err != nil {
+				m.cancel(id)
+				return err
+			}
+		case msg := <-call.reply:
+			// Output sent before the reply is already queued
+			queue, _ := call.take()
+			if err := deliver(queue, onData); err != nil {
+				return err
+			}
+			return decodeReply(msg, reply)
+		case <-call.failed:
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			return m.err
+		case <-ctx.Done():
+			m.cancel(id)
+			return ctx.Err()
+		}
+	}
+}
+
+// push queues output for the caller. It reports false, and drops what is
+// queued, once the caller has fallen more than maxQueuedData behind.
+func (c *clientCall) push(data []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.overflow {
+		return false
+	}
+	if c.queued+len(data) > maxQueuedData {
+		c.overflow = true
+		c.queue, c.queued = nil, 0
+	} else {
+		c.queue = append(c.queue, data)
+		c.queued += len(data)
+	}
+	select {
+	case c.more <- struct{}{}:
+	default:
+	}
+	return !c.overflow
+}
+
+// take empties the queue
+func (c *clientCall) take() ([][]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	queue := c.queue
+	c.queue, c.queued = nil, 0
+	return queue, c.overflow
+}
+
+func deliver(queue [][]byte, onData func([]byte) error) error {
+	if onData == nil {
+		return nil
+	}
+	for _, data := range queue {
+		if err := onData(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeReply(msg []byte, reply interface{}) error {
+	dec := gob.NewDecoder(bytes.NewReader(msg))
+	var header replyHeader
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("malformed reply: %v", err)
+	}
+	if header.Error != "" {
+		// Same error type as net/rpc, so callers see agent errors the same way on either protocol
+		return rpc.ServerError(header.Error)
+	}
+	if err := dec.Decode(reply); err != nil {
+		return fmt.Errorf("malformed reply: %v", err)
+	}
+	return nil
+}
+
+// cancel abandons a call, telling the agent to stop working on it
+func (m *muxClient) cancel(id uint32) {
+	m.forget(id)
+	m.write(frame{typ: frameCancel, stream: id})
+}
+
+func (m *muxClient) forget(id uint32) {
+	m.mu.Lock()
+	delete(m.calls, id)
+	m.mu.Unlock()
+}
+
+func (m *muxClient) write(f frame) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	return writeFrame(m.conn, f)
+}
+
+func (m *muxClient) Close() error {
+	return m.conn.Close()
+}
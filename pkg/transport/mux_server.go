@@ -0,0 +1,343 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/velocity-trinity/core/pkg/logger"
+	"github.com/velocity-trinity/core/pkg/reaper"
+)
+
+// unaryMethod is an RPC method of LivePatchServer, found the way net/rpc finds them
+type unaryMethod struct {
+	fn   reflect.Value
+	req  reflect.Type
+	resp reflect.Type
+	// withContext is set when fn is a method expression from contextMethods
+	withContext bool
+}
+
+// contextMethods are the unary methods that change files or restart the app,
+// in a form that takes the call's context. When the client cancels the call
+// or its timeout passes they stop before writing, and kill (and roll back) a
+// post-sync command that is still running.
+var contextMethods = map[string]interface{}{
+	"LivePatchServer.SyncFile":     (*LivePatchServer).syncFile,
+	"LivePatchServer.ApplyDelta":   (*LivePatchServer).applyDelta,
+	"LivePatchServer.FinishUpload": (*LivePatchServer).finishUpload,
+	"LivePatchServer.DeleteFile":   (*LivePatchServer).deleteFile,
+	"LivePatchServer.Rename":       (*LivePatchServer).rename,
+	"LivePatchServer.CommitTx":     (*LivePatchServer).commitTx,
+	"LivePatchServer.Rollback":     (*LivePatchServer).rollback,
+}
+
+// streamHandler serves a call whose output is streamed as data frames before the
+// reply. ctx is cancelled when the client cancels the call or its timeout passes.
+type streamHandler func(s *LivePatchServer, ctx context.Context, dec *gob.Decoder, out io.Writer) (interface{}, error)
+
+var streamHandlers = map[string]streamHandler{
+	"LivePatchServer.ExecStream": (*LivePatchServer).execStream,
+	"LivePatchServer.FollowLogs": (*LivePatchServer).followLogs,
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// unaryMethods lists the methods of s that net/rpc would serve, by their net/rpc name
+func unaryMethods(s *LivePatchServer) map[string]unaryMethod {
+	methods := make(map[string]unaryMethod)
+	v := reflect.ValueOf(s)
+	t := v.Type()
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		mt := m.Type
+		if mt.NumIn() != 3 || mt.NumOut() != 1 || mt.Out(0) != errorType ||
+			mt.In(1).Kind() != reflect.Ptr || mt.In(2).Kind() != reflect.Ptr {
+			continue
+		}
+		name := "LivePatchServer." + m.Name
+		methods[name] = unaryMethod{
+			fn:   v.Method(i),
+			req:  mt.In(1).Elem(),
+			resp: mt.In(2).Elem(),
+		}
+		if fn, ok := contextMethods[name]; ok {
+			methods[name] = unaryMethod{fn: reflect.ValueOf(fn), req: mt.In(1).Elem(), resp: mt.In(2).Elem(), withContext: true}
+		}
+	}
+	return methods
+}
+
+// serveConn speaks whichever protocol the client opens with: a hello starts the
+// multiplexed protocol, anything else is a legacy net/rpc client
+func (s *LivePatchServer) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	magic, err := r.Peek(len(protocolMagic))
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if !bytes.Equal(magic, protocolMagic) {
+		logger.Log.Debug("Legacy client connected from " + conn.RemoteAddr().String())
+		s.rpcServer.ServeConn(struct {
+			io.Reader
+			io.Writer
+			io.Closer
+		}{r, conn, conn})
+		return
+	}
+
+	theirs, err := readHello(r)
+	if err != nil {
+		logger.Log.Warn("Bad hello from " + conn.RemoteAddr().String() + ": " + err.Error())
+		conn.Close()
+		return
+	}
+	version := negotiate(theirs.Versions)
+	compression := pickCompression(theirs.Compression)
+	if err := writeHello(conn, hello{Versions: supportedVersions, Version: version, Compression: supportedCompression, Compress: compression}); err != nil || version == 0 {
+		if version == 0 {
+			logger.Log.Warn(fmt.Sprintf("Client %s speaks protocol versions %v, this agent speaks %v", conn.RemoteAddr(), theirs.Versions, supportedVersions))
+		}
+		conn.Close()
+		return
+	}
+
+	c := &muxConn{server: s, conn: conn, calls: make(map[uint32]context.CancelFunc)}
+	c.serve(r)
+}
+
+// muxConn serves the calls of one multiplexed connection, each in its own goroutine
+type muxConn struct {
+	server *LivePatchServer
+	conn   net.Conn
+
+	// wmu keeps frames from different calls from interleaving mid-frame
+	wmu sync.Mutex
+
+	mu    sync.Mutex
+	calls map[uint32]context.CancelFunc
+}
+
+func (c *muxConn) serve(r io.Reader) {
+	defer func() {
+		c.conn.Close()
+		c.mu.Lock()
+		for _, cancel := range c.calls {
+			cancel()
+		}
+		c.mu.Unlock()
+	}()
+
+	pending := newReassembler()
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Log.Debug("Connection closed: " + err.Error())
+			}
+			return
+		}
+
+		switch f.typ {
+		case frameCall:
+			msg, complete, err := pending.add(f)
+			if err != nil {
+				logger.Log.Warn("Dropping connection: " + err.Error())
+				return
+			}
+			if complete {
+				c.start(f.stream, msg)
+			}
+		case frameCancel:
+			c.mu.Lock()
+			if cancel, ok := c.calls[f.stream]; ok {
+				cancel()
+			}
+			c.mu.Unlock()
+		default:
+			logger.Log.Warn(fmt.Sprintf("Dropping connection: unexpected frame type %d", f.typ))
+			return
+		}
+	}
+}
+
+func (c *muxConn) start(stream uint32, msg []byte) {
+	dec := gob.NewDecoder(bytes.NewReader(msg))
+	var header callHeader
+	if err := dec.Decode(&header); err != nil {
+		c.reply(stream, err, nil)
+		return
+	}
+
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if header.Timeout <= 0 {
+		ctx, cancel = context.WithCancel(context.Background())
+	} else {
+		ctx, cancel = context.WithTimeout(context.Background(), header.Timeout)
+	}
+	c.mu.Lock()
+	if len(c.calls) >= maxConcurrentCalls {
+		c.mu.Unlock()
+		cancel()
+		c.reply(stream, fmt.Errorf("too many concurrent calls (the limit is %d)", maxConcurrentCalls), nil)
+		return
+	}
+	c.calls[stream] = cancel
+	c.mu.Unlock()
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.calls, stream)
+			c.mu.Unlock()
+			cancel()
+		}()
+		resp, err := c.call(ctx, stream, header.Method, dec)
+		if err == nil && resp == nil {
+			err = ctx.Err()
+		}
+		// Reply even if the client may have stopped waiting: a call that ran
+		// (or timed out) must never leave it waiting. Replies to cancelled calls are dropped.
+		c.reply(stream, err, resp)
+	}()
+}
+
+func (c *muxConn) call(ctx context.Context, stream uint32, method string, dec *gob.Decoder) (interface{}, error) {
+	if handler, ok := streamHandlers[method]; ok {
+		return handler(c.server, ctx, dec, &streamWriter{conn: c, stream: stream})
+	}
+
+	m, ok := c.server.methods[method]
+	if !ok {
+		return nil, fmt.Errorf("rpc: can't find method %s", method)
+	}
+	req := reflect.New(m.req)
+	if err := dec.DecodeValue(req); err != nil {
+		return nil, fmt.Errorf("malformed request for %s: %v", method, err)
+	}
+	resp := reflect.New(m.resp)
+	args := []reflect.Value{req, resp}
+	if m.withContext {
+		args = []reflect.Value{reflect.ValueOf(c.server), reflect.ValueOf(&ctx).Elem(), req, resp}
+	}
+	if err, _ := m.fn.Call(args)[0].Interface().(error); err != nil {
+		return nil, err
+	}
+	return resp.Interface(), nil
+}
+
+// failedReply stands in for the response of a failed call (gob can't send nil)
+type failedReply struct {
+	Failed bool
+}
+
+// reply sends the result of a call. Like net/rpc, a failed call carries only the error.
+func (c *muxConn) reply(stream uint32, callErr error, resp interface{}) {
+	var header replyHeader
+	if callErr != nil {
+		header.Error = callErr.Error()
+		resp = failedReply{true}
+	}
+	msg, err := encodeMessage(header, resp)
+	if err != nil {
+		msg, _ = encodeMessage(replyHeader{Error: "failed to encode reply: " + err.Error()}, failedReply{true})
+	}
+	for _, f := range fragments(frameReply, stream, msg) {
+		if err := c.write(f); err != nil {
+			return
+		}
+	}
+}
+
+func (c *muxConn) write(f frame) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return writeFrame(c.conn, f)
+}
+
+// streamWriter sends what a stream handler writes as data frames
+type streamWriter struct {
+	conn   *muxConn
+	stream uint32
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	for _, f := range fragments(frameData, w.stream, p) {
+		f.flags = 0
+		if err := w.conn.write(f); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// execStream runs a command like Exec, streaming its output; cancelling the call kills it
+func (s *LivePatchServer) execStream(ctx context.Context, dec *gob.Decoder, out io.Writer) (interface{}, error) {
+	var req CommandRequest
+	if err := dec.Decode(&req); err != nil {
+		return nil, err
+	}
+	argv, err := s.Policy.Command(req.Command)
+	if err != nil {
+		return nil, err
+	}
+	req.Command = argv
+
+	cmd, cmdCtx, cancel, err := s.command(ctx, &req)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	// With the same writer for both, exec.Cmd never calls Write concurrently
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	logger.Log.Info("Executing command: " + strings.Join(argv, " "))
+	err = timedOut(cmdCtx, reaper.Run(cmd))
+	resp := &CommandResponse{Success: err == nil, ExitCode: exitCode(cmd, err)}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp, nil
+}
+
+// followLogs streams a log source from req.Offset on until the call is cancelled
+func (s *LivePatchServer) followLogs(ctx context.Context, dec *gob.Decoder, out io.Writer) (interface{}, error) {
+	var req LogsRequest
+	if err := dec.Decode(&req); err != nil {
+		return nil, err
+	}
+	var resp LogsResponse
+	if err := s.Logs(&LogsRequest{Source: req.Source, Offset: -1}, &resp); err != nil {
+		return nil, err
+	}
+	buf := s.LogSources[resp.Source]
+
+	offset := req.Offset
+	for ctx.Err() == nil {
+		output, next, dropped := buf.read(offset, logPollWait)
+		if dropped {
+			io.WriteString(out, "... (older output dropped)\n")
+		}
+		if len(output) > 0 {
+			if _, err := out.Write(output); err != nil {
+				return nil, err
+			}
+		}
+		offset = next
+	}
+	resp.Offset = offset
+	return &resp, nil
+}
@@ -0,0 +1,290 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// muxClientFor serves s over an in-memory connection and returns a client
+// speaking the multiplexed protocol to it
+func muxClientFor(t testing.TB, s *LivePatchServer) *LivePatchClient {
+	clientConn, serverConn := net.Pipe()
+	registerMethods(t, s)
+	go s.serveConn(serverConn)
+	mux, err := handshake(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &LivePatchClient{mux: mux}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// registerMethods sets s up to serve both protocols, as Start does
+func registerMethods(t testing.TB, s *LivePatchServer) {
+	s.rpcServer = rpc.NewServer()
+	if err := s.rpcServer.Register(s); err != nil {
+		t.Fatal(err)
+	}
+	s.methods = unaryMethods(s)
+}
+
+// stagedWrite starts a transaction on the agent that writes content to rel
+func stagedWrite(t *testing.T, client *LivePatchClient, rel, content string) string {
+	txID, err := client.BeginTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.SyncFile(&FileSyncRequest{RelativePath: rel, Content: []byte(content), Mode: 0644, TxID: txID}); err != nil {
+		t.Fatal(err)
+	}
+	return txID
+}
+
+func TestCommitAfterCallEndedWritesNothing(t *testing.T) {
+	s, _ := testServer(t)
+	client := muxClientFor(t, s)
+	txID := stagedWrite(t, client, "src/a.txt", "new")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := s.commitTx(ctx, &TxRequest{TxID: txID}, &FileSyncResponse{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("commitTx = %v, want it to give up", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.BasePath, "src", "a.txt")); !os.IsNotExist(err) {
+		t.Error("the file was written after the call ended")
+	}
+	entries, _ := os.ReadDir(filepath.Join(s.BasePath, "src"))
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != "" && entry.Type().IsRegular() {
+			t.Errorf("staged file %s was left behind", entry.Name())
+		}
+	}
+}
+
+func TestAbandonedCommitIsRolledBack(t *testing.T) {
+	s, _ := testServer(t)
+	target := filepath.Join(s.BasePath, "src", "a.txt")
+	if err := os.WriteFile(target, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := muxClientFor(t, s)
+	txID := stagedWrite(t, client, "src/a.txt", "new")
+
+	client.Timeout = 300 * time.Millisecond
+	start := time.Now()
+	// Only the first run hangs: after the rollback the command runs again to restart the old version
+	_, err := client.CommitTx(txID, `sh -c "[ -e slept ] || { touch slept; sleep 10; }"`)
+	if !errors.Is(err, ErrOutcomeUnknown) {
+		t.Fatalf("CommitTx = %v, want ErrOutcomeUnknown", err)
+	}
+
+	// History waits for the agent to finish with the commit
+	client.Timeout = 0
+	patches, err := client.History(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("the post-sync command wasn't stopped")
+	}
+	if len(patches) != 1 || patches[0].Status != PatchRolledBack {
+		t.Fatalf("history = %+v, want the patch rolled back", patches)
+	}
+	if content, _ := os.ReadFile(target); string(content) != "old" {
+		t.Errorf("content = %q, want the old version back", content)
+	}
+}
+
+func TestCallNeverSentIsNotUnknown(t *testing.T) {
+	s, _ := testServer(t)
+	client := muxClientFor(t, s)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := client.WithContext(ctx).CommitTx("x", "")
+	if !errors.Is(err, context.Canceled) || errors.Is(err, ErrOutcomeUnknown) {
+		t.Errorf("CommitTx = %v, want a plain cancellation", err)
+	}
+}
+
+func TestMuxRoundTrip(t *testing.T) {
+	s, _ := testServer(t)
+	client := muxClientFor(t, s)
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"one frame", 100},
+		// both the call and the reply are split into fragments
+		{"fragmented", 3*maxFrameSize + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := bytes.Repeat([]byte("x"), tt.size)
+			if _, err := client.SyncFile(&FileSyncRequest{RelativePath: "src/" + tt.name, Content: content, Mode: 0644}); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.ReadFile("src/"+tt.name, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(resp.Content, content) {
+				t.Errorf("read back %d bytes, want %d", len(resp.Content), tt.size)
+			}
+		})
+	}
+}
+
+func TestMuxErrorsLookLikeNetRPC(t *testing.T) {
+	s, _ := testServer(t)
+	client := muxClientFor(t, s)
+	_, err := client.ReadFile("../outside", 0)
+	var serverErr rpc.ServerError
+	if !errors.As(err, &serverErr) {
+		t.Errorf("ReadFile = %T %v, want an rpc.ServerError", err, err)
+	}
+}
+
+func TestFrameLimits(t *testing.T) {
+	var buf bytes.Buffer
+	writeFrame(&buf, frame{typ: frameCall, stream: 1, payload: make([]byte, maxFrameSize+1)})
+	if _, err := readFrame(&buf); err == nil {
+		t.Error("readFrame accepted a frame over the limit")
+	}
+
+	r := newReassembler()
+	chunk := make([]byte, maxFrameSize)
+	var err error
+	for size := 0; size <= maxMessageSize && err == nil; size += len(chunk) {
+		_, _, err = r.add(frame{typ: frameCall, flags: flagMore, stream: 1, payload: chunk})
+	}
+	if err == nil {
+		t.Fatal("reassembler accepted a message over the limit")
+	}
+	if r.size != 0 {
+		t.Errorf("%d bytes still buffered after dropping the message", r.size)
+	}
+
+	r = newReassembler()
+	for stream := uint32(1); stream <= maxConcurrentCalls; stream++ {
+		if _, _, err := r.add(frame{typ: frameCall, flags: flagMore, stream: stream, payload: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := r.add(frame{typ: frameCall, flags: flagMore, stream: maxConcurrentCalls + 1, payload: []byte("x")}); err == nil {
+		t.Error("reassembler accepted more fragmented messages than calls allowed")
+	}
+}
+
+func TestMuxCancelStopsCommand(t *testing.T) {
+	s, _ := testServer(t)
+	client := muxClientFor(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := client.WithContext(ctx).Exec(&CommandRequest{Command: []string{"sleep", "10"}}, io.Discard)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Exec = %v, want it cancelled", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("cancelling didn't stop the call")
+	}
+	// The connection is still usable
+	if _, err := client.Stat("src"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSlowStreamFailsAlone(t *testing.T) {
+	s, _ := testServer(t)
+	client := muxClientFor(t, s)
+
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		first := true
+		_, err := client.Exec(&CommandRequest{Command: []string{"head", "-c", strconv.Itoa(2 * maxQueuedData), "/dev/zero"}}, writerFunc(func(p []byte) (int, error) {
+			if first {
+				first = false
+				<-release
+			}
+			return len(p), nil
+		}))
+		done <- err
+	}()
+
+	// Other calls go through while the stream's consumer is stuck
+	time.Sleep(100 * time.Millisecond)
+	if _, err := client.Stat("src"); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "faster than it was consumed") {
+		t.Errorf("Exec = %v, want it to fail for falling behind", err)
+	}
+	if _, err := client.Stat("src"); err != nil {
+		t.Error(err)
+	}
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// TestLegacyFallback checks both sides of talking to the other protocol version
+func TestLegacyFallback(t *testing.T) {
+	s, _ := testServer(t)
+	registerMethods(t, s)
+
+	t.Run("client to legacy agent", func(t *testing.T) {
+		// A real socket: a legacy agent hangs up without reading all of the hello
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go func() {
+			if conn, err := ln.Accept(); err == nil {
+				s.rpcServer.ServeConn(conn)
+			}
+		}()
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := handshake(conn); !errors.Is(err, errNotMultiplexed) {
+			t.Errorf("handshake = %v, want errNotMultiplexed", err)
+		}
+	})
+
+	t.Run("legacy client to agent", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		go s.serveConn(serverConn)
+		client := &LivePatchClient{client: rpc.NewClient(clientConn)}
+		defer client.Close()
+		if client.Protocol() != ProtocolLegacy {
+			t.Errorf("Protocol = %d", client.Protocol())
+		}
+		resp, err := client.Stat("src")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resp.Exists || !resp.IsDir {
+			t.Errorf("Stat = %+v, want a directory", resp)
+		}
+	})
+}
@@ -0,0 +1,162 @@
+package transport
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/velocity-trinity/core/pkg/glob"
+)
+
+// Policy restricts what clients may do on the agent. It's read from a YAML file:
+//
+//	hooks:                  # named commands clients refer to by name, e.g. --restart=restart
+//	  restart: ["npm", "run", "restart"]
+//	commands:               # exact argv clients may run with exec or as a post-sync command
+//	  - ["npm", "test"]
+//	writable:               # globs of files clients may write or delete (default: everything)
+//	  - "src/**"
+//	env:                    # variables clients may set for commands (default: none)
+//	  - DEBUG
+//	dirs:                   # globs of directories clients may run commands in (default: only the base path)
+//	  - "services/*"
+//
+// Hook names are case-insensitive: the file's keys are read lowercased.
+// Without a policy, every command and path is allowed.
+type Policy struct {
+	Hooks    map[string][]string `mapstructure:"hooks"`
+	Commands [][]string          `mapstructure:"commands"`
+	Writable []string            `mapstructure:"writable"`
+	Env      []string            `mapstructure:"env"`
+	Dirs     []string            `mapstructure:"dirs"`
+}
+
+// LoadPolicy reads and validates a policy file
+func LoadPolicy(file string) (*Policy, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("error reading policy file: %w", err)
+	}
+
+	var p Policy
+	if err := v.Unmarshal(&p); err != nil {
+		return nil, fmt.Errorf("unable to decode policy: %w", err)
+	}
+
+	for name, argv := range p.Hooks {
+		if len(argv) == 0 {
+			return nil, fmt.Errorf("policy: hook %q has an empty command", name)
+		}
+	}
+	for i, argv := range p.Commands {
+		if len(argv) == 0 {
+			return nil, fmt.Errorf("policy: commands[%d] is empty", i)
+		}
+	}
+	for i, pattern := range p.Writable {
+		// "src/" means the whole subtree
+		if strings.HasSuffix(pattern, "/") {
+			p.Writable[i] = pattern + "**"
+		}
+		if !glob.Valid(p.Writable[i]) {
+			return nil, fmt.Errorf("policy: writable[%d]: invalid glob %q", i, pattern)
+		}
+	}
+	for i, name := range p.Env {
+		if name == "" || strings.Contains(name, "=") {
+			return nil, fmt.Errorf("policy: env[%d]: invalid variable name %q", i, name)
+		}
+	}
+	for i, pattern := range p.Dirs {
+		if !glob.Valid(pattern) {
+			return nil, fmt.Errorf("policy: dirs[%d]: invalid glob %q", i, pattern)
+		}
+	}
+	return &p, nil
+}
+
+// Command turns a client's command into the argv to run. A command that is
+// exactly a hook name runs the hook; anything else must be an allowed argv.
+func (p *Policy) Command(argv []string) ([]string, error) {
+	if p == nil {
+		return argv, nil
+	}
+	if len(argv) == 1 {
+		for name, hook := range p.Hooks {
+			if strings.EqualFold(name, argv[0]) {
+				return hook, nil
+			}
+		}
+	}
+	for _, allowed := range p.Commands {
+		if slices.Equal(allowed, argv) {
+			return argv, nil
+		}
+	}
+	for _, hook := range p.Hooks {
+		if slices.Equal(hook, argv) {
+			return argv, nil
+		}
+	}
+	return nil, fmt.Errorf("policy: command %q is not allowed (hooks: %s)", strings.Join(argv, " "), p.hookNames())
+}
+
+// CheckWritable returns an error unless clients may change the file at rel
+func (p *Policy) CheckWritable(rel string) error {
+	if p == nil || len(p.Writable) == 0 {
+		return nil
+	}
+	if glob.MatchAny(p.Writable, path.Clean(rel)) {
+		return nil
+	}
+	return fmt.Errorf("policy: %s is not writable (writable: %s)", rel, strings.Join(p.Writable, ", "))
+}
+
+// CheckEnv returns an error unless clients may set every variable in env
+// ("NAME=value"). An allowed command could otherwise be made to run something
+// else through LD_PRELOAD, PATH, NODE_OPTIONS and the like.
+func (p *Policy) CheckEnv(env []string) error {
+	if p == nil {
+		return nil
+	}
+	for _, pair := range env {
+		name, _, _ := strings.Cut(pair, "=")
+		if !slices.Contains(p.Env, name) {
+			return fmt.Errorf("policy: setting %s is not allowed (env: %s)", name, listOrNone(p.Env))
+		}
+	}
+	return nil
+}
+
+// CheckDir returns an error unless clients may run commands in the directory
+// rel. The base path itself is always allowed.
+func (p *Policy) CheckDir(rel string) error {
+	rel = path.Clean(rel)
+	if p == nil || rel == "." || glob.MatchAny(p.Dirs, rel) {
+		return nil
+	}
+	return fmt.Errorf("policy: running commands in %s is not allowed (dirs: %s)", rel, listOrNone(p.Dirs))
+}
+
+func listOrNone(items []string) string {
+	if len(items) == 0 {
+		return "none"
+	}
+	return strings.Join(items, ", ")
+}
+
+func (p *Policy) hookNames() string {
+	if len(p.Hooks) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(p.Hooks))
+	for name := range p.Hooks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,51 @@
+package transport
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestPolicyHooksIgnoreCase(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	policy := "hooks:\n  Restart: [npm, run, restart]\ncommands:\n  - [npm, test]\n"
+	if err := os.WriteFile(file, []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadPolicy(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restart := []string{"npm", "run", "restart"}
+
+	tests := []struct {
+		argv    []string
+		want    []string
+		wantErr bool
+	}{
+		{argv: []string{"Restart"}, want: restart},
+		{argv: []string{"restart"}, want: restart},
+		{argv: []string{"RESTART"}, want: restart},
+		{argv: restart, want: restart},
+		{argv: []string{"npm", "test"}, want: []string{"npm", "test"}},
+		{argv: []string{"restart", "now"}, wantErr: true},
+		{argv: []string{"NPM", "test"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := p.Command(tt.argv)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Command(%q) error = %v, wantErr %v", tt.argv, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("Command(%q) = %q, want %q", tt.argv, got, tt.want)
+		}
+	}
+
+	// A policy built in code matches regardless of case too
+	p = &Policy{Hooks: map[string][]string{"Deploy": {"make", "deploy"}}}
+	if got, err := p.Command([]string{"deploy"}); err != nil || !slices.Equal(got, []string{"make", "deploy"}) {
+		t.Errorf("Command(deploy) = %q, %v, want the Deploy hook", got, err)
+	}
+}
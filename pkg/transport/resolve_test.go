@@ -0,0 +1,248 @@
+package transport
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/velocity-trinity/core/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// testServer returns an agent whose base path holds a few symlinks, some of
+// which lead outside it, next to a directory that must never be written to
+func testServer(t testing.TB) (*LivePatchServer, string) {
+	logger.Log = zap.NewNop()
+	dir := t.TempDir()
+	base := filepath.Join(dir, "app")
+	outside := filepath.Join(dir, "app-evil")
+	for _, d := range []string{filepath.Join(base, "src", "lib"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"src/escape":   "../../app-evil",
+		"src/absolute": outside,
+		"src/inner":    "lib",
+		"loop":         "loop",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(base, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &LivePatchServer{BasePath: base, StateDir: filepath.Join(base, ".livepatch")}
+	if err := s.open(); err != nil {
+		t.Fatal(err)
+	}
+	return s, outside
+}
+
+// realPath resolves the symlinks in the part of path that exists
+func realPath(path string) string {
+	rest := ""
+	for {
+		real, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(real, rest)
+		}
+		if !errors.Is(err, fs.ErrNotExist) || path == filepath.Dir(path) {
+			return filepath.Join(path, rest)
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = filepath.Dir(path)
+	}
+}
+
+// checkOutside fails if anything was created next to the base path
+func checkOutside(t *testing.T, outside string) {
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 0 {
+		t.Fatalf("%s was written to outside the base path", entries[0].Name())
+	}
+}
+
+var pathSeeds = []string{
+	"src/a.txt", "src/lib/../b.txt", "../app-evil/x", "/etc/passwd", "src/../../app-evil/x",
+	"src/escape/x", "src/absolute/x", "src/inner/x", "loop/x", ".livepatch/history.json",
+	"", ".", "./src//c.txt", "src/escape", "..", "a\\..\\..\\x",
+}
+
+func FuzzResolve(f *testing.F) {
+	for _, seed := range pathSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, rel string) {
+		s, _ := testServer(t)
+		fullPath, err := s.resolve(rel)
+		if err != nil {
+			return
+		}
+		if real := realPath(fullPath); !within(s.base.path, real) {
+			t.Fatalf("resolve(%q) = %s, which leads to %s outside the base path", rel, fullPath, real)
+		}
+		if s.internal(fullPath) {
+			t.Fatalf("resolve(%q) = %s, inside the state dir", rel, fullPath)
+		}
+	})
+}
+
+func FuzzSyncFile(f *testing.F) {
+	for _, seed := range pathSeeds {
+		f.Add(seed, "")
+		f.Add(seed, "../app-evil")
+	}
+	f.Add("src/up", "..")
+	f.Add("src/lib/l", "../escape")
+	f.Add("src/l", "inner/../../../app-evil")
+	f.Fuzz(func(t *testing.T, rel, link string) {
+		s, outside := testServer(t)
+		var resp FileSyncResponse
+		err := s.SyncFile(&FileSyncRequest{RelativePath: rel, Content: []byte("patched"), Mode: 0644, LinkTarget: link}, &resp)
+		checkOutside(t, outside)
+		if err != nil || link == "" {
+			return
+		}
+
+		// A synced symlink must lead somewhere inside the base path (or nowhere, if it loops)
+		fullPath := filepath.Join(s.base.path, filepath.Clean(filepath.FromSlash(rel)))
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			t.Fatalf("synced %q as a symlink, but it isn't one: %v", rel, err)
+		}
+		if real := realPath(filepath.Join(filepath.Dir(fullPath), target)); !within(s.base.path, real) {
+			t.Fatalf("symlink %q -> %q leads to %s outside the base path", rel, link, real)
+		}
+	})
+}
+
+func FuzzRename(f *testing.F) {
+	f.Add("src/lib", "src/moved")
+	f.Add("src/inner", "../app-evil/inner")
+	f.Add("src/escape", "src/lib/escape")
+	f.Add("src", "src/lib/src")
+	f.Add("src/lib/a.txt", "/tmp/a.txt")
+	f.Fuzz(func(t *testing.T, from, to string) {
+		s, outside := testServer(t)
+		if err := os.WriteFile(filepath.Join(s.base.path, "src", "lib", "a.txt"), []byte("a"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var resp FileSyncResponse
+		s.Rename(&RenameRequest{From: from, To: to}, &resp)
+		checkOutside(t, outside)
+	})
+}
+
+// policyServer is testServer with a policy that only allows writing below src,
+// and a link inside src that leads into the protected directory next to it
+func policyServer(t *testing.T) (*LivePatchServer, string) {
+	s, _ := testServer(t)
+	protected := filepath.Join(s.base.path, "protected")
+	if err := os.MkdirAll(protected, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(protected, "keep"), []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(s.base.path, "src", "lib", "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../protected", filepath.Join(s.base.path, "src", "prot")); err != nil {
+		t.Fatal(err)
+	}
+	s.Policy = &Policy{Writable: []string{"src/**"}}
+	return s, protected
+}
+
+// checkProtected fails unless the protected directory holds only its original file
+func checkProtected(t *testing.T, protected string) {
+	t.Helper()
+	entries, err := os.ReadDir(protected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "keep" {
+		t.Fatalf("protected directory was changed: %v", entries)
+	}
+}
+
+func TestWritableThroughSymlink(t *testing.T) {
+	tests := []struct {
+		name string
+		call func(s *LivePatchServer) error
+	}{
+		{"write through linked dir", func(s *LivePatchServer) error {
+			return s.SyncFile(&FileSyncRequest{RelativePath: "src/prot/x", Content: []byte("x"), Mode: 0644}, &FileSyncResponse{})
+		}},
+		{"overwrite through linked dir", func(s *LivePatchServer) error {
+			return s.SyncFile(&FileSyncRequest{RelativePath: "src/prot/keep", Content: []byte("x"), Mode: 0644}, &FileSyncResponse{})
+		}},
+		{"delete through linked dir", func(s *LivePatchServer) error {
+			return s.DeleteFile(&DeleteFileRequest{RelativePath: "src/prot/keep"}, &FileSyncResponse{})
+		}},
+		{"link into protected dir", func(s *LivePatchServer) error {
+			return s.SyncFile(&FileSyncRequest{RelativePath: "src/l", LinkTarget: "../protected"}, &FileSyncResponse{})
+		}},
+		{"link to a link into protected dir", func(s *LivePatchServer) error {
+			return s.SyncFile(&FileSyncRequest{RelativePath: "src/lib/l", LinkTarget: "../prot"}, &FileSyncResponse{})
+		}},
+		{"staged write through linked dir", func(s *LivePatchServer) error {
+			var begin BeginTxResponse
+			if err := s.BeginTx(&BeginTxRequest{}, &begin); err != nil {
+				return err
+			}
+			err := s.SyncFile(&FileSyncRequest{RelativePath: "src/prot/x", Content: []byte("x"), Mode: 0644, TxID: begin.TxID}, &FileSyncResponse{})
+			s.CommitTx(&TxRequest{TxID: begin.TxID}, &FileSyncResponse{})
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, protected := policyServer(t)
+			if err := tt.call(s); err == nil {
+				t.Error("expected the policy to refuse it")
+			}
+			checkProtected(t, protected)
+		})
+	}
+}
+
+func TestWritableAllowsLinksWithin(t *testing.T) {
+	s, _ := policyServer(t)
+	if err := s.SyncFile(&FileSyncRequest{RelativePath: "src/lib/b.txt", Content: []byte("b"), Mode: 0644}, &FileSyncResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SyncFile(&FileSyncRequest{RelativePath: "src/inner/c.txt", Content: []byte("c"), Mode: 0644}, &FileSyncResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SyncFile(&FileSyncRequest{RelativePath: "src/l", LinkTarget: "lib"}, &FileSyncResponse{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenameAcrossLink(t *testing.T) {
+	tests := []struct{ from, to string }{
+		{"src/lib/a.txt", "src/prot/a.txt"},
+		{"src/lib", "src/prot/lib"},
+		{"src/lib/a.txt", "src/prot/new/a.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.from+" to "+tt.to, func(t *testing.T) {
+			s, protected := policyServer(t)
+			if err := s.Rename(&RenameRequest{From: tt.from, To: tt.to}, &FileSyncResponse{}); err == nil {
+				t.Error("expected the move to be refused")
+			}
+			checkProtected(t, protected)
+			if _, err := os.Stat(filepath.Join(s.base.path, "src", "lib", "a.txt")); err != nil {
+				t.Errorf("source was changed: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// baseDir anchors file operations to a directory, openat-style: paths are
+// opened relative to a handle on the directory, and a symlink that leads out
+// of it fails the operation. A symlink swapped in after a path was checked
+// therefore can't redirect a write outside the base path.
+//
+// Its methods take absolute paths below path, like the rest of the agent.
+type baseDir struct {
+	root *os.Root
+	// path is absolute with symlinks resolved
+	path string
+}
+
+func openBaseDir(dir string) (*baseDir, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, err
+	}
+	root, err := os.OpenRoot(real)
+	if err != nil {
+		return nil, err
+	}
+	return &baseDir{root: root, path: real}, nil
+}
+
+// within reports whether path is dir or below it; both must be clean and absolute
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && filepath.IsLocal(rel)
+}
+
+// rel turns a path below the base dir into one relative to it
+func (b *baseDir) rel(path string) (string, error) {
+	rel, err := filepath.Rel(b.path, path)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("security violation: %s is outside %s", path, b.path)
+	}
+	return rel, nil
+}
+
+// contains checks that rel, cleaned and relative to the base dir, doesn't lead
+// out of it through a symlink. Only the part of the path that exists is checked.
+func (b *baseDir) contains(rel string) error {
+	real, err := b.evalSymlinks(filepath.Join(b.path, rel))
+	if err != nil {
+		return err
+	}
+	if !within(b.path, real) {
+		return fmt.Errorf("security violation: %s leads outside the base path through a symlink", rel)
+	}
+	return nil
+}
+
+// realRel returns where rel, cleaned and relative to the base dir, really is
+// once symlinks in its directories are followed. The last element isn't
+// followed: writes replace a symlink rather than write through it.
+func (b *baseDir) realRel(rel string) (string, error) {
+	dir, err := b.evalSymlinks(filepath.Join(b.path, filepath.Dir(rel)))
+	if err != nil {
+		return "", err
+	}
+	return b.rel(filepath.Join(dir, filepath.Base(rel)))
+}
+
+// evalSymlinks is filepath.EvalSymlinks for a path whose end may not exist
+// yet: the existing part is resolved and the rest appended
+func (b *baseDir) evalSymlinks(path string) (string, error) {
+	rest := ""
+	for {
+		real, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(real, rest), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) || path == b.path {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = filepath.Dir(path)
+	}
+}
+
+func (b *baseDir) Open(path string) (*os.File, error) {
+	rel, err := b.rel(path)
+	if err != nil {
+		return nil, err
+	}
+	return b.root.Open(rel)
+}
+
+func (b *baseDir) OpenFile(path string, flag int, perm os.FileMode) (*os.File, error) {
+	rel, err := b.rel(path)
+	if err != nil {
+		return nil, err
+	}
+	return b.root.OpenFile(rel, flag, perm)
+}
+
+func (b *baseDir) ReadFile(path string) ([]byte, error) {
+	rel, err := b.rel(path)
+	if err != nil {
+		return nil, err
+	}
+	return b.root.ReadFile(rel)
+}
+
+func (b *baseDir) ReadDir(path string) ([]os.DirEntry, error) {
+	f, err := b.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.ReadDir(-1)
+}
+
+func (b *baseDir) Stat(path string) (os.FileInfo, error) {
+	rel, err := b.rel(path)
+	if err != nil {
+		return nil, err
+	}
+	return b.root.Stat(rel)
+}
+
+func (b *baseDir) Lstat(path string) (os.FileInfo, error) {
+	rel, err := b.rel(path)
+	if err != nil {
+		return nil, err
+	}
+	return b.root.Lstat(rel)
+}
+
+func (b *baseDir) Readlink(path string) (string, error) {
+	rel, err := b.rel(path)
+	if err != nil {
+		return "", err
+	}
+	return b.root.Readlink(rel)
+}
+
+func (b *baseDir) MkdirAll(path string, perm os.FileMode) error {
+	rel, err := b.rel(path)
+	if err != nil {
+		return err
+	}
+	return b.root.MkdirAll(rel, perm)
+}
+
+func (b *baseDir) Remove(path string) error {
+	rel, err := b.rel(path)
+	if err != nil {
+		return err
+	}
+	return b.root.Remove(rel)
+}
+
+func (b *baseDir) RemoveAll(path string) error {
+	rel, err := b.rel(path)
+	if err != nil {
+		return err
+	}
+	return b.root.RemoveAll(rel)
+}
+
+func (b *baseDir) Rename(oldpath, newpath string) error {
+	oldRel, err := b.rel(oldpath)
+	if err != nil {
+		return err
+	}
+	newRel, err := b.rel(newpath)
+	if err != nil {
+		return err
+	}
+	return b.root.Rename(oldRel, newRel)
+}
+
+func (b *baseDir) Link(oldpath, newpath string) error {
+	oldRel, err := b.rel(oldpath)
+	if err != nil {
+		return err
+	}
+	newRel, err := b.rel(newpath)
+	if err != nil {
+		return err
+	}
+	return b.root.Link(oldRel, newRel)
+}
+
+// Symlink creates a link at path; target isn't checked (see checkLink)
+func (b *baseDir) Symlink(target, path string) error {
+	rel, err := b.rel(path)
+	if err != nil {
+		return err
+	}
+	return b.root.Symlink(target, rel)
+}
+
+func (b *baseDir) Chmod(path string, mode os.FileMode) error {
+	rel, err := b.rel(path)
+	if err != nil {
+		return err
+	}
+	return b.root.Chmod(rel, mode)
+}
+
+func (b *baseDir) Lchown(path string, uid, gid int) error {
+	rel, err := b.rel(path)
+	if err != nil {
+		return err
+	}
+	return b.root.Lchown(rel, uid, gid)
+}
+
+func (b *baseDir) Chtimes(path string, atime, mtime time.Time) error {
+	rel, err := b.rel(path)
+	if err != nil {
+		return err
+	}
+	return b.root.Chtimes(rel, atime, mtime)
+}
+
+// Walk is filepath.Walk below the base dir; it doesn't follow symlinks
+func (b *baseDir) Walk(path string, fn filepath.WalkFunc) error {
+	rel, err := b.rel(path)
+	if err != nil {
+		return err
+	}
+	// fs.WalkDir would walk the target of a symlink given as the root
+	info, err := b.root.Lstat(rel)
+	if err != nil || !info.IsDir() {
+		err = fn(path, info, err)
+		if err == filepath.SkipDir || err == filepath.SkipAll {
+			return nil
+		}
+		return err
+	}
+	return fs.WalkDir(b.root.FS(), filepath.ToSlash(rel), func(name string, d fs.DirEntry, err error) error {
+		full := filepath.Join(b.path, filepath.FromSlash(name))
+		if err != nil {
+			return fn(full, nil, err)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return fn(full, nil, err)
+		}
+		return fn(full, info, nil)
+	})
+}
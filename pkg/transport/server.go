@@ -1,85 +1,596 @@
 package transport
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/rpc"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/velocity-trinity/core/pkg/delta"
 	"github.com/velocity-trinity/core/pkg/logger"
+	"github.com/velocity-trinity/core/pkg/supervisor"
 )
 
 // LivePatchServer handles RPC calls
 type LivePatchServer struct {
 	BasePath string
+
+	// Name and Labels identify the agent to discovery and `live-patch agents`
+	Name   string
+	Labels map[string]string
+
+	// StateDir keeps the patch history used for rollbacks; empty disables it
+	StateDir     string
+	HistoryLimit int
+
+	// HealthURL and HealthCommand are checked after every patch; if they don't
+	// pass within HealthTimeout the patch is rolled back
+	HealthURL     string
+	HealthCommand string
+	HealthTimeout time.Duration
+
+	// CommandTimeout bounds post-sync commands, health commands and Exec calls without a timeout
+	CommandTimeout time.Duration
+
+	// Supervisor, if set, runs the application; it is reloaded after every patch
+	// and must stay up for the patch to count as healthy
+	Supervisor *supervisor.Supervisor
+
+	// LogSources are the logs clients can read: the app's output and tailed log files
+	LogSources map[string]*LogBuffer
+
+	// MaxFileSize is the largest file clients may sync, in bytes; 0 means no limit
+	MaxFileSize int64
+
+	// Policy limits the commands clients may run and the files they may change; nil allows everything
+	Policy *Policy
+
+	// Owners picks the owner of synced files; nil leaves them owned by the agent's user
+	Owners *OwnerMap
+
+	// base anchors file operations to BasePath; stateDir is StateDir with symlinks resolved
+	base     *baseDir
+	stateDir string
+	started  time.Time
+
+	mu      sync.Mutex
+	txs     map[string]*transaction
+	execs   map[string]*execution
+	uploads map[string]*upload
+
+	// patchMu serializes commits and rollbacks
+	patchMu sync.Mutex
+	history *patchHistory
+
+	// rpcServer serves legacy (protocol 1) clients, methods multiplexed ones
+	rpcServer *rpc.Server
+	methods   map[string]unaryMethod
 }
 
 // SyncFile is the RPC method called by the client
 func (s *LivePatchServer) SyncFile(req *FileSyncRequest, resp *FileSyncResponse) error {
-	fullPath := filepath.Join(s.BasePath, req.RelativePath)
-	
-	// Security check: Prevent directory traversal outside base path
-	if !filepath.IsAbs(fullPath) {
-		absBase, _ := filepath.Abs(s.BasePath)
-		absFull, _ := filepath.Abs(fullPath)
-		if len(absFull) < len(absBase) || absFull[:len(absBase)] != absBase {
-			return fmt.Errorf("security violation: path traversal detected")
+	return s.syncFile(context.Background(), req, resp)
+}
+
+// syncFile is SyncFile for a call that stops when ctx ends
+func (s *LivePatchServer) syncFile(ctx context.Context, req *FileSyncRequest, resp *FileSyncResponse) error {
+	fullPath, err := s.writable(req.RelativePath)
+	if err != nil {
+		return err
+	}
+	content, err := decompress(req.Compression, req.Content, s.maxContentSize())
+	if err != nil {
+		return fmt.Errorf("%s: %v", req.RelativePath, err)
+	}
+	if err := s.checkSize(req.RelativePath, int64(len(content))); err != nil {
+		return err
+	}
+
+	var tx *transaction
+	if req.TxID != "" {
+		if tx, err = s.tx(req.TxID); err != nil {
+			return err
+		}
+	} else {
+		// Refuse a disallowed command before the file is changed
+		if err := s.allowed(req.PostSyncCommand); err != nil {
+			return err
 		}
+		logger.Log.Info("Syncing file: " + fullPath)
+		tx = newTransaction(s.base, defaultTxTimeout)
 	}
 
-	logger.Log.Info("Syncing file: " + fullPath)
-	
-	dir := filepath.Dir(fullPath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	// Readers of the file see either the old or the new content, never a partial write
+	if err := s.stage(ctx, tx, fullPath, req, content); err != nil {
 		resp.Success = false
-		resp.Message = "Failed to create directory: " + err.Error()
+		resp.Message = err.Error()
 		return err
 	}
+	if req.TxID != "" {
+		logger.Log.Debug("Staged file: " + fullPath)
+		resp.Success = true
+		resp.Message = "File staged"
+		return nil
+	}
 
-	if err := ioutil.WriteFile(fullPath, req.Content, os.FileMode(req.Mode)); err != nil {
+	result, err := s.commit(ctx, tx, req.PostSyncCommand)
+	if err != nil {
 		resp.Success = false
 		resp.Message = "Failed to write file: " + err.Error()
 		return err
 	}
+	// A failed command isn't an RPC error: resp says what happened (and whether it was rolled back)
+	resp.Success, resp.Message = result.describe("File synced")
+	return nil
+}
+
+// runPostSync runs a post-sync command in the base path and returns its
+// combined output. The command is killed when ctx ends.
+func (s *LivePatchServer) runPostSync(ctx context.Context, command string) (string, error) {
+	logger.Log.Info("Executing post-sync command: " + command)
+
+	argv, err := s.postSyncArgv(command)
+	if err != nil {
+		return "", err
+	}
+	output, err := s.run(ctx, argv)
+	if err != nil {
+		logger.Log.Error("Post-sync command failed: " + err.Error())
+		return output, err
+	}
+
+	logger.Log.Info("Command executed successfully")
+	return output, nil
+}
+
+// postSyncArgv splits a post-sync command and checks it against the policy,
+// which may also map a hook name to the hook's command
+func (s *LivePatchServer) postSyncArgv(command string) ([]string, error) {
+	argv, err := splitCommand(command)
+	if err != nil {
+		return nil, err
+	}
+	return s.Policy.Command(argv)
+}
+
+// allowed returns an error if a post-sync command would be refused by the policy
+func (s *LivePatchServer) allowed(command string) error {
+	if command == "" {
+		return nil
+	}
+	_, err := s.postSyncArgv(command)
+	return err
+}
+
+// Signature is the RPC method that returns the block checksums of a file for delta transfer
+func (s *LivePatchServer) Signature(req *SignatureRequest, resp *SignatureResponse) error {
+	fullPath, err := s.resolve(req.RelativePath)
+	if err != nil {
+		return err
+	}
+
+	content, err := s.base.ReadFile(fullPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Exists = true
+	resp.Signature = *delta.Sign(content, delta.BlockSizeFor(int64(len(content))))
+	return nil
+}
+
+// ApplyDelta is the RPC method that rebuilds a file from its current content and a delta.
+// The result must match the client's hash; otherwise the client falls back to SyncFile.
+func (s *LivePatchServer) ApplyDelta(req *DeltaSyncRequest, resp *FileSyncResponse) error {
+	return s.applyDelta(context.Background(), req, resp)
+}
+
+// applyDelta is ApplyDelta for a call that stops when ctx ends
+func (s *LivePatchServer) applyDelta(ctx context.Context, req *DeltaSyncRequest, resp *FileSyncResponse) error {
+	fullPath, err := s.resolve(req.RelativePath)
+	if err != nil {
+		return err
+	}
+
+	old, err := s.base.ReadFile(fullPath)
+	if err != nil {
+		return err
+	}
+	// A small delta can copy the same blocks over and over: check what it
+	// expands to before building it
+	size, err := delta.OutputSize(int64(len(old)), req.BlockSize, req.Ops)
+	if err != nil {
+		return err
+	}
+	if err := s.checkSize(req.RelativePath, size); err != nil {
+		return err
+	}
+	if size > s.maxContentSize() {
+		return fmt.Errorf("%s: delta expands to %d bytes, more than the %d byte limit", req.RelativePath, size, s.maxContentSize())
+	}
+	content, err := delta.Apply(old, req.BlockSize, req.Ops)
+	if err != nil {
+		return err
+	}
+	if sha256Hex(content) != req.Hash {
+		return fmt.Errorf("checksum mismatch after applying delta to %s", req.RelativePath)
+	}
+
+	return s.syncFile(ctx, &FileSyncRequest{
+		RelativePath:    req.RelativePath,
+		Content:         content,
+		Mode:            req.Mode,
+		Timestamp:       req.Timestamp,
+		Owner:           req.Owner,
+		PostSyncCommand: req.PostSyncCommand,
+		TxID:            req.TxID,
+	}, resp)
+}
+
+// ListFiles is the RPC method that reports the files below a directory, with their hashes
+func (s *LivePatchServer) ListFiles(req *ListFilesRequest, resp *ListFilesResponse) error {
+	root, err := s.resolve(req.RelativePath)
+	if err != nil {
+		return err
+	}
+	resp.Owners = s.Owners
+	err = s.base.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == root {
+			// Nothing synced yet
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && s.internal(path) {
+			return filepath.SkipDir
+		}
+		isLink := info.Mode()&os.ModeSymlink != 0
+		if !info.Mode().IsRegular() && !isLink || strings.HasPrefix(info.Name(), tempPrefix) {
+			return nil
+		}
+
+		file, err := s.describe(path, info)
+		if err != nil {
+			return err
+		}
+		resp.Files = append(resp.Files, file)
+		return nil
+	})
+	return err
+}
+
+// describe reads the hash of a regular file, or the target of a symlink
+func (s *LivePatchServer) describe(path string, info os.FileInfo) (RemoteFile, error) {
+	file := RemoteFile{
+		RelativePath: s.relPath(path),
+		Size:         info.Size(),
+		Mode:         uint32(info.Mode()),
+		ModTime:      info.ModTime(),
+	}
+	if s.Owners != nil {
+		file.Owner = OwnerOf(info)
+	}
+	var err error
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		var target string
+		target, err = s.base.Readlink(path)
+		file.LinkTarget = filepath.ToSlash(target)
+	case info.Mode().IsRegular():
+		file.Hash, err = hashFile(s.base, path)
+	}
+	return file, err
+}
+
+// Stat is the RPC method that describes one path, with its hash if it's a regular file
+func (s *LivePatchServer) Stat(req *StatRequest, resp *StatResponse) error {
+	fullPath, err := s.resolve(req.RelativePath)
+	if err != nil {
+		return err
+	}
+	resp.Owners = s.Owners
+	info, err := s.base.Lstat(fullPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	resp.Exists, resp.IsDir = true, info.IsDir()
+	resp.File, err = s.describe(fullPath, info)
+	return err
+}
+
+// MaxReadSize caps the content ReadFile returns
+const MaxReadSize = 16 << 20
+
+// ReadFile is the RPC method that returns the content of a regular file, up to a limit
+func (s *LivePatchServer) ReadFile(req *ReadFileRequest, resp *ReadFileResponse) error {
+	fullPath, err := s.resolve(req.RelativePath)
+	if err != nil {
+		return err
+	}
+	info, err := s.base.Lstat(fullPath)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", req.RelativePath)
+	}
 
-	// Post-Sync Command Execution
-	if req.PostSyncCommand != "" {
-		logger.Log.Info("Executing post-sync command: " + req.PostSyncCommand)
-		
-		// Split command string carefully (this is simple, ignores quotes)
-		parts := strings.Fields(req.PostSyncCommand)
-		head := parts[0]
-		args := parts[1:]
+	limit := req.Limit
+	if limit <= 0 || limit > MaxReadSize {
+		limit = MaxReadSize
+	}
+	f, err := s.base.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if resp.Content, err = io.ReadAll(io.LimitReader(f, limit)); err != nil {
+		return err
+	}
+	resp.Size = info.Size()
+	resp.Truncated = resp.Size > int64(len(resp.Content))
+	return nil
+}
 
-		cmd := exec.Command(head, args...)
-		cmd.Dir = s.BasePath // Execute in project root
-		
-		output, err := cmd.CombinedOutput()
+// DeleteFile is the RPC method that removes a file, along with any directories it leaves empty
+func (s *LivePatchServer) DeleteFile(req *DeleteFileRequest, resp *FileSyncResponse) error {
+	return s.deleteFile(context.Background(), req, resp)
+}
+
+// deleteFile is DeleteFile for a call that stops when ctx ends
+func (s *LivePatchServer) deleteFile(ctx context.Context, req *DeleteFileRequest, resp *FileSyncResponse) error {
+	fullPath, err := s.writable(req.RelativePath)
+	if err != nil {
+		return err
+	}
+
+	if req.TxID != "" {
+		tx, err := s.tx(req.TxID)
 		if err != nil {
-			logger.Log.Error("Post-sync command failed: " + err.Error())
-			resp.Success = false
-			resp.Message = fmt.Sprintf("File synced, but command failed: %s\nOutput: %s", err.Error(), string(output))
-			return nil // Return nil error so RPC succeeds, but resp indicates failure
-		}
-		
-		logger.Log.Info("Command executed successfully")
-		resp.Message = fmt.Sprintf("File synced and command executed: %s", string(output))
+			return err
+		}
+		if err := tx.stageDelete(fullPath); err != nil {
+			return err
+		}
+		resp.Success = true
+		resp.Message = "Deletion staged"
+		return nil
+	}
+
+	logger.Log.Info("Deleting file: " + fullPath)
+	tx := newTransaction(s.base, defaultTxTimeout)
+	if err := tx.stageDelete(fullPath); err != nil {
+		return err
+	}
+	if _, err := s.commit(ctx, tx, ""); err != nil {
+		resp.Message = "Failed to delete file: " + err.Error()
+		return err
+	}
+
+	resp.Success = true
+	resp.Message = "File deleted"
+	return nil
+}
+
+// Rename is the RPC method that moves a file, symlink or directory tree,
+// replacing files already at the new path. Every file is staged at its new
+// path and deleted from the old one, so a move is one patch and can be rolled back.
+func (s *LivePatchServer) Rename(req *RenameRequest, resp *FileSyncResponse) error {
+	return s.rename(context.Background(), req, resp)
+}
+
+// rename is Rename for a call that stops when ctx ends
+func (s *LivePatchServer) rename(ctx context.Context, req *RenameRequest, resp *FileSyncResponse) error {
+	from, err := s.writable(req.From)
+	if err != nil {
+		return err
+	}
+	to, err := s.writable(req.To)
+	if err != nil {
+		return err
+	}
+	if _, err := s.base.Lstat(from); err != nil {
+		return err
+	}
+	if to == from || strings.HasPrefix(to, from+string(filepath.Separator)) {
+		return fmt.Errorf("can't move %s into itself", req.From)
+	}
+
+	var tx *transaction
+	if req.TxID != "" {
+		if tx, err = s.tx(req.TxID); err != nil {
+			return err
+		}
 	} else {
-		resp.Message = "File synced successfully"
+		logger.Log.Info(fmt.Sprintf("Moving %s to %s", from, to))
+		tx = newTransaction(s.base, defaultTxTimeout)
 	}
 
+	err = s.base.Walk(from, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), tempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(from, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(to, rel)
+		// Each file must be writable at both ends
+		if _, err := s.writable(s.relPath(path)); err != nil {
+			return err
+		}
+		if _, err := s.writable(s.relPath(target)); err != nil {
+			return err
+		}
+		return s.stageMove(tx, path, target)
+	})
+	if err != nil {
+		if req.TxID == "" {
+			tx.discard()
+		}
+		return err
+	}
+
+	if req.TxID != "" {
+		resp.Success = true
+		resp.Message = "Move staged"
+		return nil
+	}
+	if _, err := s.commit(ctx, tx, ""); err != nil {
+		resp.Message = "Failed to move: " + err.Error()
+		return err
+	}
 	resp.Success = true
+	resp.Message = "Moved"
+	return nil
+}
+
+// pruneEmptyDirs removes dir and its parents while they are empty, stopping at the base path
+func (s *LivePatchServer) pruneEmptyDirs(dir string) {
+	for ; dir != s.base.path && within(s.base.path, dir); dir = filepath.Dir(dir) {
+		// Fails (and stops) at the first directory that still has entries
+		if s.base.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// resolve maps a client path to a path below the base path. The path may not
+// lead outside it, whether through ".." or a symlink, or into the agent's state.
+func (s *LivePatchServer) resolve(rel string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(rel))
+	if !filepath.IsLocal(clean) {
+		return "", fmt.Errorf("security violation: %s is outside the base path", rel)
+	}
+	if err := s.base.contains(clean); err != nil {
+		return "", err
+	}
+
+	fullPath := filepath.Join(s.base.path, clean)
+	if s.internal(fullPath) {
+		return "", fmt.Errorf("%s is reserved for the agent's state", rel)
+	}
+	return fullPath, nil
+}
+
+// writable resolves a path the client wants to change, refusing paths outside
+// the policy's writable subtrees. The policy is checked where the write lands,
+// so a symlinked directory can't lead into a protected subtree.
+func (s *LivePatchServer) writable(rel string) (string, error) {
+	fullPath, err := s.resolve(rel)
+	if err != nil {
+		return "", err
+	}
+	if err := s.checkWritable(fullPath); err != nil {
+		return "", err
+	}
+	return fullPath, nil
+}
+
+// checkWritable applies the policy to fullPath with its directories' symlinks resolved
+func (s *LivePatchServer) checkWritable(fullPath string) error {
+	if s.Policy == nil || len(s.Policy.Writable) == 0 {
+		return nil
+	}
+	rel, err := s.base.rel(fullPath)
+	if err != nil {
+		return err
+	}
+	real, err := s.base.realRel(rel)
+	if err != nil {
+		return err
+	}
+	if err := s.Policy.CheckWritable(filepath.ToSlash(real)); err != nil {
+		if real != rel {
+			return fmt.Errorf("%v (%s leads there through a symlink)", err, filepath.ToSlash(rel))
+		}
+		return err
+	}
+	return nil
+}
+
+// internal reports whether path is inside the state dir (which may live under the base path)
+func (s *LivePatchServer) internal(path string) bool {
+	return s.stateDir != "" && within(s.stateDir, path)
+}
+
+// relPath turns a path below the base path into the slash-separated path clients use
+func (s *LivePatchServer) relPath(fullPath string) string {
+	rel, err := s.base.rel(fullPath)
+	if err != nil {
+		return filepath.ToSlash(fullPath)
+	}
+	return filepath.ToSlash(rel)
+}
+
+func sha256Hex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func hashFile(dir *baseDir, path string) (string, error) {
+	f, err := dir.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// open opens the base path and the patch history
+func (s *LivePatchServer) open() error {
+	base, err := openBaseDir(s.BasePath)
+	if err != nil {
+		return fmt.Errorf("failed to open base path: %v", err)
+	}
+	s.base = base
+	s.started = time.Now()
+
+	if s.StateDir != "" {
+		history, err := openHistory(s.StateDir, s.HistoryLimit)
+		if err != nil {
+			return fmt.Errorf("failed to open patch history: %v", err)
+		}
+		s.history = history
+		s.stateDir = history.dir.path
+	}
 	return nil
 }
 
 // StartServer starts the RPC server
-func StartServer(port string, basePath string, tlsConfig *tls.Config) error {
-	server := &LivePatchServer{BasePath: basePath}
-	rpc.Register(server)
+func StartServer(port string, server *LivePatchServer, tlsConfig *tls.Config) error {
+	if err := server.open(); err != nil {
+		return err
+	}
+	server.rpcServer = rpc.NewServer()
+	if err := server.rpcServer.Register(server); err != nil {
+		return err
+	}
+	server.methods = unaryMethods(server)
+	go server.sweepTxs()
 
 	listener, err := tls.Listen("tcp", ":"+port, tlsConfig)
 	if err != nil {
@@ -94,6 +605,6 @@ func StartServer(port string, basePath string, tlsConfig *tls.Config) error {
 			logger.Log.Error("Accept error: " + err.Error())
 			continue
 		}
-		go rpc.ServeConn(conn)
+		go server.serveConn(conn)
 	}
 }
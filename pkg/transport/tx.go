@@ -0,0 +1,494 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/velocity-trinity/core/pkg/logger"
+)
+
+// tempPrefix marks files the agent creates next to their targets while writing.
+// They are hidden from ListFiles.
+const tempPrefix = ".livepatch-"
+
+// defaultTxTimeout is how long an uncommitted transaction is kept after its last use before it's discarded
+const defaultTxTimeout = 10 * time.Minute
+
+// txSweepInterval is how often the agent looks for abandoned transactions
+const txSweepInterval = time.Minute
+
+// transaction holds files staged next to their targets until commit.
+// Single-file syncs use a transaction too, so every change goes through commit.
+type transaction struct {
+	// mu guards the maps below; commit holds it while applying them
+	mu  sync.Mutex
+	dir *baseDir
+	// expires is pushed back by timeout whenever the transaction is used. It's guarded by the server's mu.
+	expires time.Time
+	timeout time.Duration
+	// closed is set once the transaction is committed or discarded; staging
+	// into it then fails, since a call may still be in flight when it happens
+	closed bool
+	// writes maps target path -> staged temp file
+	writes map[string]string
+	// modes maps target path -> mode of the staged file
+	modes map[string]os.FileMode
+	// deletes are targets to remove on commit
+	deletes map[string]bool
+	// cleanupErr is set by apply if a deleted directory couldn't be removed
+	// completely; the change is still applied
+	cleanupErr error
+}
+
+func newTransaction(dir *baseDir, timeout time.Duration) *transaction {
+	return &transaction{
+		dir:     dir,
+		expires: time.Now().Add(timeout),
+		timeout: timeout,
+		writes:  make(map[string]string),
+		modes:   make(map[string]os.FileMode),
+		deletes: make(map[string]bool),
+	}
+}
+
+// BeginTx is the RPC method that starts a transaction. Files synced or deleted
+// with its TxID are staged and only become visible on CommitTx.
+func (s *LivePatchServer) BeginTx(req *BeginTxRequest, resp *BeginTxResponse) error {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	timeout := defaultTxTimeout
+	if req.Timeout > 0 {
+		timeout = time.Duration(req.Timeout) * time.Second
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.txs == nil {
+		s.txs = make(map[string]*transaction)
+	}
+	s.expireTxs()
+
+	resp.TxID = hex.EncodeToString(id)
+	s.txs[resp.TxID] = newTransaction(s.base, timeout)
+	logger.Log.Debug("Started transaction " + resp.TxID)
+	return nil
+}
+
+// CommitTx is the RPC method that applies every staged change, then runs the post-sync command.
+// If any file can't be moved into place, the files already replaced are restored.
+func (s *LivePatchServer) CommitTx(req *TxRequest, resp *FileSyncResponse) error {
+	return s.commitTx(context.Background(), req, resp)
+}
+
+// commitTx is CommitTx for a call that stops when ctx ends
+func (s *LivePatchServer) commitTx(ctx context.Context, req *TxRequest, resp *FileSyncResponse) error {
+	// A refused command leaves the transaction open, so the client can still abort it
+	if err := s.allowed(req.PostSyncCommand); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	tx, ok := s.txs[req.TxID]
+	delete(s.txs, req.TxID)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown transaction %s", req.TxID)
+	}
+
+	result, err := s.commit(ctx, tx, req.PostSyncCommand)
+	if err != nil {
+		resp.Message = "Transaction rolled back: " + err.Error()
+		return err
+	}
+	logger.Log.Info(fmt.Sprintf("Committed transaction %s as patch %d: %d written, %d deleted", req.TxID, result.PatchID, len(tx.writes), len(tx.deletes)))
+
+	resp.Success, resp.Message = result.describe("Changes committed")
+	resp.PatchID = result.PatchID
+	return nil
+}
+
+// AbortTx is the RPC method that discards a transaction
+func (s *LivePatchServer) AbortTx(req *TxRequest, resp *FileSyncResponse) error {
+	s.mu.Lock()
+	tx, ok := s.txs[req.TxID]
+	delete(s.txs, req.TxID)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown transaction %s", req.TxID)
+	}
+
+	tx.discard()
+	resp.Success = true
+	resp.Message = "Transaction aborted"
+	return nil
+}
+
+// stage writes a synced file (or symlink) to a temp file next to fullPath,
+// with the client's attributes, and records it in the transaction. Nothing is
+// written once ctx has ended.
+func (s *LivePatchServer) stage(ctx context.Context, tx *transaction, fullPath string, req *FileSyncRequest, content []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mode := os.FileMode(req.Mode).Perm()
+	if req.LinkTarget != "" {
+		if err := s.checkLink(fullPath, filepath.FromSlash(req.LinkTarget)); err != nil {
+			return err
+		}
+		mode = os.ModeSymlink | 0777
+	}
+	if err := s.base.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	var temp string
+	var err error
+	if req.LinkTarget != "" {
+		temp, err = writeLink(s.base, fullPath, filepath.FromSlash(req.LinkTarget))
+	} else {
+		temp, err = writeTemp(s.base, fullPath, bytes.NewReader(content), mode)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stage file: %v", err)
+	}
+	if err := s.setAttrs(temp, req.Timestamp, req.Owner); err != nil {
+		s.base.Remove(temp)
+		return fmt.Errorf("failed to set owner or timestamp: %v", err)
+	}
+	return tx.stageTemp(fullPath, temp, mode)
+}
+
+// stageMove stages the file or symlink at src to appear at fullPath and src
+// to be deleted. Files are hard linked where possible, so moving is cheap.
+func (s *LivePatchServer) stageMove(tx *transaction, src, fullPath string) error {
+	info, err := s.base.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if err := s.base.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	var temp string
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := s.base.Readlink(src)
+		if err != nil {
+			return err
+		}
+		// A relative link may point somewhere else from its new directory
+		if err := s.checkLink(fullPath, target); err != nil {
+			return err
+		}
+		if temp, err = writeLink(s.base, fullPath, target); err != nil {
+			return err
+		}
+	} else {
+		temp = tempName(fullPath)
+		if s.base.Link(src, temp) != nil {
+			if temp, err = copyTemp(s.base, fullPath, src, info); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tx.stageTemp(fullPath, temp, info.Mode()); err != nil {
+		return err
+	}
+	return tx.stageDelete(src)
+}
+
+// errTxClosed is returned when staging into a transaction that has ended
+var errTxClosed = errors.New("transaction already committed or aborted")
+
+// stageTemp records a file already written next to fullPath (by writeTemp or
+// an upload) as the new content of fullPath. If the transaction has ended,
+// temp is removed.
+func (tx *transaction) stageTemp(fullPath, temp string, mode os.FileMode) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.closed {
+		tx.dir.Remove(temp)
+		return errTxClosed
+	}
+	if previous, ok := tx.writes[fullPath]; ok {
+		tx.dir.Remove(previous)
+	}
+	tx.writes[fullPath] = temp
+	tx.modes[fullPath] = mode
+	delete(tx.deletes, fullPath)
+	return nil
+}
+
+// stageDelete records a deletion in the transaction
+func (tx *transaction) stageDelete(fullPath string) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.closed {
+		return errTxClosed
+	}
+	if previous, ok := tx.writes[fullPath]; ok {
+		tx.dir.Remove(previous)
+		delete(tx.writes, fullPath)
+	}
+	tx.deletes[fullPath] = true
+	return nil
+}
+
+// targets lists every path the transaction changes. Caller must hold tx.mu.
+func (tx *transaction) targets() []string {
+	targets := make([]string, 0, len(tx.writes)+len(tx.deletes))
+	for target := range tx.writes {
+		targets = append(targets, target)
+	}
+	for target := range tx.deletes {
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// tx looks up a transaction for a call that stages into it, and keeps it alive for another timeout
+func (s *LivePatchServer) tx(id string) (*transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, ok := s.txs[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown transaction %s", id)
+	}
+	tx.expires = time.Now().Add(tx.timeout)
+	return tx, nil
+}
+
+// sweepTxs discards abandoned transactions every txSweepInterval, so their
+// staged files don't wait for the next BeginTx to be cleaned up
+func (s *LivePatchServer) sweepTxs() {
+	ticker := time.NewTicker(txSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.Lock()
+		s.expireTxs()
+		s.mu.Unlock()
+	}
+}
+
+// expireTxs drops transactions a client abandoned. Caller must hold s.mu.
+func (s *LivePatchServer) expireTxs() {
+	for id, tx := range s.txs {
+		if time.Now().After(tx.expires) {
+			logger.Log.Warn("Discarding abandoned transaction " + id)
+			tx.discard()
+			delete(s.txs, id)
+		}
+	}
+}
+
+// apply moves the staged files into place. Caller must hold tx.mu. Every target keeps existing
+// throughout: its old version is linked (or copied) to a backup and the new
+// file renamed over it, so readers never miss the file, and a failure
+// part-way can put everything back.
+func (tx *transaction) apply() error {
+	backups := make(map[string]string)
+	var created []string
+
+	restore := func() {
+		for _, target := range created {
+			tx.dir.Remove(target)
+		}
+		for target, backup := range backups {
+			tx.dir.Rename(backup, target)
+		}
+	}
+
+	for target, temp := range tx.writes {
+		backup, err := tx.backup(target)
+		if err != nil {
+			restore()
+			return err
+		}
+		if err := tx.dir.Rename(temp, target); err != nil {
+			if backup != "" {
+				tx.dir.Remove(backup)
+			}
+			restore()
+			return err
+		}
+		if backup == "" {
+			created = append(created, target)
+		} else {
+			backups[target] = backup
+		}
+	}
+
+	// Deleted files are meant to disappear, so they can simply be moved aside
+	deleted := make(map[string]string)
+	for target := range tx.deletes {
+		backup := tempName(target)
+		err := tx.dir.Rename(target, backup)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			restore()
+			return err
+		}
+		backups[target] = backup
+		deleted[target] = backup
+	}
+
+	var errs []error
+	for target, backup := range backups {
+		if _, ok := deleted[target]; !ok {
+			tx.dir.Remove(backup)
+			continue
+		}
+		// A deleted directory takes its whole tree with it
+		if err := tx.dir.RemoveAll(backup); err != nil {
+			rel, _ := tx.dir.rel(target)
+			errs = append(errs, fmt.Errorf("%s was deleted, but some of it is left in %s: %v", rel, filepath.Base(backup), err))
+		}
+	}
+	tx.cleanupErr = errors.Join(errs...)
+	return nil
+}
+
+// backup keeps the current version of target next to it, leaving target in
+// place, and returns its name; "" means there's no target yet
+func (tx *transaction) backup(target string) (string, error) {
+	info, err := tx.dir.Lstat(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := tx.dir.Readlink(target)
+		if err != nil {
+			return "", err
+		}
+		return writeLink(tx.dir, target, link)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", target)
+	}
+	backup := tempName(target)
+	if tx.dir.Link(target, backup) == nil {
+		return backup, nil
+	}
+	return copyTemp(tx.dir, target, target, info)
+}
+
+// discard ends the transaction and removes the staged files
+func (tx *transaction) discard() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.closed = true
+	tx.removeTemps()
+}
+
+// removeTemps removes the staged files. Caller must hold tx.mu.
+func (tx *transaction) removeTemps() {
+	for _, temp := range tx.writes {
+		tx.dir.Remove(temp)
+	}
+}
+
+// replaceLink atomically replaces path with a symlink to target
+func replaceLink(dir *baseDir, path, target string) error {
+	temp, err := writeLink(dir, path, target)
+	if err != nil {
+		return err
+	}
+	if err := dir.Rename(temp, path); err != nil {
+		dir.Remove(temp)
+		return err
+	}
+	return nil
+}
+
+// copyTemp copies src to a new temp file next to path, keeping its mode and modification time
+func copyTemp(dir *baseDir, path, src string, info os.FileInfo) (string, error) {
+	f, err := dir.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	temp, err := writeTemp(dir, path, f, info.Mode())
+	if err != nil {
+		return "", err
+	}
+	if err := dir.Chtimes(temp, info.ModTime(), info.ModTime()); err != nil {
+		dir.Remove(temp)
+		return "", err
+	}
+	return temp, nil
+}
+
+// writeFileAtomic replaces path with content by writing a temp file in the same directory and renaming it
+func writeFileAtomic(dir *baseDir, path string, content []byte, mode os.FileMode) error {
+	return replaceAtomic(dir, path, bytes.NewReader(content), mode)
+}
+
+// copyFileAtomic replaces path in dir with a copy of src in srcDir without reading it all into memory
+func copyFileAtomic(dir *baseDir, path string, srcDir *baseDir, src string, mode os.FileMode) error {
+	f, err := srcDir.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return replaceAtomic(dir, path, f, mode)
+}
+
+func replaceAtomic(dir *baseDir, path string, r io.Reader, mode os.FileMode) error {
+	temp, err := writeTemp(dir, path, r, mode)
+	if err != nil {
+		return err
+	}
+	if err := dir.Rename(temp, path); err != nil {
+		dir.Remove(temp)
+		return err
+	}
+	return nil
+}
+
+// writeTemp writes content to a new temp file next to path and returns its name
+func writeTemp(dir *baseDir, path string, content io.Reader, mode os.FileMode) (string, error) {
+	name := tempName(path)
+	f, err := dir.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, content)
+	if err == nil {
+		err = f.Chmod(mode.Perm())
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		dir.Remove(name)
+		return "", err
+	}
+	return name, nil
+}
+
+// tempName returns an unused name next to path
+func tempName(path string) string {
+	suffix := make([]byte, 6)
+	rand.Read(suffix)
+	return filepath.Join(filepath.Dir(path), tempPrefix+filepath.Base(path)+"-"+hex.EncodeToString(suffix))
+}
@@ -0,0 +1,68 @@
+package transport
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTxExpiresAfterLastUse(t *testing.T) {
+	s, _ := testServer(t)
+	var begun BeginTxResponse
+	if err := s.BeginTx(&BeginTxRequest{Timeout: 1}, &begun); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each use keeps the transaction alive for another timeout
+	for i := 0; i < 3; i++ {
+		time.Sleep(600 * time.Millisecond)
+		if err := s.SyncFile(&FileSyncRequest{RelativePath: "src/a.txt", Content: []byte("x"), TxID: begun.TxID}, &FileSyncResponse{}); err != nil {
+			t.Fatalf("use %d: %v", i, err)
+		}
+	}
+
+	s.mu.Lock()
+	s.expireTxs()
+	s.mu.Unlock()
+	if _, err := s.tx(begun.TxID); err != nil {
+		t.Fatal("transaction in use was discarded")
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	s.mu.Lock()
+	s.expireTxs()
+	s.mu.Unlock()
+	if _, err := s.tx(begun.TxID); err == nil {
+		t.Error("idle transaction was kept")
+	}
+}
+
+func TestDeleteDirectory(t *testing.T) {
+	s, _ := testServer(t)
+	dir := filepath.Join(s.BasePath, "src", "old")
+	if err := os.MkdirAll(filepath.Join(dir, "nested"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "nested", "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp FileSyncResponse
+	if err := s.DeleteFile(&DeleteFileRequest{RelativePath: "src/old"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Success || strings.Contains(resp.Message, "left in") {
+		t.Errorf("DeleteFile = %+v", resp)
+	}
+	entries, err := os.ReadDir(filepath.Join(s.BasePath, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() == "old" || strings.HasPrefix(entry.Name(), tempPrefix) {
+			t.Errorf("%s is left behind", entry.Name())
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/velocity-trinity/core/pkg/logger"
+)
+
+const (
+	// DefaultChunkSize is how much of a file one UploadChunk call carries
+	DefaultChunkSize = 1 << 20
+	// StreamMinSize is the smallest file clients upload in chunks instead of in one SyncFile call
+	StreamMinSize = 8 << 20
+
+	maxChunkSize = 16 << 20
+	// uploadPrefix names partial uploads; being temp files, they're hidden from ListFiles
+	uploadPrefix = tempPrefix + "upload-"
+	// uploadRetention is how long an interrupted upload can be resumed
+	uploadRetention = 24 * time.Hour
+)
+
+// upload is a file being received in chunks. The chunks go to a partial file
+// next to the target, so an upload interrupted by a lost connection (or an
+// agent restart) resumes where the last acknowledged chunk ended.
+type upload struct {
+	mu        sync.Mutex
+	target    string
+	part      string
+	size      int64
+	hash      string
+	chunkSize int
+	mode      os.FileMode
+	mtime     time.Time
+	owner     *FileOwner
+}
+
+// BeginUpload is the RPC method that starts (or resumes) a chunked upload and
+// reports how much of the file the agent already has
+func (s *LivePatchServer) BeginUpload(req *UploadRequest, resp *UploadResponse) error {
+	fullPath, err := s.writable(req.RelativePath)
+	if err != nil {
+		return err
+	}
+	if err := s.checkSize(req.RelativePath, req.Size); err != nil {
+		return err
+	}
+	if req.ChunkSize <= 0 || req.ChunkSize > maxChunkSize {
+		return fmt.Errorf("chunk size must be between 1 and %d bytes", maxChunkSize)
+	}
+	if err := s.base.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+	s.expireUploads(filepath.Dir(fullPath))
+
+	// The same file sent the same way gets the same ID, which is what lets a new connection resume
+	id := sha256Hex([]byte(strings.Join([]string{req.RelativePath, strconv.FormatInt(req.Size, 10), req.Hash, strconv.Itoa(req.ChunkSize)}, "\x00")))[:32]
+	u := &upload{
+		target:    fullPath,
+		part:      filepath.Join(filepath.Dir(fullPath), uploadPrefix+id),
+		size:      req.Size,
+		hash:      req.Hash,
+		chunkSize: req.ChunkSize,
+		mode:      os.FileMode(req.Mode).Perm(),
+		mtime:     req.Timestamp,
+		owner:     req.Owner,
+	}
+
+	s.mu.Lock()
+	if s.uploads == nil {
+		s.uploads = make(map[string]*upload)
+	}
+	if existing, ok := s.uploads[id]; ok {
+		u = existing
+	}
+	s.uploads[id] = u
+	s.mu.Unlock()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	// Only whole chunks count: the last one may have been cut off mid-write
+	var offset int64
+	if info, err := s.base.Lstat(u.part); err == nil && info.Mode().IsRegular() && info.Size() <= u.size {
+		offset = info.Size() - info.Size()%int64(u.chunkSize)
+		if info.Size() == u.size {
+			offset = u.size
+		}
+	}
+	f, err := s.base.OpenFile(u.part, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(offset)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if offset > 0 {
+		logger.Log.Info(fmt.Sprintf("Resuming upload of %s at %d of %d bytes", req.RelativePath, offset, req.Size))
+	}
+	resp.UploadID = id
+	resp.Offset = offset
+	return nil
+}
+
+// UploadChunk is the RPC method that appends one chunk to an upload. The chunk
+// must start where the previous one ended and match its hash.
+func (s *LivePatchServer) UploadChunk(req *ChunkRequest, resp *ChunkResponse) error {
+	u, err := s.upload(req.UploadID)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	data, err := decompress(req.Compression, req.Data, int64(u.chunkSize))
+	if err != nil {
+		return fmt.Errorf("chunk at %d: %v", req.Offset, err)
+	}
+	if req.Offset+int64(len(data)) > u.size {
+		return fmt.Errorf("chunk at %d does not fit the upload", req.Offset)
+	}
+	if sha256Hex(data) != req.Hash {
+		return fmt.Errorf("chunk at %d is corrupt (hash mismatch)", req.Offset)
+	}
+
+	f, err := s.base.OpenFile(u.part, os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != req.Offset {
+		return fmt.Errorf("chunk at %d is out of order: the agent has %d bytes", req.Offset, info.Size())
+	}
+	if _, err := f.WriteAt(data, req.Offset); err != nil {
+		return err
+	}
+	// Acknowledged chunks must survive a crash, since resuming skips them
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	resp.Offset = req.Offset + int64(len(data))
+	return nil
+}
+
+// FinishUpload is the RPC method that checks a complete upload against its hash
+// and applies it like SyncFile: staged if TxID is set, otherwise as its own patch
+func (s *LivePatchServer) FinishUpload(req *FinishUploadRequest, resp *FileSyncResponse) error {
+	return s.finishUpload(context.Background(), req, resp)
+}
+
+// finishUpload is FinishUpload for a call that stops when ctx ends
+func (s *LivePatchServer) finishUpload(ctx context.Context, req *FinishUploadRequest, resp *FileSyncResponse) error {
+	u, err := s.upload(req.UploadID)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	info, err := s.base.Stat(u.part)
+	if err != nil {
+		return err
+	}
+	if info.Size() != u.size {
+		return fmt.Errorf("upload is incomplete: %d of %d bytes received", info.Size(), u.size)
+	}
+	hash, err := hashFile(s.base, u.part)
+	if err != nil {
+		return err
+	}
+	if hash != u.hash {
+		s.forgetUpload(req.UploadID)
+		s.base.Remove(u.part)
+		return fmt.Errorf("checksum mismatch after upload of %s; sync it again", s.relPath(u.target))
+	}
+
+	var tx *transaction
+	if req.TxID != "" {
+		if tx, err = s.tx(req.TxID); err != nil {
+			return err
+		}
+	} else {
+		if err := s.allowed(req.PostSyncCommand); err != nil {
+			return err
+		}
+		tx = newTransaction(s.base, defaultTxTimeout)
+	}
+
+	// A client that gave up can resume the upload later
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// The partial file becomes the staged file: same directory, so committing is a rename
+	if err := s.base.Chmod(u.part, u.mode); err != nil {
+		return err
+	}
+	if err := s.setAttrs(u.part, u.mtime, u.owner); err != nil {
+		return fmt.Errorf("failed to set owner or timestamp: %v", err)
+	}
+	staged := tempName(u.target)
+	if err := s.base.Rename(u.part, staged); err != nil {
+		return err
+	}
+	s.forgetUpload(req.UploadID)
+	if err := tx.stageTemp(u.target, staged, u.mode); err != nil {
+		return err
+	}
+
+	if req.TxID != "" {
+		logger.Log.Debug("Staged file: " + u.target)
+		resp.Success = true
+		resp.Message = "File staged"
+		return nil
+	}
+	logger.Log.Info("Syncing file: " + u.target)
+	result, err := s.commit(ctx, tx, req.PostSyncCommand)
+	if err != nil {
+		resp.Message = "Failed to write file: " + err.Error()
+		return err
+	}
+	resp.Success, resp.Message = result.describe("File synced")
+	return nil
+}
+
+// maxContentSize is the most a compressed file may expand to
+func (s *LivePatchServer) maxContentSize() int64 {
+	if s.MaxFileSize > 0 {
+		return s.MaxFileSize
+	}
+	return maxMessageSize
+}
+
+// checkSize refuses files larger than MaxFileSize
+func (s *LivePatchServer) checkSize(rel string, size int64) error {
+	if s.MaxFileSize > 0 && size > s.MaxFileSize {
+		return fmt.Errorf("%s is %d bytes; this agent accepts files up to %d bytes (--max-file-size)", rel, size, s.MaxFileSize)
+	}
+	return nil
+}
+
+func (s *LivePatchServer) upload(id string) (*upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.uploads[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown upload %s; call BeginUpload again to resume it", id)
+	}
+	return u, nil
+}
+
+func (s *LivePatchServer) forgetUpload(id string) {
+	s.mu.Lock()
+	delete(s.uploads, id)
+	s.mu.Unlock()
+}
+
+// expireUploads removes partial uploads in dir that nobody resumed in time
+func (s *LivePatchServer) expireUploads(dir string) {
+	entries, err := s.base.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), uploadPrefix) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > uploadRetention {
+			s.base.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+}
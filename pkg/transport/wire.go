@@ -0,0 +1,243 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Protocol versions. Version 1 is the original net/rpc + gob protocol: agents
+// still serve it to older CLIs, and CLIs fall back to it for older agents.
+// Version 2 is the framed, multiplexed protocol described in ADR-012.
+const (
+	ProtocolLegacy  = 1
+	ProtocolVersion = 2
+)
+
+// supportedVersions are the multiplexed protocol versions this build speaks
+var supportedVersions = []int{ProtocolVersion}
+
+// protocolMagic starts the client's hello. A legacy gob stream never starts with it.
+var protocolMagic = []byte("LPTP")
+
+const (
+	// minHelloSize pads the client's hello so an old agent, which reads "L" as
+	// the length of a 76-byte gob message, gets all of it, fails to decode it
+	// and hangs up instead of waiting for more
+	minHelloSize = 96
+	maxHelloSize = 4096
+
+	// frameHeaderSize is type (1) + flags (1) + stream ID (4) + payload length (4)
+	frameHeaderSize = 10
+	// maxFrameSize caps one frame; larger calls and replies are split into
+	// fragments so they don't hold up other calls on the connection
+	maxFrameSize = 64 * 1024
+	// maxMessageSize caps a reassembled call or reply. The largest legitimate
+	// ones are upload chunks and ReadFile replies, at most 16 MiB.
+	maxMessageSize = 64 << 20
+	// maxPendingSize caps what a connection buffers for all its fragmented messages together
+	maxPendingSize = 2 * maxMessageSize
+	// maxConcurrentCalls caps the calls (and fragmented messages) in flight on one connection
+	maxConcurrentCalls = 64
+)
+
+// Frame types
+const (
+	frameCall   byte = 1 // client: start a call (callHeader, then the request)
+	frameData   byte = 2 // server: a chunk of a streaming call's output
+	frameReply  byte = 3 // server: the call finished (replyHeader, then the response)
+	frameCancel byte = 4 // client: abandon a call
+)
+
+// flagMore marks a fragment that is continued by the next frame of the same type and stream
+const flagMore byte = 1
+
+// hello is exchanged after the TLS handshake. The client lists the versions
+// and compression algorithms it speaks; the agent answers with its own and the
+// ones it picked (0 and "" if none).
+type hello struct {
+	Versions    []int
+	Version     int
+	Compression []string
+	Compress    string
+}
+
+type callHeader struct {
+	Method string
+	// Timeout is how long the client waits for the call; zero means no limit.
+	// It's relative so that clock skew between client and agent doesn't matter.
+	Timeout time.Duration
+}
+
+type replyHeader struct {
+	Error string
+}
+
+type frame struct {
+	typ     byte
+	flags   byte
+	stream  uint32
+	payload []byte
+}
+
+func writeHello(w io.Writer, h hello) error {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(h); err != nil {
+		return err
+	}
+	// gob ignores whatever follows the value
+	for payload.Len() < minHelloSize {
+		payload.WriteByte(0)
+	}
+
+	msg := make([]byte, len(protocolMagic)+2, len(protocolMagic)+2+payload.Len())
+	copy(msg, protocolMagic)
+	binary.BigEndian.PutUint16(msg[len(protocolMagic):], uint16(payload.Len()))
+	_, err := w.Write(append(msg, payload.Bytes()...))
+	return err
+}
+
+// errNotMultiplexed means the other side didn't answer with a hello
+var errNotMultiplexed = errors.New("peer does not speak the multiplexed protocol")
+
+func readHello(r io.Reader) (hello, error) {
+	var h hello
+	head := make([]byte, len(protocolMagic)+2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return h, err
+	}
+	if !bytes.Equal(head[:len(protocolMagic)], protocolMagic) {
+		return h, errNotMultiplexed
+	}
+	size := int(binary.BigEndian.Uint16(head[len(protocolMagic):]))
+	if size > maxHelloSize {
+		return h, fmt.Errorf("hello of %d bytes is too large", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return h, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&h); err != nil {
+		return h, fmt.Errorf("malformed hello: %v", err)
+	}
+	return h, nil
+}
+
+// negotiate picks the newest version both sides speak, or 0
+func negotiate(theirs []int) int {
+	best := 0
+	for _, v := range theirs {
+		for _, ours := range supportedVersions {
+			if v == ours && v > best {
+				best = v
+			}
+		}
+	}
+	return best
+}
+
+func writeFrame(w io.Writer, f frame) error {
+	buf := make([]byte, frameHeaderSize, frameHeaderSize+len(f.payload))
+	buf[0] = f.typ
+	buf[1] = f.flags
+	binary.BigEndian.PutUint32(buf[2:], f.stream)
+	binary.BigEndian.PutUint32(buf[6:], uint32(len(f.payload)))
+	_, err := w.Write(append(buf, f.payload...))
+	return err
+}
+
+func readFrame(r io.Reader) (frame, error) {
+	var f frame
+	head := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return f, err
+	}
+	f.typ = head[0]
+	f.flags = head[1]
+	f.stream = binary.BigEndian.Uint32(head[2:])
+	size := binary.BigEndian.Uint32(head[6:])
+	if size > maxFrameSize {
+		return f, fmt.Errorf("frame of %d bytes exceeds the %d byte limit", size, maxFrameSize)
+	}
+	f.payload = make([]byte, size)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// fragments splits a message into frames no larger than maxFrameSize
+func fragments(typ byte, stream uint32, msg []byte) []frame {
+	var frames []frame
+	for {
+		n := len(msg)
+		if n > maxFrameSize {
+			n = maxFrameSize
+		}
+		f := frame{typ: typ, stream: stream, payload: msg[:n]}
+		msg = msg[n:]
+		if len(msg) > 0 {
+			f.flags = flagMore
+		}
+		frames = append(frames, f)
+		if len(msg) == 0 {
+			return frames
+		}
+	}
+}
+
+// reassembler joins fragmented calls and replies, bounding how much it buffers
+type reassembler struct {
+	msgs map[uint32][]byte
+	size int
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{msgs: make(map[uint32][]byte)}
+}
+
+// add returns the complete message once its last fragment arrives. An error
+// means the peer exceeded a limit and the connection should be dropped.
+func (r *reassembler) add(f frame) ([]byte, bool, error) {
+	partial, ok := r.msgs[f.stream]
+	if !ok && f.flags&flagMore != 0 && len(r.msgs) >= maxConcurrentCalls {
+		return nil, false, fmt.Errorf("more than %d fragmented messages in flight", maxConcurrentCalls)
+	}
+	if len(partial)+len(f.payload) > maxMessageSize {
+		r.drop(f.stream)
+		return nil, false, fmt.Errorf("message exceeds the %d byte limit", maxMessageSize)
+	}
+	if f.flags&flagMore != 0 {
+		if r.size+len(f.payload) > maxPendingSize {
+			return nil, false, fmt.Errorf("fragmented messages exceed the %d byte limit", maxPendingSize)
+		}
+		r.msgs[f.stream] = append(partial, f.payload...)
+		r.size += len(f.payload)
+		return nil, false, nil
+	}
+	r.drop(f.stream)
+	return append(partial, f.payload...), true, nil
+}
+
+// drop forgets the fragments of a message
+func (r *reassembler) drop(stream uint32) {
+	r.size -= len(r.msgs[stream])
+	delete(r.msgs, stream)
+}
+
+// encodeMessage gob-encodes a header followed by a body into one message
+func encodeMessage(header, body interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(header); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(body); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -3,10 +3,14 @@ package utils
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"math/big"
+	"net"
 	"os"
 	"time"
 )
@@ -52,3 +56,168 @@ func GenerateSelfSignedCert(certPath, keyPath string) error {
 
 	return nil
 }
+
+// CertOptions describes a certificate signed by the init-ca CA
+type CertOptions struct {
+	CommonName string
+	// Hosts are DNS names or IP addresses the server certificate is valid for
+	Hosts []string
+	// Client issues a client certificate instead of a server certificate
+	Client   bool
+	Validity time.Duration
+}
+
+// IssueCert creates a key pair and a certificate signed by the CA in caCertPath/caKeyPath
+func IssueCert(caCertPath, caKeyPath, certPath, keyPath string, opts CertOptions) error {
+	caCert, caKey, err := loadCA(caCertPath, caKeyPath)
+	if err != nil {
+		return err
+	}
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"Velocity Trinity"},
+			CommonName:   opts.CommonName,
+		},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(opts.Validity),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if opts.Client {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	for _, host := range opts.Hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, caCert, &priv.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(certPath, "CERTIFICATE", derBytes, 0644); err != nil {
+		return err
+	}
+	return writePEM(keyPath, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(priv), 0600)
+}
+
+// ServerTLSConfig loads the agent's certificate. With caPath set, client
+// certificates signed by that CA are verified, and required if requireClientCert is set.
+func ServerTLSConfig(certPath, keyPath, caPath string, requireClientCert bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if requireClientCert && caPath == "" {
+		return nil, errors.New("requiring client certificates needs a CA to verify them")
+	}
+	if caPath != "" {
+		pool, err := loadPool(caPath)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if requireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
+
+// ClientTLSConfig builds the CLI's TLS config. With caPath set, the agent's
+// certificate must be signed by that CA; otherwise it is only checked against
+// the system roots unless insecure is set. certPath/keyPath add a client certificate.
+func ClientTLSConfig(caPath, certPath, keyPath string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: insecure}
+
+	if caPath != "" {
+		pool, err := loadPool(caPath)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certPath != "" || keyPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func loadCA(certPath, keyPath string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, nil, fmt.Errorf("%s: no PEM certificate", certPath)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !cert.IsCA {
+		return nil, nil, fmt.Errorf("%s is not a CA certificate", certPath)
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, nil, fmt.Errorf("%s: no PEM key", keyPath)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func loadPool(caPath string) (*x509.CertPool, error) {
+	caPEM, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("%s: no certificates found", caPath)
+	}
+	return pool, nil
+}
+
+func writePEM(path, typeName string, bytes []byte, perm os.FileMode) error {
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(out, &pem.Block{Type: typeName, Bytes: bytes}); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,193 @@
+package watcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/velocity-trinity/core/pkg/logger"
+)
+
+// Watcher recursively watches a directory tree and reports changed files in
+// debounced batches, so a burst of saves (or a `git checkout`) becomes one callback.
+type Watcher struct {
+	Root     string
+	Debounce time.Duration
+
+	// Ignore reports whether a root-relative path should be skipped.
+	// Ignored directories are not watched at all.
+	Ignore func(rel string, isDir bool) bool
+
+	fs *fsnotify.Watcher
+}
+
+// New creates a watcher for root and registers every directory below it
+func New(root string, debounce time.Duration) (*Watcher, error) {
+	fs, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &Watcher{Root: root, Debounce: debounce, Ignore: DefaultIgnore, fs: fs}, nil
+}
+
+// DefaultIgnore skips VCS metadata, dependency folders and hidden directories
+func DefaultIgnore(rel string, isDir bool) bool {
+	name := filepath.Base(rel)
+	if isDir && rel != "." && strings.HasPrefix(name, ".") {
+		return true
+	}
+	return name == "node_modules" || name == "__pycache__" || name == ".git"
+}
+
+// Run blocks until ctx is cancelled, calling fn with each batch of changed
+// root-relative paths. Batches are never delivered concurrently: changes that
+// arrive while fn is running are collected into the next batch.
+// Paths may refer to files that no longer exist (deletes and renames).
+func (w *Watcher) Run(ctx context.Context, fn func(paths []string)) error {
+	if err := w.addTree(w.Root); err != nil {
+		return err
+	}
+
+	pending := make(map[string]bool)
+	var timer *time.Timer
+	var timerC <-chan time.Time
+	busy := false
+	done := make(chan struct{})
+
+	flush := func() {
+		if busy || len(pending) == 0 {
+			return
+		}
+		batch := make([]string, 0, len(pending))
+		for path := range pending {
+			batch = append(batch, path)
+		}
+		sort.Strings(batch)
+		pending = make(map[string]bool)
+
+		busy = true
+		go func() {
+			fn(batch)
+			done <- struct{}{}
+		}()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			if busy {
+				<-done
+			}
+			return ctx.Err()
+
+		case event, ok := <-w.fs.Events:
+			if !ok {
+				return nil
+			}
+			for _, rel := range w.handle(event) {
+				pending[rel] = true
+			}
+			if len(pending) == 0 {
+				continue
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.NewTimer(w.Debounce)
+			timerC = timer.C
+
+		case <-timerC:
+			timerC = nil
+			flush()
+
+		case <-done:
+			busy = false
+			// Changes that settled while fn was running
+			if timerC == nil {
+				flush()
+			}
+
+		case err, ok := <-w.fs.Errors:
+			if !ok {
+				return nil
+			}
+			logger.Log.Warn("Watcher error: " + err.Error())
+		}
+	}
+}
+
+// Close stops watching
+func (w *Watcher) Close() error {
+	return w.fs.Close()
+}
+
+// handle turns one fsnotify event into the root-relative file paths it affects
+func (w *Watcher) handle(event fsnotify.Event) []string {
+	if event.Op == fsnotify.Chmod {
+		return nil
+	}
+
+	rel, err := filepath.Rel(w.Root, event.Name)
+	if err != nil {
+		return nil
+	}
+
+	info, err := os.Lstat(event.Name)
+	if err == nil && info.IsDir() {
+		if w.Ignore != nil && w.Ignore(rel, true) {
+			return nil
+		}
+		if event.Op.Has(fsnotify.Create) {
+			// Files can land in a new directory before we start watching it
+			var files []string
+			filepath.Walk(event.Name, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return nil
+				}
+				sub, _ := filepath.Rel(w.Root, path)
+				if w.Ignore != nil && w.Ignore(sub, info.IsDir()) {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if info.IsDir() {
+					w.fs.Add(path)
+				} else {
+					files = append(files, sub)
+				}
+				return nil
+			})
+			return files
+		}
+		return nil
+	}
+
+	if w.Ignore != nil && w.Ignore(rel, false) {
+		return nil
+	}
+	return []string{rel}
+}
+
+func (w *Watcher) addTree(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(w.Root, path)
+		if w.Ignore != nil && w.Ignore(rel, true) {
+			return filepath.SkipDir
+		}
+		return w.fs.Add(path)
+	})
+}
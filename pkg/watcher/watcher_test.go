@@ -0,0 +1,161 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/velocity-trinity/core/pkg/logger"
+	"go.uber.org/zap"
+)
+
+func TestDefaultIgnore(t *testing.T) {
+	tests := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{rel: ".", isDir: true, want: false},
+		{rel: "src", isDir: true, want: false},
+		{rel: ".git", isDir: true, want: true},
+		{rel: ".cache", isDir: true, want: true},
+		{rel: "src/.hidden", isDir: true, want: true},
+		{rel: ".env", isDir: false, want: false},
+		{rel: "node_modules", isDir: true, want: true},
+		{rel: "web/node_modules", isDir: true, want: true},
+		{rel: "app/__pycache__", isDir: true, want: true},
+		{rel: "src/main.go", isDir: false, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rel, func(t *testing.T) {
+			if got := DefaultIgnore(tt.rel, tt.isDir); got != tt.want {
+				t.Errorf("DefaultIgnore(%q, %v) = %v, want %v", tt.rel, tt.isDir, got, tt.want)
+			}
+		})
+	}
+}
+
+// startWatcher watches root and returns the batches it delivers
+func startWatcher(t *testing.T, root string, debounce time.Duration) <-chan []string {
+	t.Helper()
+	logger.Log = zap.NewNop()
+	w, err := New(root, debounce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	batches := make(chan []string, 16)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.Run(ctx, func(paths []string) { batches <- paths })
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		w.Close()
+	})
+	// Run registers the tree before it reads events; give it a moment
+	time.Sleep(50 * time.Millisecond)
+	return batches
+}
+
+// nextBatch waits for the watcher's next batch
+func nextBatch(t *testing.T, batches <-chan []string) []string {
+	t.Helper()
+	select {
+	case batch := <-batches:
+		return batch
+	case <-time.After(5 * time.Second):
+		t.Fatal("no batch delivered")
+		return nil
+	}
+}
+
+// noBatch checks that the watcher delivers nothing for a while
+func noBatch(t *testing.T, batches <-chan []string) {
+	t.Helper()
+	select {
+	case batch := <-batches:
+		t.Errorf("unexpected batch %v", batch)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func write(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	root := t.TempDir()
+	batches := startWatcher(t, root, 200*time.Millisecond)
+
+	// A burst of saves becomes one batch
+	for i := 0; i < 5; i++ {
+		write(t, filepath.Join(root, "a.go"), fmt.Sprint(i))
+		write(t, filepath.Join(root, "b.go"), fmt.Sprint(i))
+		time.Sleep(20 * time.Millisecond)
+	}
+	if got, want := nextBatch(t, batches), []string{"a.go", "b.go"}; !slices.Equal(got, want) {
+		t.Errorf("batch = %v, want %v", got, want)
+	}
+	noBatch(t, batches)
+}
+
+func TestDeletions(t *testing.T) {
+	root := t.TempDir()
+	write(t, filepath.Join(root, "gone.go"), "x")
+	write(t, filepath.Join(root, "old.go"), "x")
+	batches := startWatcher(t, root, 50*time.Millisecond)
+
+	if err := os.Remove(filepath.Join(root, "gone.go")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(root, "old.go"), filepath.Join(root, "new.go")); err != nil {
+		t.Fatal(err)
+	}
+	// Both sides of a rename, and the deleted file, though they no longer exist
+	var got []string
+	for len(got) < 3 {
+		for _, path := range nextBatch(t, batches) {
+			if !slices.Contains(got, path) {
+				got = append(got, path)
+			}
+		}
+	}
+	slices.Sort(got)
+	if want := []string{"gone.go", "new.go", "old.go"}; !slices.Equal(got, want) {
+		t.Errorf("changes = %v, want %v", got, want)
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{".git", "node_modules", "src"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batches := startWatcher(t, root, 50*time.Millisecond)
+
+	write(t, filepath.Join(root, ".git", "index"), "x")
+	write(t, filepath.Join(root, "node_modules", "dep.js"), "x")
+	noBatch(t, batches)
+
+	// A new directory's files are picked up, but not its ignored subdirectories
+	if err := os.MkdirAll(filepath.Join(root, "src", "pkg", "__pycache__"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	write(t, filepath.Join(root, "src", "pkg", "__pycache__", "mod.pyc"), "x")
+	write(t, filepath.Join(root, "src", "pkg", "mod.py"), "x")
+	if got, want := nextBatch(t, batches), []string{filepath.Join("src", "pkg", "mod.py")}; !slices.Equal(got, want) {
+		t.Errorf("batch = %v, want %v", got, want)
+	}
+}